@@ -0,0 +1,484 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The x509 certificates, keys and certificate revocation lists (CRLs)
+// used by both the webserver and the clientConnection.
+//
+// The certificate files are watched and are (re)loaded whenever they
+// change, so that a re-run of the cnSetup command is picked up without
+// needing to restart the federation.
+//
+package certificates
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "encoding/pem"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "io/ioutil"
+  "os"
+  "sync"
+  "time"
+)
+
+//////////////////////////////////////////////////////////////////////
+// Certificates types
+//
+
+// The (currently loaded) x509 certificates, keys and CRL, together with
+// the paths of the files from which they were loaded.
+//
+// CONSTRAINTS: Once created, the values in this structure SHOULD only be
+// altered by structure methods.
+//
+type Certificates struct {
+  Mutex         sync.RWMutex
+  Ca_Cert_Path  string
+  Cert_Path     string
+  Key_Path      string
+  Crl_Path      string
+  keyPassphrase []byte
+  Cert         *tls.Certificate
+  CaCerts     []*x509.Certificate
+  CaPool       *x509.CertPool
+  Revoked       map[string]time.Time
+  CrlNextUpdate time.Time
+  CrlErr        error
+  ModTimes      map[string]time.Time
+  Log          *logger.LoggerType
+}
+
+//////////////////////////////////////////////////////////////////////
+// Certificates functions
+//
+
+// Create a Certificates structure by loading the certificate, key, CA
+// certificate(s) and (optional) CRL files.
+//
+// An empty crlPath means that no CRL checking is done.
+//
+// Any problems loading the certificate, key or CA certificate(s) are
+// fatal, while any problems loading the CRL are only reported (by
+// CheckCRL).
+//
+// CREATES certs;
+//
+func CreateCertificates(
+  caCertPath, certPath, keyPath, crlPath string,
+  cnLog *logger.LoggerType,
+) *Certificates {
+  return CreateUnlockedCertificates(
+    caCertPath, certPath, keyPath, crlPath, "", cnLog,
+  )
+}
+
+// Create a Certificates structure (as CreateCertificates) whose (possibly 
+// encrypted) key is unlocked using the passphrase read (once, at startup) 
+// from the given passphrase source. 
+//
+// The passphrase is kept (in memory) so that a changed key can be 
+// reloaded. 
+//
+// CREATES certs;
+//
+func CreateUnlockedCertificates(
+  caCertPath, certPath, keyPath, crlPath string,
+  passphraseSource string,
+  cnLog *logger.LoggerType,
+) *Certificates {
+  certs := &Certificates{
+    Ca_Cert_Path: caCertPath,
+    Cert_Path:    certPath,
+    Key_Path:     keyPath,
+    Crl_Path:     crlPath,
+    Revoked:      make(map[string]time.Time),
+    ModTimes:     make(map[string]time.Time),
+    Log:          cnLog,
+  }
+  var err error
+  certs.keyPassphrase, err = ReadPassphrase(passphraseSource, "the key ["+keyPath+"]")
+  cnLog.MayBeFatal("Could not read the key's passphrase", err)
+  err = certs.Reload()
+  cnLog.MayBeFatal("Could not load the certificates", err)
+  return certs
+}
+
+// Returns the paths of the certificate, key and CA files (which MUST
+// all be loaded).
+//
+// READS certs;
+//
+func (certs *Certificates) certPaths() []string {
+  return []string{ certs.Ca_Cert_Path, certs.Cert_Path, certs.Key_Path }
+}
+
+// Returns the paths of all of the files which are watched.
+//
+// READS certs;
+//
+func (certs *Certificates) watchedPaths() []string {
+  paths := certs.certPaths()
+  if certs.Crl_Path != "" { paths = append(paths, certs.Crl_Path) }
+  return paths
+}
+
+// Returns true if any of the watched files have changed since they were
+// last (re)loaded.
+//
+// THREAD-SAFE;
+//
+func (certs *Certificates) HaveChanged() bool {
+  certs.Mutex.RLock()
+  defer certs.Mutex.RUnlock()
+
+  for _, aPath := range certs.watchedPaths() {
+    fileInfo, err := os.Stat(aPath)
+    if err != nil { continue } // (probably) being rewritten... try later
+    if !fileInfo.ModTime().Equal(certs.ModTimes[aPath]) { return true }
+  }
+  return false
+}
+
+// (Re)Load all of the certificate, key, CA and CRL files.
+//
+// If the certificate, key or CA files can not be loaded, the previously
+// loaded certificates are kept and the error is returned.
+//
+// The CRL is loaded separately (see loadCRL), so a CRL which can not be
+// loaded (or is stale) never prevents the certificates from being
+// loaded.
+//
+// THREAD-SAFE;
+//
+func (certs *Certificates) Reload() error {
+  modTimes := make(map[string]time.Time)
+  for _, aPath := range certs.certPaths() {
+    fileInfo, err := os.Stat(aPath)
+    if err != nil { return fmt.Errorf("could not stat [%s]: %w", aPath, err) }
+    modTimes[aPath] = fileInfo.ModTime()
+  }
+
+  cert, err := LoadX509KeyPair(certs.Cert_Path, certs.Key_Path, certs.keyPassphrase)
+  if err != nil {
+    return fmt.Errorf("could not load cert/key pair: %w", err)
+  }
+
+  caCerts, err := LoadCertificatesFromFile(certs.Ca_Cert_Path)
+  if err != nil { return err }
+  caPool := x509.NewCertPool()
+  for _, aCaCert := range caCerts { caPool.AddCert(aCaCert) }
+
+  certs.Mutex.Lock()
+  defer certs.Mutex.Unlock()
+
+  certs.Cert     = &cert
+  certs.CaCerts  = caCerts
+  certs.CaPool   = caPool
+  certs.ModTimes = modTimes
+  certs.loadCRL()
+  return nil
+}
+
+// (Re)Load the (optional) CRL file, which MUST be signed by one of the
+// (loaded) CA certificates.
+//
+// If the CRL can not be loaded, the previously loaded revocations are
+// kept, and the error is logged and reported by CheckCRL (a stale CRL is
+// loaded, and is also reported by CheckCRL).
+//
+// NOT THREAD-SAFE (the caller MUST hold the certs.Mutex lock);
+//
+func (certs *Certificates) loadCRL() {
+  if certs.Crl_Path == "" { return }
+
+  fileInfo, err := os.Stat(certs.Crl_Path)
+  if err == nil {
+    certs.ModTimes[certs.Crl_Path] = fileInfo.ModTime()
+    var revoked map[string]time.Time
+    var crlNextUpdate time.Time
+    revoked, crlNextUpdate, err = LoadRevokedFromFile(certs.Crl_Path, certs.CaCerts)
+    if err == nil {
+      certs.Revoked       = revoked
+      certs.CrlNextUpdate = crlNextUpdate
+    }
+  } else {
+    err = fmt.Errorf("could not stat [%s]: %w", certs.Crl_Path, err)
+  }
+  certs.Log.MayBeError(
+    "Could not load the CRL (the previously loaded revocations are kept)", err,
+  )
+  certs.CrlErr = err
+}
+
+// Returns an error if the CRL could not be loaded, or if the (loaded) CRL
+// is stale (its NextUpdate has passed), since it may no longer list
+// every revoked certificate (a newer CRL has probably not been pushed by
+// cnSetup).
+//
+// Used as a (webserver) readiness check.
+//
+// THREAD-SAFE;
+//
+func (certs *Certificates) CheckCRL() error {
+  certs.Mutex.RLock()
+  defer certs.Mutex.RUnlock()
+
+  if certs.Crl_Path == "" { return nil }
+  if certs.CrlErr != nil {
+    return fmt.Errorf("the CRL [%s] could not be loaded: %w", certs.Crl_Path, certs.CrlErr)
+  }
+  if certs.CrlNextUpdate.IsZero() { return nil }
+  if time.Now().After(certs.CrlNextUpdate) {
+    return fmt.Errorf(
+      "the CRL [%s] is stale (its next update was due at %s)",
+      certs.Crl_Path, certs.CrlNextUpdate,
+    )
+  }
+  return nil
+}
+
+// Start a go routine which checks the watched files every interval and
+// (re)loads them whenever any of them have changed.
+//
+// An error is logged (once) when the loaded CRL becomes stale.
+//
+func (certs *Certificates) WatchFiles(interval time.Duration) {
+  go func() {
+    crlWasStale := false
+    for {
+      time.Sleep(interval)
+      if certs.HaveChanged() {
+        err := certs.Reload()
+        if err != nil {
+          certs.Log.MayBeError("Could not reload the (changed) certificates", err)
+        } else {
+          certs.Log.Log("reloaded the (changed) certificates")
+        }
+      }
+      crlErr := certs.CheckCRL()
+      if crlErr != nil && !crlWasStale {
+        certs.Log.MayBeError("The revoked certificates can no longer be checked", crlErr)
+      }
+      crlWasStale = crlErr != nil
+    }
+  }()
+}
+
+// Load all of the PEM encoded CERTIFICATE blocks found in a file.
+//
+func LoadCertificatesFromFile(certPath string) ([]*x509.Certificate, error) {
+  pemBytes, err := ioutil.ReadFile(certPath)
+  if err != nil {
+    return nil, fmt.Errorf("could not read [%s]: %w", certPath, err)
+  }
+  foundCerts := make([]*x509.Certificate, 0)
+  for {
+    var pemBlock *pem.Block
+    pemBlock, pemBytes = pem.Decode(pemBytes)
+    if pemBlock == nil { break }
+    if pemBlock.Type != "CERTIFICATE" { continue }
+    aCert, err := x509.ParseCertificate(pemBlock.Bytes)
+    if err != nil {
+      return nil, fmt.Errorf("could not parse a certificate in [%s]: %w", certPath, err)
+    }
+    foundCerts = append(foundCerts, aCert)
+  }
+  if len(foundCerts) < 1 {
+    return nil, fmt.Errorf("could not find any certificates in [%s]", certPath)
+  }
+  return foundCerts, nil
+}
+
+// Load the serial numbers (and revocation times) of the certificates
+// revoked by the (PEM or DER encoded) CRL in crlPath, together with the
+// CRL's NextUpdate.
+//
+// The CRL MUST be signed by one of the caCerts. A stale CRL (whose
+// NextUpdate has passed) is still loaded (its staleness is reported by
+// Certificates.CheckCRL).
+//
+func LoadRevokedFromFile(
+  crlPath  string,
+  caCerts []*x509.Certificate,
+) (map[string]time.Time, time.Time, error) {
+  var noUpdate time.Time
+  crlBytes, err := ioutil.ReadFile(crlPath)
+  if err != nil {
+    return nil, noUpdate, fmt.Errorf("could not read the CRL [%s]: %w", crlPath, err)
+  }
+  crlPEM, _ := pem.Decode(crlBytes)
+  if crlPEM != nil {
+    if crlPEM.Type != "X509 CRL" {
+      return nil, noUpdate, fmt.Errorf("could not locate the X509 CRL block in [%s]", crlPath)
+    }
+    crlBytes = crlPEM.Bytes
+  }
+  crl, err := x509.ParseRevocationList(crlBytes)
+  if err != nil {
+    return nil, noUpdate, fmt.Errorf("could not parse the CRL [%s]: %w", crlPath, err)
+  }
+
+  signedByCA := false
+  for _, aCaCert := range caCerts {
+    if crl.CheckSignatureFrom(aCaCert) == nil { signedByCA = true ; break }
+  }
+  if !signedByCA {
+    return nil, noUpdate, fmt.Errorf("the CRL [%s] is not signed by a known CA", crlPath)
+  }
+
+  revoked := make(map[string]time.Time)
+  for _, anEntry := range crl.RevokedCertificateEntries {
+    revoked[anEntry.SerialNumber.String()] = anEntry.RevocationTime
+  }
+  return revoked, crl.NextUpdate, nil
+}
+
+// Returns an error if the given certificate has been revoked.
+//
+// THREAD-SAFE;
+//
+func (certs *Certificates) CheckRevoked(aCert *x509.Certificate) error {
+  certs.Mutex.RLock()
+  defer certs.Mutex.RUnlock()
+
+  revokedAt, isRevoked := certs.Revoked[aCert.SerialNumber.String()]
+  if isRevoked {
+    return fmt.Errorf(
+      "the certificate for [%s] (serial %s) was revoked at %s",
+      aCert.Subject.CommonName, aCert.SerialNumber, revokedAt,
+    )
+  }
+  return nil
+}
+
+// Returns an error if any certificate in any of the verified chains has
+// been revoked.
+//
+// THREAD-SAFE;
+//
+func (certs *Certificates) CheckChainsRevoked(
+  verifiedChains [][]*x509.Certificate,
+) error {
+  for _, aChain := range verifiedChains {
+    for _, aCert := range aChain {
+      err := certs.CheckRevoked(aCert)
+      if err != nil { return err }
+    }
+  }
+  return nil
+}
+
+// Returns the currently loaded certificate/key pair.
+//
+// Used as the tls.Config.GetCertificate callback.
+//
+// THREAD-SAFE;
+//
+func (certs *Certificates) GetCertificate(
+  hello *tls.ClientHelloInfo,
+) (*tls.Certificate, error) {
+  certs.Mutex.RLock()
+  defer certs.Mutex.RUnlock()
+
+  return certs.Cert, nil
+}
+
+// Returns the currently loaded certificate/key pair.
+//
+// Used as the tls.Config.GetClientCertificate callback.
+//
+// THREAD-SAFE;
+//
+func (certs *Certificates) GetClientCertificate(
+  request *tls.CertificateRequestInfo,
+) (*tls.Certificate, error) {
+  certs.Mutex.RLock()
+  defer certs.Mutex.RUnlock()
+
+  return certs.Cert, nil
+}
+
+// Returns the currently loaded pool of CA certificates.
+//
+// THREAD-SAFE;
+//
+func (certs *Certificates) GetCaPool() *x509.CertPool {
+  certs.Mutex.RLock()
+  defer certs.Mutex.RUnlock()
+
+  return certs.CaPool
+}
+
+// Create the (double ended) tls.Config used by a webserver.
+//
+// Each new TLS connection uses the currently loaded certificates, CA
+// pool and CRL.
+//
+func (certs *Certificates) ServerTLSConfig() *tls.Config {
+  return &tls.Config{
+    GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+      caPool := certs.GetCaPool()
+      return &tls.Config{
+        ClientAuth:     tls.RequireAndVerifyClientCert,
+        GetCertificate: certs.GetCertificate,
+        RootCAs:        caPool,
+        ClientCAs:      caPool,
+        VerifyPeerCertificate: func(
+          rawCerts [][]byte,
+          verifiedChains [][]*x509.Certificate,
+        ) error {
+          return certs.CheckChainsRevoked(verifiedChains)
+        },
+      }, nil
+    },
+  }
+}
+
+// Create the (double ended) tls.Config used by a clientConnection.
+//
+// Since the tls.Config.RootCAs can not be changed once a client has been
+// created, the server's certificate chain is verified (by
+// VerifyServerConnection) against the currently loaded CA pool and CRL.
+//
+func (certs *Certificates) ClientTLSConfig() *tls.Config {
+  return &tls.Config{
+    GetClientCertificate: certs.GetClientCertificate,
+    InsecureSkipVerify:   true, // we verify the server in VerifyConnection
+    VerifyConnection:     certs.VerifyServerConnection,
+  }
+}
+
+// Verify the server's certificate chain against the currently loaded CA
+// pool and CRL.
+//
+// Used as the (client) tls.Config.VerifyConnection callback.
+//
+// THREAD-SAFE;
+//
+func (certs *Certificates) VerifyServerConnection(cs tls.ConnectionState) error {
+  if len(cs.PeerCertificates) < 1 {
+    return fmt.Errorf("the server [%s] did not provide a certificate", cs.ServerName)
+  }
+  intermediates := x509.NewCertPool()
+  for _, aCert := range cs.PeerCertificates[1:] { intermediates.AddCert(aCert) }
+  verifiedChains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+    DNSName:       cs.ServerName,
+    Roots:         certs.GetCaPool(),
+    Intermediates: intermediates,
+    KeyUsages:     []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth },
+  })
+  if err != nil { return err }
+  return certs.CheckChainsRevoked(verifiedChains)
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certificates
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "math/big"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// Write the DER bytes to a PEM file of the given type.
+//
+func writePEM(t *testing.T, path, pemType string, derBytes []byte) {
+  pemBytes := pem.EncodeToMemory(&pem.Block{ Type: pemType, Bytes: derBytes })
+  err := ioutil.WriteFile(path, pemBytes, 0600)
+  assert.Nil(t, err)
+}
+
+// Test loading certificates and revoking them with a CRL.
+//
+func TestRevocation(t *testing.T) {
+  dir := t.TempDir()
+
+  caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  assert.Nil(t, err)
+  caTemplate := &x509.Certificate{
+    SerialNumber:          big.NewInt(1),
+    Subject:               pkix.Name{ CommonName: "test CA" },
+    NotBefore:             time.Now(),
+    NotAfter:              time.Now().AddDate(1, 0, 0),
+    IsCA:                  true,
+    BasicConstraintsValid: true,
+    KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+  }
+  caBytes, err := x509.CreateCertificate(
+    rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey,
+  )
+  assert.Nil(t, err)
+  caCert, err := x509.ParseCertificate(caBytes)
+  assert.Nil(t, err)
+
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  assert.Nil(t, err)
+  certTemplate := &x509.Certificate{
+    SerialNumber: big.NewInt(42),
+    Subject:      pkix.Name{ CommonName: "aNursery" },
+    NotBefore:    time.Now(),
+    NotAfter:     time.Now().AddDate(1, 0, 0),
+    ExtKeyUsage:  []x509.ExtKeyUsage{ x509.ExtKeyUsageClientAuth },
+  }
+  certBytes, err := x509.CreateCertificate(
+    rand.Reader, certTemplate, caCert, &key.PublicKey, caKey,
+  )
+  assert.Nil(t, err)
+  cert, err := x509.ParseCertificate(certBytes)
+  assert.Nil(t, err)
+  keyBytes, err := x509.MarshalECPrivateKey(key)
+  assert.Nil(t, err)
+
+  caPath   := filepath.Join(dir, "ca-crt.pem")
+  certPath := filepath.Join(dir, "crt.pem")
+  keyPath  := filepath.Join(dir, "key.pem")
+  crlPath  := filepath.Join(dir, "crl.pem")
+  writePEM(t, caPath,   "CERTIFICATE",    caBytes)
+  writePEM(t, certPath, "CERTIFICATE",    certBytes)
+  writePEM(t, keyPath,  "EC PRIVATE KEY", keyBytes)
+
+  emptyCRL, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+    Number:     big.NewInt(1),
+    ThisUpdate: time.Now(),
+    NextUpdate: time.Now().AddDate(0, 1, 0),
+  }, caCert, caKey)
+  assert.Nil(t, err)
+  writePEM(t, crlPath, "X509 CRL", emptyCRL)
+
+  certs := CreateCertificates(
+    caPath, certPath, keyPath, crlPath, logger.CreateLogger("certsTest"),
+  )
+  assert.NotNil(t, certs.Cert)
+  assert.Nil(t, certs.CheckRevoked(cert))
+  assert.False(t, certs.HaveChanged())
+
+  revokingCRL, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+    Number:     big.NewInt(2),
+    ThisUpdate: time.Now(),
+    NextUpdate: time.Now().AddDate(0, 1, 0),
+    RevokedCertificateEntries: []x509.RevocationListEntry{
+      { SerialNumber: big.NewInt(42), RevocationTime: time.Now() },
+    },
+  }, caCert, caKey)
+  assert.Nil(t, err)
+  writePEM(t, crlPath, "X509 CRL", revokingCRL)
+
+  assert.Nil(t, certs.Reload())
+  assert.NotNil(t, certs.CheckRevoked(cert))
+  assert.NotNil(t, certs.CheckChainsRevoked([][]*x509.Certificate{{ cert, caCert }}))
+  assert.Nil(t, certs.CheckRevoked(caCert))
+
+  // a CRL which is not signed by a known CA is refused (the previously
+  // loaded revocations are kept, but the certificates are still loaded)
+  otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  assert.Nil(t, err)
+  otherCA := *caCert
+  otherCA.PublicKey = &otherKey.PublicKey
+  forgedCRL, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+    Number:     big.NewInt(3),
+    ThisUpdate: time.Now(),
+    NextUpdate: time.Now().AddDate(0, 1, 0),
+  }, &otherCA, otherKey)
+  assert.Nil(t, err)
+  writePEM(t, crlPath, "X509 CRL", forgedCRL)
+
+  assert.Nil(t, certs.Reload())
+  assert.NotNil(t, certs.CheckRevoked(cert))
+  assert.Contains(t, certs.CheckCRL().Error(), "could not be loaded")
+  assert.False(t, certs.HaveChanged())
+
+  // a stale CRL (whose NextUpdate has passed) is loaded, but is reported
+  // by CheckCRL
+  staleCRL, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+    Number:     big.NewInt(4),
+    ThisUpdate: time.Now().AddDate(0, -2, 0),
+    NextUpdate: time.Now().AddDate(0, -1, 0),
+  }, caCert, caKey)
+  assert.Nil(t, err)
+  writePEM(t, crlPath, "X509 CRL", staleCRL)
+
+  _, _, err = LoadRevokedFromFile(crlPath, []*x509.Certificate{ caCert })
+  assert.Nil(t, err)
+  assert.Nil(t, certs.Reload())
+  assert.Nil(t, certs.CheckRevoked(cert))
+  assert.Contains(t, certs.CheckCRL().Error(), "is stale")
+
+  // a stale CRL does not prevent the certificates from being loaded at
+  // startup
+  staleCerts := CreateCertificates(
+    caPath, certPath, keyPath, crlPath, logger.CreateLogger("certsTest"),
+  )
+  assert.NotNil(t, staleCerts.Cert)
+  assert.NotNil(t, staleCerts.CheckCRL())
+}
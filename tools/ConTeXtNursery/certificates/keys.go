@@ -0,0 +1,172 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certificates
+
+import (
+  "bufio"
+  "crypto"
+  "crypto/tls"
+  "crypto/x509"
+  "encoding/pem"
+  "fmt"
+  "github.com/youmark/pkcs8"
+  "golang.org/x/term"
+  "io/ioutil"
+  "os"
+  "strings"
+)
+
+// The sources from which a key's passphrase can be read.
+//
+// A passphrase source is either "prompt" (read from the terminal),
+// "env:<NAME>" (read from the environment variable NAME) or
+// "file:<PATH>" (read from the first line of the file PATH).
+//
+const (
+  PromptPassphrase     = "prompt"
+  EnvPassphrasePrefix  = "env:"
+  FilePassphrasePrefix = "file:"
+)
+
+// The PEM block type of an (encrypted) PKCS#8 private key.
+//
+const EncryptedKeyType = "ENCRYPTED PRIVATE KEY"
+
+// Returns true if the given passphrase source is well formed.
+//
+func IsPassphraseSource(source string) bool {
+  if source == PromptPassphrase { return true }
+  if strings.HasPrefix(source, EnvPassphrasePrefix) {
+    return EnvPassphrasePrefix < source
+  }
+  if strings.HasPrefix(source, FilePassphrasePrefix) {
+    return FilePassphrasePrefix < source
+  }
+  return false
+}
+
+// Read a passphrase from the given passphrase source. An empty source
+// means there is no passphrase (and returns nil).
+//
+// When prompting, the description (of the key being unlocked) is shown on
+// stderr, and the passphrase is read (without echo) from the terminal (or
+// is the next line on stdin if it is not a terminal).
+//
+func ReadPassphrase(source, description string) ([]byte, error) {
+  passphrase := ""
+  switch {
+    case source == "" : return nil, nil
+    case source == PromptPassphrase :
+      fmt.Fprintf(os.Stderr, "Passphrase for %s: ", description)
+      stdinFd := int(os.Stdin.Fd())
+      if term.IsTerminal(stdinFd) {
+        passphraseBytes, err := term.ReadPassword(stdinFd)
+        fmt.Fprintf(os.Stderr, "\n")
+        if err != nil {
+          return nil, fmt.Errorf("could not read the passphrase for %s: %w", description, err)
+        }
+        passphrase = string(passphraseBytes)
+      } else {
+        passphrase, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+      }
+    case strings.HasPrefix(source, EnvPassphrasePrefix) :
+      passphrase = os.Getenv(strings.TrimPrefix(source, EnvPassphrasePrefix))
+    case strings.HasPrefix(source, FilePassphrasePrefix) :
+      passphrasePath  := strings.TrimPrefix(source, FilePassphrasePrefix)
+      passphraseBytes, err := ioutil.ReadFile(passphrasePath)
+      if err != nil {
+        return nil, fmt.Errorf("could not read the passphrase file [%s]: %w", passphrasePath, err)
+      }
+      passphrase = strings.SplitN(string(passphraseBytes), "\n", 2)[0]
+    default :
+      return nil, fmt.Errorf("unknown passphrase source [%s]", source)
+  }
+  passphrase = strings.TrimRight(passphrase, "\r\n")
+  if passphrase == "" {
+    return nil, fmt.Errorf("the passphrase for %s (from [%s]) is empty", description, source)
+  }
+  return []byte(passphrase), nil
+}
+
+// Encrypt a private key (using PKCS#8 with PBES2, PBKDF2 and AES-256-CBC)
+// as an "ENCRYPTED PRIVATE KEY" PEM block.
+//
+func EncryptPrivateKeyPEMBlock(
+  privateKey crypto.Signer,
+  passphrase []byte,
+) (*pem.Block, error) {
+  if len(passphrase) < 1 {
+    return nil, fmt.Errorf("a private key can not be encrypted without a passphrase")
+  }
+  keyBytes, err := pkcs8.MarshalPrivateKey(privateKey, passphrase, nil)
+  if err != nil {
+    return nil, fmt.Errorf("could not encrypt the private key: %w", err)
+  }
+  return &pem.Block{ Type: EncryptedKeyType, Bytes: keyBytes }, nil
+}
+
+// Decrypt an "ENCRYPTED PRIVATE KEY" PEM block.
+//
+func DecryptPrivateKeyPEMBlock(
+  keyPEM     *pem.Block,
+  passphrase []byte,
+) (crypto.Signer, error) {
+  if len(passphrase) < 1 {
+    return nil, fmt.Errorf("the private key is encrypted (but no passphrase has been configured)")
+  }
+  privateKey, err := pkcs8.ParsePKCS8PrivateKey(keyPEM.Bytes, passphrase)
+  if err != nil {
+    return nil, fmt.Errorf("could not decrypt the private key: %w", err)
+  }
+  signer, ok := privateKey.(crypto.Signer)
+  if !ok { return nil, fmt.Errorf("the decrypted private key can not sign") }
+  return signer, nil
+}
+
+// Load a certificate (chain) and its (possibly encrypted) private key
+// from a pair of PEM files.
+//
+// An encrypted private key is decrypted (in memory) using the given
+// passphrase.
+//
+func LoadX509KeyPair(
+  certPath, keyPath string,
+  passphrase        []byte,
+) (tls.Certificate, error) {
+  certPEM, err := ioutil.ReadFile(certPath)
+  if err != nil {
+    return tls.Certificate{}, fmt.Errorf("could not read [%s]: %w", certPath, err)
+  }
+  keyBytes, err := ioutil.ReadFile(keyPath)
+  if err != nil {
+    return tls.Certificate{}, fmt.Errorf("could not read [%s]: %w", keyPath, err)
+  }
+
+  keyPEM, _ := pem.Decode(keyBytes)
+  if keyPEM != nil && keyPEM.Type == EncryptedKeyType {
+    privateKey, err := DecryptPrivateKeyPEMBlock(keyPEM, passphrase)
+    if err != nil {
+      return tls.Certificate{}, fmt.Errorf("could not unlock [%s]: %w", keyPath, err)
+    }
+    // (the decrypted key is only ever held in memory)
+    //
+    keyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+    if err != nil {
+      return tls.Certificate{}, fmt.Errorf("could not marshal the key [%s]: %w", keyPath, err)
+    }
+    keyBytes = pem.EncodeToMemory(&pem.Block{ Type: "PRIVATE KEY", Bytes: keyDER })
+  }
+  return tls.X509KeyPair(certPEM, keyBytes)
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certificates
+
+import (
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "math/big"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// Test reading passphrases from each of the passphrase sources.
+//
+func TestReadPassphrase(t *testing.T) {
+  dir := t.TempDir()
+
+  passphrase, err := ReadPassphrase("", "nothing")
+  assert.Nil(t, err)
+  assert.Nil(t, passphrase)
+
+  os.Setenv("CN_TEST_PASSPHRASE", "sesame")
+  defer os.Unsetenv("CN_TEST_PASSPHRASE")
+  passphrase, err = ReadPassphrase("env:CN_TEST_PASSPHRASE", "a key")
+  assert.Nil(t, err)
+  assert.Equal(t, "sesame", string(passphrase))
+  _, err = ReadPassphrase("env:CN_TEST_NO_PASSPHRASE", "a key")
+  assert.NotNil(t, err)
+
+  passphrasePath := filepath.Join(dir, "passphrase")
+  assert.Nil(t, ioutil.WriteFile(passphrasePath, []byte("open sesame\nignored\n"), 0600))
+  passphrase, err = ReadPassphrase("file:"+passphrasePath, "a key")
+  assert.Nil(t, err)
+  assert.Equal(t, "open sesame", string(passphrase))
+  _, err = ReadPassphrase("file:"+dir+"/missing", "a key")
+  assert.NotNil(t, err)
+
+  _, err = ReadPassphrase("vault:secret", "a key")
+  assert.NotNil(t, err)
+  assert.True(t, IsPassphraseSource("prompt"))
+  assert.False(t, IsPassphraseSource("env:"))
+  assert.False(t, IsPassphraseSource("vault:secret"))
+}
+
+// Test loading a certificate whose key is encrypted.
+//
+func TestLoadEncryptedKeyPair(t *testing.T) {
+  dir := t.TempDir()
+
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  assert.Nil(t, err)
+  certTemplate := &x509.Certificate{
+    SerialNumber: big.NewInt(42),
+    Subject:      pkix.Name{ CommonName: "aNursery" },
+    NotBefore:    time.Now(),
+    NotAfter:     time.Now().AddDate(1, 0, 0),
+  }
+  certBytes, err := x509.CreateCertificate(
+    rand.Reader, certTemplate, certTemplate, &key.PublicKey, key,
+  )
+  assert.Nil(t, err)
+  keyPEM, err := EncryptPrivateKeyPEMBlock(key, []byte("sesame"))
+  assert.Nil(t, err)
+  assert.Equal(t, EncryptedKeyType, keyPEM.Type)
+
+  certPath := filepath.Join(dir, "crt.pem")
+  keyPath  := filepath.Join(dir, "key.pem")
+  writePEM(t, certPath, "CERTIFICATE", certBytes)
+  assert.Nil(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(keyPEM), 0600))
+
+  cert, err := LoadX509KeyPair(certPath, keyPath, []byte("sesame"))
+  assert.Nil(t, err)
+  assert.True(t, key.Equal(cert.PrivateKey))
+  _, err = LoadX509KeyPair(certPath, keyPath, []byte("wrong"))
+  assert.NotNil(t, err)
+  _, err = LoadX509KeyPair(certPath, keyPath, nil)
+  assert.NotNil(t, err)
+}
@@ -19,11 +19,13 @@ package clientConnection
 
 import (
   "bytes"
-  "crypto/tls"
-  "crypto/x509"
+  "context"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
   "github.com/diSimplex/ConTeXtNursery/logger"
   "io/ioutil"
   "net/http"
+  "strings"
   "time"
 )
 
@@ -32,30 +34,50 @@ type CC struct {
   Log        *logger.LoggerType
 }
 
+// The reply to a request sent by a client connection.
+//
+// NOTE: redirects are NOT followed, the redirected url is returned in 
+// the Location. 
+//
+type Reply struct {
+  Status_Code int
+  Location    string
+  Request_Id  string
+  Body        []byte
+}
+
+// The error returned when a nursery replies with an HTTP status code 
+// which is neither a success (2xx) nor a redirect (3xx). 
+//
+type StatusError struct {
+  Method      string
+  Url         string
+  Status_Code int
+  Status      string
+  Request_Id  string
+  Body        string
+}
+
+// Provide the standard error interface for StatusErrors
+//
+func (se *StatusError) Error() string {
+  return fmt.Sprintf(
+    "%s %s replied [%s] (request %s): %s",
+    se.Method, se.Url, se.Status, se.Request_Id, strings.TrimSpace(se.Body),
+  )
+}
+
+// Create a client connection which uses the (hot reloadable) 
+// certificates. 
+//
 func CreateClientConnection(
-  caCertPath, certPath, keyPath string,
+  certs      *certificates.Certificates,
   cnLog      *logger.LoggerType,
 ) *CC {
 
-  // Load the Server x509 Certificates and keys for this client connection
-  //
-  serverCert, err := tls.LoadX509KeyPair( certPath, keyPath )
-  cnLog.MayBeFatal("Could not load cert/key pair", err)
-  //
-  caCert, err := ioutil.ReadFile(caCertPath)
-  cnLog.MayBeFatal("Could not load the CA certificate", err)
+  // Setup HTTPS client configuration
   //
-  caCertPool := x509.NewCertPool()
-  caCertPool.AppendCertsFromPEM(caCert)
-  //
-  // Setup HTTPS server configuration
-  //
-  tlsConfig := &tls.Config{
-    ClientAuth:     tls.RequireAndVerifyClientCert,
-    Certificates: []tls.Certificate{serverCert},
-    RootCAs:        caCertPool,
-    ClientCAs:      caCertPool,
-  }
+  tlsConfig := certs.ClientTLSConfig()
 
   cc := CC{}
 
@@ -69,6 +91,9 @@ func CreateClientConnection(
 
   cc.Client = &http.Client{
     Transport: transport,
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+      return http.ErrUseLastResponse
+    },
   }
 
   cc.Log = cnLog
@@ -76,76 +101,70 @@ func CreateClientConnection(
   return &cc
 }
 
-
-func (cc CC) GetMessage(baseUrl, url string) []byte {
-
-  replyBytes := []byte{}
-
-  resp, err := cc.Client.Get(baseUrl + url)
-  if err != nil {
-    cc.Log.MayBeError(
-      "Could not get client connection request to the Nursery: "+baseUrl,
-      err,
-    )
-    if resp != nil {
-      cc.Log.Logf("Response code: %s / %s", resp.Status, resp.Proto)
-    }
-    return replyBytes
-  }
-  defer resp.Body.Close()
-
-  respBody, err := ioutil.ReadAll(resp.Body)
-  resp.Body.Close()
-  if err != nil {
-    cc.Log.MayBeFatal(
-      "Could not read the body of the client connection response",
-       err,
-    )
-    return replyBytes
-  }
-
-  return respBody
-}
-
-func (cc CC) SendJsonMessage(baseUrl, url, method string, jsonBytes []byte) []byte {
-
-  replyBytes := []byte{}
-
-  ccReq, err := http.NewRequest(
+// Send a request, with an (optional) JSON body, to the url of the 
+// nursery at baseUrl. 
+//
+// The request id (if any) carried by ctx is sent in the X-Request-Id 
+// header, so that the nursery at baseUrl logs this request under the 
+// same id. 
+//
+// Returns an error if the request could not be sent, its reply could not 
+// be read, or if the reply's status code is neither a success nor a 
+// redirect (in which case the error is a *StatusError). 
+//
+// THREAD-SAFE;
+//
+func (cc CC) SendRequest(
+  ctx       context.Context,
+  method    string,
+  baseUrl   string,
+  url       string,
+  jsonBytes []byte,
+) (*Reply, error) {
+
+  ccReq, err := http.NewRequestWithContext(
+    ctx,
     method,
     baseUrl + url,
     bytes.NewReader(jsonBytes),
   )
   if err != nil {
-    cc.Log.MayBeError("Could not create client connection request", err)
-    return replyBytes
+    return nil, fmt.Errorf("could not create the request: %w", err)
   }
 
   ccReq.Header.Add("Accept", "application/json")
+  if 0 < len(jsonBytes) {
+    ccReq.Header.Add("Content-Type", "application/json")
+  }
+  requestId := logger.RequestIdFromContext(ctx)
+  if requestId != "" { ccReq.Header.Set(logger.RequestIdHeader, requestId) }
 
   resp, err := cc.Client.Do(ccReq)
   if err != nil {
-    cc.Log.MayBeError(
-      "Could not send client connection request to the Nursery: "+baseUrl,
-      err,
-    )
-    if resp != nil {
-      cc.Log.Logf("Response code: %s / %s", resp.Status, resp.Proto)
-    }
-    return replyBytes
+    return nil, fmt.Errorf("could not send the request to [%s]: %w", baseUrl, err)
   }
   defer resp.Body.Close()
 
   respBody, err := ioutil.ReadAll(resp.Body)
-  resp.Body.Close()
   if err != nil {
-    cc.Log.MayBeFatal(
-      "Could not read the body of the client connection response",
-       err,
-    )
-    return replyBytes
+    return nil, fmt.Errorf("could not read the reply from [%s]: %w", baseUrl, err)
   }
 
-  return respBody
-}
+  if resp.StatusCode < 200 || 399 < resp.StatusCode {
+    return nil, &StatusError{
+      Method:      method,
+      Url:         baseUrl + url,
+      Status_Code: resp.StatusCode,
+      Status:      resp.Status,
+      Request_Id:  resp.Header.Get(logger.RequestIdHeader),
+      Body:        string(respBody),
+    }
+  }
 
+  return &Reply{
+    Status_Code: resp.StatusCode,
+    Location:    resp.Header.Get("Location"),
+    Request_Id:  resp.Header.Get(logger.RequestIdHeader),
+    Body:        respBody,
+  }, nil
+}
@@ -41,7 +41,140 @@ Certificates signed by the Certificate Authority manged by a cnSetup
 command. 
 
 The configuration used to configure a cnNursery is created and managed by 
-the cnSetup command. 
+the cnSetup command. When it starts, the cnNursery validates its 
+configuration, and (if there are any) reports EVERY problem (unknown keys, 
+a missing base_url or primary candidates, URLs which are not https URLs, 
+colliding ports, bad passphrase sources, or certificate, key and crl files 
+which do not exist), each at its file:line, before exiting. 
+
+A cnNursery shuts down gracefully, allowing active requests to complete, 
+when it receives either a SIGINT or SIGTERM signal. The (hidden) 
+/health/live and /health/ready routes can be used as liveness and 
+readiness probes by systemd or podman. The webserver's timeouts and 
+request size limits can be configured in the "limits" section of the 
+cnNursery configuration file. 
+
+The certificate, key, CA certificate and (optional) certificate 
+revocation list (crl_path) files are checked every cert_check_interval 
+seconds, and are reloaded whenever they change. Connections presenting a 
+revoked certificate are refused. The CRL is loaded separately from the 
+certificates, so a CRL which can not be loaded (the previously loaded 
+revocations are kept) or is stale (its next update has passed, since 
+cnSetup's newer CRL has not been pushed) never prevents the certificates 
+from being (re)loaded, but the cnNursery is no longer ready. 
+
+Every request is given a request id, which is included in each of the 
+log lines (and JSON error replies) it produces. Request ids are carried 
+between cnNurseries in the X-Request-Id HTTP (and NATS) header, so that 
+a federation wide operation (such as /control/all/pause) can be found 
+in the logs of every host by grepping for its request id. 
+
+The (hidden) /metrics route exports, in the Prometheus text format, the 
+request counts and latencies (by route and method), the action run 
+counts, durations and failures (by action), the action queue depth, the 
+load, memory and swap figures collected by the heartbeat, as well as the 
+heartbeat and reaper outcomes. 
+
+The federation's primary cnNursery is elected (over the /election route) 
+from the ordered list of primary_candidates (which defaults to the 
+primary_url). A candidate becomes the primary once a majority of the 
+candidates have granted it a lease (of lease_duration seconds, default 
+15), which it then regularly renews. Should the primary stop renewing 
+its lease, the next available candidate takes over. Heartbeats are 
+always sent to the current primary, and only the current primary reaps 
+unresponsive cnNurseries. A lease is only granted to a candidate which 
+asks for it itself (the common name, or one of the hosts, of its client 
+certificate MUST be the host of its candidate url); any other lease 
+request is refused (403). The lease requests of a campaign are sent to 
+the candidates concurrently, so an unresponsive candidate does not 
+delay the grants of the others. 
+
+A cnNursery without a base_url, or without any primary candidates, 
+refuses to start (cnSetup writes both the base_url and the 
+primary_candidates, the base_url of the is_primary nursery, into each 
+nursery's configuration). Exactly two primary candidates are also 
+refused, since they could not elect a leader once either had failed (use 
+one, or at least three, candidates). 
+
+Each cnNursery sends a heartbeat to the primary once every 
+heartbeat_interval, plus or minus a random heartbeat_jitter (default 20) 
+percent. The primary's reply contains only the changes to its (versioned) 
+map of the federation since the version last received by that cnNursery. 
+
+The primary judges the liveness of each cnNursery by the age of its last 
+heartbeat. A cnNursery which has missed suspect_heartbeats (default 3) 
+heartbeat_intervals (default 10 seconds) is marked suspect, and one which 
+has missed dead_heartbeats (default 6) is declared dead and removed. The 
+names of dead cnNurseries are remembered for tombstone_period (default 
+600) seconds, and a dead cnNursery which comes back is re-admitted by its 
+next heartbeat. 
+
+Each heartbeat also reports the cnNursery's (administrator defined) 
+labels, the (sha256) hash of each registered action, the versions of the 
+tools found by the tool_commands (by default ConTeXt and LuaMetaTeX), the 
+fonts_dir, the free disk in the work_dir, and the number of actions 
+currently running. The /heartbeat?label=key=value&action=name route 
+lists only those cnNurseries which have all of the given labels and 
+actions. 
+
+An action posted to /action/all/<anAction> is run on the "best" 
+cnNursery, as chosen by the primary using a placement policy: 
+least-loaded (the default placement_policy), cache-affine (by the 
+affinity query parameter) or pinned (to the nursery query parameter). 
+Only cnNurseries which are up, have registered the action and have all 
+of the label query parameters are considered. The reply redirects to the 
+output of the new run on the chosen cnNursery. Since a run's reply is 
+only sent once the run has finished, running (or placing) an action is 
+limited neither by the retry's request_timeout nor by the webserver's 
+write_timeout. 
+
+Every cnNursery saves its map of the federation (including each 
+cnNursery's control state), together with the federation-wide desired 
+state last requested via /control/all, in the federation.json file in 
+its work_dir. A restarted cnNursery restores this file, marking each 
+restored cnNursery stale until its next heartbeat confirms it, and takes 
+on a desired state of paused or down (as a legal transition, recorded in 
+its history with the actor "restore"). 
+
+A federation-wide state change (/control/all/<state>) is sent 
+concurrently to every targeted cnNursery, each within control_timeout 
+(default 10) seconds, and replies with the previous state, new state and 
+any error of each cnNursery. The nursery and label query parameters 
+target a subset of the federation, while dry_run=true only reports the 
+targeted cnNurseries. 
+
+A cnNursery only makes legal state transitions: a killed cnNursery can 
+not be changed, and one which is down must be brought up before it can 
+be paused. Illegal transitions are refused with a 409 (Conflict). Each 
+transition is recorded, together with its (optional) reason query 
+parameter and its actor (the client certificate's CommonName), in a 
+history (of at most history_length, default 100, transitions per 
+cnNursery) which is listed by /control/history. The state of the 
+"Federation" (in /control) is computed from its members: it is degraded 
+if some are down, killed or not alive, and mixed if some are up while 
+others are paused or draining. 
+
+A draining cnNursery (/control/draining) is given no new placed actions, 
+but lets its running actions finish. The primary cnNursery stores (and 
+persists in federation.json) scheduled state changes, posted (as a JSON 
+Schedule) to /control/schedule, listed by GET /control/schedule and 
+removed by DELETE /control/schedule/<id>. A schedule changes the state 
+of its target either once, at a given time, or at every time matching 
+its five field (minute hour day month weekday) cron specification, such 
+as "0 1 * * *" to pause the federation at one o'clock every night. Due 
+schedules are applied, as federation-wide state changes, by the primary 
+(which checks for them every schedule_interval, default 15, seconds). 
+Each schedule is given a new Id by the primary. Schedules are NOT 
+replicated: a newly elected primary does not know (nor apply) the 
+schedules stored by its predecessor. 
+
+Clients need not poll /heartbeat and /control: the /events route streams 
+(as Server-Sent Events) nursery-joined, nursery-reaped, state-changed, 
+run-started and run-finished events, optionally selected by the type and 
+nursery query parameters. Each cnNursery remembers its most recent 
+events (event_history, default 100), so that a client which reconnects 
+with the Last-Event-ID header is sent the events it missed. The event 
+streams are exempt from the webserver's (write_timeout) limit. 
 
 Usage of cnSetup:
   
@@ -76,10 +209,16 @@ command.
 
 HOWEVER, this security is ONLY AS SECURE AS YOUR WEAKEST USER.
 
-The CA, and Server x509 keys ARE NOT PASSWORD encrypted. Your security 
-DEPENDS upon the security of your file system. In particular any one with 
-access to the CA key can create their own client/server x509 certificates 
-and then interact with the ConTeXt Nursery federation. 
+By default the CA, and Server x509 keys ARE NOT PASSWORD encrypted. Your 
+security then DEPENDS upon the security of your file system. In particular 
+any one with access to the CA key can create their own client/server x509 
+certificates and then interact with the ConTeXt Nursery federation. 
+
+A nursery's key may be encrypted (see the cnSetup key_passphrase), in which 
+case the cnNursery configuration's key_passphrase gives the source from 
+which the passphrase is read (once) when the cnNursery starts: "prompt" 
+(read from the terminal), "env:<NAME>" (read from the environment variable 
+NAME) or "file:<PATH>" (read from the first line of the file PATH). 
 
 It is assumed that the CA as well as the cnNursery certificates and 
 configuration are under the control of a ConTeXt Nursery administrator who 
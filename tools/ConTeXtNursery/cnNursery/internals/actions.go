@@ -16,10 +16,12 @@ package CNNurseries
 
 import (
   "bytes"
-  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
   "github.com/diSimplex/ConTeXtNursery/interfaces/action"
   "github.com/diSimplex/ConTeXtNursery/interfaces/control"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/events"
   "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/diSimplex/ConTeXtNursery/metrics"
   "github.com/diSimplex/ConTeXtNursery/webserver"
   "github.com/jinzhu/configor"
   "io"
@@ -27,6 +29,7 @@ import (
   "os/exec"
   "path/filepath"
   "sync"
+  "time"
 )
 
 type ActionOutputHandler struct {
@@ -47,12 +50,19 @@ type ActionRunner struct {
 //
 type ActionsState struct {
   Mutex      sync.RWMutex
+  Name       string
   State      control.NurseryState
   ActionsDir string
   WorkDir    string
   Actions    action.ActionList
+  Scanned    bool
+  ScanCount  int
+  ScanTime   time.Time
+  Hashes     map[string]ActionHash
+  Running    uint
   Ws        *webserver.WS
-  Cc        *clientConnection.CC
+  Fc        *federationClient.Client
+  Events    *CNEvents
   CNLog     *logger.LoggerType
 }
 
@@ -60,14 +70,17 @@ type ActionsState struct {
 //
 // READS config;
 // FIELD ws (ActionState);
-// FIELD cc (ActionState);
+// FIELD fc (ActionState);
+// FIELD cnEvents (ActionState, which may be nil);
 //
 func CreateActionsState(
-  config *ConfigType,
-  ws     *webserver.WS,
-  cc     *clientConnection.CC,
+  config   *ConfigType,
+  ws       *webserver.WS,
+  fc       *federationClient.Client,
+  cnEvents *CNEvents,
 ) *ActionsState {
   return &ActionsState{
+    Name: config.Name,
     State: control.NurseryState{
       Base_Url:     config.Base_Url,
       Url_Modifier: "",
@@ -77,20 +90,52 @@ func CreateActionsState(
     ActionsDir: config.Actions_Dir,
     WorkDir:    config.Work_Dir,
     Actions:    make(action.ActionList, 0),
+    Hashes:     make(map[string]ActionHash, 0),
     Ws:         ws,
-    Cc:         cc,
+    Fc:         fc,
+    Events:     cnEvents,
     CNLog:      config.CNLog,
   }
 }
 
+// Returns the number of action descriptions in the Actions_Dir, together
+// with the latest modification time of the Actions_Dir and of each of
+// those descriptions.
+//
+func actionsDirVersion(actionsDir string) (int, time.Time) {
+  latest := time.Time{}
+  if info, err := os.Stat(actionsDir) ; err == nil { latest = info.ModTime() }
+  actionDescriptions, _ := filepath.Glob(actionsDir+"/*.config")
+  for _, aPath := range actionDescriptions {
+    info, err := os.Stat(aPath)
+    if err == nil && latest.Before(info.ModTime()) { latest = info.ModTime() }
+  }
+  return len(actionDescriptions), latest
+}
+
 // (re)Scan for actions in the configured Actions_Dir.
 //
-// Look for each *.yaml, *.toml, or *.json file, read it and store the 
-// associated Action Description in the ActionList. 
+// Look for each *.config file, read it and store the associated Action 
+// Description in a new ActionList (so that copies of the previous 
+// ActionList remain unchanged). 
+//
+// THREAD-SAFE;
 //
 func (aState *ActionsState) ScanForActions() {
+  aState.Mutex.Lock()
+  defer aState.Mutex.Unlock()
+
+  aState.scanForActions()
+}
 
+// (re)Scan for actions in the configured Actions_Dir.
+//
+// NOT THREAD-SAFE (the caller MUST hold the aState.Mutex lock);
+//
+func (aState *ActionsState) scanForActions() {
   aState.CNLog.Logf("Looking for actions in [%s]", aState.ActionsDir)
+  aState.ScanCount, aState.ScanTime = actionsDirVersion(aState.ActionsDir)
+  aState.Scanned = true
 
   // walk the ActionsDirectory looking for *.config files 
   actionDescriptions, err := filepath.Glob(aState.ActionsDir+"/*.config")
@@ -100,18 +145,36 @@ func (aState *ActionsState) ScanForActions() {
   
   // for each file found we use configor to load it and capture the 
   // description storing the description in the ActionsList 
+  actions := make(action.ActionList, 0)
   for _, aPath := range actionDescriptions {
-    aState.CNLog.Logf("Loading action description from [%s]", aPath)
     var anActionDesc action.ActionDescription
     err := configor.Load(&anActionDesc, aPath)
     if err == nil && anActionDesc.Name != "" {
-      aState.Actions[anActionDesc.Name] = anActionDesc
+      actions[anActionDesc.Name] = anActionDesc
     } else {
       aState.CNLog.MayBeErrorf(
         err, "Could not load action description from [%s]", aPath,
       )
     }
   }
+  aState.Actions = actions
+  aState.CNLog.Logf("Found %d actions in [%s]", len(actions), aState.ActionsDir)
+}
+
+// Rescan for actions, but only if the Actions_Dir (or any action
+// description in it) has changed since the last scan.
+//
+// THREAD-SAFE;
+//
+func (aState *ActionsState) RefreshActions() {
+  numDescs, latest := actionsDirVersion(aState.ActionsDir)
+
+  aState.Mutex.Lock()
+  defer aState.Mutex.Unlock()
+
+  if aState.Scanned && numDescs == aState.ScanCount &&
+     !aState.ScanTime.Before(latest) { return }
+  aState.scanForActions()
 }
 
 // Returns the mapping of the currently registered actions together with a 
@@ -119,9 +182,20 @@ func (aState *ActionsState) ScanForActions() {
 //
 // Part of the action.ActionImpl interface.
 //
+// CALLS RefreshActions;
+// THREAD-SAFE (returns a copy of the ActionList);
+//
 func (aState *ActionsState) ResponseListActionsJSON() action.ActionList {
-  aState.ScanForActions()
-  return aState.Actions
+  aState.RefreshActions()
+
+  aState.Mutex.RLock()
+  defer aState.Mutex.RUnlock()
+
+  actions := make(action.ActionList, len(aState.Actions))
+  for anActionName, anActionDesc := range aState.Actions {
+    actions[anActionName] = anActionDesc
+  }
+  return actions
 }
 
 // TODO Part of the action.ActionImpl interface.
@@ -164,8 +238,31 @@ aState.CNLog.Logf("Hello from ActionRunAction [%s]", actionName)
   cmd.Stdout = os.Stdout
   cmd.Stderr = os.Stderr
   
+  reg          := aState.Ws.Metrics
+  actionLabels := metrics.Labels{ "action": actionName }
+  reg.IncCounter(ActionRunsMetric, actionLabels)
+  reg.AddToGauge(QueueDepthMetric, nil, 1)
+  aState.Mutex.Lock()
+  aState.Running++
+  aState.Mutex.Unlock()
+  startTime := time.Now()
+  runEvent  := events.Event{
+    Type: events.RunStarted, Nursery: aState.Name, Action: actionName, Run: "1234",
+  }
+  aState.Events.Emit(runEvent)
+
   err := cmd.Run()
   aState.CNLog.MayBeError("completed run actionRunAction", err)
+
+  aState.Mutex.Lock()
+  aState.Running--
+  aState.Mutex.Unlock()
+  runEvent.Type = events.RunFinished
+  if err != nil { runEvent.Error = err.Error() }
+  aState.Events.Emit(runEvent)
+  reg.AddToGauge(QueueDepthMetric, nil, -1)
+  reg.Observe(ActionDurationMetric, actionLabels, time.Since(startTime).Seconds())
+  if err != nil { reg.IncCounter(ActionFailuresMetric, actionLabels) }
   
   return "1234"
 }
@@ -174,11 +271,17 @@ aState.CNLog.Logf("Hello from ActionRunAction [%s]", actionName)
 //
 // Part of the action.ActionImpl interface.
 //
+// CALLS RefreshActions;
+// THREAD-SAFE;
+//
 func (aState *ActionsState) ResponseDescribeActionJSON(
   actionName string,
 ) action.ActionDescription {
-  aState.ScanForActions()
+  aState.RefreshActions()
+
+  aState.Mutex.RLock()
   actionDesc := aState.Actions[actionName]
+  aState.Mutex.RUnlock()
   if actionDesc.Name == "" {
     actionDesc = action.ActionDescription{
       Name: "not found",
@@ -0,0 +1,155 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "io"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// The (cached) hash of an action's executable. The hash is only
+// recomputed when the executable's size or modification time changes.
+//
+type ActionHash struct {
+  Size     int64
+  Mod_Time time.Time
+  Hash     string
+}
+
+// The default commands used to detect the versions of the installed
+// tools.
+//
+var DefaultToolCommands = map[string]string{
+  "context":    "context --version",
+  "luametatex": "luametatex --version",
+}
+
+// Returns the (sha256) hash of the file at aPath.
+//
+func hashFile(aPath string) (string, error) {
+  aFile, err := os.Open(aPath)
+  if err != nil { return "", err }
+  defer aFile.Close()
+
+  hasher := sha256.New()
+  if _, err := io.Copy(hasher, aFile) ; err != nil { return "", err }
+  return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Returns a map of the name of each registered action (which has an
+// executable) to the (sha256) hash of its executable.
+//
+// Actions with the same hash on two different cnNurseries run the same
+// code.
+//
+// CALLS RefreshActions (so the actions are only rescanned when they change);
+// THREAD-SAFE;
+//
+func (aState *ActionsState) ActionHashes() map[string]string {
+  aState.RefreshActions()
+
+  aState.Mutex.Lock()
+  defer aState.Mutex.Unlock()
+
+  hashes := make(map[string]string, 0)
+  for anActionName := range aState.Actions {
+    aPath := filepath.Join(aState.ActionsDir, anActionName)
+    info, err := os.Stat(aPath)
+    if err != nil || info.IsDir() {
+      delete(aState.Hashes, anActionName)
+      continue
+    }
+    cached, ok := aState.Hashes[anActionName]
+    if !ok || cached.Size != info.Size() || !cached.Mod_Time.Equal(info.ModTime()) {
+      hash, err := hashFile(aPath)
+      if err != nil {
+        aState.CNLog.MayBeErrorf(err, "Could not hash the action [%s]", aPath)
+        continue
+      }
+      cached = ActionHash{ Size: info.Size(), Mod_Time: info.ModTime(), Hash: hash }
+      aState.Hashes[anActionName] = cached
+    }
+    hashes[anActionName] = cached.Hash
+  }
+  return hashes
+}
+
+// Returns the number of actions currently running.
+//
+// THREAD-SAFE;
+//
+func (aState *ActionsState) QueueDepth() uint {
+  aState.Mutex.RLock()
+  defer aState.Mutex.RUnlock()
+
+  return aState.Running
+}
+
+// Returns the version reported by a tool's version command output: the
+// first line which mentions a version, or (if there is no such line) the
+// first non-empty line.
+//
+func parseToolVersion(output string) string {
+  firstLine := ""
+  for _, aLine := range strings.Split(output, "\n") {
+    aLine = strings.TrimSpace(aLine)
+    if aLine == "" { continue }
+    if firstLine == "" { firstLine = aLine }
+    if strings.Contains(strings.ToLower(aLine), "version") { return aLine }
+  }
+  return firstLine
+}
+
+// Detect the versions of the tools installed on this cnNursery by running
+// each of the configured Tool_Commands. Tools whose command fails are
+// not installed (and are not listed).
+//
+// READS config;
+//
+func DetectToolVersions(config *ConfigType) map[string]string {
+  tools := make(map[string]string, 0)
+  for aToolName, aCommand := range config.Tool_Commands {
+    cmdLine := strings.Fields(aCommand)
+    if len(cmdLine) < 1 { continue }
+    output, err := exec.Command(cmdLine[0], cmdLine[1:]...).Output()
+    if err != nil {
+      config.CNLog.Logf("Could not detect the tool [%s]: %s", aToolName, err)
+      continue
+    }
+    tools[aToolName] = parseToolVersion(string(output))
+    config.CNLog.Logf("Detected the tool [%s] version [%s]", aToolName, tools[aToolName])
+  }
+  return tools
+}
+
+// Returns the configured Fonts_Dir, if it exists, or "" otherwise.
+//
+// READS config;
+//
+func DetectFontsDir(config *ConfigType) string {
+  if config.Fonts_Dir == "" { return "" }
+  info, err := os.Stat(config.Fonts_Dir)
+  if err != nil || !info.IsDir() {
+    config.CNLog.Logf("Could not find the fonts directory [%s]", config.Fonts_Dir)
+    return ""
+  }
+  return config.Fonts_Dir
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Test hashing the executables of the registered actions.
+//
+func TestActionHashes(t *testing.T) {
+  actionsDir := t.TempDir()
+  config := CreateConfiguration(logger.CreateLogger("capabilitiesTest"))
+  config.Actions_Dir = actionsDir
+  aState := CreateActionsState(config, nil, nil, nil)
+
+  ioutil.WriteFile(
+    filepath.Join(actionsDir, "typeset.config"),
+    []byte("name: typeset\ndesc: typeset a document\n"), 0644,
+  )
+  ioutil.WriteFile(
+    filepath.Join(actionsDir, "missing.config"),
+    []byte("name: missing\ndesc: has no executable\n"), 0644,
+  )
+  ioutil.WriteFile(
+    filepath.Join(actionsDir, "typeset"), []byte("#!/bin/sh\n"), 0755,
+  )
+
+  hashes := aState.ActionHashes()
+  assert.Len(t, hashes, 1)
+  assert.Len(t, hashes["typeset"], 64)
+
+  ioutil.WriteFile(
+    filepath.Join(actionsDir, "typeset"), []byte("#!/bin/sh\necho changed\n"), 0755,
+  )
+  assert.NotEqual(t, hashes["typeset"], aState.ActionHashes()["typeset"])
+}
+
+// Test that the actions are only rescanned when the actions directory
+// changes, and that copies of the actions are returned.
+//
+func TestRefreshActions(t *testing.T) {
+  actionsDir := t.TempDir()
+  config := CreateConfiguration(logger.CreateLogger("capabilitiesTest"))
+  config.Actions_Dir = actionsDir
+  aState := CreateActionsState(config, nil, nil, nil)
+
+  typesetPath := filepath.Join(actionsDir, "typeset.config")
+  ioutil.WriteFile(typesetPath, []byte("name: typeset\ndesc: typeset\n"), 0644)
+  actions := aState.ResponseListActionsJSON()
+  assert.Len(t, actions, 1)
+  scanTime := aState.ScanTime
+
+  // (the returned actions are a copy)
+  delete(actions, "typeset")
+  assert.Equal(t, "typeset", aState.ResponseDescribeActionJSON("typeset").Desc)
+  assert.Equal(t, scanTime, aState.ScanTime)
+
+  // a changed description is rescanned
+  ioutil.WriteFile(typesetPath, []byte("name: typeset\ndesc: changed\n"), 0644)
+  os.Chtimes(typesetPath, time.Now(), scanTime.Add(time.Second))
+  assert.Equal(t, "changed", aState.ResponseDescribeActionJSON("typeset").Desc)
+
+  // as are removed descriptions
+  os.Remove(typesetPath)
+  assert.Empty(t, aState.ResponseListActionsJSON())
+  assert.Equal(t, "not found", aState.ResponseDescribeActionJSON("typeset").Name)
+
+  // the actions may be listed (and hashed) concurrently
+  ioutil.WriteFile(typesetPath, []byte("name: typeset\ndesc: typeset\n"), 0644)
+  var wg sync.WaitGroup
+  for i := 0 ; i < 4 ; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for j := 0 ; j < 10 ; j++ {
+        aState.ActionHashes()
+        assert.Len(t, aState.ResponseListActionsJSON(), 1)
+      }
+    }()
+  }
+  wg.Wait()
+}
+
+// Test parsing the output of a tool's version command.
+//
+func TestParseToolVersion(t *testing.T) {
+  assert.Equal(t,
+    "mtx-context     | current version: 2020.05.29 19:57",
+    parseToolVersion(
+      "\nmtx-context     | ConTeXt Process Management 1.03\n"+
+      "mtx-context     |\n"+
+      "mtx-context     | current version: 2020.05.29 19:57\n",
+    ),
+  )
+  assert.Equal(t, "luametatex 2.06", parseToolVersion("\n luametatex 2.06 \n"))
+  assert.Equal(t, "", parseToolVersion(""))
+}
+
+// Test selecting nurseries by label and action.
+//
+func TestSelectNurseries(t *testing.T) {
+  niMap := discovery.NurseryInfoMap{
+    "a": discovery.NurseryInfo{
+      Name:    "a",
+      Labels:  map[string]string{ "fonts": "full", "arch": "amd64" },
+      Actions: map[string]string{ "typeset": "1234" },
+    },
+    "b": discovery.NurseryInfo{
+      Name:    "b",
+      Labels:  map[string]string{ "arch": "arm64" },
+    },
+  }
+
+  selectors, err := discovery.ParseLabelSelectors([]string{ "arch=amd64" })
+  assert.NoError(t, err)
+  assert.Equal(t, []string{ "a" }, mapNames(niMap.Select(selectors, nil)))
+
+  selectors, err = discovery.ParseLabelSelectors([]string{ "arch" })
+  assert.NoError(t, err)
+  assert.Equal(t, []string{ "a", "b" }, sortedNames(mapNames(niMap.Select(selectors, nil))))
+  assert.Equal(t,
+    []string{ "a" }, mapNames(niMap.Select(selectors, []string{ "typeset" })),
+  )
+
+  selectors, err = discovery.ParseLabelSelectors([]string{ "fonts=minimal" })
+  assert.NoError(t, err)
+  assert.Empty(t, niMap.Select(selectors, nil))
+
+  _, err = discovery.ParseLabelSelectors([]string{ "=amd64" })
+  assert.Error(t, err)
+}
@@ -17,7 +17,10 @@ package CNNurseries
 import (
   "encoding/json"
   "fmt"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/action"
   "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/diSimplex/ConTeXtNursery/webserver"
   "github.com/jinzhu/configor"
   "os"
 )
@@ -28,19 +31,39 @@ import (
 // altered by structure methods.
 //
 type ConfigType struct {
-  Name         string
-  Host         string
-  Interface    string
-  Port         string
-  Html_Dir     string
-  Base_Url     string
-  Primary_Url  string
-  Ca_Cert_Path string
-  Cert_Path    string
-  Key_Path     string
-  Work_Dir     string
-  Actions_Dir  string
-  CNLog       *logger.LoggerType
+  Name                string
+  Host                string
+  Interface           string
+  Port                string
+  Html_Dir            string
+  Base_Url            string
+  Primary_Url         string
+  Primary_Candidates []string
+  Lease_Duration      uint
+  Heartbeat_Interval  uint
+  Heartbeat_Jitter    uint
+  Suspect_Heartbeats  uint
+  Dead_Heartbeats     uint
+  Tombstone_Period    uint
+  Ca_Cert_Path        string
+  Cert_Path           string
+  Key_Path            string
+  Key_Passphrase      string
+  Crl_Path            string
+  Cert_Check_Interval uint
+  Work_Dir            string
+  Actions_Dir         string
+  Fonts_Dir           string
+  Labels              map[string]string
+  Tool_Commands       map[string]string
+  Placement_Policy    string
+  Control_Timeout     uint
+  History_Length      uint
+  Schedule_Interval   uint
+  Event_History       uint
+  Limits              webserver.Limits
+  Retry               federationClient.RetryPolicy
+  CNLog              *logger.LoggerType
 }
 
 // Create an (empty) configuration structure
@@ -66,7 +89,37 @@ func (config *ConfigType) LoadConfiguration(
   configFileName string,
   showConfig     bool,
 ) {
-  configor.Load(config, configFileName)
+  err := configor.Load(config, configFileName)
+  config.CNLog.MayBeFatal("Could not load the configuration ["+configFileName+"]", err)
+
+  config.Limits.NormalizeLimits()
+  config.Retry.NormalizeRetry()
+  if config.Cert_Check_Interval == 0 { config.Cert_Check_Interval = 10 }
+  if config.Lease_Duration      == 0 { config.Lease_Duration      = 15 }
+  if config.Heartbeat_Interval  == 0 { config.Heartbeat_Interval  = 10 }
+  if config.Heartbeat_Jitter    == 0 { config.Heartbeat_Jitter    = 20 }
+  if config.Suspect_Heartbeats  == 0 { config.Suspect_Heartbeats  = 3 }
+  if config.Dead_Heartbeats     == 0 { config.Dead_Heartbeats     = 6 }
+  if config.Tombstone_Period    == 0 { config.Tombstone_Period    = 600 }
+  if config.Control_Timeout     == 0 { config.Control_Timeout     = 10 }
+  if config.History_Length      == 0 { config.History_Length      = 100 }
+  if config.Schedule_Interval   == 0 { config.Schedule_Interval   = 15 }
+  if config.Event_History       == 0 { config.Event_History       = 100 }
+  if config.Dead_Heartbeats < config.Suspect_Heartbeats {
+    config.Dead_Heartbeats = config.Suspect_Heartbeats
+  }
+  if config.Placement_Policy == "" {
+    config.Placement_Policy = action.LeastLoadedPolicy
+  }
+  if config.Tool_Commands == nil {
+    config.Tool_Commands = make(map[string]string, 0)
+    for aToolName, aCommand := range DefaultToolCommands {
+      config.Tool_Commands[aToolName] = aCommand
+    }
+  }
+  if len(config.Primary_Candidates) < 1 && config.Primary_Url != "" {
+    config.Primary_Candidates = []string{ config.Primary_Url }
+  }
   
   if showConfig {
     configBytes, _ := json.MarshalIndent(config, "", "  ")
@@ -74,12 +127,3 @@ func (config *ConfigType) LoadConfiguration(
     os.Exit(0)
   }
 }
-
-// Returns true if this cnNursery is configured as the Primary cnNursery 
-// of this federation. 
-//
-// READS config;
-//
-func (config *ConfigType) IsPrimary() bool {
-  return config.Base_Url == config.Primary_Url
-}
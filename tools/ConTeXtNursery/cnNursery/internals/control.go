@@ -16,42 +16,61 @@ package CNNurseries
 
 import (
   "context"
-  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
   "github.com/diSimplex/ConTeXtNursery/interfaces/control"
   "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
   "github.com/diSimplex/ConTeXtNursery/logger"
   "github.com/diSimplex/ConTeXtNursery/webserver"
   "sync"
+  "time"
 )
 
 // CNState contains the (essentially global) state required to implement 
 // the Control RESTful interface. 
 //
+// The Desired_State is the federation-wide control state last requested 
+// (via /control/all), which is persisted (by the Store) so that it 
+// survives restarts. Each federation-wide state change sent to a Nursery 
+// must complete within the Control_Timeout. The History records (at most 
+// History_Length of) the transitions of each Nursery. The Schedules are 
+// the scheduled state changes (indexed by Id) stored by the primary, 
+// whose Schedules_Version changes whenever they do. 
+//
 // CONSTRAINTS: Once created, the values in this structure SHOULD only be 
 // altered by structure methods.
 //
 type CNState struct {
-  Mutex       sync.RWMutex
-  Primary_Url string
-  State       control.NurseryState
-  Ws         *webserver.WS
-  Cc         *clientConnection.CC
-  CNLog      *logger.LoggerType
-  CNInfoMap  *CNInfoMap
+  Mutex             sync.RWMutex
+  State             control.NurseryState
+  Desired_State     string
+  Labels            map[string]string
+  Control_Timeout   time.Duration
+  History           control.TransitionHistory
+  History_Length    int
+  Schedules         map[string]control.Schedule
+  Schedules_Version uint64
+  Store            *FederationStore
+  Ws               *webserver.WS
+  Fc               *federationClient.Client
+  CNLog            *logger.LoggerType
+  CNInfoMap        *CNInfoMap
 }
 
 // Create a CNState structure
 //
 // READS config;
 // FIELD cnInfoMap;
+// FIELD store;
 // FIELD ws;
-// FIELD cc;
+// FIELD fc;
 //
 func CreateCNState(
   config    *ConfigType,
   cnInfoMap *CNInfoMap,
+  store     *FederationStore,
   ws        *webserver.WS,
-  cc        *clientConnection.CC,
+  fc        *federationClient.Client,
 ) *CNState {
   return &CNState{
     State: control.NurseryState{
@@ -60,22 +79,67 @@ func CreateCNState(
       State:        "up",
       Processes:    0,
     },
+    Desired_State: control.StateUp,
+    Labels: config.Labels,
+    Control_Timeout: time.Duration(config.Control_Timeout) * time.Second,
+    History: make(control.TransitionHistory),
+    History_Length: int(config.History_Length),
+    Schedules: make(map[string]control.Schedule),
+    Store: store,
     Ws: ws,
-    Cc: cc,
+    Fc: fc,
     CNLog: config.CNLog,
     CNInfoMap: cnInfoMap,
   }
 }
 
-// Sets the current state of this cnNursery.
+// Record a transition (of the named Nursery) in the (bounded) history, 
+// forgetting the oldest transitions beyond the History_Length. 
+//
+// NOT THREAD-SAFE (the caller MUST hold the cnState.Mutex lock);
+//
+func (cnState *CNState) recordTransition(
+  name       string,
+  transition control.Transition,
+) {
+  history := append(cnState.History[name], transition)
+  if 0 < cnState.History_Length && cnState.History_Length < len(history) {
+    history = history[len(history)-cnState.History_Length:]
+  }
+  cnState.History[name] = history
+}
+
+// Sets the current state of this cnNursery, if the transition (from the 
+// current state) is legal, and records the transition in the history. 
+//
+// Returns true if the state was changed, or a *control.TransitionError if 
+// the transition is illegal. 
 //
 // THREAD-SAFE;
 //
-func (cnState *CNState) SetState(newState string) {
+func (cnState *CNState) SetState(
+  ctx    context.Context,
+  change control.StateChange,
+) (bool, error) {
   cnState.Mutex.Lock()
   defer cnState.Mutex.Unlock()
 
-  cnState.State.State = newState // this is too permissive! but works for now.
+  fromState := cnState.State.State
+  if !control.CanTransition(fromState, change.State) {
+    return false, &control.TransitionError{ From: fromState, To: change.State }
+  }
+  if fromState == change.State { return false, nil }
+
+  cnState.State.State = change.State
+  cnState.recordTransition(cnState.CNInfoMap.Name, control.Transition{
+    At:         time.Now(),
+    From:       fromState,
+    To:         change.State,
+    Reason:     change.Reason,
+    Actor:      change.Actor,
+    Request_Id: logger.RequestIdFromContext(ctx),
+  })
+  return true, nil
 }
 
 // Gets the current state of this cnNursery.
@@ -89,38 +153,244 @@ func (cnState *CNState) GetState() string {
   return cnState.State.State
 }
 
+// Gets the (federation-wide) desired state.
+//
+// THREAD-SAFE;
+//
+func (cnState *CNState) GetDesiredState() string {
+  cnState.Mutex.RLock()
+  defer cnState.Mutex.RUnlock()
+
+  return cnState.Desired_State
+}
+
+// Restore the (persisted) federation-wide desired state. This cnNursery 
+// takes on a paused or down desired state, through the same (legal, and 
+// recorded) transition as any other state change. 
+//
+// CALLS SetState;
+// THREAD-SAFE;
+//
+func (cnState *CNState) RestoreDesiredState(desiredState string) {
+  if desiredState == "" || desiredState == control.StateUp { return }
+  ctx   := logger.ContextWithNewRequestId(context.Background())
+  cnLog := cnState.CNLog.ForContext(ctx)
+  if desiredState != control.StatePaused && desiredState != control.StateDown {
+    cnLog.Logf("Refusing to restore the desired federation state [%s]", desiredState)
+    return
+  }
+
+  cnLog.Logf("Restoring the desired federation state [%s]", desiredState)
+  _, err := cnState.SetState(ctx, control.StateChange{
+    State:  desiredState,
+    Reason: "restored from the persisted federation",
+    Actor:  "restore",
+  })
+  if err != nil {
+    cnLog.MayBeError("Refusing to restore the desired federation state", err)
+    return
+  }
+  cnState.Mutex.Lock()
+  defer cnState.Mutex.Unlock()
+
+  cnState.Desired_State = desiredState
+}
+
+// Returns an error if this cnNursery is not ready to accept new work 
+// (that is, it is draining, or has been brought down or killed). 
+//
+// Used as a webserver.ReadinessCheck.
+//
+// THREAD-SAFE;
+//
+func (cnState *CNState) CheckReady() error {
+  state := cnState.GetState()
+  if state == control.StateDraining ||
+    state == control.StateDown || state == control.StateKill {
+    return fmt.Errorf("this nursery is [%s]", state)
+  }
+  return nil
+}
+
 // Change the control state of this Nursery.
 //
 // Part of the control.ControlImpl interface.
 //
+// Returns a *control.TransitionError if the change is illegal.
+//
 // NOTE: control.StateKill is NOT THREAD-SAFE as all threads will be 
 // killed. 
 //
 // All other control.StateXXs are THREAD-SAFE (via SetState)
 //
-func (cnState *CNState) ActionChangeNurseryState(stateChange string) {
-  switch stateChange {
-    case control.StateUp     : cnState.SetState(stateChange)
-    case control.StatePaused : cnState.SetState(stateChange)
-    case control.StateDown   : cnState.SetState(stateChange)
-    case control.StateKill   : cnState.SetState(stateChange)
-      cnState.Ws.Server.Shutdown(context.Background())
-    default                  :
-      cnState.CNLog.Logf("Ignoring incorrect state change: [%s]", stateChange)
+func (cnState *CNState) ActionChangeNurseryState(
+  ctx    context.Context,
+  change control.StateChange,
+) error {
+  cnLog := cnState.CNLog.ForContext(ctx)
+  cnLog.Logf(
+    "changing the state of this nursery to [%s] (actor: %s, reason: %s)",
+    change.State, change.Actor, change.Reason,
+  )
+  changed, err := cnState.SetState(ctx, change)
+  if err != nil {
+    cnLog.MayBeError("Refusing the state change", err)
+    return err
+  }
+  // the primary's map of the federation (and so its event stream) 
+  // reflects its own changes immediately, rather than at its next 
+  // heartbeat 
+  if changed && cnState.CNInfoMap.Election.IsLeader() {
+    cnState.CNInfoMap.SetNurseryState(cnState.CNInfoMap.Name, change.State)
   }
+  if changed && change.State == control.StateKill {
+    // we are (probably) being called from inside a request handler
+    // so the shutdown MUST happen in its own go routine
+    go func() {
+      err := cnState.Ws.ShutdownWithTimeout()
+      cnLog.MayBeError("Could not gracefully shutdown", err)
+    }()
+  }
+  return nil
 }
 
-// Change the control state of the federation of Nurseries.
+// Change the control state of the targeted Nurseries in the federation.
 //
 // Part of the control.ControlImpl interface.
 //
-// THREAD-SAFE (via CNInfoMap.DoToAllOthers)
+// The state change is sent concurrently (each with its own 
+// Control_Timeout) to every targeted Nursery other than this one, and 
+// then (so that a kill does not cut the others short) to this Nursery. 
+// The previous state, new state and any error of each Nursery are 
+// returned. A dry run only reports the targeted Nurseries. 
 //
-func (cnState *CNState) ActionChangeFederationState(stateChange string) {
-  cnState.CNInfoMap.DoToAllOthers(func (name string, ni discovery.NurseryInfo) {
-    control.SendNurseryControlMessage(ni.Base_Url, stateChange, cnState.Cc)
-  })
-  control.SendNurseryControlMessage(cnState.State.Base_Url, stateChange, cnState.Cc)
+// Only a (non dry run) change of the whole federation changes the 
+// (persisted) federation-wide desired state.
+//
+// The request id carried by ctx is forwarded to every Nursery, so that
+// the log lines of this one federation-wide operation can be found on
+// every host.
+//
+// THREAD-SAFE (via CNInfoMap.Snapshot)
+//
+func (cnState *CNState) ActionChangeFederationState(
+  ctx    context.Context,
+  change control.StateChange,
+  target control.ControlTarget,
+) control.FederationChangeResult {
+  stateChange := change.State
+  cnLog := cnState.CNLog.ForContext(ctx)
+  cnLog.Logf(
+    "changing the state of the federation to [%s] (actor: %s, reason: %s, dry run: %t)",
+    stateChange, change.Actor, change.Reason, target.Dry_Run,
+  )
+
+  // record (and persist) the desired state... a kill is never desired
+  // once the federation restarts
+  if !target.Dry_Run && target.IsWholeFederation() {
+    switch stateChange {
+      case control.StateUp, control.StatePaused, control.StateDown :
+        cnState.Mutex.Lock()
+        cnState.Desired_State = stateChange
+        cnState.Mutex.Unlock()
+        err := cnState.Store.SaveIfChanged(cnState.CNInfoMap, cnState)
+        cnLog.MayBeError("Could not save the desired federation state", err)
+    }
+  }
+
+  // this nursery is always known (even before its first heartbeat)
+  selfName := cnState.CNInfoMap.Name
+  niMap    := cnState.CNInfoMap.Snapshot()
+  if _, ok := niMap[selfName] ; !ok {
+    niMap[selfName] = discovery.NurseryInfo{
+      Name:     selfName,
+      Base_Url: cnState.State.Base_Url,
+      State:    cnState.GetState(),
+      Labels:   cnState.Labels,
+    }
+  }
+
+  result := control.FederationChangeResult{
+    State_Change: stateChange,
+    Reason:       change.Reason,
+    Actor:        change.Actor,
+    Dry_Run:      target.Dry_Run,
+    Nurseries:    make(map[string]control.NurseryChangeResult),
+  }
+  legal := make(map[string]bool)
+  for aName, ni := range niMap {
+    if !target.Targets(aName, ni) { continue }
+    aResult := control.NurseryChangeResult{
+      Base_Url:       ni.Base_Url,
+      Previous_State: ni.State,
+      New_State:      stateChange,
+    }
+    legal[aName] = control.CanTransition(ni.State, stateChange)
+    if !legal[aName] {
+      aResult.New_State = ni.State
+      aResult.Error     =
+        (&control.TransitionError{ From: ni.State, To: stateChange }).Error()
+    }
+    result.Nurseries[aName] = aResult
+  }
+  if target.Dry_Run { return result }
+
+  changeState := func(
+    name   string,
+    result control.NurseryChangeResult,
+  ) control.NurseryChangeResult {
+    ctx, cancel := context.WithTimeout(ctx, cnState.Control_Timeout)
+    defer cancel()
+    _, err := cnState.Fc.ControlNursery(ctx, result.Base_Url, change)
+    if err != nil {
+      cnLog.MayBeErrorf(err, "Could not change the state of [%s]", name)
+      result.New_State = result.Previous_State
+      result.Error     = err.Error()
+      return result
+    }
+    cnState.CNInfoMap.SetNurseryState(name, stateChange)
+    // this nursery records its own transitions (via SetState)
+    if name != selfName && result.Previous_State != stateChange {
+      cnState.Mutex.Lock()
+      cnState.recordTransition(name, control.Transition{
+        At:         time.Now(),
+        From:       result.Previous_State,
+        To:         stateChange,
+        Reason:     change.Reason,
+        Actor:      change.Actor,
+        Request_Id: logger.RequestIdFromContext(ctx),
+      })
+      cnState.Mutex.Unlock()
+    }
+    return result
+  }
+
+  // the results are collected before any are changed, since the map 
+  // MUST NOT be iterated over while the go routines alter it 
+  pending := make(map[string]control.NurseryChangeResult)
+  for aName, aChange := range result.Nurseries {
+    if aName == selfName || !legal[aName] { continue }
+    pending[aName] = aChange
+  }
+
+  var resultsMutex sync.Mutex
+  var wg sync.WaitGroup
+  for aName, aChange := range pending {
+    wg.Add(1)
+    go func(name string, change control.NurseryChangeResult) {
+      defer wg.Done()
+      change = changeState(name, change)
+      resultsMutex.Lock()
+      result.Nurseries[name] = change
+      resultsMutex.Unlock()
+    }(aName, aChange)
+  }
+  wg.Wait()
+
+  if selfChange, ok := result.Nurseries[selfName] ; ok && legal[selfName] {
+    result.Nurseries[selfName] = changeState(selfName, selfChange)
+  }
+  return result
 }
 
 // Return the control status information about the federation of ConTeXt 
@@ -133,6 +403,10 @@ func (cnState *CNState) ActionChangeFederationState(stateChange string) {
 //
 // Part of the control.ControlImpl interface.
 //
+// The state of the "Federation" is computed from the states (and 
+// liveness) of its members, while its Desired_State is the 
+// federation-wide desired state. 
+//
 // TREAD-SAFE (via Mutex and CNInfoMap.DoToAll)
 //
 func (cnState *CNState) ResponseListFederationStatusJSON() *control.FederationStateMap {
@@ -141,6 +415,7 @@ func (cnState *CNState) ResponseListFederationStatusJSON() *control.FederationSt
   
   fedStateMap     := control.FederationStateMap{}
   fedNumProcesses := uint(0)
+  memberStates    := make([]string, 0)
   cnState.CNInfoMap.DoToAll(func(name string, ni discovery.NurseryInfo) {
     ns := control.NurseryState{
       Base_Url:     ni.Base_Url,
@@ -150,12 +425,37 @@ func (cnState *CNState) ResponseListFederationStatusJSON() *control.FederationSt
     }
     fedNumProcesses = fedNumProcesses + ni.Processes
     fedStateMap[name] = ns
+    // a member which is not (known to be) alive degrades the federation
+    if ni.Liveness != "" && ni.Liveness != discovery.LivenessAlive {
+      memberStates = append(memberStates, ni.Liveness)
+    } else {
+      memberStates = append(memberStates, ni.State)
+    }
   })
   fedStateMap["Federation"] = control.NurseryState{
-    Base_Url:     cnState.Primary_Url,
-    Url_Modifier: "/all",
-    State:        control.StateUp,
-    Processes:    fedNumProcesses,
+    Base_Url:      cnState.CNInfoMap.Election.GetLeader(),
+    Url_Modifier:  "/all",
+    State:         control.ComputeFederationState(memberStates),
+    Desired_State: cnState.Desired_State,
+    Processes:     fedNumProcesses,
   }
   return &fedStateMap
 }
+
+// Return the (bounded) history of the transitions of this Nursery, and 
+// (on the primary) of the transitions it made to other Nurseries. 
+//
+// Part of the control.ControlImpl interface.
+//
+// THREAD-SAFE;
+//
+func (cnState *CNState) ResponseControlHistoryJSON() control.TransitionHistory {
+  cnState.Mutex.RLock()
+  defer cnState.Mutex.RUnlock()
+
+  history := make(control.TransitionHistory, len(cnState.History))
+  for aName, transitions := range cnState.History {
+    history[aName] = append([]control.Transition{}, transitions...)
+  }
+  return history
+}
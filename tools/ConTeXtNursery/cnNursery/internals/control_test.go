@@ -0,0 +1,161 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "context"
+  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/control"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "testing"
+)
+
+// Test changing the state of (some of) the federation.
+//
+func TestChangeFederationState(t *testing.T) {
+  var requestsMutex sync.Mutex
+  requests := make([]string, 0)
+  server := httptest.NewServer(http.HandlerFunc(
+    func(w http.ResponseWriter, r *http.Request) {
+      requestsMutex.Lock()
+      requests = append(requests, r.URL.Path)
+      requestsMutex.Unlock()
+      if r.URL.Path == "/broken/control/paused" {
+        http.Error(w, "broken", http.StatusBadRequest)
+        return
+      }
+      w.Write([]byte("{}"))
+    },
+  ))
+  defer server.Close()
+
+  config := CreateConfiguration(logger.CreateLogger("controlTest"))
+  config.Name            = "primary"
+  config.Base_Url        = server.URL+"/primary"
+  config.Work_Dir        = t.TempDir()
+  config.Control_Timeout = 1
+  cc := &clientConnection.CC{ Client: &http.Client{}, Log: config.CNLog }
+  fc := federationClient.CreateClient(cc, federationClient.RetryPolicy{})
+
+  cniMap := CreateCNInfoMap(config, createTestElection("https://primary"), nil)
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{
+    Name: "a", Base_Url: server.URL+"/a", State: "up",
+    Labels: map[string]string{ "fonts": "full" },
+  })
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{
+    Name: "broken", Base_Url: server.URL+"/broken", State: "up",
+  })
+  cnState := CreateCNState(config, cniMap, CreateFederationStore(config), nil, fc)
+
+  // a dry run only reports the targeted nurseries
+  result := cnState.ActionChangeFederationState(
+    context.Background(),
+    control.StateChange{ State: control.StatePaused },
+    control.ControlTarget{ Dry_Run: true },
+  )
+  assert.Empty(t, requests)
+  assert.Len(t, result.Nurseries, 3)
+  assert.Equal(t, control.StateUp, cnState.GetDesiredState())
+
+  result = cnState.ActionChangeFederationState(
+    context.Background(),
+    control.StateChange{
+      State: control.StatePaused, Reason: "maintenance", Actor: "admin",
+    },
+    control.ControlTarget{},
+  )
+  assert.Len(t, requests, 3)
+  assert.Equal(t, "/primary/control/paused", requests[2])
+  assert.Equal(t, "maintenance", cnState.History["a"][0].Reason)
+  assert.Equal(t, "admin",       cnState.History["a"][0].Actor)
+  assert.Empty(t, cnState.History["broken"])
+  assert.Equal(t, "up",     result.Nurseries["a"].Previous_State)
+  assert.Equal(t, "paused", result.Nurseries["a"].New_State)
+  assert.Equal(t, "",       result.Nurseries["a"].Error)
+  assert.Equal(t, "up",     result.Nurseries["broken"].New_State)
+  assert.NotEqual(t, "",    result.Nurseries["broken"].Error)
+  assert.Equal(t, "paused", cniMap.Snapshot()["a"].State)
+  assert.Equal(t, control.StatePaused, cnState.GetDesiredState())
+
+  // a subset (by label) does not change the desired state
+  requests = requests[:0]
+  result = cnState.ActionChangeFederationState(
+    context.Background(),
+    control.StateChange{ State: control.StateUp },
+    control.ControlTarget{
+      Labels: []discovery.LabelSelector{ { Key: "fonts", Value: "full" } },
+    },
+  )
+  assert.Equal(t, []string{ "/a/control/up" }, requests)
+  assert.Len(t, result.Nurseries, 1)
+  assert.Equal(t, control.StatePaused, cnState.GetDesiredState())
+}
+
+// Test the legal transitions of a nursery, and its (bounded) history.
+//
+func TestTransitions(t *testing.T) {
+  config := CreateConfiguration(logger.CreateLogger("controlTest"))
+  config.Name           = "aNursery"
+  config.History_Length = 2
+  cniMap  := CreateCNInfoMap(config, createTestElection("https://primary"), nil)
+  cnState := CreateCNState(config, cniMap, CreateFederationStore(config), nil, nil)
+  ctx     := context.Background()
+
+
+  change := func(state, reason string) error {
+    return cnState.ActionChangeNurseryState(
+      ctx, control.StateChange{ State: state, Reason: reason, Actor: "admin" },
+    )
+  }
+
+  assert.NoError(t, change(control.StateDown, "disk full"))
+  err := change(control.StatePaused, "")
+  assert.IsType(t, &control.TransitionError{}, err)
+  assert.Equal(t, control.StateDown, cnState.GetState())
+
+  // re-requesting the current state changes nothing
+  assert.NoError(t, change(control.StateDown, "still full"))
+  assert.Len(t, cnState.ResponseControlHistoryJSON()["aNursery"], 1)
+
+  assert.NoError(t, change(control.StateUp, ""))
+  assert.NoError(t, change(control.StatePaused, ""))
+  history := cnState.ResponseControlHistoryJSON()["aNursery"]
+  assert.Len(t, history, 2)
+  assert.Equal(t, control.StateDown,   history[0].From)
+  assert.Equal(t, control.StatePaused, history[1].To)
+}
+
+// Test computing the state of a federation from the states of its members.
+//
+func TestComputeFederationState(t *testing.T) {
+  assert.Equal(t, control.StateUp, control.ComputeFederationState(
+    []string{ control.StateUp, control.StateUp },
+  ))
+  assert.Equal(t, control.StateMixed, control.ComputeFederationState(
+    []string{ control.StateUp, control.StatePaused },
+  ))
+  assert.Equal(t, control.StateDegraded, control.ComputeFederationState(
+    []string{ control.StateUp, control.StateDown },
+  ))
+  assert.Equal(t, control.StateDegraded, control.ComputeFederationState(
+    []string{ control.StateUp, discovery.LivenessSuspect },
+  ))
+}
@@ -0,0 +1,429 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "context"
+  "crypto/x509"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/election"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "net/url"
+  "sync"
+  "time"
+)
+
+// CNElection contains the (essentially global) state required to elect
+// the federation's primary (leader) cnNursery from among the (ordered)
+// primary candidates.
+//
+// A candidate becomes the leader once a majority of the candidates have
+// granted it a lease on the leadership. The leader renews its lease every
+// third of the lease duration. A candidate only grants a lease if it
+// knows of no other leader whose lease has yet to expire, and grants at
+// most one (new) leader in any given term. When a leader fails to renew
+// its lease, the remaining candidates campaign (in candidate order) to
+// replace it.
+//
+// Nurseries which are not candidates follow the leader by asking the
+// candidates who the current leader is.
+//
+// CONSTRAINTS: Once created, the values in this structure SHOULD only be
+// altered by structure methods.
+//
+type CNElection struct {
+  Mutex          sync.RWMutex
+  Self           string
+  Candidates     []string
+  Lease_Duration time.Duration
+  Leader         string
+  Term           uint64
+  Lease_Expires  time.Time
+  Voted_Term     uint64
+  Voted_For      string
+  Fc            *federationClient.Client
+  CNLog         *logger.LoggerType
+}
+
+// Returns an error unless this cnNursery (at self) has a base_url, and
+// there is at least one primary candidate (without which this cnNursery
+// would never have, nor follow, a leader).
+//
+// Exactly two candidates are also refused, since a majority of two is
+// both of them (so the federation would lose its leader if either
+// candidate failed).
+//
+func CheckCandidates(self string, candidates []string) error {
+  if self == "" {
+    return fmt.Errorf("the base_url MUST be specified")
+  }
+  return checkPrimaryCandidates(candidates)
+}
+
+// Returns an error if there are no primary candidates, or exactly two
+// (see CheckCandidates).
+//
+func checkPrimaryCandidates(candidates []string) error {
+  if len(candidates) < 1 {
+    return fmt.Errorf("the primary_candidates (or the primary_url) MUST be specified")
+  }
+  if len(candidates) == 2 {
+    return fmt.Errorf(
+      "the primary_candidates %v can not elect a leader once either has failed (use one, or at least three, candidates)",
+      candidates,
+    )
+  }
+  return nil
+}
+
+// Create a CNElection structure
+//
+// Exits if the election could never have a leader (see CheckCandidates).
+//
+// READS config;
+// FIELD fc;
+//
+func CreateCNElection(
+  config *ConfigType,
+  fc     *federationClient.Client,
+) *CNElection {
+  err := CheckCandidates(config.Base_Url, config.Primary_Candidates)
+  config.CNLog.MayBeFatal("Could not start the election of the primary", err)
+
+  return &CNElection{
+    Self:           config.Base_Url,
+    Candidates:     config.Primary_Candidates,
+    Lease_Duration: time.Duration(config.Lease_Duration) * time.Second,
+    Fc:             fc,
+    CNLog:          config.CNLog,
+  }
+}
+
+// Returns the index of this cnNursery in the (ordered) candidates, or -1
+// if this cnNursery is not a candidate.
+//
+// READS cnElection (which never changes the Self or Candidates);
+//
+func (cnElection *CNElection) CandidateIndex() int {
+  for i, aCandidate := range cnElection.Candidates {
+    if aCandidate == cnElection.Self { return i }
+  }
+  return -1
+}
+
+// Returns the Base_Url of the current leader of the federation, or "" if
+// there is no currently leased leader.
+//
+// THREAD-SAFE;
+//
+func (cnElection *CNElection) GetLeader() string {
+  cnElection.Mutex.RLock()
+  defer cnElection.Mutex.RUnlock()
+
+  if time.Now().Before(cnElection.Lease_Expires) { return cnElection.Leader }
+  return ""
+}
+
+// Returns true if this cnNursery is the current leader of the federation.
+//
+// THREAD-SAFE;
+//
+func (cnElection *CNElection) IsLeader() bool {
+  return cnElection.GetLeader() == cnElection.Self
+}
+
+// Returns true if a lease on the leadership for the given term can be
+// granted to the leader.
+//
+// A lease can be granted if it is for at least the current term, if it
+// either renews the current leader's lease or there is no currently
+// leased leader, and if no other leader has been granted a lease in this
+// term.
+//
+// NOT THREAD-SAFE (the caller MUST hold the cnElection.Mutex lock);
+//
+func (cnElection *CNElection) canGrant(leader string, term uint64) bool {
+  if term < cnElection.Term { return false }
+  if cnElection.Voted_Term == term && cnElection.Voted_For != leader {
+    return false
+  }
+  leaseValid := time.Now().Before(cnElection.Lease_Expires)
+  return !leaseValid || leader == cnElection.Leader
+}
+
+// Returns a *election.LeaseError unless the lease's Leader is one of the
+// candidates and the clientCert is that of the Leader (its CommonName, or
+// one of its DNS names or IP addresses, is the Leader's host).
+//
+// READS cnElection (which never changes the Candidates);
+//
+func (cnElection *CNElection) authorizeLease(
+  lease       election.Lease,
+  clientCert *x509.Certificate,
+) error {
+  isCandidate := false
+  for _, aCandidate := range cnElection.Candidates {
+    if aCandidate == lease.Leader { isCandidate = true }
+  }
+  if !isCandidate {
+    return &election.LeaseError{ Leader: lease.Leader, Reason: "it is not a primary candidate" }
+  }
+  if clientCert == nil {
+    return &election.LeaseError{ Leader: lease.Leader, Reason: "no client certificate was presented" }
+  }
+  leaderUrl, err := url.Parse(lease.Leader)
+  if err != nil || leaderUrl.Hostname() == "" {
+    return &election.LeaseError{ Leader: lease.Leader, Reason: "it is not a valid URL" }
+  }
+  leaderHost := leaderUrl.Hostname()
+  if clientCert.Subject.CommonName != leaderHost &&
+     clientCert.VerifyHostname(leaderHost) != nil {
+    return &election.LeaseError{
+      Leader: lease.Leader,
+      Reason: "the client certificate [" + clientCert.Subject.CommonName + "] is not that of the candidate",
+    }
+  }
+  return nil
+}
+
+// Grant (or refuse) a candidate's request for a lease on the leadership
+// of the federation.
+//
+// A lease is only considered for a Leader which is a candidate and which
+// is the (certified) client making the request.
+//
+// Part of the election.ElectionImpl interface.
+//
+// THREAD-SAFE;
+//
+func (cnElection *CNElection) ActionRequestLease(
+  lease       election.Lease,
+  clientCert *x509.Certificate,
+) (election.LeaseReply, error) {
+  err := cnElection.authorizeLease(lease, clientCert)
+  if err != nil { return election.LeaseReply{}, err }
+
+  cnElection.Mutex.Lock()
+  defer cnElection.Mutex.Unlock()
+
+  now     := time.Now()
+  granted := cnElection.canGrant(lease.Leader, lease.Term)
+  if granted {
+    if lease.Leader != cnElection.Leader {
+      cnElection.CNLog.Logf(
+        "granted the leadership (term %d) to [%s]", lease.Term, lease.Leader,
+      )
+    }
+    cnElection.Leader        = lease.Leader
+    cnElection.Term          = lease.Term
+    cnElection.Voted_Term    = lease.Term
+    cnElection.Voted_For     = lease.Leader
+    cnElection.Lease_Expires =
+      now.Add(time.Duration(lease.Duration_Ms) * time.Millisecond)
+  }
+  return election.LeaseReply{
+    Granted: granted,
+    Leader:  cnElection.Leader,
+    Term:    cnElection.Term,
+  }, nil
+}
+
+// Return the leader of the federation as currently known to this
+// cnNursery.
+//
+// Part of the election.ElectionImpl interface.
+//
+// THREAD-SAFE;
+//
+func (cnElection *CNElection) ResponseElectionStatusJSON() election.ElectionStatus {
+  cnElection.Mutex.RLock()
+  defer cnElection.Mutex.RUnlock()
+
+  status := election.ElectionStatus{
+    Term:       cnElection.Term,
+    Candidates: cnElection.Candidates,
+  }
+  remaining := time.Until(cnElection.Lease_Expires)
+  if 0 < remaining {
+    status.Leader             = cnElection.Leader
+    status.Lease_Remaining_Ms = uint(remaining / time.Millisecond)
+  }
+  return status
+}
+
+// The reply of a candidate to a request for a lease.
+//
+type leaseResult struct {
+  Candidate  string
+  Reply      election.LeaseReply
+  Err        error
+}
+
+// Ask each of the candidates (concurrently) for a lease on the leadership
+// for the given term. If a majority of the candidates (including this
+// one) grant the lease, this cnNursery becomes (or remains) the leader.
+//
+// The grants are counted as they arrive, so a candidate which does not
+// reply only delays the campaign (at most) until the others have
+// replied.
+//
+// CALLS fc (federationClient.RequestLease);
+// THREAD-SAFE;
+//
+func (cnElection *CNElection) campaign(term uint64) {
+  ctx   := logger.ContextWithNewRequestId(context.Background())
+  cnLog := cnElection.CNLog.ForContext(ctx)
+  ctx, cancel := context.WithTimeout(ctx, cnElection.Lease_Duration/3)
+  defer cancel()
+
+  lease := election.Lease{
+    Leader:      cnElection.Self,
+    Term:        term,
+    Duration_Ms: uint(cnElection.Lease_Duration / time.Millisecond),
+  }
+  startTime := time.Now()
+
+  // this candidate votes for itself (unless it knows of another leader)
+  cnElection.Mutex.Lock()
+  if !cnElection.canGrant(cnElection.Self, term) {
+    cnElection.Mutex.Unlock()
+    return
+  }
+  cnElection.Voted_Term = term
+  cnElection.Voted_For  = cnElection.Self
+  cnElection.Mutex.Unlock()
+  numGrants := 1
+
+  // (the results channel is buffered so that the requests still
+  //  outstanding, which are cancelled on return, never block)
+  results     := make(chan leaseResult, len(cnElection.Candidates))
+  numRequests := 0
+  for _, aCandidate := range cnElection.Candidates {
+    if aCandidate == cnElection.Self { continue }
+    numRequests++
+    go func(aCandidate string) {
+      leaseReply, err := cnElection.Fc.RequestLease(ctx, aCandidate, lease)
+      results <- leaseResult{ Candidate: aCandidate, Reply: leaseReply, Err: err }
+    }(aCandidate)
+  }
+
+  highestTerm := term
+  for ; 0 < numRequests && numGrants <= len(cnElection.Candidates)/2 ; numRequests-- {
+    result := <-results
+    if result.Err != nil {
+      cnLog.MayBeErrorf(result.Err, "Could not request a lease from [%s]", result.Candidate)
+      continue
+    }
+    if result.Reply.Granted { numGrants++ }
+    if highestTerm < result.Reply.Term { highestTerm = result.Reply.Term }
+  }
+
+  cnElection.Mutex.Lock()
+  defer cnElection.Mutex.Unlock()
+
+  if len(cnElection.Candidates)/2 < numGrants {
+    if cnElection.Leader != cnElection.Self {
+      cnLog.Logf("became the leader of the federation (term %d)", term)
+    }
+    cnElection.Leader        = cnElection.Self
+    cnElection.Term          = term
+    cnElection.Lease_Expires = startTime.Add(cnElection.Lease_Duration)
+    return
+  }
+
+  if cnElection.Leader == cnElection.Self {
+    cnLog.Logf("lost the leadership of the federation (term %d)", term)
+    cnElection.Leader        = ""
+    cnElection.Lease_Expires = time.Time{}
+  }
+  // any further campaign MUST be for a later term
+  if cnElection.Term < highestTerm { cnElection.Term = highestTerm }
+}
+
+// Ask each of the candidates (in order) who the current leader is, and
+// follow the first leader found.
+//
+// CALLS fc (federationClient.ElectionStatus);
+// THREAD-SAFE;
+//
+func (cnElection *CNElection) follow() {
+  ctx   := logger.ContextWithNewRequestId(context.Background())
+  cnLog := cnElection.CNLog.ForContext(ctx)
+  ctx, cancel := context.WithTimeout(ctx, cnElection.Lease_Duration/3)
+  defer cancel()
+
+  for _, aCandidate := range cnElection.Candidates {
+    status, err := cnElection.Fc.ElectionStatus(ctx, aCandidate)
+    if err != nil {
+      cnLog.MayBeErrorf(err, "Could not ask [%s] for the leader", aCandidate)
+      continue
+    }
+    if status.Leader == "" { continue }
+
+    cnElection.Mutex.Lock()
+    if status.Leader != cnElection.Leader {
+      cnLog.Logf("following the leader [%s] (term %d)", status.Leader, status.Term)
+    }
+    cnElection.Leader        = status.Leader
+    cnElection.Term          = status.Term
+    cnElection.Lease_Expires = time.Now().Add(
+      time.Duration(status.Lease_Remaining_Ms) * time.Millisecond,
+    )
+    cnElection.Mutex.Unlock()
+    return
+  }
+}
+
+// Implements the election go routine.
+//
+// Every third of the lease duration:
+//
+//   - the leader renews its lease,
+//
+//   - if there is no leader, each candidate waits a (candidate order)
+//     number of renewal intervals before campaigning to become the
+//     leader (so that, normally, the first available candidate wins),
+//
+//   - nurseries which are not candidates find (and follow) the leader.
+//
+// CALLS cnElection;
+//
+func (cnElection *CNElection) RunElection() {
+  interval       := cnElection.Lease_Duration / 3
+  candidateIndex := cnElection.CandidateIndex()
+
+  for {
+    switch {
+      case candidateIndex < 0         :
+        if cnElection.GetLeader() == "" { cnElection.follow() }
+
+      case cnElection.IsLeader()      :
+        cnElection.Mutex.RLock()
+        term := cnElection.Term
+        cnElection.Mutex.RUnlock()
+        cnElection.campaign(term)
+
+      case cnElection.GetLeader() == "" :
+        time.Sleep(time.Duration(candidateIndex) * interval)
+        if cnElection.GetLeader() != "" { break }
+        cnElection.Mutex.RLock()
+        term := cnElection.Term + 1
+        cnElection.Mutex.RUnlock()
+        cnElection.campaign(term)
+    }
+    time.Sleep(interval)
+  }
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "errors"
+  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/election"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+func createTestElection(self string, candidates ...string) *CNElection {
+  return &CNElection{
+    Self:           self,
+    Candidates:     candidates,
+    Lease_Duration: time.Second,
+    CNLog:          logger.CreateLogger("electionTest"),
+  }
+}
+
+// Returns a (test) client certificate for the nursery at the host.
+//
+func createTestCert(host string) *x509.Certificate {
+  return &x509.Certificate{ Subject: pkix.Name{ CommonName: host } }
+}
+
+// Request a lease, as the leader itself, which MUST be authorized.
+//
+func requestTestLease(
+  t          *testing.T,
+  cnElection *CNElection,
+  lease       election.Lease,
+) election.LeaseReply {
+  reply, err := cnElection.ActionRequestLease(
+    lease, createTestCert(strings.TrimPrefix(lease.Leader, "https://")),
+  )
+  assert.NoError(t, err)
+  return reply
+}
+
+// Test the granting of leases.
+//
+func TestLeases(t *testing.T) {
+  cnElection := createTestElection("https://b", "https://a", "https://b", "https://c")
+  assert.Equal(t, 1, cnElection.CandidateIndex())
+  assert.Equal(t, "", cnElection.GetLeader())
+
+  reply := requestTestLease(
+    t, cnElection, election.Lease{ Leader: "https://a", Term: 1, Duration_Ms: 1000 },
+  )
+  assert.True(t, reply.Granted)
+  assert.Equal(t, "https://a", cnElection.GetLeader())
+  assert.False(t, cnElection.IsLeader())
+
+  // another leader is refused while the lease is valid
+  reply = requestTestLease(
+    t, cnElection, election.Lease{ Leader: "https://c", Term: 2, Duration_Ms: 1000 },
+  )
+  assert.False(t, reply.Granted)
+  assert.Equal(t, "https://a", reply.Leader)
+
+  // the current leader may renew its lease
+  reply = requestTestLease(
+    t, cnElection, election.Lease{ Leader: "https://a", Term: 1, Duration_Ms: 10 },
+  )
+  assert.True(t, reply.Granted)
+
+  // once the lease has expired, a new leader may be granted a lease for
+  // a later term (but not for an earlier term, nor for the same term, as
+  // a candidate never votes for two leaders in the same term)
+  time.Sleep(20 * time.Millisecond)
+  assert.Equal(t, "", cnElection.GetLeader())
+  reply = requestTestLease(
+    t, cnElection, election.Lease{ Leader: "https://c", Term: 1, Duration_Ms: 1000 },
+  )
+  assert.False(t, reply.Granted)
+  reply = requestTestLease(
+    t, cnElection, election.Lease{ Leader: "https://c", Term: 0, Duration_Ms: 1000 },
+  )
+  assert.False(t, reply.Granted)
+  reply = requestTestLease(
+    t, cnElection, election.Lease{ Leader: "https://c", Term: 2, Duration_Ms: 1000 },
+  )
+  assert.True(t, reply.Granted)
+  assert.Equal(t, "https://c", cnElection.ResponseElectionStatusJSON().Leader)
+}
+
+// Test that an election without a base_url, or without candidates (or
+// with exactly two candidates), is refused.
+//
+func TestCheckCandidates(t *testing.T) {
+  assert.NoError(t, CheckCandidates("https://b", []string{ "https://a" }))
+  assert.Error(t, CheckCandidates("", []string{ "https://a" }))
+  assert.Error(t, CheckCandidates("https://b", nil))
+  assert.Error(t, CheckCandidates("https://b", []string{ "https://a", "https://b" }))
+}
+
+// Test that a single candidate elects itself.
+//
+func TestSingleCandidate(t *testing.T) {
+  cnElection := createTestElection("https://a", "https://a")
+  cnElection.campaign(1)
+  assert.True(t, cnElection.IsLeader())
+  assert.Equal(t, uint64(1), cnElection.Term)
+}
+
+// Test that a candidate which does not reply does not prevent the
+// others from granting a lease (in time).
+//
+func TestUnresponsiveCandidate(t *testing.T) {
+  released := make(chan bool)
+  server   := httptest.NewServer(http.HandlerFunc(
+    func(w http.ResponseWriter, r *http.Request) {
+      if r.URL.Path == "/hung/election" {
+        <-released
+        return
+      }
+      w.Write([]byte(`{"Granted":true,"Leader":"","Term":1}`))
+    },
+  ))
+  defer server.Close()
+  defer close(released)
+
+  cnElection := createTestElection(
+    server.URL+"/a", server.URL+"/hung", server.URL+"/a", server.URL+"/b",
+  )
+  cnElection.Lease_Duration = 3 * time.Second
+  cc := &clientConnection.CC{ Client: &http.Client{}, Log: cnElection.CNLog }
+  cnElection.Fc = federationClient.CreateClient(cc, federationClient.RetryPolicy{})
+
+  startTime := time.Now()
+  cnElection.campaign(1)
+  assert.True(t, cnElection.IsLeader())
+  assert.Less(t, int64(time.Since(startTime)), int64(cnElection.Lease_Duration/3))
+}
+
+// Test that leases are refused for nurseries which are not candidates,
+// and for clients which are not the candidate.
+//
+func TestLeaseAuthorization(t *testing.T) {
+  cnElection := createTestElection("https://a", "https://a", "https://b:4224")
+  lease      := election.Lease{ Leader: "https://b:4224", Term: 1, Duration_Ms: 1000 }
+
+  _, err := cnElection.ActionRequestLease(lease, nil)
+  assert.Error(t, err)
+  _, err = cnElection.ActionRequestLease(lease, createTestCert("a"))
+  var leaseErr *election.LeaseError
+  assert.True(t, errors.As(err, &leaseErr))
+  assert.Contains(t, err.Error(), "is not that of the candidate")
+  assert.Equal(t, "", cnElection.GetLeader())
+
+  lease.Leader = "https://c"
+  _, err = cnElection.ActionRequestLease(lease, createTestCert("c"))
+  assert.Contains(t, err.Error(), "is not a primary candidate")
+
+  // (a certificate is also that of the candidate if it names the host)
+  lease.Leader = "https://b:4224"
+  bCert := createTestCert("plato02")
+  bCert.DNSNames = []string{ "b" }
+  reply, err := cnElection.ActionRequestLease(lease, bCert)
+  assert.NoError(t, err)
+  assert.True(t, reply.Granted)
+  assert.Equal(t, "https://b:4224", cnElection.GetLeader())
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "github.com/diSimplex/ConTeXtNursery/interfaces/events"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "sync"
+  "time"
+)
+
+// The number of events buffered for each subscriber. A subscriber which
+// falls further behind is dropped (and must re-subscribe).
+//
+const SubscriberBufferSize = 64
+
+// CNEvents contains the (essentially global) state required to implement
+// the Events RESTful interface: the subscribers to, and the (at most
+// Recent_Length) most recent of, the events emitted by this cnNursery.
+//
+// A nil *CNEvents emits nothing, so that the CNInfoMap, CNState and
+// ActionsState may be used without one.
+//
+// CONSTRAINTS: Once created, the values in this structure SHOULD only be
+// altered by structure methods.
+//
+type CNEvents struct {
+  Mutex         sync.Mutex
+  Last_Id       uint64
+  Recent        []events.Event
+  Recent_Length int
+  Subscribers   map[uint64]chan events.Event
+  Next_Sub_Id   uint64
+  CNLog        *logger.LoggerType
+}
+
+// Create a CNEvents structure.
+//
+// READS config;
+//
+func CreateCNEvents(config *ConfigType) *CNEvents {
+  return &CNEvents{
+    Recent:        make([]events.Event, 0),
+    Recent_Length: int(config.Event_History),
+    Subscribers:   make(map[uint64]chan events.Event),
+    CNLog:         config.CNLog,
+  }
+}
+
+// Emit an event (of the given type, about the named nursery) to every
+// subscriber. The event's Id and At time are assigned here.
+//
+// Subscribers which can not keep up are dropped (their channel is
+// closed), so that emitting an event never blocks.
+//
+// THREAD-SAFE;
+//
+func (cnEvents *CNEvents) Emit(event events.Event) {
+  if cnEvents == nil { return }
+  cnEvents.Mutex.Lock()
+  defer cnEvents.Mutex.Unlock()
+
+  cnEvents.Last_Id++
+  event.Id = cnEvents.Last_Id
+  event.At = time.Now()
+
+  cnEvents.Recent = append(cnEvents.Recent, event)
+  if cnEvents.Recent_Length < len(cnEvents.Recent) {
+    cnEvents.Recent = cnEvents.Recent[len(cnEvents.Recent)-cnEvents.Recent_Length:]
+  }
+
+  for subId, subChan := range cnEvents.Subscribers {
+    select {
+      case subChan <- event :
+      default               :
+        cnEvents.CNLog.Logf("Dropping the (slow) event subscriber [%d]", subId)
+        close(subChan)
+        delete(cnEvents.Subscribers, subId)
+    }
+  }
+}
+
+// Subscribe to the events emitted after the event with the lastId. Any
+// such events which are still remembered are sent first.
+//
+// Part of the events.EventsImpl interface.
+//
+// THREAD-SAFE;
+//
+func (cnEvents *CNEvents) ActionSubscribe(
+  lastId uint64,
+) (<-chan events.Event, func()) {
+  cnEvents.Mutex.Lock()
+  defer cnEvents.Mutex.Unlock()
+
+  // a lastId from before this cnNursery (re)started asks for every
+  // remembered event
+  if cnEvents.Last_Id < lastId { lastId = 0 }
+
+  missed := make([]events.Event, 0)
+  for _, anEvent := range cnEvents.Recent {
+    if lastId < anEvent.Id { missed = append(missed, anEvent) }
+  }
+  bufferSize := SubscriberBufferSize
+  if bufferSize < len(missed) { bufferSize = len(missed) }
+  subChan := make(chan events.Event, bufferSize)
+  for _, anEvent := range missed { subChan <- anEvent }
+
+  cnEvents.Next_Sub_Id++
+  subId := cnEvents.Next_Sub_Id
+  cnEvents.Subscribers[subId] = subChan
+
+  unsubscribe := func() {
+    cnEvents.Mutex.Lock()
+    defer cnEvents.Mutex.Unlock()
+
+    if _, ok := cnEvents.Subscribers[subId] ; ok {
+      close(subChan)
+      delete(cnEvents.Subscribers, subId)
+    }
+  }
+  return subChan, unsubscribe
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "context"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/events"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/diSimplex/ConTeXtNursery/webserver"
+  "github.com/stretchr/testify/assert"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// Returns the types of the events (already) sent on the channel.
+//
+func eventTypes(eventChan <-chan events.Event) []string {
+  types := make([]string, 0)
+  for {
+    select {
+      case anEvent, ok := <-eventChan :
+        if !ok { return types }
+        types = append(types, anEvent.Type+" "+anEvent.Nursery)
+      default :
+        return types
+    }
+  }
+}
+
+// Test the events emitted by changes to the federation, and the replay of
+// missed events.
+//
+func TestEvents(t *testing.T) {
+  config := CreateConfiguration(logger.CreateLogger("eventsTest"))
+  config.Event_History      = 3
+  config.Heartbeat_Interval = 10
+  config.Suspect_Heartbeats = 3
+  config.Dead_Heartbeats    = 6
+  cnEvents := CreateCNEvents(config)
+  cniMap   := CreateCNInfoMap(config, createTestElection("https://primary"), cnEvents)
+
+  eventChan, unsubscribe := cnEvents.ActionSubscribe(0)
+  now := time.Now()
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a", State: "up" })
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a", State: "up" })
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a", State: "paused" })
+  cniMap.SetNurseryState("a", "draining")
+  cniMap.CheckLiveness(now.Add(90 * time.Second))
+  assert.Equal(t, []string{
+    "nursery-joined a", "state-changed a", "state-changed a", "nursery-reaped a",
+  }, eventTypes(eventChan))
+  unsubscribe()
+  unsubscribe()
+
+  // only the most recent events are replayed
+  replayChan, unsubscribe := cnEvents.ActionSubscribe(1)
+  defer unsubscribe()
+  replayed := eventTypes(replayChan)
+  assert.Equal(t, []string{
+    "state-changed a", "state-changed a", "nursery-reaped a",
+  }, replayed)
+
+  // a slow subscriber is dropped rather than blocking
+  slowChan, _ := cnEvents.ActionSubscribe(4)
+  for i := 0 ; i <= SubscriberBufferSize ; i++ {
+    cnEvents.Emit(events.Event{ Type: events.RunStarted, Nursery: "b" })
+  }
+  assert.Len(t, eventTypes(slowChan), SubscriberBufferSize)
+  _, ok := <-slowChan
+  assert.False(t, ok)
+}
+
+// Test streaming the (selected) events as Server-Sent Events.
+//
+func TestEventStream(t *testing.T) {
+  config := CreateConfiguration(logger.CreateLogger("eventsTest"))
+  config.Event_History = 10
+  cnEvents := CreateCNEvents(config)
+  cnEvents.Emit(events.Event{ Type: events.NurseryJoined, Nursery: "a" })
+  cnEvents.Emit(events.Event{ Type: events.RunStarted,    Nursery: "a", Action: "typeset" })
+  cnEvents.Emit(events.Event{ Type: events.RunFinished,   Nursery: "a", Action: "typeset" })
+
+  ws := webserver.WS{
+    Log:    config.CNLog,
+    Limits: webserver.Limits{ Write_Timeout: 60 },
+  }
+  ws.BaseRoute = ws.CreateNewRoute("/", "", "base route", true)
+  events.AddEventsInterface(&ws, cnEvents)
+
+  ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+  defer cancel()
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest(http.MethodGet, "/events?type=run-finished", nil)
+  r.Header.Set("Last-Event-ID", "1")
+  ws.ServeHTTP(w, r.WithContext(ctx))
+
+  assert.Equal(t, http.StatusOK, w.Code)
+  assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+  body := w.Body.String()
+  assert.Contains(t, body, "id: 3\nevent: run-finished\ndata: {\"Id\":3,")
+  assert.NotContains(t, body, "run-started")
+}
@@ -15,43 +15,61 @@
 package CNNurseries
 
 import (
-  "github.com/diSimplex/ConTeXtNursery/clientConnection"
-  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
-  "math/rand"
+  "github.com/diSimplex/ConTeXtNursery/metrics"
   "time"
 )
 
 // Implements the grimReaper go routine.
 //
-// If this is the primary cnNursery of a federation, periodically attempt 
-// to contact each cnNursery in the cnInfoMap. If a given cnNursery does 
-// not respond, then it is deleted from the cnInfoMap. 
+// While this is the primary (leader) cnNursery of a federation, check 
+// the liveness of each cnNursery in the cnInfoMap once every heartbeat 
+// interval. A cnNursery whose last heartbeat is too old is first marked 
+// suspect, and then (if it still does not send a heartbeat) declared dead 
+// and deleted from the cnInfoMap. 
+//
+// NOTE: no other cnNursery is contacted, so one slow (or unreachable) 
+// cnNursery can not stall the reaping of any others. 
 //
 // READS config;
-// CALLS cnInfoMap;
-// CALLS cc;
+// CALLS cnInfoMap (CheckLiveness);
+// ALTERS reg (ReaperChecksMetric);
 //
 func GrimReaper(
   config    *ConfigType,
   cnInfoMap *CNInfoMap,
-  cc        *clientConnection.CC,
+  reg       *metrics.Registry,
 ) {
-  // if we are not the primary Nursery... don't do anything...
-  if ! config.IsPrimary() { return }
-
+  interval  := time.Duration(config.Heartbeat_Interval) * time.Second
+  wasLeader := false
   for {
-    time.Sleep(time.Duration(rand.Int63n(20)) * time.Second)
+    time.Sleep(interval)
 
-    deadNurseries := make([]string, 0)
+    // if we are not (currently) the leader... don't do anything...
+    if ! cnInfoMap.Election.IsLeader() { wasLeader = false ; continue }
 
-    cnInfoMap.DoToAllOthers(func (name string, ni discovery.NurseryInfo) {
-      replyBytes := cc.GetMessage(ni.Base_Url, "/")
-      if len(replyBytes) < 1 {
-        // could not reach this Nursery.... so reap it!
-        deadNurseries = append(deadNurseries, name)
-      }
-    })
+    // if we have just become the leader... give every cnNursery time to 
+    // send us its heartbeat
+    if ! wasLeader {
+      wasLeader = true
+      cnInfoMap.RestartLiveness(time.Now())
+      continue
+    }
 
-    cnInfoMap.DeleteAll(deadNurseries)
+    alive, suspect, dead := cnInfoMap.CheckLiveness(time.Now())
+    for _, aName := range suspect {
+      config.CNLog.Logf("The [%s] nursery has missed its heartbeats", aName)
+    }
+    for _, aName := range dead {
+      config.CNLog.Logf("Reaping the (dead) [%s] nursery", aName)
+    }
+    reg.AddToCounter(
+      ReaperChecksMetric, metrics.Labels{ "outcome": "alive" },   float64(len(alive)),
+    )
+    reg.AddToCounter(
+      ReaperChecksMetric, metrics.Labels{ "outcome": "suspect" }, float64(len(suspect)),
+    )
+    reg.AddToCounter(
+      ReaperChecksMetric, metrics.Labels{ "outcome": "dead" },    float64(len(dead)),
+    )
   }
 }
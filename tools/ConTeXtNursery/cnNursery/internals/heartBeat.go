@@ -15,80 +15,163 @@
 package CNNurseries
 
 import (
-  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "context"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
   "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/diSimplex/ConTeXtNursery/metrics"
   "github.com/shirou/gopsutil/cpu"
+  "github.com/shirou/gopsutil/disk"
   "github.com/shirou/gopsutil/load"
   "github.com/shirou/gopsutil/mem"
   "math/rand"
   "time"
 )
 
+// Returns the delay before the next heartbeat: the heartbeat interval 
+// plus or minus a random jitter of at most jitterPercent (which is 
+// bounded to 50%) of the interval. 
+//
+// The delay is never less than half of the interval, so the heartbeat 
+// go routine never spins. 
+//
+func HeartbeatDelay(interval time.Duration, jitterPercent uint) time.Duration {
+  if 50 < jitterPercent { jitterPercent = 50 }
+  maxJitter := int64(interval) * int64(jitterPercent) / 100
+  if maxJitter < 1 { return interval }
+  return interval + time.Duration(rand.Int63n(2*maxJitter+1) - maxJitter)
+}
+
+// Collect the current NurseryInfo (state, labels, actions, queue depth, 
+// load, cores, memory, swap and free disk) of this cnNursery. 
+//
+// READS config;
+// CALLS cnState;
+// CALLS cnActions;
+//
+func CollectNurseryInfo(
+  config    *ConfigType,
+  cnState   *CNState,
+  cnActions *ActionsState,
+) discovery.NurseryInfo {
+  ni := discovery.NurseryInfo{
+    Name:        config.Name,
+    Port:        config.Port,
+    Base_Url:    config.Base_Url,
+    State:       cnState.GetState(),
+    Processes:   1,
+    Labels:      config.Labels,
+    Actions:     cnActions.ActionHashes(),
+    Queue_Depth: cnActions.QueueDepth(),
+  }
+
+  loads, err := load.Avg()
+  if err != nil {
+    config.CNLog.MayBeError("Could not read the load average", err)
+    loads = &load.AvgStat{ Load1: 1.0, Load5: 1.0, Load15: 1.0, }
+  }
+  ni.Load.Load1  = loads.Load1
+  ni.Load.Load5  = loads.Load5
+  ni.Load.Load15 = loads.Load15
+
+  cpuInfo, err := cpu.Info()
+  if err != nil {
+    config.CNLog.MayBeError("Could not read the cpu information", err)
+    cpuInfo = []cpu.InfoStat{ cpu.InfoStat{ Cores: 1, Mhz: 1000 } }
+  }
+  ni.Speed_Mhz = cpuInfo[0].Mhz
+
+  numCores, err := cpu.Counts(true)
+  if err != nil || numCores < 1 {
+    config.CNLog.MayBeError("Could not count the (logical) cores", err)
+    numCores = 1
+  }
+  ni.Cores = uint(numCores)
+
+  virtMem, err := mem.VirtualMemory()
+  if err != nil {
+    config.CNLog.MayBeError("Could not read the virtual memory information", err)
+    virtMem = &mem.VirtualMemoryStat{ Total: 1000, Used: 1000 }
+  }
+  ni.Memory.Total = virtMem.Total
+  ni.Memory.Used  = virtMem.Used
+
+  swapMem, err := mem.SwapMemory()
+  if err != nil {
+    config.CNLog.MayBeError("Could not read the swap memory information", err)
+    swapMem = &mem.SwapMemoryStat{ Total: 1000, Used: 1000 }
+  }
+  ni.Swap.Total = swapMem.Total
+  ni.Swap.Used  = swapMem.Used
+
+  diskUsage, err := disk.Usage(config.Work_Dir)
+  if err != nil {
+    config.CNLog.MayBeErrorf(err, "Could not read the free disk in [%s]", config.Work_Dir)
+    diskUsage = &disk.UsageStat{ Free: 0 }
+  }
+  ni.Disk_Free = diskUsage.Free
+
+  return ni
+}
+
 // Implements the heart beat go routine.
 //
-// Periodically attempt to contact each cnNursery in the cnInfoMap. If a 
-// given cnNursery does not respond, then it is deleted from the 
+// Once every (jittered) heartbeat interval, send this cnNursery's 
+// NurseryInfo to the federation's primary cnNursery, and apply the 
+// changes (to the primary's map) which the primary sends in reply to the 
 // cnInfoMap. 
 //
+// The versions of the installed tools are detected (once) when the 
+// heartbeat go routine starts. 
+//
 // READS config;
 // CALLS cnState;
+// CALLS cnActions;
 // CALLS cnInfoMap;
-// PARAMETER cc (discovery.SendDiscoveryMessage);
+// CALLS fc (federationClient.Heartbeat);
+// ALTERS reg (RecordNurseryInfo, HeartbeatsMetric);
 //
 func SendPeriodicHeartBeats(
   config    *ConfigType,
   cnState   *CNState,
+  cnActions *ActionsState,
   cnInfoMap *CNInfoMap,
-  cc        *clientConnection.CC,
+  fc        *federationClient.Client,
+  reg       *metrics.Registry,
 ) {
+  tools    := DetectToolVersions(config)
+  fontsDir := DetectFontsDir(config)
+  interval := time.Duration(config.Heartbeat_Interval) * time.Second
   for {
-    time.Sleep(time.Duration(rand.Int63n(10)) * time.Second)
+    time.Sleep(HeartbeatDelay(interval, config.Heartbeat_Jitter))
     //config.CNLog.Logf("\n\n\nheartBeat state: [%s]\n\n\n", cnState.GetState())
-    ni := discovery.NurseryInfo{
-      Name: config.Name,
-      Port: config.Port,
-      Base_Url: config.Base_Url,
-      State: cnState.GetState(),
-      Processes: 1,
-    }
+    ni := CollectNurseryInfo(config, cnState, cnActions)
+    ni.Tools     = tools
+    ni.Fonts_Dir = fontsDir
 
-    loads, err := load.Avg()
-    if err != nil {
-      config.CNLog.MayBeError("Could not read the load average", err)
-      loads = &load.AvgStat{ Load1: 1.0, Load5: 1.0, Load15: 1.0, }
-    }
-    ni.Load.Load1  = loads.Load1
-    ni.Load.Load5  = loads.Load5
-    ni.Load.Load15 = loads.Load15
+    RecordNurseryInfo(reg, ni)
 
-    cpuInfo, err := cpu.Info()
-    if err != nil {
-      config.CNLog.MayBeError("Could not read the cpu information", err)
-      cpuInfo = []cpu.InfoStat{ cpu.InfoStat{ Cores: 1, Mhz: 1000 } }
-    }
-    ni.Cores     = uint(len(cpuInfo))
-    ni.Speed_Mhz = cpuInfo[0].Mhz
-
-    virtMem, err := mem.VirtualMemory()
-    if err != nil {
-      config.CNLog.MayBeError("Could not read the virtual memory information", err)
-      virtMem = &mem.VirtualMemoryStat{ Total: 1000, Used: 1000 }
+    //config.CNLog.Json("beat request ", "ni", ni)
+    // send the heartbeat to the current leader (if there is one)
+    primaryUrl := cnInfoMap.Election.GetLeader()
+    if primaryUrl == "" {
+      config.CNLog.Log("Could not send a heartbeat: the federation has no leader")
+      reg.IncCounter(HeartbeatsMetric, metrics.Labels{ "outcome": "no_leader" })
+      continue
     }
-    ni.Memory.Total = virtMem.Total
-    ni.Memory.Used  = virtMem.Used
-
-    swapMem, err := mem.SwapMemory()
+    ctx := logger.ContextWithNewRequestId(context.Background())
+    mapId, since := cnInfoMap.PrimaryVersion()
+    delta, err := fc.Heartbeat(ctx, primaryUrl, mapId, since, ni)
     if err != nil {
-      config.CNLog.MayBeError("Could not read the swap memory information", err)
-      swapMem = &mem.SwapMemoryStat{ Total: 1000, Used: 1000 }
+      config.CNLog.ForContext(ctx).MayBeErrorf(
+        err, "Could not send a heartbeat to the primary [%s]", primaryUrl,
+      )
+      reg.IncCounter(HeartbeatsMetric, metrics.Labels{ "outcome": "error" })
+      continue
     }
-    ni.Swap.Total = swapMem.Total
-    ni.Swap.Used  = swapMem.Used
-
-    //config.CNLog.Json("beat request ", "ni", ni)
-    niInfoMap := discovery.SendDiscoveryMessage(config.Primary_Url, ni, cc)
-    //config.CNLog.Json("beat response ", "niInfoMap", niInfoMap)
-    cnInfoMap.ActionUpdateNurseryInfoMap(niInfoMap)
+    reg.IncCounter(HeartbeatsMetric, metrics.Labels{ "outcome": "ok" })
+    //config.CNLog.Json("beat response ", "delta", delta)
+    cnInfoMap.ActionApplyNurseryInfoDelta(&delta)
   }
 
 }
@@ -0,0 +1,75 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/metrics"
+)
+
+// The names of the metrics exported (on /metrics) by a cnNursery.
+//
+const (
+  ActionRunsMetric       = "cn_action_runs_total"
+  ActionFailuresMetric   = "cn_action_failures_total"
+  ActionDurationMetric   = "cn_action_duration_seconds"
+  QueueDepthMetric       = "cn_action_queue_depth"
+  LoadMetric             = "cn_nursery_load"
+  MemoryTotalMetric      = "cn_nursery_memory_total_bytes"
+  MemoryUsedMetric       = "cn_nursery_memory_used_bytes"
+  SwapTotalMetric        = "cn_nursery_swap_total_bytes"
+  SwapUsedMetric         = "cn_nursery_swap_used_bytes"
+  HeartbeatsMetric       = "cn_heartbeats_total"
+  ReaperChecksMetric     = "cn_reaper_checks_total"
+  PlacementsMetric       = "cn_placements_total"
+)
+
+// Describe the metrics exported by a cnNursery.
+//
+// ALTERS reg;
+//
+func DescribeNurseryMetrics(reg *metrics.Registry) {
+  reg.DescribeCounter(ActionRunsMetric, "The number of action runs by action")
+  reg.DescribeCounter(ActionFailuresMetric, "The number of failed action runs by action")
+  reg.DescribeHistogram(
+    ActionDurationMetric, "The action run durations by action",
+    metrics.DurationBuckets,
+  )
+  reg.DescribeGauge(QueueDepthMetric, "The number of actions currently running")
+  reg.DescribeGauge(LoadMetric, "The load average by period (1m, 5m, 15m)")
+  reg.DescribeGauge(MemoryTotalMetric, "The total virtual memory")
+  reg.DescribeGauge(MemoryUsedMetric, "The used virtual memory")
+  reg.DescribeGauge(SwapTotalMetric, "The total swap memory")
+  reg.DescribeGauge(SwapUsedMetric, "The used swap memory")
+  reg.DescribeCounter(HeartbeatsMetric, "The number of heartbeats sent by outcome")
+  reg.DescribeCounter(ReaperChecksMetric, "The number of nurseries checked by the reaper by liveness")
+  reg.DescribeCounter(PlacementsMetric, "The number of action placements by policy and outcome")
+
+  reg.SetGauge(QueueDepthMetric, nil, 0)
+}
+
+// Record the load, memory and swap figures collected by a heartbeat.
+//
+// ALTERS reg;
+//
+func RecordNurseryInfo(reg *metrics.Registry, ni discovery.NurseryInfo) {
+  reg.SetGauge(LoadMetric, metrics.Labels{ "period": "1m"  }, ni.Load.Load1)
+  reg.SetGauge(LoadMetric, metrics.Labels{ "period": "5m"  }, ni.Load.Load5)
+  reg.SetGauge(LoadMetric, metrics.Labels{ "period": "15m" }, ni.Load.Load15)
+  reg.SetGauge(MemoryTotalMetric, nil, float64(ni.Memory.Total))
+  reg.SetGauge(MemoryUsedMetric,  nil, float64(ni.Memory.Used))
+  reg.SetGauge(SwapTotalMetric,   nil, float64(ni.Swap.Total))
+  reg.SetGauge(SwapUsedMetric,    nil, float64(ni.Swap.Used))
+}
@@ -15,38 +15,83 @@
 package CNNurseries
 
 import (
+  "bytes"
+  "encoding/json"
   "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/events"
   "github.com/diSimplex/ConTeXtNursery/logger"
-  "strings"
+  "math"
   "sync"
+  "time"
 )
 
 // The CNInfoMap collects a cnNursery's map of all other cnNurseries in 
 // the federation. 
 //
+// The liveness of each cnNursery is judged by the age of its last 
+// heartbeat. A cnNursery which has missed Suspect_After worth of 
+// heartbeats is suspect, and one which has missed Dead_After worth of 
+// heartbeats is dead and is removed from the map. The names of dead 
+// cnNurseries are kept as Tombstones for the Tombstone_Period, so that 
+// stale information about them is not re-admitted while a cnNursery 
+// which comes back (and sends its own heartbeat) is re-admitted cleanly. 
+//
+// The map is versioned. The Version is incremented whenever a cnNursery 
+// is (materially) changed, added or deleted, and the version of each such 
+// change is recorded (in Changed or Deleted), so that other cnNurseries 
+// need only be sent the changes since the last version they know of. The 
+// Map_Id (which is new for each CNInfoMap) distinguishes the versions of 
+// different primary cnNurseries. The Primary_Map_Id and Primary_Version 
+// record the version of the primary's map last applied to this map. 
+//
 // CONSTRAINTS: Once created, the values in this structure SHOULD only be 
 // altered by structure methods.
 //
 type CNInfoMap struct {
-  IsPrimary bool
-  Name      string
-  Mutex     sync.RWMutex
-  NI        discovery.NurseryInfoMap
-  CNLog     *logger.LoggerType
+  Name              string
+  Mutex             sync.RWMutex
+  NI                discovery.NurseryInfoMap
+  Tombstones        map[string]time.Time
+  Map_Id            string
+  Version           uint64
+  Changed           map[string]uint64
+  Deleted           map[string]uint64
+  Forgotten_Version uint64
+  Primary_Map_Id    string
+  Primary_Version   uint64
+  Suspect_After     time.Duration
+  Dead_After        time.Duration
+  Tombstone_Period  time.Duration
+  Election         *CNElection
+  Events           *CNEvents
+  CNLog            *logger.LoggerType
 }
 
 // Creates a CNInfoMap.
 //
 // READS config;
+// FIELD cnElection;
+// FIELD cnEvents (which may be nil);
 //
 func CreateCNInfoMap(
-  config *ConfigType,
+  config     *ConfigType,
+  cnElection *CNElection,
+  cnEvents   *CNEvents,
 ) *CNInfoMap {
+  interval := time.Duration(config.Heartbeat_Interval) * time.Second
   infoMap := CNInfoMap{}
-  infoMap.IsPrimary = strings.Contains(config.Primary_Url, config.Name)
-  infoMap.Name      = config.Name
-  infoMap.NI        = make(discovery.NurseryInfoMap)
-  infoMap.CNLog     = config.CNLog
+  infoMap.Election         = cnElection
+  infoMap.Events           = cnEvents
+  infoMap.Name             = config.Name
+  infoMap.NI               = make(discovery.NurseryInfoMap)
+  infoMap.Tombstones       = make(map[string]time.Time)
+  infoMap.Map_Id           = logger.NewRequestId()
+  infoMap.Changed          = make(map[string]uint64)
+  infoMap.Deleted          = make(map[string]uint64)
+  infoMap.Suspect_After    = time.Duration(config.Suspect_Heartbeats) * interval
+  infoMap.Dead_After       = time.Duration(config.Dead_Heartbeats) * interval
+  infoMap.Tombstone_Period = time.Duration(config.Tombstone_Period) * time.Second
+  infoMap.CNLog            = config.CNLog
   return &infoMap
 }
 
@@ -59,16 +104,30 @@ func CreateCNInfoMap(
 //
 type ANurseryAction func(string, discovery.NurseryInfo)
 
+// Returns a copy of the current discovery.NurseryInfoMap.
+//
+// THREAD-SAFE;
+//
+func (cniMap *CNInfoMap) Snapshot() discovery.NurseryInfoMap {
+  cniMap.Mutex.RLock()
+  defer cniMap.Mutex.RUnlock()
+
+  niMap := make(discovery.NurseryInfoMap, len(cniMap.NI))
+  for aKey, aValue := range cniMap.NI { niMap[aKey] = aValue }
+  return niMap
+}
+
 // Runs the ANurseryAction closure function against every cnNursery listed 
 // in the CNInfoMap **except** the federation's Primary cnNursery. 
 //
+// The closure is run against a snapshot of the CNInfoMap (and so WITHOUT 
+// holding the CNInfoMap lock), so that a slow closure (such as one which 
+// contacts other cnNurseries) can not stall the heartbeats. 
+//
 // THREAD-SAFE;
 //
 func (cniMap *CNInfoMap) DoToAllOthers(anAction ANurseryAction) {
-  cniMap.Mutex.Lock()
-  defer cniMap.Mutex.Unlock()
-
-  for aKey, aValue := range cniMap.NI {
+  for aKey, aValue := range cniMap.Snapshot() {
     if aKey == cniMap.Name { continue } // do not do this to myself!
     anAction(aKey, aValue)
   }
@@ -77,72 +136,355 @@ func (cniMap *CNInfoMap) DoToAllOthers(anAction ANurseryAction) {
 // Runs the ANurseryAction closure function against every cnNursery listed 
 // in the CNInfoMap **including** the federation's Primary cnNursery. 
 //
+// The closure is run against a snapshot of the CNInfoMap (and so WITHOUT 
+// holding the CNInfoMap lock). 
+//
 // THREAD-SAFE;
 //
 func (cniMap *CNInfoMap) DoToAll(anAction ANurseryAction) {
+  for aKey, aValue := range cniMap.Snapshot() {
+    anAction(aKey, aValue)
+  }
+}
+
+// Record a new version in which the named cnNursery has been changed 
+// (or added). 
+//
+// NOT THREAD-SAFE (the caller MUST hold the cniMap.Mutex lock);
+//
+func (cniMap *CNInfoMap) touch(name string) {
+  cniMap.Version++
+  cniMap.Changed[name] = cniMap.Version
+  delete(cniMap.Deleted, name)
+}
+
+// Delete the named cnNursery (recording the new version in which it was 
+// deleted). 
+//
+// NOT THREAD-SAFE (the caller MUST hold the cniMap.Mutex lock);
+//
+func (cniMap *CNInfoMap) remove(name string, now time.Time) {
+  cniMap.Version++
+  delete(cniMap.NI, name)
+  delete(cniMap.Changed, name)
+  cniMap.Deleted[name]    = cniMap.Version
+  cniMap.Tombstones[name] = now
+}
+
+// Emit the events implied by the change of the named cnNursery from the 
+// oldNI (if it was known) to the newNI. 
+//
+// CALLS cniMap.Events (Emit);
+//
+func (cniMap *CNInfoMap) emitChange(
+  name         string,
+  oldNI, newNI discovery.NurseryInfo,
+  known        bool,
+) {
+  switch {
+    case !known :
+      cniMap.Events.Emit(events.Event{
+        Type: events.NurseryJoined, Nursery: name, State: newNI.State,
+      })
+    case oldNI.State != newNI.State :
+      cniMap.Events.Emit(events.Event{
+        Type:           events.StateChanged,
+        Nursery:        name,
+        Previous_State: oldNI.State,
+        State:          newNI.State,
+      })
+  }
+}
+
+// Returns true if two values differ by more than the given fraction of 
+// the scale. 
+//
+func differs(oldValue, newValue, fraction, scale float64) bool {
+  return fraction * scale < math.Abs(oldValue - newValue)
+}
+
+// Returns true if the newNI is materially different from the oldNI.
+//
+// The Last_Seen time is ignored, as are changes in the load averages of 
+// less than 0.1, changes in the memory and swap used of less than 1% 
+// of the total, and changes in the free disk of less than 1%. This 
+// ensures that a cnNursery whose (other) information has not changed does 
+// not create a new version with every heartbeat. 
+//
+func materiallyChanged(oldNI, newNI discovery.NurseryInfo) bool {
+  if differs(oldNI.Load.Load1,  newNI.Load.Load1,  0.1, 1) ||
+     differs(oldNI.Load.Load5,  newNI.Load.Load5,  0.1, 1) ||
+     differs(oldNI.Load.Load15, newNI.Load.Load15, 0.1, 1) ||
+     differs(
+       float64(oldNI.Memory.Used), float64(newNI.Memory.Used),
+       0.01, float64(newNI.Memory.Total),
+     ) ||
+     differs(
+       float64(oldNI.Swap.Used), float64(newNI.Swap.Used),
+       0.01, float64(newNI.Swap.Total),
+     ) ||
+     differs(
+       float64(oldNI.Disk_Free), float64(newNI.Disk_Free),
+       0.01, float64(oldNI.Disk_Free),
+     ) {
+    return true
+  }
+  oldNI.Last_Seen = newNI.Last_Seen
+  oldNI.Load      = newNI.Load
+  oldNI.Memory    = newNI.Memory
+  oldNI.Swap      = newNI.Swap
+  oldNI.Disk_Free = newNI.Disk_Free
+  oldJson, _ := json.Marshal(oldNI)
+  newJson, _ := json.Marshal(newNI)
+  return !bytes.Equal(oldJson, newJson)
+}
+
+// Update the heartbeat status information about the given Nursery in the 
+// federation of Nurseries. 
+//
+// Records the time the heartbeat was seen (and so marks the Nursery as 
+// alive). A Nursery which was previously declared dead is re-admitted. 
+//
+// Part of the discovery.DiscoveryImpl interface.
+//
+// THREAD-SAFE;
+//
+func (cniMap *CNInfoMap) ActionUpdateNurseryInfo(ni discovery.NurseryInfo) {
   cniMap.Mutex.Lock()
   defer cniMap.Mutex.Unlock()
 
-  for aKey, aValue := range cniMap.NI {
-    anAction(aKey, aValue)
+  if ni.Name == "" { return }
+
+  _, wasDead := cniMap.Tombstones[ni.Name]
+  if wasDead {
+    delete(cniMap.Tombstones, ni.Name)
+    cniMap.CNLog.Logf("Re-admitting the (previously dead) [%s] nursery", ni.Name)
   }
+  ni.Last_Seen = time.Now()
+  ni.Liveness  = discovery.LivenessAlive
+  oldNI, known := cniMap.NI[ni.Name]
+  cniMap.NI[ni.Name] = ni
+  if !known || materiallyChanged(oldNI, ni) { cniMap.touch(ni.Name) }
+  cniMap.emitChange(ni.Name, oldNI, ni, known)
 }
 
-// Deletes each cnNursery in the deadNurseries from the cniMap. 
+// Record the (new) control state of the named Nursery (which will be 
+// confirmed by its next heartbeat). 
 //
 // THREAD-SAFE;
 //
-func (cniMap *CNInfoMap) DeleteAll(deadNurseries []string) {
+func (cniMap *CNInfoMap) SetNurseryState(name, state string) {
   cniMap.Mutex.Lock()
   defer cniMap.Mutex.Unlock()
 
-  for _, aNursery := range deadNurseries {
-    delete(cniMap.NI, aNursery)
+  ni, known := cniMap.NI[name]
+  if !known || ni.State == state { return }
+  oldNI   := ni
+  ni.State = state
+  cniMap.NI[name] = ni
+  cniMap.touch(name)
+  cniMap.emitChange(name, oldNI, ni, known)
+}
+
+// Check the liveness of each Nursery by the age of its last heartbeat.
+//
+// Nurseries which have not been seen for Suspect_After are marked 
+// suspect. Nurseries which have not been seen for Dead_After are removed 
+// (and tombstoned). Tombstones older than the Tombstone_Period are 
+// forgotten (as are the versions in which their cnNurseries were 
+// deleted). 
+//
+// Returns the names of the Nurseries found to be alive, suspect and 
+// dead. 
+//
+// Used by the grimReaper go routine.
+//
+// THREAD-SAFE;
+//
+func (cniMap *CNInfoMap) CheckLiveness(
+  now time.Time,
+) (alive, suspect, dead []string) {
+  cniMap.Mutex.Lock()
+  defer cniMap.Mutex.Unlock()
+
+  for aName, ni := range cniMap.NI {
+    age := now.Sub(ni.Last_Seen)
+    switch {
+      case cniMap.Dead_After < age    :
+        cniMap.remove(aName, now)
+        cniMap.Events.Emit(events.Event{ Type: events.NurseryReaped, Nursery: aName })
+        dead = append(dead, aName)
+      case cniMap.Suspect_After < age :
+        // stale (restored) nurseries remain stale until confirmed
+        if ni.Liveness != discovery.LivenessSuspect &&
+           ni.Liveness != discovery.LivenessStale {
+          ni.Liveness = discovery.LivenessSuspect
+          cniMap.NI[aName] = ni
+          cniMap.touch(aName)
+        }
+        suspect = append(suspect, aName)
+      default                         :
+        alive = append(alive, aName)
+    }
+  }
+
+  for aName, diedAt := range cniMap.Tombstones {
+    if cniMap.Tombstone_Period < now.Sub(diedAt) {
+      delete(cniMap.Tombstones, aName)
+      deletedVersion, ok := cniMap.Deleted[aName]
+      if ok && cniMap.Forgotten_Version < deletedVersion {
+        cniMap.Forgotten_Version = deletedVersion
+      }
+      delete(cniMap.Deleted, aName)
+    }
   }
+  return alive, suspect, dead
 }
 
-// Update the heartbeat status information about the given Nursery in the 
-// federation of Nurseries. 
+// Restore the (persisted) niMap into an (otherwise empty) cniMap.
 //
-// Part of the discovery.DiscoveryImpl interface.
+// Each restored cnNursery is marked stale, and as last seen now, so that 
+// it is removed (by CheckLiveness) unless its next heartbeat confirms it 
+// in time. 
 //
 // THREAD-SAFE;
 //
-func (cniMap *CNInfoMap) ActionUpdateNurseryInfo(ni discovery.NurseryInfo) {
+func (cniMap *CNInfoMap) RestoreNurseryInfo(
+  niMap discovery.NurseryInfoMap,
+  now   time.Time,
+) {
   cniMap.Mutex.Lock()
   defer cniMap.Mutex.Unlock()
 
-  if ni.Name != "" {
-    cniMap.NI[ni.Name] = ni
+  for aName, ni := range niMap {
+    if _, known := cniMap.NI[aName] ; known { continue }
+    ni.Liveness  = discovery.LivenessStale
+    ni.Last_Seen = now
+    cniMap.NI[aName] = ni
+    cniMap.touch(aName)
   }
 }
 
-// Update the cniMap from the provided discovery.NurseryInfoMap if this 
-// cnNursery is not the federation's Primary cnNursery. 
+// Restart the liveness clock of every cnNursery (by marking each as 
+// last seen now). 
+//
+// Used by the grimReaper go routine when this cnNursery becomes the 
+// federation's primary, since the Last_Seen times it has been sent were 
+// recorded by the previous primary. 
+//
+// THREAD-SAFE;
+//
+func (cniMap *CNInfoMap) RestartLiveness(now time.Time) {
+  cniMap.Mutex.Lock()
+  defer cniMap.Mutex.Unlock()
+
+  for aName, ni := range cniMap.NI {
+    ni.Last_Seen = now
+    cniMap.NI[aName] = ni
+  }
+}
+
+// Returns the Map_Id and version of the primary's map which was last 
+// applied to this map. 
+//
+// THREAD-SAFE;
+//
+func (cniMap *CNInfoMap) PrimaryVersion() (string, uint64) {
+  cniMap.Mutex.RLock()
+  defer cniMap.Mutex.RUnlock()
+
+  return cniMap.Primary_Map_Id, cniMap.Primary_Version
+}
+
+// Update the cniMap from the provided discovery.NurseryInfoDelta if this 
+// cnNursery is not (currently) the federation's Primary (leader) 
+// cnNursery. 
 //
 // Used by the heart beat go routine (SendPeriodicHeartBeats).
 //
 // THREAD-SAFE;
 //
-func (cniMap *CNInfoMap) ActionUpdateNurseryInfoMap(niMap *discovery.NurseryInfoMap) {
+func (cniMap *CNInfoMap) ActionApplyNurseryInfoDelta(
+  delta *discovery.NurseryInfoDelta,
+) {
   cniMap.Mutex.Lock()
   defer cniMap.Mutex.Unlock()
 
-  if !cniMap.IsPrimary && (0 < len(*niMap)) {
-    cniMap.NI = *niMap
+  if cniMap.Election.IsLeader() { return }
+
+  now := time.Now()
+  if delta.Full {
+    for aName := range cniMap.NI {
+      _, stillKnown := delta.Updated[aName]
+      if !stillKnown {
+        cniMap.remove(aName, now)
+        cniMap.Events.Emit(events.Event{ Type: events.NurseryReaped, Nursery: aName })
+      }
+    }
+  }
+  for aName, ni := range delta.Updated {
+    oldNI, known := cniMap.NI[aName]
+    cniMap.NI[aName] = ni
+    delete(cniMap.Tombstones, aName)
+    cniMap.touch(aName)
+    cniMap.emitChange(aName, oldNI, ni, known)
   }
+  for _, aName := range delta.Deleted {
+    _, known := cniMap.NI[aName]
+    if known {
+      cniMap.remove(aName, now)
+      cniMap.Events.Emit(events.Event{ Type: events.NurseryReaped, Nursery: aName })
+    }
+  }
+  cniMap.Primary_Map_Id  = delta.Map_Id
+  cniMap.Primary_Version = delta.Version
 }
 
-// Return the heartbeat status information about the federation of ConTeXt 
-// Nurseries. 
+// Return the changes to the heartbeat status information about the 
+// federation of ConTeXt Nurseries since the given version of the given 
+// map. 
+//
+// The whole map is returned if the mapId is not this map's Map_Id, or if 
+// the changes since the given version are no longer known. 
 //
 // Part of the discovery.DiscoveryImpl interface.
 //
 // THREAD-SAFE;
 //
-func (cniMap *CNInfoMap) ResponseListNurseryInformationJSON() discovery.NurseryInfoMap {
+func (cniMap *CNInfoMap) ResponseNurseryInfoDeltaJSON(
+  mapId string,
+  since uint64,
+) discovery.NurseryInfoDelta {
   cniMap.Mutex.RLock()
   defer cniMap.Mutex.RUnlock()
 
-  return cniMap.NI
+  delta := discovery.NurseryInfoDelta{
+    Map_Id:  cniMap.Map_Id,
+    Version: cniMap.Version,
+    Updated: make(discovery.NurseryInfoMap),
+    Deleted: make([]string, 0),
+  }
+  delta.Full = mapId != cniMap.Map_Id || since == 0 ||
+    since < cniMap.Forgotten_Version || cniMap.Version < since
+
+  for aName, ni := range cniMap.NI {
+    if delta.Full || since < cniMap.Changed[aName] { delta.Updated[aName] = ni }
+  }
+  if !delta.Full {
+    for aName, deletedVersion := range cniMap.Deleted {
+      if since < deletedVersion { delta.Deleted = append(delta.Deleted, aName) }
+    }
+  }
+  return delta
+}
+
+// Return the heartbeat status information about the federation of ConTeXt 
+// Nurseries. 
+//
+// Part of the discovery.DiscoveryImpl interface.
+//
+// THREAD-SAFE;
+//
+func (cniMap *CNInfoMap) ResponseListNurseryInformationJSON() discovery.NurseryInfoMap {
+  return cniMap.Snapshot()
 }
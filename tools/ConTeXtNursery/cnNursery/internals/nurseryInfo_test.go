@@ -0,0 +1,121 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "sort"
+  "testing"
+  "time"
+)
+
+// Test marking nurseries suspect, dead and then re-admitting them.
+//
+func TestLiveness(t *testing.T) {
+  config := CreateConfiguration(logger.CreateLogger("nurseryInfoTest"))
+  config.Name               = "primary"
+  config.Heartbeat_Interval = 10
+  config.Suspect_Heartbeats = 3
+  config.Dead_Heartbeats    = 6
+  config.Tombstone_Period   = 600
+  cniMap := CreateCNInfoMap(config, createTestElection("https://primary"), nil)
+
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "aNursery" })
+  assert.Equal(t, discovery.LivenessAlive, cniMap.Snapshot()["aNursery"].Liveness)
+
+  now := time.Now()
+  alive, suspect, dead := cniMap.CheckLiveness(now)
+  assert.Equal(t, []string{ "aNursery" }, alive)
+  assert.Empty(t, suspect)
+  assert.Empty(t, dead)
+
+  _, suspect, _ = cniMap.CheckLiveness(now.Add(45 * time.Second))
+  assert.Equal(t, []string{ "aNursery" }, suspect)
+  assert.Equal(t, discovery.LivenessSuspect, cniMap.Snapshot()["aNursery"].Liveness)
+
+  _, _, dead = cniMap.CheckLiveness(now.Add(90 * time.Second))
+  assert.Equal(t, []string{ "aNursery" }, dead)
+  assert.Empty(t, cniMap.Snapshot())
+  assert.Contains(t, cniMap.Tombstones, "aNursery")
+
+  // a dead nursery which sends a heartbeat is re-admitted
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "aNursery" })
+  assert.NotContains(t, cniMap.Tombstones, "aNursery")
+  assert.Equal(t, discovery.LivenessAlive, cniMap.Snapshot()["aNursery"].Liveness)
+
+  // tombstones are forgotten after the tombstone period
+  cniMap.CheckLiveness(now.Add(90 * time.Second))
+  assert.Contains(t, cniMap.Tombstones, "aNursery")
+  cniMap.CheckLiveness(now.Add(800 * time.Second))
+  assert.NotContains(t, cniMap.Tombstones, "aNursery")
+}
+
+// Test sending (and applying) only the changes since a given version.
+//
+func TestDeltas(t *testing.T) {
+  config := CreateConfiguration(logger.CreateLogger("nurseryInfoTest"))
+  config.Heartbeat_Interval = 10
+  config.Suspect_Heartbeats = 3
+  config.Dead_Heartbeats    = 6
+  config.Tombstone_Period   = 600
+  primary  := CreateCNInfoMap(config, createTestElection("https://primary"), nil)
+  follower := CreateCNInfoMap(config, createTestElection("https://follower"), nil)
+
+  primary.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a" })
+  primary.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "b" })
+
+  mapId, since := follower.PrimaryVersion()
+  delta := primary.ResponseNurseryInfoDeltaJSON(mapId, since)
+  assert.True(t, delta.Full)
+  assert.Len(t, delta.Updated, 2)
+  follower.ActionApplyNurseryInfoDelta(&delta)
+  assert.Len(t, follower.Snapshot(), 2)
+
+  // an unchanged heartbeat does not create a new version
+  primary.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a" })
+  mapId, since = follower.PrimaryVersion()
+  delta = primary.ResponseNurseryInfoDeltaJSON(mapId, since)
+  assert.False(t, delta.Full)
+  assert.Empty(t, delta.Updated)
+  assert.Empty(t, delta.Deleted)
+
+  // only the changed (and deleted) nurseries are sent
+  primary.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a", State: "paused" })
+  primary.CheckLiveness(time.Now().Add(90 * time.Second))
+  primary.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "c" })
+  delta = primary.ResponseNurseryInfoDeltaJSON(mapId, since)
+  assert.False(t, delta.Full)
+  assert.Equal(t, []string{ "a", "b" }, sortedNames(delta.Deleted))
+  assert.Contains(t, delta.Updated, "c")
+  follower.ActionApplyNurseryInfoDelta(&delta)
+  assert.Equal(t, []string{ "c" }, sortedNames(mapNames(follower.Snapshot())))
+
+  // a different map is sent in full
+  delta = primary.ResponseNurseryInfoDeltaJSON("anotherMap", since)
+  assert.True(t, delta.Full)
+}
+
+func mapNames(niMap discovery.NurseryInfoMap) []string {
+  names := make([]string, 0)
+  for aName := range niMap { names = append(names, aName) }
+  return names
+}
+
+func sortedNames(names []string) []string {
+  sort.Strings(names)
+  return names
+}
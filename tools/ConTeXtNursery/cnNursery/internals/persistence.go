@@ -0,0 +1,221 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "encoding/json"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/control"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+)
+
+// The name of the file (in the Work_Dir) in which the federation is
+// persisted.
+//
+const FederationFileName = "federation.json"
+
+// The persisted state of the federation: the map of the federation's
+// cnNurseries (including each cnNursery's control state) together with
+// the federation-wide desired (control) state and the scheduled state
+// changes.
+//
+type FederationSnapshot struct {
+  Saved_At      time.Time
+  Desired_State string
+  Nurseries     discovery.NurseryInfoMap
+  Schedules     []control.Schedule
+}
+
+// The FederationStore persists a FederationSnapshot in a (JSON) file, so
+// that a (primary) cnNursery which restarts does not claim an empty
+// federation until every cnNursery has sent it a heartbeat.
+//
+// The Saving lock serializes each (whole) SaveIfChanged, so that an older
+// snapshot is never saved over a newer one.
+//
+// CONSTRAINTS: Once created, the values in this structure SHOULD only be
+// altered by structure methods.
+//
+type FederationStore struct {
+  Mutex           sync.Mutex
+  Saving          sync.Mutex
+  Path            string
+  Saved_Version   uint64
+  Saved_State     string
+  Saved_Schedules uint64
+  CNLog          *logger.LoggerType
+}
+
+// Create a FederationStore which persists the federation in the
+// FederationFileName file in the configured Work_Dir.
+//
+// READS config;
+//
+func CreateFederationStore(config *ConfigType) *FederationStore {
+  return &FederationStore{
+    Path:  filepath.Join(config.Work_Dir, FederationFileName),
+    CNLog: config.CNLog,
+  }
+}
+
+// Load the persisted FederationSnapshot.
+//
+// Returns an empty snapshot (and no error) if nothing has been persisted.
+//
+// THREAD-SAFE;
+//
+func (store *FederationStore) Load() (FederationSnapshot, error) {
+  store.Mutex.Lock()
+  defer store.Mutex.Unlock()
+
+  snapshot := FederationSnapshot{ Nurseries: make(discovery.NurseryInfoMap) }
+  jsonBytes, err := ioutil.ReadFile(store.Path)
+  if os.IsNotExist(err) { return snapshot, nil }
+  if err != nil {
+    return snapshot, fmt.Errorf("could not read [%s]: %w", store.Path, err)
+  }
+  err = json.Unmarshal(jsonBytes, &snapshot)
+  if err != nil {
+    return snapshot, fmt.Errorf("could not unmarshal [%s]: %w", store.Path, err)
+  }
+  if snapshot.Nurseries == nil {
+    snapshot.Nurseries = make(discovery.NurseryInfoMap)
+  }
+  return snapshot, nil
+}
+
+// Save the FederationSnapshot.
+//
+// The snapshot is written to a temporary file which is then renamed, so
+// that a cnNursery which dies while saving never leaves a partial file.
+//
+// THREAD-SAFE;
+//
+func (store *FederationStore) Save(snapshot FederationSnapshot) error {
+  store.Mutex.Lock()
+  defer store.Mutex.Unlock()
+
+  snapshot.Saved_At = time.Now()
+  jsonBytes, err := json.MarshalIndent(snapshot, "", "  ")
+  if err != nil {
+    return fmt.Errorf("could not marshal the federation: %w", err)
+  }
+  tmpPath := store.Path+".tmp"
+  err = ioutil.WriteFile(tmpPath, jsonBytes, 0644)
+  if err != nil {
+    return fmt.Errorf("could not write [%s]: %w", tmpPath, err)
+  }
+  err = os.Rename(tmpPath, store.Path)
+  if err != nil {
+    return fmt.Errorf("could not rename [%s]: %w", tmpPath, err)
+  }
+  return nil
+}
+
+// Save the current federation if the cnInfoMap's version, the
+// federation's desired state, or the schedules have changed since it was
+// last saved.
+//
+// CALLS cnInfoMap (Snapshot);
+// CALLS cnState (GetDesiredState, ListSchedules);
+// THREAD-SAFE;
+//
+func (store *FederationStore) SaveIfChanged(
+  cnInfoMap *CNInfoMap,
+  cnState   *CNState,
+) error {
+  store.Saving.Lock()
+  defer store.Saving.Unlock()
+
+  cnInfoMap.Mutex.RLock()
+  version := cnInfoMap.Version
+  cnInfoMap.Mutex.RUnlock()
+  desiredState := cnState.GetDesiredState()
+  schedules, schedulesVersion := cnState.ListSchedules()
+
+  store.Mutex.Lock()
+  unchanged := version == store.Saved_Version &&
+    desiredState     == store.Saved_State &&
+    schedulesVersion == store.Saved_Schedules
+  store.Mutex.Unlock()
+  if unchanged { return nil }
+
+  err := store.Save(FederationSnapshot{
+    Desired_State: desiredState,
+    Nurseries:     cnInfoMap.Snapshot(),
+    Schedules:     schedules,
+  })
+  if err != nil { return err }
+
+  store.Mutex.Lock()
+  store.Saved_Version   = version
+  store.Saved_State     = desiredState
+  store.Saved_Schedules = schedulesVersion
+  store.Mutex.Unlock()
+  return nil
+}
+
+// Restore the persisted federation (if any) into the cnInfoMap and
+// cnState.
+//
+// The restored cnNurseries are marked stale until their next heartbeat
+// confirms them.
+//
+// CALLS cnInfoMap (RestoreNurseryInfo);
+// CALLS cnState (RestoreDesiredState, RestoreSchedules);
+//
+func (store *FederationStore) Restore(cnInfoMap *CNInfoMap, cnState *CNState) {
+  snapshot, err := store.Load()
+  if err != nil {
+    store.CNLog.MayBeError("Could not restore the federation", err)
+    return
+  }
+  if 0 < len(snapshot.Nurseries) {
+    store.CNLog.Logf(
+      "Restoring %d (stale) nurseries saved at %s",
+      len(snapshot.Nurseries), snapshot.Saved_At.Format(time.RFC3339),
+    )
+  }
+  cnInfoMap.RestoreNurseryInfo(snapshot.Nurseries, time.Now())
+  cnState.RestoreDesiredState(snapshot.Desired_State)
+  cnState.RestoreSchedules(snapshot.Schedules)
+}
+
+// Implements the federation persistence go routine.
+//
+// Once every heartbeat interval, save the federation if it has changed.
+//
+// READS config;
+// CALLS store (SaveIfChanged);
+//
+func PersistFederation(
+  config    *ConfigType,
+  store     *FederationStore,
+  cnInfoMap *CNInfoMap,
+  cnState   *CNState,
+) {
+  interval := time.Duration(config.Heartbeat_Interval) * time.Second
+  for {
+    time.Sleep(interval)
+    err := store.SaveIfChanged(cnInfoMap, cnState)
+    config.CNLog.MayBeError("Could not save the federation", err)
+  }
+}
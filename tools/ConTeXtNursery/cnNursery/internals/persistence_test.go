@@ -0,0 +1,122 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "github.com/diSimplex/ConTeXtNursery/interfaces/control"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Test persisting, and then restoring, the federation.
+//
+func TestPersistFederation(t *testing.T) {
+  config := CreateConfiguration(logger.CreateLogger("persistenceTest"))
+  config.Name               = "primary"
+  config.Work_Dir           = t.TempDir()
+  config.Heartbeat_Interval = 10
+  config.Suspect_Heartbeats = 3
+  config.Dead_Heartbeats    = 6
+
+  store   := CreateFederationStore(config)
+  cniMap  := CreateCNInfoMap(config, createTestElection("https://primary"), nil)
+  cnState := CreateCNState(config, cniMap, store, nil, nil)
+
+  // nothing has been persisted yet
+  snapshot, err := store.Load()
+  assert.NoError(t, err)
+  assert.Empty(t, snapshot.Nurseries)
+
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a", State: "up" })
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "b", State: "paused" })
+  cnState.Desired_State = control.StatePaused
+  assert.NoError(t, store.SaveIfChanged(cniMap, cnState))
+
+  // "restart" the primary
+  store    = CreateFederationStore(config)
+  cniMap   = CreateCNInfoMap(config, createTestElection("https://primary"), nil)
+  cnState  = CreateCNState(config, cniMap, store, nil, nil)
+  store.Restore(cniMap, cnState)
+
+  restored := cniMap.Snapshot()
+  assert.Equal(t, []string{ "a", "b" }, sortedNames(mapNames(restored)))
+  assert.Equal(t, discovery.LivenessStale, restored["a"].Liveness)
+  assert.Equal(t, "paused", restored["b"].State)
+  assert.Equal(t, control.StatePaused, cnState.GetDesiredState())
+  assert.Equal(t, control.StatePaused, cnState.GetState())
+  history := cnState.ResponseControlHistoryJSON()["primary"]
+  assert.Len(t, history, 1)
+  assert.Equal(t, control.StateUp, history[0].From)
+  assert.Equal(t, control.StatePaused, history[0].To)
+  assert.Equal(t, "restore", history[0].Actor)
+  assert.NotEqual(t, "", history[0].Request_Id)
+  assert.Equal(t,
+    control.StatePaused,
+    (*cnState.ResponseListFederationStatusJSON())["Federation"].Desired_State,
+  )
+
+  // a heartbeat confirms a stale nursery, while unconfirmed nurseries
+  // stay stale until they are reaped
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a", State: "up" })
+  assert.Equal(t, discovery.LivenessAlive, cniMap.Snapshot()["a"].Liveness)
+  now := time.Now()
+  cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a", State: "up" })
+  _, suspect, _ := cniMap.CheckLiveness(now.Add(45 * time.Second))
+  assert.Contains(t, suspect, "b")
+  assert.Equal(t, discovery.LivenessStale, cniMap.Snapshot()["b"].Liveness)
+  _, _, dead := cniMap.CheckLiveness(now.Add(90 * time.Second))
+  assert.Contains(t, dead, "b")
+
+  // concurrent saves are serialized
+  var wg sync.WaitGroup
+  for i := 0 ; i < 4 ; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      cniMap.ActionUpdateNurseryInfo(discovery.NurseryInfo{ Name: "a", State: "up" })
+      assert.NoError(t, store.SaveIfChanged(cniMap, cnState))
+    }()
+  }
+  wg.Wait()
+  assert.NoError(t, store.SaveIfChanged(cniMap, cnState))
+  cniMap.Mutex.RLock()
+  assert.Equal(t, cniMap.Version, store.Saved_Version)
+  cniMap.Mutex.RUnlock()
+}
+
+// Test that a persisted desired state which is not restorable (or is not
+// a legal transition) is refused.
+//
+func TestRestoreDesiredState(t *testing.T) {
+  config := CreateConfiguration(logger.CreateLogger("persistenceTest"))
+  config.Name = "primary"
+  cniMap  := CreateCNInfoMap(config, createTestElection("https://primary"), nil)
+  cnState := CreateCNState(config, cniMap, nil, nil, nil)
+
+  cnState.RestoreDesiredState("bogus")
+  assert.Equal(t, control.StateUp, cnState.GetDesiredState())
+  assert.Empty(t, cnState.ResponseControlHistoryJSON())
+
+  // (a killed nursery can not be brought down)
+  cnState.State.State = control.StateKill
+  cnState.RestoreDesiredState(control.StateDown)
+  assert.Equal(t, control.StateUp, cnState.GetDesiredState())
+  assert.Equal(t, control.StateKill, cnState.GetState())
+  assert.Empty(t, cnState.ResponseControlHistoryJSON())
+}
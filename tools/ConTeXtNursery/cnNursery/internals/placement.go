@@ -0,0 +1,286 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "context"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/action"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/control"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/diSimplex/ConTeXtNursery/metrics"
+  "hash/fnv"
+  "net/http"
+  "net/url"
+  "sort"
+  "sync"
+)
+
+// A placement policy chooses, from the (non-empty, name ordered)
+// candidates able to run the named action, the nursery which should run
+// it.
+//
+// Used by:
+//    - CNPlacement.ActionPlaceAction
+//
+type PlacementPolicy func(
+  candidates []discovery.NurseryInfo,
+  actionName string,
+  placement  action.Placement,
+) (discovery.NurseryInfo, error)
+
+// CNPlacement contains the (essentially global) state required to
+// implement the Placement RESTful interface, which (on the federation's
+// primary cnNursery) runs an action on the "best" cnNursery.
+//
+// CONSTRAINTS: Once created, the values in this structure SHOULD only be
+// altered by structure methods.
+//
+type CNPlacement struct {
+  Mutex          sync.RWMutex
+  Default_Policy string
+  Policies       map[string]PlacementPolicy
+  CNInfoMap     *CNInfoMap
+  Fc            *federationClient.Client
+  Reg           *metrics.Registry
+  CNLog         *logger.LoggerType
+}
+
+// Create a CNPlacement structure with the standard (least-loaded,
+// cache-affine and pinned) placement policies.
+//
+// READS config;
+// FIELD cnInfoMap;
+// FIELD fc;
+// FIELD reg;
+//
+func CreateCNPlacement(
+  config    *ConfigType,
+  cnInfoMap *CNInfoMap,
+  fc        *federationClient.Client,
+  reg       *metrics.Registry,
+) *CNPlacement {
+  cnPlacement := &CNPlacement{
+    Default_Policy: config.Placement_Policy,
+    Policies:       make(map[string]PlacementPolicy, 0),
+    CNInfoMap:      cnInfoMap,
+    Fc:             fc,
+    Reg:            reg,
+    CNLog:          config.CNLog,
+  }
+  cnPlacement.AddPolicy(action.LeastLoadedPolicy, LeastLoaded)
+  cnPlacement.AddPolicy(action.CacheAffinePolicy, CacheAffine)
+  cnPlacement.AddPolicy(action.PinnedPolicy,      Pinned)
+  return cnPlacement
+}
+
+// Add (or replace) a named placement policy.
+//
+// THREAD-SAFE;
+//
+func (cnPlacement *CNPlacement) AddPolicy(name string, policy PlacementPolicy) {
+  cnPlacement.Mutex.Lock()
+  defer cnPlacement.Mutex.Unlock()
+
+  cnPlacement.Policies[name] = policy
+}
+
+// Returns the (load adjusted) number of running processes per core of a
+// nursery. The queue depth is included, since it reacts more quickly
+// than the load average to newly placed actions.
+//
+func loadPerCore(ni discovery.NurseryInfo) float64 {
+  cores := ni.Cores
+  if cores < 1 { cores = 1 }
+  return (ni.Load.Load1 + float64(ni.Queue_Depth)) / float64(cores)
+}
+
+// The least-loaded placement policy: chooses the candidate with the
+// lowest load (and queue depth) per core.
+//
+func LeastLoaded(
+  candidates []discovery.NurseryInfo,
+  actionName string,
+  placement  action.Placement,
+) (discovery.NurseryInfo, error) {
+  best := candidates[0]
+  for _, aCandidate := range candidates[1:] {
+    if loadPerCore(aCandidate) < loadPerCore(best) { best = aCandidate }
+  }
+  return best, nil
+}
+
+// The cache-affine placement policy: chooses the candidate with the
+// highest (rendezvous) hash of the affinity key (which defaults to the
+// action name) and the candidate's name.
+//
+// Runs with the same affinity key are placed on the same nursery (whose
+// caches are then warm) for as long as it remains a candidate, and only
+// the runs placed on a nursery which stops being a candidate move.
+//
+func CacheAffine(
+  candidates []discovery.NurseryInfo,
+  actionName string,
+  placement  action.Placement,
+) (discovery.NurseryInfo, error) {
+  affinity := placement.Affinity
+  if affinity == "" { affinity = actionName }
+
+  var best discovery.NurseryInfo
+  var bestWeight uint64
+  for i, aCandidate := range candidates {
+    hasher := fnv.New64a()
+    hasher.Write([]byte(affinity+"/"+aCandidate.Name))
+    weight := hasher.Sum64()
+    if i == 0 || bestWeight < weight {
+      best       = aCandidate
+      bestWeight = weight
+    }
+  }
+  return best, nil
+}
+
+// The pinned placement policy: chooses the candidate named by the
+// placement's Nursery.
+//
+func Pinned(
+  candidates []discovery.NurseryInfo,
+  actionName string,
+  placement  action.Placement,
+) (discovery.NurseryInfo, error) {
+  if placement.Nursery == "" {
+    return discovery.NurseryInfo{}, &action.PlacementError{
+      Status_Code: http.StatusBadRequest,
+      Message:     "the pinned placement policy requires a nursery",
+    }
+  }
+  for _, aCandidate := range candidates {
+    if aCandidate.Name == placement.Nursery { return aCandidate, nil }
+  }
+  return discovery.NurseryInfo{}, &action.PlacementError{
+    Status_Code: http.StatusConflict,
+    Message:     fmt.Sprintf(
+      "the nursery [%s] is not able to run the action [%s]",
+      placement.Nursery, actionName,
+    ),
+  }
+}
+
+// Returns the (name ordered) nurseries which are up (so neither paused
+// nor draining), alive, have registered the named action, and have all
+// of the placement's labels.
+//
+// CALLS cnInfoMap (Snapshot);
+//
+func (cnPlacement *CNPlacement) Candidates(
+  actionName string,
+  placement  action.Placement,
+) []discovery.NurseryInfo {
+  selected := cnPlacement.CNInfoMap.Snapshot().Select(
+    placement.Labels, []string{ actionName },
+  )
+  candidates := make([]discovery.NurseryInfo, 0)
+  for _, ni := range selected {
+    if ni.State != control.StateUp { continue }
+    if ni.Liveness != "" && ni.Liveness != discovery.LivenessAlive { continue }
+    candidates = append(candidates, ni)
+  }
+  sort.Slice(candidates, func(i, j int) bool {
+    return candidates[i].Name < candidates[j].Name
+  })
+  return candidates
+}
+
+// Returns the Base_Url of the federation's primary cnNursery, and whether
+// or not this cnNursery is the primary.
+//
+// Part of the action.PlacementImpl interface.
+//
+// CALLS cnInfoMap.Election;
+//
+func (cnPlacement *CNPlacement) ResponsePrimaryUrl() (string, bool) {
+  cnElection := cnPlacement.CNInfoMap.Election
+  return cnElection.GetLeader(), cnElection.IsLeader()
+}
+
+// Choose (using the placement's policy) a cnNursery able to run the named
+// action, and run the action on it.
+//
+// Returns the (absolute) url of the output of the new run.
+//
+// Part of the action.PlacementImpl interface.
+//
+// CALLS fc (federationClient.RunAction);
+// ALTERS reg (PlacementsMetric);
+// THREAD-SAFE;
+//
+func (cnPlacement *CNPlacement) ActionPlaceAction(
+  ctx          context.Context,
+  actionName   string,
+  placement    action.Placement,
+  actionConfig *action.ActionConfig,
+) (string, error) {
+  if placement.Policy == "" { placement.Policy = cnPlacement.Default_Policy }
+  outcome := func(anOutcome string) {
+    cnPlacement.Reg.IncCounter(PlacementsMetric, metrics.Labels{
+      "policy": placement.Policy, "outcome": anOutcome,
+    })
+  }
+
+  cnPlacement.Mutex.RLock()
+  policy, ok := cnPlacement.Policies[placement.Policy]
+  cnPlacement.Mutex.RUnlock()
+  if !ok {
+    outcome("unknown_policy")
+    return "", &action.PlacementError{
+      Status_Code: http.StatusBadRequest,
+      Message:     fmt.Sprintf("unknown placement policy [%s]", placement.Policy),
+    }
+  }
+
+  candidates := cnPlacement.Candidates(actionName, placement)
+  if len(candidates) < 1 {
+    outcome("no_candidates")
+    return "", &action.PlacementError{
+      Status_Code: http.StatusServiceUnavailable,
+      Message:     fmt.Sprintf("no nursery is able to run the action [%s]", actionName),
+    }
+  }
+
+  target, err := policy(candidates, actionName, placement)
+  if err != nil {
+    outcome("refused")
+    return "", err
+  }
+  cnPlacement.CNLog.ForContext(ctx).Logf(
+    "placing the action [%s] on [%s] (%s)", actionName, target.Name, placement.Policy,
+  )
+
+  runId, err := cnPlacement.Fc.RunAction(ctx, target.Base_Url, actionName, actionConfig)
+  if err != nil {
+    outcome("error")
+    return "", &action.PlacementError{
+      Status_Code: http.StatusBadGateway,
+      Message:     fmt.Sprintf(
+        "could not run the action [%s] on [%s]: %s", actionName, target.Name, err,
+      ),
+    }
+  }
+  outcome("ok")
+  return target.Base_Url+"/action/output/"+url.PathEscape(actionName)+"/"+
+    url.PathEscape(runId), nil
+}
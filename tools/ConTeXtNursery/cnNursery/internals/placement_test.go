@@ -0,0 +1,140 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "context"
+  "errors"
+  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/action"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/diSimplex/ConTeXtNursery/metrics"
+  "github.com/stretchr/testify/assert"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "testing"
+)
+
+func createTestNursery(
+  name, baseUrl string,
+  load float64,
+  labels map[string]string,
+) discovery.NurseryInfo {
+  ni := discovery.NurseryInfo{
+    Name:     name,
+    Base_Url: baseUrl,
+    State:    "up",
+    Cores:    2,
+    Labels:   labels,
+    Actions:  map[string]string{ "typeset": "1234" },
+  }
+  ni.Load.Load1 = load
+  return ni
+}
+
+// Test the standard placement policies.
+//
+func TestPlacementPolicies(t *testing.T) {
+  candidates := []discovery.NurseryInfo{
+    createTestNursery("a", "https://a", 1.5, nil),
+    createTestNursery("b", "https://b", 0.5, nil),
+    createTestNursery("c", "https://c", 0.9, nil),
+  }
+  candidates[1].Queue_Depth = 2
+
+  best, err := LeastLoaded(candidates, "typeset", action.Placement{})
+  assert.NoError(t, err)
+  assert.Equal(t, "c", best.Name)
+
+  // the same affinity key is always placed on the same nursery, unless
+  // that nursery stops being a candidate
+  placement := action.Placement{ Affinity: "aDocument" }
+  first, _  := CacheAffine(candidates, "typeset", placement)
+  again, _  := CacheAffine(candidates, "typeset", placement)
+  assert.Equal(t, first.Name, again.Name)
+  others := make([]discovery.NurseryInfo, 0)
+  for _, aCandidate := range candidates {
+    if aCandidate.Name != first.Name { others = append(others, aCandidate) }
+  }
+  moved, _ := CacheAffine(others, "typeset", placement)
+  assert.NotEqual(t, first.Name, moved.Name)
+
+  pinned, err := Pinned(candidates, "typeset", action.Placement{ Nursery: "a" })
+  assert.NoError(t, err)
+  assert.Equal(t, "a", pinned.Name)
+  _, err = Pinned(candidates, "typeset", action.Placement{ Nursery: "z" })
+  var placementErr *action.PlacementError
+  assert.True(t, errors.As(err, &placementErr))
+  assert.Equal(t, http.StatusConflict, placementErr.Status_Code)
+}
+
+// Test choosing a nursery, and running an action on it.
+//
+func TestPlaceAction(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(
+    func(w http.ResponseWriter, r *http.Request) {
+      assert.Equal(t, "/action/typeset", r.URL.Path)
+      http.Redirect(w, r, "/action/output/typeset/42", http.StatusSeeOther)
+    },
+  ))
+  defer server.Close()
+
+  config := CreateConfiguration(logger.CreateLogger("placementTest"))
+  config.Placement_Policy = action.LeastLoadedPolicy
+  cniMap := CreateCNInfoMap(config, createTestElection("https://primary"), nil)
+  cniMap.ActionUpdateNurseryInfo(
+    createTestNursery("a", server.URL, 0.1, map[string]string{ "fonts": "full" }),
+  )
+  cniMap.ActionUpdateNurseryInfo(createTestNursery("b", "https://b", 0.0, nil))
+  paused := createTestNursery("c", "https://c", 0.0, map[string]string{ "fonts": "full" })
+  paused.State = "paused"
+  cniMap.ActionUpdateNurseryInfo(paused)
+
+  cc := &clientConnection.CC{
+    Client: &http.Client{
+      CheckRedirect: func(req *http.Request, via []*http.Request) error {
+        return http.ErrUseLastResponse
+      },
+    },
+    Log: config.CNLog,
+  }
+  fc  := federationClient.CreateClient(cc, federationClient.RetryPolicy{})
+  reg := metrics.CreateRegistry()
+  DescribeNurseryMetrics(reg)
+  cnPlacement := CreateCNPlacement(config, cniMap, fc, reg)
+
+  placement, err := action.ParsePlacement(url.Values{ "label": { "fonts=full" } })
+  assert.NoError(t, err)
+  assert.Len(t, cnPlacement.Candidates("typeset", placement), 1)
+
+  runUrl, err := cnPlacement.ActionPlaceAction(
+    context.Background(), "typeset", placement, &action.ActionConfig{},
+  )
+  assert.NoError(t, err)
+  assert.Equal(t, server.URL+"/action/output/typeset/42", runUrl)
+  assert.Equal(t, 1.0, reg.Value(
+    PlacementsMetric, metrics.Labels{ "policy": "least-loaded", "outcome": "ok" },
+  ))
+
+  _, err = cnPlacement.ActionPlaceAction(
+    context.Background(), "missing", placement, &action.ActionConfig{},
+  )
+  var placementErr *action.PlacementError
+  assert.True(t, errors.As(err, &placementErr))
+  assert.Equal(t, http.StatusServiceUnavailable, placementErr.Status_Code)
+}
@@ -0,0 +1,250 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "context"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/control"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "net/http"
+  "sort"
+  "time"
+)
+
+// Returns the Base_Url of the federation's primary cnNursery, and whether
+// or not this cnNursery is the primary.
+//
+// Part of the control.ControlImpl interface.
+//
+// CALLS cnInfoMap.Election;
+//
+func (cnState *CNState) ResponsePrimaryUrl() (string, bool) {
+  cnElection := cnState.CNInfoMap.Election
+  return cnElection.GetLeader(), cnElection.IsLeader()
+}
+
+// Returns the (Next_Run ordered) schedules, together with the
+// Schedules_Version.
+//
+// THREAD-SAFE;
+//
+func (cnState *CNState) ListSchedules() ([]control.Schedule, uint64) {
+  cnState.Mutex.RLock()
+  defer cnState.Mutex.RUnlock()
+
+  schedules := make([]control.Schedule, 0, len(cnState.Schedules))
+  for _, aSchedule := range cnState.Schedules {
+    schedules = append(schedules, aSchedule)
+  }
+  sort.Slice(schedules, func(i, j int) bool {
+    if schedules[i].Next_Run.Equal(schedules[j].Next_Run) {
+      return schedules[i].Id < schedules[j].Id
+    }
+    return schedules[i].Next_Run.Before(schedules[j].Next_Run)
+  })
+  return schedules, cnState.Schedules_Version
+}
+
+// Return the (Next_Run ordered) schedules stored by this cnNursery.
+//
+// Part of the control.ControlImpl interface.
+//
+// THREAD-SAFE (via ListSchedules);
+//
+func (cnState *CNState) ResponseListSchedulesJSON() []control.Schedule {
+  schedules, _ := cnState.ListSchedules()
+  return schedules
+}
+
+// Persist the (changed) schedules.
+//
+// CALLS store (SaveIfChanged);
+//
+func (cnState *CNState) saveSchedules(ctx context.Context) error {
+  if cnState.Store == nil { return nil }
+  err := cnState.Store.SaveIfChanged(cnState.CNInfoMap, cnState)
+  if err != nil {
+    cnState.CNLog.ForContext(ctx).MayBeError("Could not save the schedules", err)
+    return &control.ScheduleError{
+      Status_Code: http.StatusInternalServerError,
+      Message:     fmt.Sprintf("could not save the schedules: %s", err),
+    }
+  }
+  return nil
+}
+
+// Validate and store a new schedule, whose Id is always newly generated
+// (a client may choose its request id, but never a schedule's Id). The
+// schedule is logged under the id of the request which added it.
+//
+// Part of the control.ControlImpl interface.
+//
+// THREAD-SAFE;
+//
+func (cnState *CNState) ActionAddSchedule(
+  ctx      context.Context,
+  schedule control.Schedule,
+) (control.Schedule, error) {
+  err := schedule.Validate()
+  if err != nil {
+    return schedule, &control.ScheduleError{
+      Status_Code: http.StatusBadRequest,
+      Message:     err.Error(),
+    }
+  }
+  schedule.Next_Run = schedule.NextRun(time.Now())
+  if schedule.Next_Run.IsZero() {
+    return schedule, &control.ScheduleError{
+      Status_Code: http.StatusBadRequest,
+      Message:     "the schedule is never due",
+    }
+  }
+  schedule.Id          = logger.NewRequestId()
+  schedule.Last_Run    = time.Time{}
+  schedule.Last_Result = nil
+
+  cnState.Mutex.Lock()
+  cnState.Schedules[schedule.Id] = schedule
+  cnState.Schedules_Version++
+  cnState.Mutex.Unlock()
+
+  cnState.CNLog.ForContext(ctx).Logf(
+    "scheduled the state [%s] (id: %s, actor: %s, next run: %s)",
+    schedule.State, schedule.Id, schedule.Actor,
+    schedule.Next_Run.Format(time.RFC3339),
+  )
+  return schedule, cnState.saveSchedules(ctx)
+}
+
+// Remove the schedule with the given Id.
+//
+// Part of the control.ControlImpl interface.
+//
+// THREAD-SAFE;
+//
+func (cnState *CNState) ActionDeleteSchedule(
+  ctx        context.Context,
+  scheduleId string,
+) error {
+  cnState.Mutex.Lock()
+  _, ok := cnState.Schedules[scheduleId]
+  if ok {
+    delete(cnState.Schedules, scheduleId)
+    cnState.Schedules_Version++
+  }
+  cnState.Mutex.Unlock()
+
+  if !ok {
+    return &control.ScheduleError{
+      Status_Code: http.StatusNotFound,
+      Message:     fmt.Sprintf("unknown schedule [%s]", scheduleId),
+    }
+  }
+  cnState.CNLog.ForContext(ctx).Logf("removed the schedule [%s]", scheduleId)
+  return cnState.saveSchedules(ctx)
+}
+
+// Restore the (persisted) schedules.
+//
+// THREAD-SAFE;
+//
+func (cnState *CNState) RestoreSchedules(schedules []control.Schedule) {
+  if len(schedules) < 1 { return }
+  cnState.CNLog.Logf("Restoring %d schedules", len(schedules))
+  cnState.Mutex.Lock()
+  defer cnState.Mutex.Unlock()
+
+  for _, aSchedule := range schedules {
+    cnState.Schedules[aSchedule.Id] = aSchedule
+  }
+}
+
+// Apply (as federation-wide state changes of their targets) the
+// schedules which are due at the given time, if this cnNursery is the
+// primary.
+//
+// A schedule which was missed (for example while the primary was
+// restarting) is applied once, late. Cron-like schedules are then
+// rescheduled, while one-shot schedules are removed.
+//
+// Returns the Ids of the applied schedules.
+//
+// CALLS cnState (ActionChangeFederationState);
+// THREAD-SAFE;
+//
+func (cnState *CNState) ApplyDueSchedules(now time.Time) []string {
+  if !cnState.CNInfoMap.Election.IsLeader() { return nil }
+
+  due := make([]control.Schedule, 0)
+  cnState.Mutex.RLock()
+  for _, aSchedule := range cnState.Schedules {
+    if !aSchedule.Next_Run.After(now) { due = append(due, aSchedule) }
+  }
+  cnState.Mutex.RUnlock()
+
+  applied := make([]string, 0)
+  for _, aSchedule := range due {
+    ctx   := logger.ContextWithNewRequestId(context.Background())
+    actor := "schedule "+aSchedule.Id
+    if aSchedule.Actor != "" { actor = actor+" (for "+aSchedule.Actor+")" }
+    cnState.CNLog.ForContext(ctx).Logf(
+      "applying the schedule [%s] (state: %s)", aSchedule.Id, aSchedule.State,
+    )
+    result := cnState.ActionChangeFederationState(
+      ctx,
+      control.StateChange{
+        State:  aSchedule.State,
+        Reason: aSchedule.Reason,
+        Actor:  actor,
+      },
+      aSchedule.Target,
+    )
+
+    cnState.Mutex.Lock()
+    // the schedule may have been removed while it was being applied
+    if _, ok := cnState.Schedules[aSchedule.Id] ; ok {
+      aSchedule.Last_Run    = now
+      aSchedule.Last_Result = &result
+      aSchedule.Next_Run    = aSchedule.NextRun(now)
+      if aSchedule.Cron == "" || aSchedule.Next_Run.IsZero() {
+        delete(cnState.Schedules, aSchedule.Id)
+      } else {
+        cnState.Schedules[aSchedule.Id] = aSchedule
+      }
+      cnState.Schedules_Version++
+    }
+    cnState.Mutex.Unlock()
+    applied = append(applied, aSchedule.Id)
+  }
+  if 0 < len(applied) { cnState.saveSchedules(context.Background()) }
+  return applied
+}
+
+// Implements the schedule go routine.
+//
+// Once every Schedule_Interval, the primary cnNursery applies any
+// due schedules.
+//
+// READS config;
+// CALLS cnState (ApplyDueSchedules);
+//
+func RunSchedules(config *ConfigType, cnState *CNState) {
+  interval := time.Duration(config.Schedule_Interval) * time.Second
+  for {
+    time.Sleep(interval)
+    cnState.ApplyDueSchedules(time.Now())
+  }
+}
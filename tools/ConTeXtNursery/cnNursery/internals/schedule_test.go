@@ -0,0 +1,159 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "context"
+  "errors"
+  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/action"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/control"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/election"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/diSimplex/ConTeXtNursery/metrics"
+  "github.com/stretchr/testify/assert"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Test parsing cron specifications, and finding their next run.
+//
+func TestCron(t *testing.T) {
+  at := func(day, hour, minute int) time.Time {
+    // 2020-06-01 is a Monday
+    return time.Date(2020, time.June, day, hour, minute, 0, 0, time.UTC)
+  }
+
+  cron, err := control.ParseCron("0 1 * * 1-5")
+  assert.NoError(t, err)
+  assert.Equal(t, at(2, 1, 0), cron.Next(at(1, 1, 0)))
+  // friday night skips to monday
+  assert.Equal(t, at(8, 1, 0), cron.Next(at(5, 2, 30)))
+
+  cron, err = control.ParseCron("*/15 22-23 * * 0,7")
+  assert.NoError(t, err)
+  assert.Equal(t, at(7, 22, 0),  cron.Next(at(2, 12, 0)))
+  assert.Equal(t, at(7, 22, 15), cron.Next(at(7, 22, 1)))
+
+  // either the day of the month or the day of the week matches
+  cron, err = control.ParseCron("30 3 15 * 3")
+  assert.NoError(t, err)
+  assert.Equal(t, at(3, 3, 30),  cron.Next(at(1, 0, 0)))
+  assert.Equal(t, at(10, 3, 30), cron.Next(at(3, 3, 30)))
+  assert.Equal(t, at(15, 3, 30), cron.Next(at(10, 3, 30)))
+
+  cron, err = control.ParseCron("0 0 31 2 *")
+  assert.NoError(t, err)
+  assert.True(t, cron.Next(at(1, 0, 0)).IsZero())
+
+  for _, aSpec := range []string{ "0 1 * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *" } {
+    _, err = control.ParseCron(aSpec)
+    assert.Error(t, err, aSpec)
+  }
+}
+
+// Test adding, applying and removing scheduled state changes, and that a
+// draining nursery is not given new placements.
+//
+func TestSchedules(t *testing.T) {
+  var requestsMutex sync.Mutex
+  requests := make([]string, 0)
+  server := httptest.NewServer(http.HandlerFunc(
+    func(w http.ResponseWriter, r *http.Request) {
+      requestsMutex.Lock()
+      requests = append(requests, r.URL.Path+" "+r.URL.Query().Get("actor"))
+      requestsMutex.Unlock()
+      w.Write([]byte("{}"))
+    },
+  ))
+  defer server.Close()
+
+  config := CreateConfiguration(logger.CreateLogger("scheduleTest"))
+  config.Name            = "primary"
+  config.Base_Url        = server.URL+"/primary"
+  config.Work_Dir        = t.TempDir()
+  config.Control_Timeout = 1
+  cc := &clientConnection.CC{ Client: &http.Client{}, Log: config.CNLog }
+  fc := federationClient.CreateClient(cc, federationClient.RetryPolicy{})
+
+  cnElection := createTestElection("https://primary", "https://primary")
+  cniMap     := CreateCNInfoMap(config, cnElection, nil)
+  cniMap.ActionUpdateNurseryInfo(createTestNursery("a", server.URL+"/a", 0.0, nil))
+  store   := CreateFederationStore(config)
+  cnState := CreateCNState(config, cniMap, store, nil, fc)
+  ctx     := logger.ContextWithRequestId(context.Background(), "drainAt")
+
+  // invalid schedules are refused
+  _, err := cnState.ActionAddSchedule(ctx, control.Schedule{ State: "asleep", Cron: "* * * * *" })
+  var scheduleErr *control.ScheduleError
+  assert.True(t, errors.As(err, &scheduleErr))
+  assert.Equal(t, http.StatusBadRequest, scheduleErr.Status_Code)
+  _, err = cnState.ActionAddSchedule(ctx, control.Schedule{
+    State: control.StateDraining, At: time.Now().Add(-time.Hour),
+  })
+  assert.Error(t, err)
+
+  now := time.Now()
+  drainAt, err := cnState.ActionAddSchedule(ctx, control.Schedule{
+    State:  control.StateDraining,
+    Target: control.ControlTarget{ Nurseries: []string{ "a" } },
+    At:     now.Add(time.Minute),
+    Reason: "backups",
+    Actor:  "admin",
+  })
+  assert.NoError(t, err)
+  // (the Id is always generated, never the client's request id)
+  assert.NotEqual(t, "", drainAt.Id)
+  assert.NotEqual(t, "drainAt", drainAt.Id)
+  nightly, err := cnState.ActionAddSchedule(
+    logger.ContextWithRequestId(context.Background(), "nightly"),
+    control.Schedule{ State: control.StateUp, Cron: "0 5 * * *" },
+  )
+  assert.NoError(t, err)
+  assert.Len(t, cnState.ResponseListSchedulesJSON(), 2)
+
+  // schedules are only applied by the primary
+  assert.Empty(t, cnState.ApplyDueSchedules(now.Add(2 * time.Minute)))
+  requestTestLease(
+    t, cnElection, election.Lease{ Leader: "https://primary", Term: 1, Duration_Ms: 60000 },
+  )
+  assert.Equal(t, []string{ drainAt.Id }, cnState.ApplyDueSchedules(now.Add(2 * time.Minute)))
+  assert.Equal(t, []string{ "/a/control/draining schedule "+drainAt.Id+" (for admin)" }, requests)
+  assert.Equal(t, control.StateDraining, cniMap.Snapshot()["a"].State)
+  assert.Equal(t, "backups", cnState.ResponseControlHistoryJSON()["a"][0].Reason)
+  // one-shot schedules are removed once applied
+  schedules := cnState.ResponseListSchedulesJSON()
+  assert.Len(t, schedules, 1)
+  assert.Equal(t, nightly.Id, schedules[0].Id)
+
+  // a draining nursery is not given new placements
+  cnPlacement := CreateCNPlacement(config, cniMap, fc, metrics.CreateRegistry())
+  assert.Empty(t, cnPlacement.Candidates("typeset", action.Placement{}))
+
+  // the schedules are persisted
+  snapshot, err := store.Load()
+  assert.NoError(t, err)
+  assert.Len(t, snapshot.Schedules, 1)
+
+  err = cnState.ActionDeleteSchedule(ctx, "missing")
+  assert.True(t, errors.As(err, &scheduleErr))
+  assert.Equal(t, http.StatusNotFound, scheduleErr.Status_Code)
+  assert.NoError(t, cnState.ActionDeleteSchedule(ctx, nightly.Id))
+  assert.Empty(t, cnState.ResponseListSchedulesJSON())
+}
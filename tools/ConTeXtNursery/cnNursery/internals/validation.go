@@ -0,0 +1,93 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "github.com/diSimplex/ConTeXtNursery/configValidation"
+  "os"
+  "reflect"
+)
+
+// The keys written (by cnSetup) into a nursery's configuration file for
+// the cnMessages(NATS) microService, which the cnNursery ignores.
+//
+var natsKeys = []string{
+  "federation_name", "federation_port", "messages_port", "monitor_port",
+  "librarian_port", "nats_routes",
+}
+
+// Validate the (cnNursery) configuration file at configFileName,
+// returning a validator containing EVERY problem found (each at its
+// file:line).
+//
+// The validation reports unknown (not NATS) keys, a missing name or
+// base_url, missing (or malformed) primary candidates (see
+// CheckCandidates), malformed URLs, port collisions, bad passphrase
+// sources, as well as certificate, key (and crl) files which do not
+// exist.
+//
+// CREATES validator;
+//
+func ValidateConfiguration(configFileName string) *configValidation.Validator {
+  validator := configValidation.LoadValidator(configFileName)
+  if 0 < len(validator.Problems) { return validator }
+  root      := validator.Root
+  validator.IgnoreKeys(natsKeys...)
+  validator.CheckKeys(root, reflect.TypeOf(ConfigType{}))
+
+  validator.Require(root, "name", "base_url", "ca_cert_path", "cert_path", "key_path")
+  validator.CheckUrls(root, "base_url", "primary_url", "primary_candidates")
+  candidates := []string{}
+  for _, aCandidate := range configValidation.GetItems(root, "primary_candidates") {
+    candidates = append(candidates, aCandidate.Value)
+  }
+  if len(candidates) < 1 {
+    if primaryUrl := configValidation.GetValue(root, "primary_url") ; primaryUrl != "" {
+      candidates = append(candidates, primaryUrl)
+    }
+  }
+  if err := checkPrimaryCandidates(candidates) ; err != nil {
+    candidatesNode := configValidation.GetKey(root, "primary_candidates")
+    if candidatesNode == nil { candidatesNode = root }
+    validator.Addf(candidatesNode, "%s", err.Error())
+  }
+  validator.CheckPorts(
+    root, "port", "federation_port", "messages_port", "monitor_port", "librarian_port",
+  )
+  for _, aKey := range []string{ "ca_cert_path", "cert_path", "key_path", "crl_path" } {
+    validator.CheckPathExists(root, aKey, "")
+  }
+  validator.CheckPassphraseSource(root)
+  validator.Sort()
+  return validator
+}
+
+// Validate the (cnNursery) configuration file at configFileName, and, if
+// any problems are found, log EVERY problem and exit.
+//
+// READS config;
+//
+func (config *ConfigType) CheckConfiguration(configFileName string) {
+  validator := ValidateConfiguration(configFileName)
+  if len(validator.Problems) < 1 { return }
+  for _, aProblem := range validator.Problems {
+    config.CNLog.Logf("%s", aProblem.String())
+  }
+  config.CNLog.Logf(
+    "Found %d problem(s) in the configuration [%s]",
+    len(validator.Problems), configFileName,
+  )
+  os.Exit(-1)
+}
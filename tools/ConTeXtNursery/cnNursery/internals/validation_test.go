@@ -0,0 +1,94 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNNurseries
+
+import (
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "strings"
+  "testing"
+)
+
+// Test the validation of a (cnSetup generated) cnNursery configuration.
+//
+func TestValidateConfiguration(t *testing.T) {
+  dir := t.TempDir()
+  for _, aFile := range []string{ "ca-crt.pem", "crt.pem", "key.pem" } {
+    assert.NoError(t, ioutil.WriteFile(dir+"/"+aFile, []byte("PEM"), 0644))
+  }
+  configPath := dir+"/nursery.yaml"
+  configStr  := `federation_name: "test"
+name:            "plato01"
+host:            "plato01"
+port:            "4222"
+federation_port:  4221
+messages_port:    4222
+ca_cert_path:    "` + dir + `/ca-crt.pem"
+cert_path:       "` + dir + `/crt.pem"
+key_path:        "` + dir + `/key.pem"
+crl_path:        "` + dir + `/crl.pem"
+nats_routes:
+  - nats://plato01:4222
+limits:
+  read_timeout: 30
+base_url:        "https://plato01:4222"
+primary_candidates:
+  - https://plato01:4222
+`
+  assert.NoError(t, ioutil.WriteFile(configPath, []byte(configStr), 0644))
+  validator := ValidateConfiguration(configPath)
+  assert.Len(t, validator.Problems, 2)
+  assert.Equal(t, 6,  validator.Problems[0].Line)
+  assert.Equal(t, "the messages_port [4222] is also the port", validator.Problems[0].Message)
+  assert.Equal(t, 10, validator.Problems[1].Line)
+  assert.Contains(t, validator.Problems[1].Message, "the crl_path")
+
+  // (a missing name and a misspelt key)
+  //
+  configStr = strings.Replace(configStr, "name:            \"plato01\"\n", "", 1)
+  configStr = configStr + "lables:\n  fast: true\n"
+  assert.NoError(t, ioutil.WriteFile(configPath, []byte(configStr), 0644))
+  messages := []string{}
+  for _, aProblem := range ValidateConfiguration(configPath).Problems {
+    messages = append(messages, aProblem.Message)
+  }
+  assert.Contains(t, messages, "the name MUST be specified")
+  assert.Contains(t, messages, "unknown key [lables]")
+
+  // (a missing base_url, and malformed or exactly two primary candidates)
+  //
+  configStr = strings.Replace(configStr, "base_url:        \"https://plato01:4222\"\n", "", 1)
+  configStr = strings.Replace(
+    configStr, "  - https://plato01:4222\n", "  - https://plato01:4222\n  - plato02:4222\n", 1,
+  )
+  assert.NoError(t, ioutil.WriteFile(configPath, []byte(configStr), 0644))
+  messages = []string{}
+  for _, aProblem := range ValidateConfiguration(configPath).Problems {
+    messages = append(messages, aProblem.Message)
+  }
+  assert.Contains(t, messages, "the base_url MUST be specified")
+  assert.Contains(t, messages, "the primary_candidates [plato02:4222] MUST be an https URL (https://<host>:<port>)")
+  assert.Contains(t, strings.Join(messages, "\n"), "can not elect a leader")
+
+  // (neither a primary_url nor any primary_candidates)
+  //
+  configStr = configStr[:strings.Index(configStr, "primary_candidates:")]
+  assert.NoError(t, ioutil.WriteFile(configPath, []byte(configStr), 0644))
+  messages = []string{}
+  for _, aProblem := range ValidateConfiguration(configPath).Problems {
+    messages = append(messages, aProblem.Message)
+  }
+  assert.Contains(t, messages, "the primary_candidates (or the primary_url) MUST be specified")
+}
@@ -20,14 +20,16 @@
 package main
 
 import (
-  "crypto/tls"
-  "crypto/x509"
   "flag"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
   "github.com/diSimplex/ConTeXtNursery/clientConnection"
   "github.com/diSimplex/ConTeXtNursery/cnNursery/internals"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
   "github.com/diSimplex/ConTeXtNursery/interfaces/action"
   "github.com/diSimplex/ConTeXtNursery/interfaces/control"
   "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/election"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/events"
   "github.com/diSimplex/ConTeXtNursery/logger"
   "github.com/diSimplex/ConTeXtNursery/webserver"
   "math/rand"
@@ -37,8 +39,6 @@ import (
 
 var configFileName string
 var showConfig     bool
-var serverCert     tls.Certificate
-var caCertPool     *x509.CertPool
 
 func main() {
   const (
@@ -56,7 +56,10 @@ func main() {
   cnLog  := logger.CreateLogger("cnNursery")
   cnLog.SetPrintStack(true)
   
+  // (every problem in the configuration is reported before we start)
+  //
   config := CNNurseries.CreateConfiguration(cnLog)
+  config.CheckConfiguration(configFileName)
   config.LoadConfiguration(configFileName, showConfig)
 
   cnLog.Logf("cnNursery: %s started", config.Name)
@@ -69,11 +72,16 @@ func main() {
   ////////////////////////////////
   // initialize interfaces
   //   BEFORE we start any threads
-  cc := clientConnection.CreateClientConnection(
-    config.Ca_Cert_Path, config.Cert_Path, config.Key_Path,
-    cnLog,
+  // (an encrypted key is unlocked, once, using the key_passphrase source)
+  //
+  certs := certificates.CreateUnlockedCertificates(
+    config.Ca_Cert_Path, config.Cert_Path, config.Key_Path, config.Crl_Path,
+    config.Key_Passphrase, cnLog,
   )
 
+  cc := clientConnection.CreateClientConnection(certs, cnLog)
+  fc := federationClient.CreateClient(cc, config.Retry)
+
   ws := webserver.CreateWebServer(
     config.Interface, config.Port, `
 
@@ -84,7 +92,8 @@ Each ConTeXt Nursery in the federation is capable of managing the type
 setting of one or more ConTeXt based (sub)documents in parallel.
 
 `,
-    config.Ca_Cert_Path, config.Cert_Path, config.Key_Path,
+    certs,
+    config.Limits,
     cnLog,
   )
 
@@ -93,27 +102,61 @@ setting of one or more ConTeXt based (sub)documents in parallel.
     "static/images/TeddyBear.ico",
     "/static",
     "static",
+    FSByte,
   )
   cnLog.MayBeError("Could not add static file handlers", err)
+
+  CNNurseries.DescribeNurseryMetrics(ws.Metrics)
   
-  cnActions := CNNurseries.CreateActionsState(config, ws, cc)
+  cnEvents := CNNurseries.CreateCNEvents(config)
+  events.AddEventsInterface(ws, cnEvents)
+
+  cnActions := CNNurseries.CreateActionsState(config, ws, fc, cnEvents)
   action.AddActionInterface(ws, cnActions)
   
-  cnInfoMap := CNNurseries.CreateCNInfoMap(config)
+  cnElection := CNNurseries.CreateCNElection(config, fc)
+  election.AddElectionInterface(ws, cnElection)
+
+  cnInfoMap := CNNurseries.CreateCNInfoMap(config, cnElection, cnEvents)
   discovery.AddDiscoveryInterface(ws, cnInfoMap)
 
-  cnState := CNNurseries.CreateCNState(config, cnInfoMap, ws, cc)
+  cnPlacement := CNNurseries.CreateCNPlacement(config, cnInfoMap, fc, ws.Metrics)
+  action.AddPlacementInterface(ws, cnPlacement)
+
+  cnStore := CNNurseries.CreateFederationStore(config)
+  cnState := CNNurseries.CreateCNState(config, cnInfoMap, cnStore, ws, fc)
+  cnStore.Restore(cnInfoMap, cnState)
   control.AddControlInterface(ws, cnState)
+  ws.AddReadinessCheck("control state", cnState.CheckReady)
+  ws.AddReadinessCheck("certificate revocation list", certs.CheckCRL)
 
   /////////////////////////////////////
   // Start client and webServer threads
 
+  // periodically reload any certificates which have been changed by
+  // a re-run of cnSetup
+  certs.WatchFiles(time.Duration(config.Cert_Check_Interval) * time.Second)
+
+  // elect (or follow) the federation's primary (leader) cnNursery
+  go cnElection.RunElection()
+
   // periodically send out a heart beat message the the federation's
   // primary cnNursery 
-  go CNNurseries.SendPeriodicHeartBeats(config, cnState, cnInfoMap, cc)
+  go CNNurseries.SendPeriodicHeartBeats(
+    config, cnState, cnActions, cnInfoMap, fc, ws.Metrics,
+  )
 
-  // periodically cull Nurseries to which we can no longer connect to
-  go CNNurseries.GrimReaper(config, cnInfoMap, cc)
-  
-  ws.RunWebServer()
+  // periodically persist the federation (so that it survives restarts)
+  go CNNurseries.PersistFederation(config, cnStore, cnInfoMap, cnState)
+  go CNNurseries.RunSchedules(config, cnState)
+
+  // periodically cull Nurseries which have stopped sending heartbeats
+  go CNNurseries.GrimReaper(config, cnInfoMap, ws.Metrics)
+
+  // shutdown gracefully when asked to by systemd, podman or the user
+  ws.ShutdownOnSignals()
+
+  err = ws.RunWebServer()
+  cnLog.MayBeFatal("The webserver stopped unexpectedly", err)
+  cnLog.Logf("cnNursery: %s stopped", config.Name)
 }
@@ -30,6 +30,21 @@ In particular the cnSetup command:
   4. Creates the (YAML) configuration files used by the cnNursery and 
      cnTypeSetting commands. 
 
+  5. Revokes x509 certificates, and publishes the CA's Certificate 
+     Revocation List (CRL). 
+
+  6. Reports on, and renews, the x509 certificates which are about to 
+     expire. 
+
+  7. Keeps a ledger of every x509 certificate issued by the CA (from 
+     which their serial numbers are allocated). 
+
+  8. (Optionally) creates an (online) intermediate CA signed by an 
+     (offline) root CA. 
+
+  9. Validates its configuration (as well as the cnNursery and 
+     cnTypeSetter configuration files it has written). 
+
 The x509 client certificates are meant to be loaded by each user into 
 their web broswer to enable the user to browse the HTML ConTeXt Nursery 
 interfaces. 
@@ -38,6 +53,26 @@ Usage of cnSetup:
   
   cnSetup [-c|-config string] [-createCA] [-s|-show]
 
+  cnSetup [-c|-config string] [-reason string] revoke <name>...
+
+  cnSetup [-c|-config string] status
+
+  cnSetup [-c|-config string] [-rotateKeys] renew [<name>...]
+
+  cnSetup [-c|-config string] list
+
+  cnSetup [-c|-config string] lookup <serial|name|path>...
+
+  cnSetup [-c|-config string] diff
+
+  cnSetup [-c|-config string] [-rotateKeys] intermediate
+
+  cnSetup [-c|-config string] add-nursery|add-user <name>...
+
+  cnSetup [-c|-config string] [-reason string] remove-nursery|remove-user <name>...
+
+  cnSetup [-c|-config string] validate
+
     -c string
       The configuration file to load (default: "nurseries.yaml")
         
@@ -55,6 +90,177 @@ Usage of cnSetup:
     -show
       Show the loaded configuration (default: configuration not listed)
 
+    -reason string
+      The reason recorded for any revocations (default: "")
+
+    -rotateKeys
+      Give renewed certificates new keys (default: keep the existing keys)
+
+    revoke <name>...
+      Revoke the current certificates of the named users and/or 
+      nurseries. 
+
+    status
+      List every issued certificate with its serial number, subject and 
+      days to expiry. 
+
+    renew [<name>...]
+      Reissue the certificates of the named users and/or nurseries, or 
+      (if none are named) of those which expire within renew_within_days 
+      (default 30) days. 
+
+    list
+      List every certificate recorded in the CA's ledger. 
+
+    lookup <serial|name|path>...
+      List the ledger entries of the certificates with the given serial 
+      numbers (decimal, or hexadecimal prefixed with "0x"), common names 
+      or certificate paths. 
+
+    diff
+      Compare the CA's ledger with the configured (and installed) 
+      certificates. 
+
+    intermediate
+      Recreate the intermediate CA (which requires the root CA's files) 
+      and then renew the certificates of every user and nursery. 
+
+    add-nursery <name>...
+    add-user <name>...
+      Create the certificates (and configuration) of the named nurseries 
+      or users (which MUST already be listed in the configuration file) 
+      without regenerating anything else. The configuration files of the 
+      other nurseries and users are only rewritten if they change, and 
+      those which MUST be pushed are reported. 
+
+    remove-nursery <name>...
+    remove-user <name>...
+      Revoke the certificates of the named nurseries or users, remove 
+      them from the configuration file (preserving its comments, although 
+      its blank lines and alignment are normalized), and rewrite (only) 
+      the configuration files of the others which change. 
+
+    validate
+      Report EVERY problem (each at its file:line) in the configuration 
+      file: unknown keys, duplicate nursery (or user) names, hosts used by 
+      more than one nursery, colliding ports, a missing (or multiple) 
+      primary nursery, bad key algorithms, pkcs12 encryptions and 
+      passphrase sources, as well as passphrase files which do not exist. 
+      If there are none, the cnNursery and cnTypeSetter configuration 
+      files already written for each nursery and user are also validated. 
+      Exits with a non-zero status if any problem is found. 
+
+------------------------------------- NATS ROUTES ------------------------------
+
+Each nursery's (and user's) NATS routes are shuffled, so that the 
+nurseries do not all connect to the same nursery first. The shuffle is 
+seeded by the nats_routes_seed (which, if not configured, is created and 
+persisted in the nats_routes_seed_path file, by default 
+"servers/nats-routes-seed"), so the routes keep the same order every time 
+cnSetup is run, and adding (or removing) a nursery only inserts (or 
+removes) its own route. 
+
+A nursery's (cluster) federation routes, used by its cnMessages(NATS) 
+server, connect to the federation_port of each nursery, while the 
+message routes, listed in the nursery's and each user's configuration, 
+connect to the messages_port of each nursery. 
+
+If nats_tls is true, each nursery's cnMessages(NATS) server requires TLS 
+on both its messages and federation ports (using the nursery's 
+certificate, found in the nats_conf_dir, by default "/cnNursery/conf", 
+and the federation's CA). Each client is then authorized by the identity 
+mapped from its certificate: nurseries (by their first host name) may use 
+every subject, while users (by their certificate's subject, which 
+contains their common name) may only use the "artifact.>" subjects. Since 
+the NATS server can not unlock an encrypted key, nats_tls can not be used 
+with a nursery key_passphrase. 
+
+(The NATS server does not check the CRL, so the "remove-user" command 
+SHOULD be used to also remove a revoked user's authorization.) 
+
+------------------------------------- INTERMEDIATE CA ------------------------------
+
+By default the CA is a self-signed (root) CA, whose private key MUST be 
+available every time cnSetup issues a certificate. 
+
+If the certificate_authority is configured with "intermediate: true", 
+then the "-createCA" switch instead creates a self-signed root CA (in the 
+root_dir, by default "ca/<federation>/root") as well as an intermediate CA 
+signed by the root CA. The intermediate CA then signs every nursery and 
+user certificate (as well as the CRL). The intermediate CA's certificate 
+file, as well as each nursery's and user's CA certificate file (and 
+PKCS12 file), contain the whole chain (the intermediate followed by the 
+root CA's certificate). 
+
+Once created, the root_dir can be moved onto (for example) a USB stick, 
+and the root_dir configured to point at it. The root CA is only needed 
+(the USB stick only needs to be mounted) to recreate the intermediate CA, 
+using the "intermediate" command, which then renews every certificate. 
+
+If the intermediate CA can not be loaded, the "-createCA" switch creates 
+a new intermediate CA signed by the existing root CA (if its files can be 
+loaded) or by a new root CA. 
+
+------------------------------------- LEDGER ---------------------------------------
+
+The CA keeps a ledger of every certificate it has issued (by default 
+"ca/<federation>/<federation>-index.txt", in the style of an openssl 
+index.txt file). Serial numbers are allocated (monotonically) from this 
+ledger, so re-ordering the nurseries or users in the configuration never 
+re-uses a serial number, and a certificate with an already recorded 
+serial number is never issued. 
+
+Certificates installed before the ledger was kept are recorded in the 
+ledger on the next run of cnSetup. Revocations (made with the "revoke" 
+command) are also recorded in the ledger. 
+
+The "diff" command reports the configured certificates which are 
+"missing" (not installed) or "unrecorded" (not in the ledger), as well as 
+the valid certificates in the ledger which have been "revoked" (but are 
+still installed), are "unconfigured" (issued to a nursery or user no 
+longer in the configuration) or have been "superseded" (by a renewal). 
+
+Re-creating the CA (using the "-createCA" switch) moves the old ledger 
+(and revocation database) aside (to "*.old" files), since the new CA has 
+not issued any certificates. 
+
+------------------------------------- RENEWAL --------------------------------------
+
+Without a command, cnSetup only creates the certificates which do not 
+already exist. The "status" command flags (with "[RENEW]") the 
+certificates which expire within renew_within_days, which the "renew" 
+command then reissues (signed by the existing CA). Renewed certificates 
+keep their existing keys unless the "-rotateKeys" switch is given. A 
+renewed user's PKCS12 file is regenerated using their existing password, 
+and a renewed nursery's (or user's) configuration files are rewritten. 
+
+Superseded certificates remain valid until they expire (use the "revoke" 
+command to revoke them). The CA's own certificate is not renewed. 
+
+------------------------------------- REVOCATION -----------------------------------
+
+The "revoke" command records each revoked certificate in the CA's 
+revocation database (by default "ca/<federation>/<federation>-revoked.json") 
+and moves the revoked certificate, key (and PKCS12) files aside (to 
+"*.revoked" files). A departed user or retired nursery SHOULD also be 
+removed from the configuration (as the "remove-nursery" and "remove-user" 
+commands do), otherwise the next run of cnSetup will issue them a new 
+certificate. 
+
+Every run of cnSetup (re)publishes the CA's Certificate Revocation List 
+(CRL), signed by the CA, to "ca/<federation>/<federation>-crl.pem" as well 
+as to each nursery's crl_path (by default next to its certificates). Each 
+nursery's configuration points at its crl_path, and each cnNursery 
+reloads its CRL whenever it changes. 
+
+The CRL is valid for crl_valid_days (default 30) days, so cnSetup SHOULD 
+be rerun (and the CRL redistributed) well before then. 
+
+A CA created before cnSetup could revoke certificates can not sign a CRL 
+and MUST be recreated (using the "-createCA" switch, after removing the 
+old CA files) before its certificates can be revoked. Until then the 
+nursery configurations do not point at a CRL.
+
   
 ------------------------------------- SECURITY -------------------------------------
 
@@ -72,10 +278,32 @@ command.
 
 HOWEVER, this security is ONLY AS SECURE AS YOUR WEAKEST USER.
 
-The CA, and Server x509 keys ARE NOT PASSWORD encrypted. Your security 
-DEPENDS upon the security of your file system. In particular any one with 
-access to the CA key can create their own client/server x509 certificates 
-and then interact with the ConTeXt Nursery federation. 
+The x509 keys can use the "rsa" (the default), "ecdsa-p256", 
+"ecdsa-p384" or "ed25519" key_algorithm, which can be configured for the 
+whole federation, the CA, and each nursery and user. RSA keys are written 
+as "RSA PRIVATE KEY", ECDSA keys as "EC PRIVATE KEY", and Ed25519 keys as 
+(PKCS#8) "PRIVATE KEY" PEM blocks. Since browsers do not (yet) understand 
+Ed25519 keys, users can not use them. 
+
+By default the CA, and Server x509 keys ARE NOT PASSWORD encrypted. Your 
+security then DEPENDS upon the security of your file system. In particular 
+any one with access to the CA key can create their own client/server x509 
+certificates and then interact with the ConTeXt Nursery federation. 
+
+The CA's key (and the root CA's key) can be encrypted (as a PKCS#8 
+"ENCRYPTED PRIVATE KEY" using AES-256-CBC with PBKDF2) by giving the 
+certificate_authority a key_passphrase, which is the source of the 
+passphrase: 
+
+    prompt        read (without echo) from the terminal 
+    env:<NAME>    read from the environment variable NAME 
+    file:<PATH>   read from the first line of the file PATH 
+
+Each nursery's key can (similarly) be encrypted by giving the nursery (or 
+the nursery_defaults) a key_passphrase. This key_passphrase source is 
+copied into the nursery's cnNursery configuration, so that the cnNursery 
+can unlock its key when it starts (the passphrase itself is never written 
+by cnSetup). 
 
 It is assumed that the CA as well as the cnNursery certificates and 
 configuration are under the control of a ConTeXt Nursery administrator who 
@@ -86,6 +314,12 @@ Each user's PKCS12 file (which is loaded into each user's web browser) IS
 password encrypted. The passwords for each user are contained in the users 
 password file typically loacted in the "user/passwords" file. 
 
+Each user's PKCS12 file is generated by cnSetup itself (no openssl command 
+is required) using the "modern" encryption (AES-256 with PBKDF2 and 
+SHA-256). Users whose (older) browsers can not load such files may be 
+given the "legacy" encryption (3DES with SHA-1) by setting their (or the 
+user_defaults') pkcs12_encryption to "legacy". 
+
 */
 package main 
 
@@ -19,12 +19,13 @@ package CNSetup
 
 import (
   "bytes"
+  "crypto"
   "crypto/rand"
-  "crypto/rsa"
   "crypto/x509"
   "crypto/x509/pkix"
   "encoding/pem"
   "fmt"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
   "github.com/diSimplex/ConTeXtNursery/logger"
   "io/ioutil"
   "math/big"
@@ -33,16 +34,20 @@ import (
 )
 
 // CAType contains a Certificate Authority's x509 certificate as well as 
-// public/private RSA keys, as well as auxilary fields to control where 
+// public/private (RSA, ECDSA or Ed25519) keys, as well as auxilary fields to control where 
 // external PEM files can be found or stored. 
 //
+// When Intermediate is true, this CA is an (online) intermediate CA whose 
+// certificate is signed by an (offline) root CA, whose certificate and key 
+// files are kept in the Root_Dir (which can be on a removable USB stick). 
+// The root CA is only needed to (re)create the intermediate CA. 
+//
 // CONSTRAINTS: Once created, the values in this structure SHOULD only be 
 // altered by structure methods. 
 //
 type  CAType struct {
   // Standard x509 fields
   //
-  Serial_Number   uint
   Organization    string
   Federation_Name string
   Country         string
@@ -61,16 +66,32 @@ type  CAType struct {
  
   // Auxilary fields required to write CA files
   //
-  Dir            string
-  Cert_File_Name string
-  Key_File_Name  string
+  Dir               string
+  Cert_File_Name    string
+  Key_File_Name     string
+  Revoked_File_Name string
+  Crl_File_Name     string
+  Crl_Valid_Days    uint
+  Index_File_Name   string
+
+  // Auxilary fields required to use an (offline) root CA
+  //
+  Intermediate        bool
+  Root_Dir            string
+  Root_Cert_File_Name string
+  Root_Key_File_Name  string
   
   // Auxilary fields required to create, contain and manage access 
   // to the actual certificates and keys. 
   //
+  Key_Algorithm  string
   Key_Size       uint
+  Key_Passphrase string
   Cert          *x509.Certificate
-  PrivateKey    *rsa.PrivateKey
+  Chain       []*x509.Certificate
+  PrivateKey     crypto.Signer
+  root          *CAType
+  Ledger        *CertificateLedger
   CSLog         *logger.LoggerType
 }
 
@@ -81,10 +102,6 @@ type  CAType struct {
 // CALLED BY: LoadConfiguration ONLY;
 //
 func (ca *CAType) NormalizeCA(config *ConfigType) {
-  // Make sure the Serial_Number is constantly increasing...
-  //
-  if ca.Serial_Number == 0 { ca.Serial_Number = uint(time.Now().Unix()) }
-
   if config.Federation_Name != "" {
     ca.Federation_Name = config.Federation_Name
     
@@ -101,17 +118,65 @@ func (ca *CAType) NormalizeCA(config *ConfigType) {
        ca.Dir + "/" +
        config.Federation_Name + "-ca-key.pem"
     }
+    if ca.Revoked_File_Name == "" {
+      ca.Revoked_File_Name =
+        ca.Dir + "/" +
+        config.Federation_Name + "-revoked.json"
+    }
+    if ca.Crl_File_Name == "" {
+      ca.Crl_File_Name =
+        ca.Dir + "/" +
+        config.Federation_Name + "-crl.pem"
+    }
+    if ca.Index_File_Name == "" {
+      ca.Index_File_Name =
+        ca.Dir + "/" +
+        config.Federation_Name + "-index.txt"
+    }
+    if ca.Root_Dir == "" {
+      ca.Root_Dir = ca.Dir + "/root"
+    }
+    if ca.Root_Cert_File_Name == "" {
+      ca.Root_Cert_File_Name =
+        ca.Root_Dir + "/" +
+        config.Federation_Name + "-root-ca-crt.pem"
+    }
+    if ca.Root_Key_File_Name == "" {
+      ca.Root_Key_File_Name =
+        ca.Root_Dir + "/" +
+        config.Federation_Name + "-root-ca-key.pem"
+    }
   } else {
     config.CSLog.Logf("You MUST specify a Federation Name")
     os.Exit(-1)
   }
   
+  if ca.Crl_Valid_Days == 0 { ca.Crl_Valid_Days = 30 }
+
   if 1023 < config.Key_Size {
     if ca.Key_Size == 0 { ca.Key_Size = config.Key_Size }
   } else {
     config.CSLog.Logf("You MUST specify a Key_Size of at least 1024")
     os.Exit(-1)
   }
+
+  if ca.Key_Passphrase != "" && !certificates.IsPassphraseSource(ca.Key_Passphrase) {
+    config.CSLog.Logf(
+      "The key_passphrase of the certificate authority MUST be [%s], [%s<NAME>] or [%s<PATH>]",
+      certificates.PromptPassphrase,
+      certificates.EnvPassphrasePrefix, certificates.FilePassphrasePrefix,
+    )
+    os.Exit(-1)
+  }
+
+  if ca.Key_Algorithm == "" { ca.Key_Algorithm = config.Key_Algorithm }
+  if !IsKeyAlgorithm(ca.Key_Algorithm) {
+    config.CSLog.Logf(
+      "The key_algorithm of the certificate authority MUST be one of [%s], [%s], [%s] or [%s]",
+      RsaKey, EcdsaP256Key, EcdsaP384Key, Ed25519Key,
+    )
+    os.Exit(-1)
+  }
 }
 
 // Create the Certificate Authority Structure (only) from the details in 
@@ -120,11 +185,45 @@ func (ca *CAType) NormalizeCA(config *ConfigType) {
 // CREATES ca;
 //
 func CreateCA(config *ConfigType) *CAType {
-  newCA       := config.Certificate_Authority
-  newCA.CSLog  = config.CSLog
+  newCA        := config.Certificate_Authority
+  newCA.Ledger  = CreateCertificateLedger(newCA.Index_File_Name)
+  newCA.CSLog   = config.CSLog
   return &newCA
 }
 
+// Returns the (offline) root CA of an intermediate CA (without its 
+// certificate or keys, which must be loaded or created). 
+//
+// The root CA shares the intermediate CA's ledger.
+//
+// READS ca;
+//
+func (ca *CAType) RootCA() *CAType {
+  root                := *ca
+  root.Intermediate    = false
+  root.Dir             = ca.Root_Dir
+  root.Cert_File_Name  = ca.Root_Cert_File_Name
+  root.Key_File_Name   = ca.Root_Key_File_Name
+  root.Common_Name     = ca.Common_Name + " Root"
+  root.Cert            = nil
+  root.Chain           = nil
+  root.PrivateKey      = nil
+  root.root            = nil
+  return &root
+}
+
+// Returns the CA's certificate followed by the rest of its chain (the 
+// root CA's certificate when this CA is an intermediate CA). 
+//
+// These are the certificates shipped in each Nursery's and User's CA 
+// certificate files.
+//
+// READS ca;
+//
+func (ca *CAType) Certificates() []*x509.Certificate {
+  return append([]*x509.Certificate{ ca.Cert }, ca.Chain...)
+}
+
 // Cerate a new "base" x509 Certificate based upon the CA's configured 
 // certificate information.
 //
@@ -132,22 +231,23 @@ func CreateCA(config *ConfigType) *CAType {
 // to be filed in by the CA, Nursery, or User certificate code 
 // respectively.
 //
-// It is CRITICAL that we use DIFFERENT serial numbers for each of the: 
-//  - Certificate Authority:  1,
-//  - Clien/Server:           (1<<5) + nurseryNum, and
-//  - User:                   (2<<5) + userNum
-// certificates. We do this using the "serialNumModifier" parameter. (This 
-// assumes a maximum of 2^5 - 1 = 31 nurseries or 2^6 - 1 = 63 users) 
+// It is CRITICAL that we use DIFFERENT serial numbers for every 
+// certificate. So, unless an explicit serialNumber is given, the serial 
+// number is left unset, to be allocated by the CA's ledger when the 
+// certificate is signed. An explicit serialNumber (a nursery's or user's 
+// non-zero Serial_Number) can only be issued once (see 
+// CertificateLedger.Issue). 
 //
 // READS ca;
 //
 func (ca *CAType) NewBaseCertificate(
-  commonName string,
-  serialNumModifier uint,
+  commonName   string,
+  serialNumber uint,
 ) *x509.Certificate {  
+  var certSerial *big.Int
+  if serialNumber != 0 { certSerial = new(big.Int).SetUint64(uint64(serialNumber)) }
   return &x509.Certificate {
-    SerialNumber: big.NewInt(int64(serialNumModifier)<<32 | int64(ca.Serial_Number)),
-    SignatureAlgorithm: x509.SHA512WithRSA,
+    SerialNumber: certSerial,
     Subject: pkix.Name {
       Organization:       []string{ca.Organization},
       OrganizationalUnit: []string{ca.Federation_Name},
@@ -166,38 +266,46 @@ func (ca *CAType) NewBaseCertificate(
   }
 }
 
-// Create a new RSA Public/Private Key pair.
+// Creates a new signed x509 Certificate returned as as "raw" ([]byte) 
+// certificate using an x509 Certificate and its associated (RSA, ECDSA 
+// or Ed25519) public key. 
 //
-// IGNORES ca;
+// The certificate is signed using the signature algorithm which matches 
+// the CA's own private key. 
 //
-func (ca *CAType) NewRsaKeys(keySize uint) (*rsa.PrivateKey, error) {
-  return rsa.GenerateKey(rand.Reader, int(keySize))
-}
-
-// Creates a new signed x509 Certificate returned as as "raw" ([]byte) 
-// certificate using an x509 Certificate and its associated RSA public 
-// key. 
+// The certificate (which will be written to certPath) is issued through 
+// the CA's ledger, which allocates its serial number (if it has none) and 
+// refuses any serial number which has already been issued. 
 //
 // READS ca;
+// ALTERS ca.Ledger;
 //
 func (ca *CAType) SignCertificate(
   certToSign     *x509.Certificate,
-  certPublicKey  *rsa.PublicKey,
+  certPublicKey   crypto.PublicKey,
+  certPath        string,
 ) ([]byte, error) {
-//  key, err := certPrivateKey.(crypto.Signer)
-//  if err != nil {
-//    return nil, fmt.Errorf("Could not type cast private key to crypto.Signer: %w", err)
-//  }
-  return x509.CreateCertificate(
-    rand.Reader,
-    certToSign, ca.Cert,
-    certPublicKey,
-    ca.PrivateKey,
+  certToSign.SignatureAlgorithm = SignatureAlgorithmFor(ca.PrivateKey)
+  return ca.Ledger.Issue(
+    certToSign,
+    certPath,
+    func(template *x509.Certificate) ([]byte, error) {
+      return x509.CreateCertificate(
+        rand.Reader,
+        template, ca.Cert,
+        certPublicKey,
+        ca.PrivateKey,
+      )
+    },
   )
 }
 
 // Create a new Certificate Authority by creating a totally new 
-// self-signed x509 certificate and associated public/private RSA keys. 
+// self-signed x509 certificate and associated public/private keys (of the 
+// CA's Key_Algorithm). 
+//
+// An intermediate CA is instead created by CreateNewIntermediateCA 
+// (which creates a new root CA if the existing one can not be loaded). 
 //
 // This code has been inspired by: Shane Utt's excellent article:
 //   https://shaneutt.com/blog/golang-ca-and-signed-cert-go/
@@ -206,11 +314,21 @@ func (ca *CAType) SignCertificate(
 // NOT THREAD-SAFE;
 //
 func (ca *CAType) CreateNewCA() error {
+  if ca.Intermediate { return ca.CreateNewIntermediateCA(true) }
+
   fmt.Printf("\nCreating a new Certificate Authority for [%s]\n", ca.Federation_Name)
+
+  // A new CA starts a new ledger (and revocation database), the old ones 
+  // are kept as *.old files 
+  //
+  for _, aPath := range []string{ ca.Index_File_Name, ca.Revoked_File_Name } {
+    if _, err := os.Stat(aPath) ; err == nil { os.Rename(aPath, aPath+".old") }
+  }
+  ca.Ledger = CreateCertificateLedger(ca.Index_File_Name)
   
   ca.Cert = ca.NewBaseCertificate(
     "ConTeXt Nursery "+ca.Common_Name,
-    1,
+    0,
   )
   //
   // Apply Certificate Authority only modifications
@@ -220,36 +338,131 @@ func (ca *CAType) CreateNewCA() error {
 //      x509.ExtKeyUsageClientAuth,
 //      x509.ExtKeyUsageServerAuth,
 //    }
-  ca.Cert.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign 
+  ca.Cert.KeyUsage = x509.KeyUsageDigitalSignature |
+    x509.KeyUsageCertSign |
+    x509.KeyUsageCRLSign
   ca.Cert.BasicConstraintsValid =true
   
-  // Create a new RSA public/private key pair
+  // Create a new public/private key pair
   //
   var err error
-  ca.PrivateKey, err = ca.NewRsaKeys(ca.Key_Size)
+  ca.PrivateKey, err = NewPrivateKey(ca.Key_Algorithm, ca.Key_Size)
   if err != nil {
-    return fmt.Errorf("could not generate rsa key for CA: %w", err)
+    return fmt.Errorf("could not generate %s key for CA: %w", ca.Key_Algorithm, err)
   }
   
   // create a self-signed certificate using our own ca.Cert and 
   // ca.PrivateKey 
   //
-  ca.Cert.Raw, err = ca.SignCertificate(ca.Cert, &ca.PrivateKey.PublicKey)
+  caBytes, err := ca.SignCertificate(ca.Cert, ca.PrivateKey.Public(), ca.Cert_File_Name)
   if err != nil {
     return fmt.Errorf("could not create the CA certificate: %w", err)
   }
 
+  // (re)parse the signed certificate to pick up the fields (such as the
+  // SubjectKeyId) filled in while signing it
+  //
+  ca.Cert, err = x509.ParseCertificate(caBytes)
+  if err != nil {
+    return fmt.Errorf("could not parse the new CA certificate: %w", err)
+  }
+  ca.Chain = nil
+
+  return nil
+}
+
+// Create a new intermediate Certificate Authority, with a totally new x509 
+// certificate and associated public/private keys signed by the (offline) 
+// root CA. 
+//
+// The root CA is loaded from its files, which MUST be available. If they 
+// can not be loaded, and createRoot is true, then a new root CA is 
+// created (and will be written by WriteCAFiles). 
+//
+// ALTERS ca;
+// NOT THREAD-SAFE;
+//
+func (ca *CAType) CreateNewIntermediateCA(createRoot bool) error {
+  if !ca.Intermediate {
+    return fmt.Errorf("the [%s] CA is not configured as an intermediate CA", ca.Federation_Name)
+  }
+
+  root := ca.RootCA()
+  err  := root.LoadCAFromFiles()
+  if err != nil {
+    if !createRoot {
+      return fmt.Errorf("could not load the root CA (is the root_dir [%s] available?): %w", ca.Root_Dir, err)
+    }
+    err = root.CreateNewCA()
+    if err != nil {
+      return fmt.Errorf("could not create the root CA: %w", err)
+    }
+    ca.Ledger = root.Ledger // (a new root CA starts a new ledger)
+    ca.root   = root        // (the new root CA's files are still to be written)
+  }
+
+  fmt.Printf("\nCreating a new intermediate Certificate Authority for [%s]\n", ca.Federation_Name)
+
+  ca.Cert = ca.NewBaseCertificate(
+    "ConTeXt Nursery "+ca.Common_Name,
+    0,
+  )
+  ca.Cert.IsCA = true
+  ca.Cert.KeyUsage = x509.KeyUsageDigitalSignature |
+    x509.KeyUsageCertSign |
+    x509.KeyUsageCRLSign
+  ca.Cert.BasicConstraintsValid = true
+  ca.Cert.MaxPathLenZero        = true // (only the root CA can sign CAs)
+  if root.Cert.NotAfter.Before(ca.Cert.NotAfter) {
+    ca.Cert.NotAfter = root.Cert.NotAfter
+  }
+
+  ca.PrivateKey, err = NewPrivateKey(ca.Key_Algorithm, ca.Key_Size)
+  if err != nil {
+    return fmt.Errorf("could not generate %s key for the intermediate CA: %w", ca.Key_Algorithm, err)
+  }
+
+  caBytes, err := root.SignCertificate(ca.Cert, ca.PrivateKey.Public(), ca.Cert_File_Name)
+  if err != nil {
+    return fmt.Errorf("could not create the intermediate CA certificate: %w", err)
+  }
+  ca.Cert, err = x509.ParseCertificate(caBytes)
+  if err != nil {
+    return fmt.Errorf("could not parse the new intermediate CA certificate: %w", err)
+  }
+  ca.Chain = root.Certificates()
+
   return nil
 }
 
-// Write the Certificate Authority's x509 certificate and RSA keys to files
+// Returns the passphrase (read from the CA's Key_Passphrase source) used 
+// to encrypt the CA's private key (or nil if the key is not encrypted). 
+//
+// READS ca;
+//
+func (ca *CAType) KeyPassphrase() ([]byte, error) {
+  return KeyPassphrase(ca.Key_Passphrase, "the CA key ["+ca.Key_File_Name+"]")
+}
+
+// Write the Certificate Authority's x509 certificate and keys to files
 // on the disk. 
 //
 // READS ca;
 //
 func (ca *CAType) WriteCAFiles(config *ConfigType) error {
-  caSubject := "Subject: ConTeXt Nursery " + config.Federation_Name + " Certificate Authority\n"
-  caDate    := "Date:    "+time.Now().String()+"\n"
+  if ca.root != nil {
+    err := ca.root.WriteCAFiles(config)
+    if err != nil { return err }
+  }
+
+  caKind := " Certificate Authority\n"
+  if ca.Intermediate { caKind = " Intermediate Certificate Authority\n" }
+  if ca.Cert_File_Name == ca.Root_Cert_File_Name {
+    caKind = " Root Certificate Authority\n"
+  }
+  caSubject   := "Subject: ConTeXt Nursery " + config.Federation_Name + caKind
+  rootSubject := "Subject: ConTeXt Nursery " + config.Federation_Name + " Root Certificate Authority\n"
+  caDate      := "Date:    "+time.Now().String()+"\n"
 
   os.MkdirAll(ca.Dir, 0755)
 
@@ -261,23 +474,40 @@ func (ca *CAType) WriteCAFiles(config *ConfigType) error {
     Type:  "CERTIFICATE",
     Bytes: ca.Cert.Raw,
   })
+  //
+  // add the (root CA's) chain
+  //
+  for _, aCert := range ca.Chain {
+    caPEM.WriteString("\n")
+    caPEM.WriteString(rootSubject)
+    caPEM.WriteString(caDate)
+    pem.Encode(caPEM, &pem.Block {
+      Type:  "CERTIFICATE",
+      Bytes: aCert.Raw,
+    })
+  }
   err := ioutil.WriteFile(ca.Cert_File_Name, caPEM.Bytes(), 0644)
   if err != nil {
     return fmt.Errorf("could not write the certificateAuthority.crt file: %w", err)
   }
   
-  // NOTE this private key is left UN-ENCRYPTED on the file system!
-  // SO you need to ensure it is not readable by anyone other than the
-  // user who needs to run the cnSetup!
+  // NOTE unless a key_passphrase is configured, this private key is left 
+  // UN-ENCRYPTED on the file system! SO you need to ensure it is not 
+  // readable by anyone other than the user who needs to run the cnSetup!
   //
+  passphrase, err := ca.KeyPassphrase()
+  if err != nil {
+    return fmt.Errorf("could not read the certificateAuthority.key passphrase: %w", err)
+  }
+  caKeyBlock, err := PrivateKeyPEMBlock(ca.PrivateKey, passphrase)
+  if err != nil {
+    return fmt.Errorf("could not encode the certificateAuthority.key: %w", err)
+  }
   caPrivateKeyPEM := new(bytes.Buffer)
   caPrivateKeyPEM.WriteString("\n")
   caPrivateKeyPEM.WriteString(caSubject)
   caPrivateKeyPEM.WriteString(caDate)
-  pem.Encode(caPrivateKeyPEM, &pem.Block {
-    Type: "RSA PRIVATE KEY",
-    Bytes: x509.MarshalPKCS1PrivateKey(ca.PrivateKey),
-  })
+  pem.Encode(caPrivateKeyPEM, caKeyBlock)
   err = ioutil.WriteFile(ca.Key_File_Name, caPrivateKeyPEM.Bytes(), 0600)
   if err != nil {
     return fmt.Errorf("could not write the certificateAuthority.key file: %w", err)
@@ -286,26 +516,35 @@ func (ca *CAType) WriteCAFiles(config *ConfigType) error {
   return nil
 }
 
+// Returns true if the Certificate Authority's certificate allows it to 
+// sign Certificate Revocation Lists. 
+//
+// (CAs created before cnSetup could revoke certificates can not, and 
+// MUST be recreated before their certificates can be revoked.) 
+//
+// READS ca;
+//
+func (ca *CAType) CanSignCRLs() bool {
+  return ca.Cert != nil && ca.Cert.KeyUsage&x509.KeyUsageCRLSign != 0
+}
+
 // Attempt to load an existing Certificate Authority from PEM files 
-// containing x509 certificates and public/private RSA keys. 
+// containing x509 certificates and public/private (RSA, ECDSA or Ed25519) 
+// keys. 
+//
+// Any certificates following the CA's own certificate are its chain (the 
+// root CA's certificate when this CA is an intermediate CA). 
 //
 // ALTERS ca;
 // NOT THREAD-SAFE;
 //
 func (ca *CAType) LoadCAFromFiles() error {
-  caCertBytes, err := ioutil.ReadFile(ca.Cert_File_Name)
+  lcaCerts, err := certificates.LoadCertificatesFromFile(ca.Cert_File_Name)
   if err != nil {
     return fmt.Errorf("could not load the certificate authority's *.crt file: %w", err)
   }
-
-  caCertPEM, _ /*restCaCertBytes*/ := pem.Decode(caCertBytes)
-  if caCertPEM == nil || caCertPEM.Type != "CERTIFICATE" {
-    return fmt.Errorf("could not locate the certificate authority's CERTIFICATE block: %w", err)
-  }
-
-  lcaCert, err := x509.ParseCertificate(caCertPEM.Bytes)
-  if err != nil {
-    return fmt.Errorf("could not parse the certificate authority's certificate: %w", err)
+  if ca.Intermediate && len(lcaCerts) < 2 {
+    return fmt.Errorf("the intermediate certificate authority's *.crt file does not contain its root CA")
   }
 
   caKeyBytes,  err  := ioutil.ReadFile(ca.Key_File_Name)
@@ -314,18 +553,26 @@ func (ca *CAType) LoadCAFromFiles() error {
   }
 
   caKeyPEM, _ /*restCaKeyBytes*/ := pem.Decode(caKeyBytes)
-  if caKeyPEM == nil || caKeyPEM.Type != "RSA PRIVATE KEY" {
-    return fmt.Errorf("could not locate the certificate authority's RSA PRIVATE KEY block: %w", err)
+  if caKeyPEM == nil {
+    return fmt.Errorf("could not locate the certificate authority's PRIVATE KEY block")
   }
 
-  lcaPrivateKey, err := x509.ParsePKCS1PrivateKey(caKeyPEM.Bytes)
+  passphrase := []byte(nil)
+  if caKeyPEM.Type == certificates.EncryptedKeyType {
+    passphrase, err = ca.KeyPassphrase()
+    if err != nil {
+      return fmt.Errorf("could not read the certificate authority's key passphrase: %w", err)
+    }
+  }
+  lcaPrivateKey, err := ParsePrivateKeyPEMBlock(caKeyPEM, passphrase)
   if err != nil {
-    return fmt.Errorf("could not parse the certificate authority's private key: 5w", err)
+    return fmt.Errorf("could not parse the certificate authority's private key: %w", err)
   }
 
   // If we managed to get this far... both the cert and key are OK...
   // so store the local copies in the global variables...
-  ca.Cert       = lcaCert
+  ca.Cert       = lcaCerts[0]
+  ca.Chain      = lcaCerts[1:]
   ca.PrivateKey = lcaPrivateKey
   
   return nil
@@ -0,0 +1,98 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "crypto/x509"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "os"
+  "testing"
+)
+
+// Test creating an intermediate CA (signed by an offline root CA), whose
+// chain is shipped to the nurseries, and recreating it once the root CA
+// is (temporarily) available again.
+//
+func TestIntermediateCA(t *testing.T) {
+  dir := t.TempDir()
+  config := CreateConfiguration(logger.CreateLogger("cnSetupTest"))
+  config.Federation_Name = "test"
+  config.Key_Algorithm   = EcdsaP256Key
+  config.Key_Size        = 1024
+  config.Certificate_Authority.Dir          = dir+"/ca"
+  config.Certificate_Authority.Root_Dir     = dir+"/usb"
+  config.Certificate_Authority.Intermediate = true
+  config.Certificate_Authority.Valid_For.Years = 1
+  config.Certificate_Authority.NormalizeCA(config)
+  config.Nurseries = []NurseryType{ { Host: "plato01", Cert_Dir: dir+"/servers/plato01" } }
+  config.Nurseries[0].NormalizeConfig(0, &NurseryDefaults, config)
+  plato01 := &config.Nurseries[0]
+
+  ca := CreateCA(config)
+  assert.Error(t, ca.CreateNewIntermediateCA(false)) // (no root CA yet)
+  assert.NoError(t, ca.CreateNewCA())
+  assert.NoError(t, ca.WriteCAFiles(config))
+  assert.Len(t, ca.Chain, 1)
+  root := ca.Chain[0]
+  assert.NoError(t, ca.Cert.CheckSignatureFrom(root))
+  assert.True(t, ca.Cert.MaxPathLenZero)
+  assert.False(t, ca.Cert.NotAfter.After(root.NotAfter))
+  _, err := os.Stat(config.Certificate_Authority.Root_Key_File_Name)
+  assert.NoError(t, err)
+
+  // the nursery's CA file ships the whole chain, against which its own
+  // certificate verifies (using only the root CA as the trust anchor)
+  assert.NoError(t, plato01.CreateNurseryCertificateToFiles(0, ca, config.Federation_Name))
+  nurseryCerts := certificates.CreateCertificates(
+    plato01.Ca_Cert_Path, plato01.Cert_Path, plato01.Key_Path, "", config.CSLog,
+  )
+  assert.Len(t, nurseryCerts.CaCerts, 2)
+  chain, err := certificates.LoadCertificatesFromFile(plato01.Cert_Path)
+  assert.NoError(t, err)
+  assert.Len(t, chain, 3)
+  roots         := x509.NewCertPool()
+  intermediates := x509.NewCertPool()
+  roots.AddCert(root)
+  intermediates.AddCert(chain[1])
+  _, err = chain[0].Verify(x509.VerifyOptions{
+    Roots: roots, Intermediates: intermediates, DNSName: "plato01",
+  })
+  assert.NoError(t, err)
+
+  // the intermediate CA (and its chain) is reloaded without the root CA
+  assert.NoError(t, os.Rename(dir+"/usb", dir+"/offline"))
+  reloaded := CreateCA(config)
+  assert.NoError(t, reloaded.Ledger.Load())
+  assert.NoError(t, reloaded.LoadCAFromFiles())
+  assert.Equal(t, ca.Cert.Raw, reloaded.Cert.Raw)
+  assert.Equal(t, root.Raw, reloaded.Chain[0].Raw)
+  assert.True(t, reloaded.CanSignCRLs())
+  assert.Error(t, reloaded.CreateNewIntermediateCA(false))
+
+  // ... while recreating the intermediate CA requires the root CA
+  assert.NoError(t, os.Rename(dir+"/offline", dir+"/usb"))
+  assert.NoError(t, reloaded.CreateNewIntermediateCA(false))
+  assert.NoError(t, reloaded.WriteCAFiles(config))
+  assert.NotEqual(t, ca.Cert.Raw, reloaded.Cert.Raw)
+  assert.Equal(t, root.Raw, reloaded.Chain[0].Raw)
+  assert.Len(t, reloaded.Ledger.List(), 4)
+  // (only the old intermediate CA's certificate is superseded, the root 
+  // CA's certificate is kept offline)
+  diffs := reloaded.Ledger.Diff(config, reloaded.Cert.NotBefore)
+  assert.Len(t, diffs, 1)
+  assert.Contains(t, diffs[0], "superseded:   ["+reloaded.Cert_File_Name+"]")
+}
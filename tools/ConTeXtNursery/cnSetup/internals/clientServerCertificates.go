@@ -16,6 +16,7 @@ package CNSetup
 
 import (
   "bytes"
+  "crypto"
   "crypto/x509"
   "encoding/pem"
   "fmt"
@@ -26,8 +27,8 @@ import (
   "time"
 )
 
-// Create a Server's' x509 Certificate and associated public/private RSA 
-// keys. The Server certificate and keys are written to disk in the PEM 
+// Create a Server's' x509 Certificate and associated public/private keys 
+// (of the nursery's Key_Algorithm). The Server certificate and keys are written to disk in the PEM 
 // format. 
 //
 // This code has been inspired by: Shane Utt's excellent article:
@@ -57,17 +58,62 @@ func (nursery *NurseryType) CreateNurseryCertificateToFiles(
   }
 
   fmt.Printf("\n\nCreating certificate files for the [%s] Nursery\n", nursery.Name)
-  
+
+  nPrivateKey, err := NewPrivateKey(nursery.Key_Algorithm, nursery.Key_Size)
+  if err != nil {
+    return fmt.Errorf("could not generate "+nursery.Key_Algorithm+" key for ["+nursery.Name+"] Nursery: %w", err)
+  }
+  return nursery.WriteNurseryCertificateToFiles(ca, federationName, nPrivateKey)
+}
+
+// Renew a Server's x509 Certificate, either keeping its existing private 
+// key or (if rotateKey is true) rotating it. The new Server 
+// certificate (and keys) are written to disk in the PEM format. 
+//
+// READS ca;
+// READS nursery;
+//
+func (nursery *NurseryType) RenewNurseryCertificateToFiles(
+  ca            *CAType,
+  federationName string,
+  rotateKey      bool,
+) error {
+  fmt.Printf("\n\nRenewing certificate files for the [%s] Nursery\n", nursery.Name)
+
+  passphrase, err := nursery.KeyPassphrase()
+  if err != nil {
+    return fmt.Errorf("could not read the key passphrase for ["+nursery.Name+"] Nursery: %w", err)
+  }
+  nPrivateKey, err := ca.RenewalKey(
+    nursery.Key_Path, passphrase, nursery.Key_Algorithm, nursery.Key_Size, rotateKey,
+  )
+  if err != nil {
+    return fmt.Errorf("could not renew the ["+nursery.Name+"] Nursery: %w", err)
+  }
+  return nursery.WriteNurseryCertificateToFiles(ca, federationName, nPrivateKey)
+}
+
+// Sign a new Server's x509 Certificate for the given private key, and 
+// write the CA certificate, the Server certificate (chain) and the key to 
+// disk in the PEM format. 
+//
+// READS ca;
+// READS nursery;
+//
+func (nursery *NurseryType) WriteNurseryCertificateToFiles(
+  ca            *CAType,
+  federationName string,
+  nPrivateKey    crypto.Signer,
+) error {
+  os.MkdirAll(nursery.Cert_Dir, 0755)
+
   nCert := ca.NewBaseCertificate(nursery.Name, nursery.Serial_Number)
   nCert.ExtKeyUsage = []x509.ExtKeyUsage{
       x509.ExtKeyUsageClientAuth,
       x509.ExtKeyUsageServerAuth,
     }
   nCert.SubjectKeyId = []byte{1,2,3,4,6}
-  nCert.KeyUsage = x509.KeyUsageDigitalSignature |
-      x509.KeyUsageKeyEncipherment |
-      x509.KeyUsageKeyAgreement |
-      x509.KeyUsageDataEncipherment
+  nCert.KeyUsage = KeyUsageFor(nPrivateKey)
 
   // Add the DNSNames and IPAddresses
   for _, aHost := range nursery.Hosts {
@@ -79,12 +125,7 @@ func (nursery *NurseryType) CreateNurseryCertificateToFiles(
     }
   }
 
-  nPrivateKey, err := ca.NewRsaKeys(nursery.Key_Size)
-  if err != nil {
-    return fmt.Errorf("could not generate rsa key for ["+nursery.Name+"] Nursery: %w", err)
-  }
-
-  nBytes, err := ca.SignCertificate(nCert, &nPrivateKey.PublicKey)
+  nBytes, err := ca.SignCertificate(nCert, nPrivateKey.Public(), nursery.Cert_Path)
   if err != nil {
     return fmt.Errorf("could not create the certificate for ["+nursery.Name+"] Nursery: %w", err)
   }
@@ -92,14 +133,18 @@ func (nursery *NurseryType) CreateNurseryCertificateToFiles(
   nSubject := "Subject: ConTeXt Nursery " + federationName + " Server Certificate for ["+nursery.Name+"] Nursery"
   nDate    := "Date:    "+time.Now().String()+"\n"
 
+  // (the CA's certificates include any root CA's certificate)
+  //
   caPEM := new(bytes.Buffer)
-  caPEM.WriteString("\n")
-  caPEM.WriteString(nSubject + " (CA)\n")
-  caPEM.WriteString(nDate)
-  pem.Encode(caPEM, &pem.Block {
-    Type:  "CERTIFICATE",
-    Bytes: ca.Cert.Raw,
-  })
+  for _, aCaCert := range ca.Certificates() {
+    caPEM.WriteString("\n")
+    caPEM.WriteString(nSubject + " (CA)\n")
+    caPEM.WriteString(nDate)
+    pem.Encode(caPEM, &pem.Block {
+      Type:  "CERTIFICATE",
+      Bytes: aCaCert.Raw,
+    })
+  }
   os.MkdirAll(filepath.Dir(nursery.Ca_Cert_Path), 0755)
   err = ioutil.WriteFile(nursery.Ca_Cert_Path, caPEM.Bytes(), 0644)
   if err != nil {
@@ -115,33 +160,40 @@ func (nursery *NurseryType) CreateNurseryCertificateToFiles(
     Bytes: nBytes,
   })
   //
-  // add the CA certificate to the chain..
+  // add the CA certificates to the chain..
   //
-  nPEM.WriteString("\n")
-  nPEM.WriteString(nSubject + " (CA)\n")
-  nPEM.WriteString(nDate)
-  pem.Encode(nPEM, &pem.Block {
-    Type:  "CERTIFICATE",
-    Bytes: ca.Cert.Raw,
-  })
+  for _, aCaCert := range ca.Certificates() {
+    nPEM.WriteString("\n")
+    nPEM.WriteString(nSubject + " (CA)\n")
+    nPEM.WriteString(nDate)
+    pem.Encode(nPEM, &pem.Block {
+      Type:  "CERTIFICATE",
+      Bytes: aCaCert.Raw,
+    })
+  }
   os.MkdirAll(filepath.Dir(nursery.Cert_Path), 0755)
   err = ioutil.WriteFile(nursery.Cert_Path, nPEM.Bytes(), 0644)
   if err != nil {
     return fmt.Errorf("could not write the ["+nursery.Cert_Path+"] file: %w", err)
   }
 
-  // NOTE this private key is left UN-ENCRYPTED on the file system!
-  // SO you need to ensure it is not readable by anyone other than the
-  // user who needs to run the cnNursery!
+  // NOTE unless a key_passphrase is configured, this private key is left 
+  // UN-ENCRYPTED on the file system! SO you need to ensure it is not 
+  // readable by anyone other than the user who needs to run the cnNursery!
   //
+  passphrase, err := nursery.KeyPassphrase()
+  if err != nil {
+    return fmt.Errorf("could not read the key passphrase for ["+nursery.Name+"] Nursery: %w", err)
+  }
+  nKeyBlock, err := PrivateKeyPEMBlock(nPrivateKey, passphrase)
+  if err != nil {
+    return fmt.Errorf("could not encode the key for ["+nursery.Name+"] Nursery: %w", err)
+  }
   nPrivateKeyPEM := new(bytes.Buffer)
   nPrivateKeyPEM.WriteString("\n")
   nPrivateKeyPEM.WriteString(nSubject + "\n")
   nPrivateKeyPEM.WriteString(nDate)
-  pem.Encode(nPrivateKeyPEM, &pem.Block {
-    Type: "RSA PRIVATE KEY",
-    Bytes: x509.MarshalPKCS1PrivateKey(nPrivateKey),
-  })
+  pem.Encode(nPrivateKeyPEM, nKeyBlock)
   os.MkdirAll(filepath.Dir(nursery.Key_Path), 0755)
   err = ioutil.WriteFile(nursery.Key_Path, nPrivateKeyPEM.Bytes(), 0644)
   if err != nil {
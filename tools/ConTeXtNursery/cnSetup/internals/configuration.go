@@ -40,8 +40,10 @@ type ConfigType struct {
 
   // Certificate information
   //
+  Key_Algorithm           string `default:"rsa"`
   Key_Size                uint `default:"4096"`
   Certificate_Authority   CAType
+  Renew_Within_Days       uint `default:"30"`
 
   // Nurseries
   //
@@ -49,6 +51,9 @@ type ConfigType struct {
   Nurseries              []NurseryType
   NATS_Federation_Routes []string
   NATS_Message_Routes    []string
+  NATS_Routes_Seed         uint64
+  NATS_Routes_Seed_Path    string
+  NATS_TLS                 bool
 
   // Users
   //
@@ -82,9 +87,9 @@ func (config *ConfigType) LoadConfiguration(
   configFileName string,
   showConfig     bool,
 ) {
-  configor.Load(&config, configFileName)
+  err := configor.Load(config, configFileName)
+  config.CSLog.MayBeFatal("Could not load the configuration ["+configFileName+"]", err)
 
-    
   config.Certificate_Authority.NormalizeCA(config)
   
   if config.Federation_Name == "" {
@@ -100,24 +105,15 @@ func (config *ConfigType) LoadConfiguration(
   // locate the primary Nursery and normalize each Nursery structure 
   //
   config.Nursery_Defaults.NormalizeConfig(0, &NurseryDefaults, config)
-  config.NATS_Federation_Routes = make([]string, len(config.Nurseries))
-  config.NATS_Message_Routes    = make([]string, len(config.Nurseries))
-  natsShuffle := make([]int, len(config.Nurseries))
   for i, _ := range config.Nurseries {
-    natsShuffle[i] = i
     config.Nurseries[i].NormalizeConfig(i, &config.Nursery_Defaults, config)
-    config.NATS_Federation_Routes[i] = config.Nurseries[i].ComputeFederationNATS()
-    config.NATS_Message_Routes[i]    = config.Nurseries[i].ComputeMessageNATS()
-  }
-
-  // now explicitly reshuffle the NATS routes for each cnNursery
-  //
-  for i, _ := range config.Nurseries {
-    config.Nurseries[i].SetNatsRoutes(
-      &config.NATS_Federation_Routes,
-      &config.NATS_Message_Routes,
-      &natsShuffle,
-    )
+    if config.Nurseries[i].Port == 0 {
+      config.CSLog.Logf(
+        "The port for the [%s] nursery MUST be specified (it is part of its base_url)",
+        config.Nurseries[i].Name,
+      )
+      os.Exit(-1)
+    }
   }
 
   config.User_Defaults.NormalizeConfig(
@@ -133,13 +129,27 @@ func (config *ConfigType) LoadConfiguration(
     )
   }
 
-  // now explicitly reshuffle the NATS routes for each user
+  // now (re)shuffle the NATS routes for each cnNursery and user (using 
+  // the persisted seed, so that the routes keep the same order on every 
+  // run of cnSetup) 
   //
-  for i, _ := range config.Users {
-    config.Users[i].SetNatsRoutes(
-      &config.NATS_Message_Routes,
-      &natsShuffle,
-    )
+  if config.NATS_Routes_Seed_Path == "" {
+    config.NATS_Routes_Seed_Path = "servers/nats-routes-seed"
+  }
+  if config.NATS_Routes_Seed == 0 {
+    seed, err := LoadNatsRoutesSeed(config.NATS_Routes_Seed_Path)
+    config.CSLog.MayBeFatal("Could not load the NATS routes seed", err)
+    config.NATS_Routes_Seed = seed
+  }
+  config.SetNatsRoutes()
+  config.SetNatsUsers()
+
+  // every nursery follows (or campaigns to be) the primary nursery
+  //
+  config.SetPrimaryCandidates()
+  if len(config.Nurseries[0].Primary_Candidates) < 1 {
+    config.CSLog.Logf("EXACTLY one nursery MUST be the primary (is_primary: true)")
+    os.Exit(-1)
   }
     
   if showConfig {
@@ -148,3 +158,22 @@ func (config *ConfigType) LoadConfiguration(
     os.Exit(0)
   }
 }
+
+// Set the primary candidates of every Nursery to the base URLs of the 
+// primary Nurseries (so that each cnNursery can elect, or follow, the 
+// federation's primary). 
+//
+// ALTERS config;
+// NOT THREAD-SAFE;
+//
+func (config *ConfigType) SetPrimaryCandidates() {
+  primaryCandidates := []string{}
+  for _, aNursery := range config.Nurseries {
+    if aNursery.Is_Primary {
+      primaryCandidates = append(primaryCandidates, aNursery.Base_Url)
+    }
+  }
+  for i, _ := range config.Nurseries {
+    config.Nurseries[i].Primary_Candidates = primaryCandidates
+  }
+}
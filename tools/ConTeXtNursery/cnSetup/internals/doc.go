@@ -22,6 +22,9 @@ The cnSetup command consists of methods to manage:
     2. CertificateAuthority (CAType)
     3. Nursery Certificates and Configuration (NurseryType)
     4. User Certificates and Configuration (UserType)
+    5. Certificate Revocations (RevocationDB)
+    6. The Ledger of Issued Certificates (CertificateLedger)
+    7. The (seeded) shuffle of the NATS routes
   
 This CNSetup package is used by the cnSetup command to orchestrate the 
 creation of a Certificate Authority, as well as Certificates and 
@@ -0,0 +1,228 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "bytes"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/configValidation"
+  "gopkg.in/yaml.v3"
+  "io/ioutil"
+  "os"
+  "strings"
+)
+
+// Write a generated (configuration) file, unless the file already has
+// exactly the same contents.
+//
+// Returns true if the file has been (re)written.
+//
+func writeGeneratedFile(filePath string, contents []byte) (bool, error) {
+  oldContents, err := ioutil.ReadFile(filePath)
+  if err == nil && bytes.Equal(oldContents, contents) { return false, nil }
+  err = ioutil.WriteFile(filePath, contents, 0644)
+  if err != nil {
+    return false, fmt.Errorf("could not write [%s]: %w", filePath, err)
+  }
+  return true, nil
+}
+
+// Returns the index of the named Nursery (or -1 if it is not configured).
+//
+// READS config;
+//
+func (config *ConfigType) NurseryIndex(name string) int {
+  for i, aNursery := range config.Nurseries {
+    if aNursery.Name == name { return i }
+  }
+  return -1
+}
+
+// Returns the index of the named User (or -1 if it is not configured).
+//
+// READS config;
+//
+func (config *ConfigType) UserIndex(name string) int {
+  for i, aUser := range config.Users {
+    if aUser.Name == name { return i }
+  }
+  return -1
+}
+
+// Remove the named Nurseries and Users from the (loaded) configuration,
+// and then reshuffle the (remaining) NATS routes (and users).
+//
+// The primary Nursery can not be removed (the remaining Nurseries would
+// have no primary candidates).
+//
+// (The nurseries.yaml file itself is altered by RemoveNamedFromFile.)
+//
+// ALTERS config;
+// NOT THREAD-SAFE;
+//
+func (config *ConfigType) RemoveNamed(names []string) error {
+  for _, aName := range names {
+    if config.NurseryIndex(aName) < 0 && config.UserIndex(aName) < 0 {
+      return fmt.Errorf("[%s] is neither a configured nursery nor user", aName)
+    }
+    if i := config.NurseryIndex(aName) ; 0 <= i && config.Nurseries[i].Is_Primary {
+      return fmt.Errorf("the primary nursery [%s] can not be removed", aName)
+    }
+  }
+  removed := map[string]bool{}
+  for _, aName := range names { removed[aName] = true }
+
+  nurseries := []NurseryType{}
+  for _, aNursery := range config.Nurseries {
+    if !removed[aNursery.Name] { nurseries = append(nurseries, aNursery) }
+  }
+  users := []UserType{}
+  for _, aUser := range config.Users {
+    if !removed[aUser.Name] { users = append(users, aUser) }
+  }
+  if len(nurseries) < 1 {
+    return fmt.Errorf("the last nursery can not be removed")
+  }
+  config.Nurseries = nurseries
+  config.Users     = users
+  config.SetNatsRoutes()
+  config.SetNatsUsers()
+  config.SetPrimaryCandidates()
+  return nil
+}
+
+// Returns the name of a nurseries (or users) item of the configuration
+// file (a nursery without a name is named after its first host).
+//
+func itemName(anItem *yaml.Node) string {
+  if name := configValidation.GetValue(anItem, "name") ; name != "" { return name }
+  host := strings.Split(configValidation.GetValue(anItem, "host"), ",")[0]
+  return strings.TrimSpace(host)
+}
+
+// Remove the named Nurseries and Users from the configuration file
+// itself, editing its YAML nodes so that the comments (of the remaining
+// entries) are preserved (although its layout, such as blank lines and
+// alignment, is normalized).
+//
+// Returns an error if any of the names is not listed in the file.
+//
+// ALTERS the configuration file;
+//
+func RemoveNamedFromFile(configFileName string, names []string) error {
+  yamlBytes, err := ioutil.ReadFile(configFileName)
+  if err != nil {
+    return fmt.Errorf("could not read [%s]: %w", configFileName, err)
+  }
+  var document yaml.Node
+  err = yaml.Unmarshal(yamlBytes, &document)
+  if err != nil {
+    return fmt.Errorf("could not parse [%s]: %w", configFileName, err)
+  }
+  if len(document.Content) < 1 {
+    return fmt.Errorf("the configuration [%s] is empty", configFileName)
+  }
+
+  removed := map[string]bool{}
+  for _, aName := range names { removed[aName] = false }
+  for _, aKey := range []string{ "nurseries", "users" } {
+    items := configValidation.Get(document.Content[0], aKey)
+    if items == nil || items.Kind != yaml.SequenceNode { continue }
+    kept := []*yaml.Node{}
+    for _, anItem := range items.Content {
+      name := itemName(anItem)
+      if _, ok := removed[name] ; ok {
+        removed[name] = true
+        continue
+      }
+      kept = append(kept, anItem)
+    }
+    items.Content = kept
+  }
+  for _, aName := range names {
+    if !removed[aName] {
+      return fmt.Errorf("[%s] is not listed in [%s]", aName, configFileName)
+    }
+  }
+
+  var buffer bytes.Buffer
+  encoder := yaml.NewEncoder(&buffer)
+  encoder.SetIndent(2)
+  err = encoder.Encode(&document)
+  if err == nil { err = encoder.Close() }
+  if err != nil {
+    return fmt.Errorf("could not encode [%s]: %w", configFileName, err)
+  }
+  _, err = writeGeneratedFile(configFileName, buffer.Bytes())
+  return err
+}
+
+// (Re)write the configuration files of every Nursery which already has a
+// certificate, returning the names of the Nurseries whose configuration
+// files have changed (and so MUST be pushed to those Nurseries).
+//
+// Nurseries which do not (yet) have a certificate are skipped.
+//
+// READS config;
+// NOT THREAD-SAFE;
+//
+func (config *ConfigType) WriteNurseryConfigurations() ([]string, []error) {
+  changedNurseries := []string{}
+  errs             := []error{}
+  for i, _ := range config.Nurseries {
+    aNursery := &config.Nurseries[i]
+    if _, err := os.Stat(aNursery.Cert_Path) ; err != nil { continue }
+
+    changed := false
+    for _, aWriter := range []func() (bool, error){
+      aNursery.WriteConfiguration,
+      aNursery.WriteNATSConfiguration,
+      aNursery.WriteENVSConfiguration,
+    } {
+      written, err := aWriter()
+      if err != nil {
+        errs = append(errs, fmt.Errorf("nursery [%s]: %w", aNursery.Name, err))
+      }
+      changed = changed || written
+    }
+    if changed { changedNurseries = append(changedNurseries, aNursery.Name) }
+  }
+  return changedNurseries, errs
+}
+
+// (Re)write the configuration file of every User who already has a
+// certificate, returning the names of the Users whose configuration files
+// have changed (and so MUST be sent to those Users).
+//
+// Users who do not (yet) have a certificate are skipped.
+//
+// READS config;
+// NOT THREAD-SAFE;
+//
+func (config *ConfigType) WriteUserConfigurations() ([]string, []error) {
+  changedUsers := []string{}
+  errs         := []error{}
+  for i, _ := range config.Users {
+    aUser := &config.Users[i]
+    if _, err := os.Stat(aUser.Cert_Path) ; err != nil { continue }
+
+    changed, err := aUser.WriteConfiguration()
+    if err != nil {
+      errs = append(errs, fmt.Errorf("user [%s]: %w", aUser.Name, err))
+    }
+    if changed { changedUsers = append(changedUsers, aUser.Name) }
+  }
+  return changedUsers, errs
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "testing"
+)
+
+// Returns the given routes without the excluded route.
+//
+func routesWithout(routes []string, excluded string) []string {
+  kept := []string{}
+  for _, aRoute := range routes {
+    if aRoute != excluded { kept = append(kept, aRoute) }
+  }
+  return kept
+}
+
+// Test that adding (and removing) a nursery keeps the (seeded) order of
+// the other routes, and only rewrites the configuration files which
+// change.
+//
+func TestIncrementalNurseries(t *testing.T) {
+  dir := t.TempDir()
+  config, ca := createTestSetup(t, dir, "plato01", "plato02", "plato03")
+
+  // the persisted seed is reloaded
+  seed, err := LoadNatsRoutesSeed(dir+"/servers/nats-routes-seed")
+  assert.NoError(t, err)
+  reloadedSeed, err := LoadNatsRoutesSeed(dir+"/servers/nats-routes-seed")
+  assert.NoError(t, err)
+  assert.Equal(t, seed, reloadedSeed)
+
+  config.NATS_Routes_Seed = seed
+  config.SetNatsRoutes()
+  changed, errs := config.WriteNurseryConfigurations()
+  assert.Empty(t, errs)
+  assert.Equal(t, []string{ "plato01", "plato02", "plato03" }, changed)
+  changed, errs = config.WriteNurseryConfigurations()
+  assert.Empty(t, errs)
+  assert.Empty(t, changed)
+  routes := config.Nurseries[0].NATS_Federation_Routes
+
+  // a new nursery is only inserted into the existing routes
+  config.Nurseries = append(config.Nurseries, NurseryType{
+    Host: "plato04", Cert_Dir: dir+"/servers/plato04",
+  })
+  config.Nurseries[3].NormalizeConfig(3, &NurseryDefaults, config)
+  config.SetNatsRoutes()
+  newRoute := config.Nurseries[3].ComputeFederationNATS()
+  assert.Len(t, config.Nurseries[0].NATS_Federation_Routes, 4)
+  assert.Equal(t, routes, routesWithout(config.Nurseries[0].NATS_Federation_Routes, newRoute))
+
+  // ... whose configuration is only written once it has a certificate
+  changed, errs = config.WriteNurseryConfigurations()
+  assert.Empty(t, errs)
+  assert.Equal(t, []string{ "plato01", "plato02", "plato03" }, changed)
+  err = config.Nurseries[3].CreateNurseryCertificateToFiles(3, ca, config.Federation_Name)
+  assert.NoError(t, err)
+  changed, errs = config.WriteNurseryConfigurations()
+  assert.Empty(t, errs)
+  assert.Equal(t, []string{ "plato04" }, changed)
+
+  // removing the new nursery restores the original routes
+  assert.Error(t, config.RemoveNamed([]string{ "socrates" }))
+  assert.NoError(t, config.RemoveNamed([]string{ "plato04" }))
+  assert.Equal(t, -1, config.NurseryIndex("plato04"))
+  assert.Equal(t, routes, config.Nurseries[0].NATS_Federation_Routes)
+  changed, errs = config.WriteNurseryConfigurations()
+  assert.Empty(t, errs)
+  assert.Equal(t, []string{ "plato01", "plato02", "plato03" }, changed)
+}
+
+// Test that every nursery's configuration lists its base_url and the
+// primary candidates, and that the primary can not be removed.
+//
+func TestPrimaryCandidates(t *testing.T) {
+  dir := t.TempDir()
+  config, _ := createTestSetup(t, dir, "plato01", "plato02")
+  for i, _ := range config.Nurseries {
+    config.Nurseries[i].Port     = 8989
+    config.Nurseries[i].Base_Url = config.Nurseries[i].ComputeBaseUrl()
+  }
+  config.Nurseries[0].Is_Primary = true
+  config.SetPrimaryCandidates()
+  assert.Equal(t, []string{ "https://plato01:8989" }, config.Nurseries[1].Primary_Candidates)
+
+  _, err := config.Nurseries[1].WriteConfiguration()
+  assert.NoError(t, err)
+  yamlBytes, err := ioutil.ReadFile(config.Nurseries[1].Config_Path)
+  assert.NoError(t, err)
+  assert.Contains(t, string(yamlBytes), "base_url:        \"https://plato02:8989\"\n")
+  assert.Contains(t, string(yamlBytes), "primary_candidates:\n  - https://plato01:8989\n")
+
+  assert.Error(t, config.RemoveNamed([]string{ "plato01" }))
+}
+
+// Test that removing nurseries and users from the configuration file
+// keeps the other entries and the comments.
+//
+func TestRemoveNamedFromFile(t *testing.T) {
+  configPath := t.TempDir()+"/nurseries.yaml"
+  err := ioutil.WriteFile(configPath, []byte(`# the federation
+federation_name: test
+
+nurseries:
+  # the primary
+  - host: plato01, 10.0.0.1
+    is_primary: true
+  - host: plato02
+  - name: plato03
+    host: plato03.example.com
+
+users:
+  - name: plato@example.com # plato himself
+  - name: socrates@example.com
+`), 0644)
+  assert.NoError(t, err)
+
+  err = RemoveNamedFromFile(configPath, []string{ "plato02", "aristotle" })
+  assert.Error(t, err)
+  err = RemoveNamedFromFile(configPath, []string{ "plato02", "plato03", "socrates@example.com" })
+  assert.NoError(t, err)
+
+  yamlBytes, err := ioutil.ReadFile(configPath)
+  assert.NoError(t, err)
+  assert.Equal(t, `# the federation
+federation_name: test
+nurseries:
+  # the primary
+  - host: plato01, 10.0.0.1
+    is_primary: true
+users:
+  - name: plato@example.com # plato himself
+`, string(yamlBytes))
+}
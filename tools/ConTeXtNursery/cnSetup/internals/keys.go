@@ -0,0 +1,203 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/ed25519"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/rsa"
+  "crypto/x509"
+  "encoding/pem"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "io/ioutil"
+  "sync"
+)
+
+// The algorithms which can be used to create the public/private keys of
+// the CA, Nurseries and Users.
+//
+// RSA keys (of Key_Size bits) are understood everywhere, but are slow to
+// generate and heavy to use. ECDSA keys are fast, and are understood by
+// all current browsers. Ed25519 keys are the fastest, but are NOT (yet)
+// understood by browsers, so can not be used by Users (and SHOULD only be
+// used by a CA or Nurseries which are never browsed).
+//
+const (
+  RsaKey       = "rsa"
+  EcdsaP256Key = "ecdsa-p256"
+  EcdsaP384Key = "ecdsa-p384"
+  Ed25519Key   = "ed25519"
+)
+
+// Returns true if the given key algorithm is known.
+//
+func IsKeyAlgorithm(keyAlgorithm string) bool {
+  switch keyAlgorithm {
+    case RsaKey, EcdsaP256Key, EcdsaP384Key, Ed25519Key : return true
+  }
+  return false
+}
+
+// Create a new Public/Private Key pair using the given key algorithm (the
+// keySize is only used by RSA keys).
+//
+func NewPrivateKey(keyAlgorithm string, keySize uint) (crypto.Signer, error) {
+  switch keyAlgorithm {
+    case RsaKey       : return rsa.GenerateKey(rand.Reader, int(keySize))
+    case EcdsaP256Key : return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    case EcdsaP384Key : return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+    case Ed25519Key   :
+      _, privateKey, err := ed25519.GenerateKey(rand.Reader)
+      return privateKey, err
+  }
+  return nil, fmt.Errorf("unknown key algorithm [%s]", keyAlgorithm)
+}
+
+// Returns the x509 KeyUsage appropriate for an (end entity) certificate
+// for the given private key.
+//
+// (Only RSA keys can be used to encipher keys or data, while only ECDSA
+// keys can be used for key agreement.)
+//
+func KeyUsageFor(privateKey crypto.Signer) x509.KeyUsage {
+  switch privateKey.(type) {
+    case *rsa.PrivateKey   :
+      return x509.KeyUsageDigitalSignature |
+        x509.KeyUsageKeyEncipherment |
+        x509.KeyUsageDataEncipherment
+    case *ecdsa.PrivateKey :
+      return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+  }
+  return x509.KeyUsageDigitalSignature
+}
+
+// Returns the x509 SignatureAlgorithm used to sign certificates with the
+// given (CA's) private key.
+//
+func SignatureAlgorithmFor(privateKey crypto.Signer) x509.SignatureAlgorithm {
+  switch key := privateKey.(type) {
+    case *rsa.PrivateKey   : return x509.SHA512WithRSA
+    case *ecdsa.PrivateKey :
+      if key.Curve == elliptic.P384() { return x509.ECDSAWithSHA384 }
+      return x509.ECDSAWithSHA256
+    case ed25519.PrivateKey : return x509.PureEd25519
+  }
+  return x509.UnknownSignatureAlgorithm
+}
+
+// The passphrases (already) read from each passphrase source.
+//
+var keyPassphrases      = map[string][]byte{}
+var keyPassphrasesMutex   sync.Mutex
+
+// Returns the passphrase from the given passphrase source (see the
+// certificates package), which is only read (or prompted for) once. An
+// empty source means there is no passphrase (and returns nil).
+//
+// THREAD-SAFE;
+//
+func KeyPassphrase(source, description string) ([]byte, error) {
+  if source == "" { return nil, nil }
+  keyPassphrasesMutex.Lock()
+  defer keyPassphrasesMutex.Unlock()
+
+  passphrase, ok := keyPassphrases[source]
+  if ok { return passphrase, nil }
+  passphrase, err := certificates.ReadPassphrase(source, description)
+  if err != nil { return nil, err }
+  keyPassphrases[source] = passphrase
+  return passphrase, nil
+}
+
+// Encode a private key as a PEM block.
+//
+// RSA keys are (as they always have been) encoded as PKCS#1 "RSA PRIVATE
+// KEY" blocks, ECDSA keys as SEC 1 "EC PRIVATE KEY" blocks, and Ed25519
+// keys as PKCS#8 "PRIVATE KEY" blocks.
+//
+// If a passphrase is given, any key is instead encrypted as a PKCS#8
+// "ENCRYPTED PRIVATE KEY" block.
+//
+func PrivateKeyPEMBlock(
+  privateKey crypto.Signer,
+  passphrase []byte,
+) (*pem.Block, error) {
+  if 0 < len(passphrase) {
+    return certificates.EncryptPrivateKeyPEMBlock(privateKey, passphrase)
+  }
+  switch key := privateKey.(type) {
+    case *rsa.PrivateKey   :
+      return &pem.Block{
+        Type:  "RSA PRIVATE KEY",
+        Bytes: x509.MarshalPKCS1PrivateKey(key),
+      }, nil
+    case *ecdsa.PrivateKey :
+      keyBytes, err := x509.MarshalECPrivateKey(key)
+      if err != nil {
+        return nil, fmt.Errorf("could not marshal the ecdsa key: %w", err)
+      }
+      return &pem.Block{ Type: "EC PRIVATE KEY", Bytes: keyBytes }, nil
+  }
+  keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+  if err != nil {
+    return nil, fmt.Errorf("could not marshal the private key: %w", err)
+  }
+  return &pem.Block{ Type: "PRIVATE KEY", Bytes: keyBytes }, nil
+}
+
+// Decode a private key from a PEM block (of any of the types written by
+// PrivateKeyPEMBlock), using the passphrase to decrypt an encrypted key.
+//
+func ParsePrivateKeyPEMBlock(
+  keyPEM     *pem.Block,
+  passphrase []byte,
+) (crypto.Signer, error) {
+  switch keyPEM.Type {
+    case certificates.EncryptedKeyType :
+      return certificates.DecryptPrivateKeyPEMBlock(keyPEM, passphrase)
+    case "RSA PRIVATE KEY" : return x509.ParsePKCS1PrivateKey(keyPEM.Bytes)
+    case "EC PRIVATE KEY"  : return x509.ParseECPrivateKey(keyPEM.Bytes)
+    case "PRIVATE KEY"     :
+      privateKey, err := x509.ParsePKCS8PrivateKey(keyPEM.Bytes)
+      if err != nil { return nil, err }
+      signer, ok := privateKey.(crypto.Signer)
+      if !ok { return nil, fmt.Errorf("the PRIVATE KEY can not sign") }
+      return signer, nil
+  }
+  return nil, fmt.Errorf("unknown private key block type [%s]", keyPEM.Type)
+}
+
+// Load a (possibly encrypted) PEM encoded private key from the given 
+// file.
+//
+func LoadPrivateKey(keyPath string, passphrase []byte) (crypto.Signer, error) {
+  keyBytes, err := ioutil.ReadFile(keyPath)
+  if err != nil {
+    return nil, fmt.Errorf("could not read the key [%s]: %w", keyPath, err)
+  }
+  keyPEM, _ := pem.Decode(keyBytes)
+  if keyPEM == nil {
+    return nil, fmt.Errorf("could not locate a PRIVATE KEY block in [%s]", keyPath)
+  }
+  privateKey, err := ParsePrivateKeyPEMBlock(keyPEM, passphrase)
+  if err != nil {
+    return nil, fmt.Errorf("could not parse the key [%s]: %w", keyPath, err)
+  }
+  return privateKey, nil
+}
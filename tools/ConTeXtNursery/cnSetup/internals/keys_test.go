@@ -0,0 +1,127 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "crypto/x509"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "os"
+  "software.sslmate.com/src/go-pkcs12"
+  "testing"
+)
+
+// Test creating (and reloading) a CA, nurseries and users with each of
+// the (non RSA) key algorithms.
+//
+func TestKeyAlgorithms(t *testing.T) {
+  dir := t.TempDir()
+  config, ca := createKeyedTestSetup(t, dir, EcdsaP384Key, "plato01")
+  assert.Equal(t, x509.ECDSA, ca.Cert.PublicKeyAlgorithm)
+  assert.Equal(t, x509.ECDSAWithSHA384, ca.Cert.SignatureAlgorithm)
+
+  // the CA (and its key) can be reloaded
+  reloaded := CreateCA(config)
+  assert.NoError(t, reloaded.LoadCAFromFiles())
+  assert.Equal(t, ca.PrivateKey, reloaded.PrivateKey)
+
+  // an Ed25519 nursery can be loaded by the cnNursery
+  plato02 := NurseryType{
+    Host: "plato02", Cert_Dir: dir+"/servers/plato02", Key_Algorithm: Ed25519Key,
+  }
+  plato02.NormalizeConfig(1, &NurseryDefaults, config)
+  assert.NoError(t, plato02.CreateNurseryCertificateToFiles(1, ca, config.Federation_Name))
+  nurseryCerts := certificates.CreateCertificates(
+    plato02.Ca_Cert_Path, plato02.Cert_Path, plato02.Key_Path, "", config.CSLog,
+  )
+  assert.NotNil(t, nurseryCerts.Cert)
+  assert.Equal(t, x509.Ed25519, nurseryCerts.Cert.Leaf.PublicKeyAlgorithm)
+  assert.Equal(t, x509.KeyUsageDigitalSignature, nurseryCerts.Cert.Leaf.KeyUsage)
+
+  // an ECDSA user gets a loadable PKCS#12 file
+  config.Users = []UserType{
+    { Name: "plato@example.com", Cert_Dir: dir+"/users/plato", Key_Algorithm: EcdsaP256Key },
+  }
+  config.Users[0].NormalizeConfig(0, &UserDefaults, config)
+  plato := &config.Users[0]
+  assert.NoError(t, plato.CreateUserCertificate(0, ca, config.Federation_Name))
+  pfxBytes, err := ioutil.ReadFile(plato.Pkcs12_Path)
+  assert.NoError(t, err)
+  key, cert, _, err := pkcs12.DecodeChain(pfxBytes, plato.Password)
+  assert.NoError(t, err)
+  assert.Equal(t, x509.ECDSA, cert.PublicKeyAlgorithm)
+  assert.NoError(t, cert.CheckSignatureFrom(ca.Cert))
+  loadedKey, err := LoadPrivateKey(plato.Key_Path, nil)
+  assert.NoError(t, err)
+  assert.Equal(t, loadedKey, key)
+
+  // renewing keeps the algorithm of a rotated key
+  assert.NoError(t, plato02.RenewNurseryCertificateToFiles(ca, config.Federation_Name, true))
+  renewedCerts, err := certificates.LoadCertificatesFromFile(plato02.Cert_Path)
+  assert.NoError(t, err)
+  assert.Equal(t, x509.Ed25519, renewedCerts[0].PublicKeyAlgorithm)
+
+  _, err = NewPrivateKey("dsa", 1024)
+  assert.Error(t, err)
+}
+
+// Test creating (and reloading) a CA and nursery whose keys are encrypted
+// with passphrases read from the environment and from a file.
+//
+func TestEncryptedKeys(t *testing.T) {
+  dir := t.TempDir()
+  config, ca := createTestSetup(t, dir)
+  os.Setenv("CN_TEST_CA_PASSPHRASE", "sesame")
+  defer os.Unsetenv("CN_TEST_CA_PASSPHRASE")
+  passphrasePath := dir+"/nursery.passphrase"
+  assert.NoError(t, ioutil.WriteFile(passphrasePath, []byte("open sesame\n"), 0600))
+
+  // the CA key is encrypted (and can only be reloaded with its passphrase)
+  config.Certificate_Authority.Key_Passphrase = "env:CN_TEST_CA_PASSPHRASE"
+  ca.Key_Passphrase = config.Certificate_Authority.Key_Passphrase
+  assert.NoError(t, ca.WriteCAFiles(config))
+  caKeyBytes, err := ioutil.ReadFile(ca.Key_File_Name)
+  assert.NoError(t, err)
+  assert.Contains(t, string(caKeyBytes), certificates.EncryptedKeyType)
+  reloaded := CreateCA(config)
+  assert.NoError(t, reloaded.LoadCAFromFiles())
+  assert.Equal(t, ca.PrivateKey, reloaded.PrivateKey)
+  reloaded.Key_Passphrase = ""
+  assert.Error(t, reloaded.LoadCAFromFiles())
+
+  // the nursery key is encrypted, and unlocked by the cnNursery
+  plato01 := NurseryType{
+    Host: "plato01", Cert_Dir: dir+"/servers/plato01",
+    Key_Passphrase: "file:"+passphrasePath,
+  }
+  plato01.NormalizeConfig(0, &NurseryDefaults, config)
+  assert.NoError(t, plato01.CreateNurseryCertificateToFiles(0, ca, config.Federation_Name))
+  _, err = LoadPrivateKey(plato01.Key_Path, nil)
+  assert.Error(t, err)
+  nurseryCerts := certificates.CreateUnlockedCertificates(
+    plato01.Ca_Cert_Path, plato01.Cert_Path, plato01.Key_Path, "",
+    plato01.Key_Passphrase, config.CSLog,
+  )
+  assert.NotNil(t, nurseryCerts.Cert)
+
+  // renewing (and rotating) the nursery key keeps it encrypted
+  assert.NoError(t, plato01.RenewNurseryCertificateToFiles(ca, config.Federation_Name, true))
+  nurseryKeyBytes, err := ioutil.ReadFile(plato01.Key_Path)
+  assert.NoError(t, err)
+  assert.Contains(t, string(nurseryKeyBytes), certificates.EncryptedKeyType)
+  _, err = LoadPrivateKey(plato01.Key_Path, []byte("open sesame"))
+  assert.NoError(t, err)
+}
@@ -0,0 +1,510 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "io"
+  "io/ioutil"
+  "math/big"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+// The status of each certificate in the ledger (as used by an openssl
+// index.txt file).
+//
+const (
+  LedgerValid   = "V"
+  LedgerRevoked = "R"
+  LedgerExpired = "E"
+)
+
+// Serial numbers are allocated (monotonically) above this base, so that
+// they never collide with those of certificates issued before the ledger
+// was kept (which were all below 1<<39).
+//
+const LedgerSerialBase = 1 << 40
+
+// The format of the times recorded in the ledger.
+//
+const ledgerTimeFormat = "060102150405Z"
+
+// The record of a single certificate issued by the CA.
+//
+// The Cert_Path is the file to which the certificate was written, while
+// the Subject is its (openssl style) distinguished name.
+//
+type LedgerEntry struct {
+  Status      string
+  Not_After   time.Time
+  Revoked_At  time.Time
+  Reason      string
+  Serial     *big.Int
+  Cert_Path   string
+  Subject     string
+}
+
+// Returns the status of this entry at the given time (a valid
+// certificate which has expired is reported as expired).
+//
+func (entry LedgerEntry) StatusAt(now time.Time) string {
+  if entry.Status == LedgerValid && entry.Not_After.Before(now) {
+    return LedgerExpired
+  }
+  return entry.Status
+}
+
+// Returns the Common Name recorded in this entry's Subject.
+//
+func (entry LedgerEntry) CommonName() string {
+  cnIndex := strings.LastIndex(entry.Subject, "/CN=")
+  if cnIndex < 0 { return "" }
+  return entry.Subject[cnIndex+4:]
+}
+
+// Format a distinguished name in the (openssl style) form used by the
+// ledger.
+//
+func ledgerSubject(name pkix.Name) string {
+  subject := ""
+  addParts := func(key string, values []string) {
+    for _, aValue := range values {
+      if aValue == "" { continue }
+      subject += "/"+key+"="+ledgerField(aValue)
+    }
+  }
+  addParts("C",  name.Country)
+  addParts("ST", name.Province)
+  addParts("L",  name.Locality)
+  addParts("O",  name.Organization)
+  addParts("OU", name.OrganizationalUnit)
+  addParts("CN", []string{ name.CommonName })
+  return subject
+}
+
+// Make a value safe to record in a (tab separated) ledger field.
+//
+func ledgerField(value string) string {
+  return strings.NewReplacer("\t", " ", "\n", " ", ",", " ").Replace(value)
+}
+
+// Format (one line of) this entry as an openssl index.txt line.
+//
+func (entry LedgerEntry) String() string {
+  revoked := ""
+  if entry.Status == LedgerRevoked {
+    revoked = entry.Revoked_At.UTC().Format(ledgerTimeFormat)
+    if entry.Reason != "" { revoked += ","+ledgerField(entry.Reason) }
+  }
+  return strings.Join([]string{
+    entry.Status,
+    entry.Not_After.UTC().Format(ledgerTimeFormat),
+    revoked,
+    strings.ToUpper(entry.Serial.Text(16)),
+    entry.Cert_Path,
+    entry.Subject,
+  }, "\t")
+}
+
+// Parse (one line of) an openssl index.txt file.
+//
+func parseLedgerEntry(line string) (LedgerEntry, error) {
+  fields := strings.Split(line, "\t")
+  if len(fields) != 6 {
+    return LedgerEntry{}, fmt.Errorf("expected 6 fields but found %d", len(fields))
+  }
+  entry := LedgerEntry{
+    Status:    fields[0],
+    Cert_Path: fields[4],
+    Subject:   fields[5],
+  }
+  if entry.Status != LedgerValid &&
+     entry.Status != LedgerRevoked &&
+     entry.Status != LedgerExpired {
+    return entry, fmt.Errorf("unknown status [%s]", entry.Status)
+  }
+  var err error
+  entry.Not_After, err = time.Parse(ledgerTimeFormat, fields[1])
+  if err != nil { return entry, fmt.Errorf("invalid expiry time: %w", err) }
+  if fields[2] != "" {
+    revoked := strings.SplitN(fields[2], ",", 2)
+    entry.Revoked_At, err = time.Parse(ledgerTimeFormat, revoked[0])
+    if err != nil { return entry, fmt.Errorf("invalid revocation time: %w", err) }
+    if 1 < len(revoked) { entry.Reason = revoked[1] }
+  }
+  serial, ok := new(big.Int).SetString(fields[3], 16)
+  if !ok { return entry, fmt.Errorf("invalid serial number [%s]", fields[3]) }
+  entry.Serial = serial
+  return entry, nil
+}
+
+// The CertificateLedger records every certificate issued by a
+// Certificate Authority (in an openssl index.txt style file kept next to
+// the CA's certificate and key files), and allocates their serial
+// numbers.
+//
+// CONSTRAINTS: Once created, the values in this structure SHOULD only be
+// altered by structure methods.
+//
+type CertificateLedger struct {
+  Mutex     sync.Mutex
+  Path      string
+  Entries []LedgerEntry
+}
+
+// Create an (empty) CertificateLedger kept in the given file.
+//
+// Typically this empty CertificateLedger will be used to Load the
+// existing ledger.
+//
+// CREATES ledger;
+//
+func CreateCertificateLedger(ledgerPath string) *CertificateLedger {
+  return &CertificateLedger{
+    Path:    ledgerPath,
+    Entries: make([]LedgerEntry, 0),
+  }
+}
+
+// Load the ledger from its file.
+//
+// A missing file is not an error (nothing has been issued yet).
+//
+// THREAD-SAFE;
+//
+func (ledger *CertificateLedger) Load() error {
+  ledger.Mutex.Lock()
+  defer ledger.Mutex.Unlock()
+
+  ledgerFile, err := os.Open(ledger.Path)
+  if os.IsNotExist(err) { return nil }
+  if err != nil {
+    return fmt.Errorf("could not open the ledger [%s]: %w", ledger.Path, err)
+  }
+  defer ledgerFile.Close()
+
+  entries := make([]LedgerEntry, 0)
+  scanner := bufio.NewScanner(ledgerFile)
+  lineNum := 0
+  for scanner.Scan() {
+    lineNum++
+    if strings.TrimSpace(scanner.Text()) == "" { continue }
+    anEntry, err := parseLedgerEntry(scanner.Text())
+    if err != nil {
+      return fmt.Errorf("could not parse line %d of the ledger [%s]: %w", lineNum, ledger.Path, err)
+    }
+    entries = append(entries, anEntry)
+  }
+  if err = scanner.Err() ; err != nil {
+    return fmt.Errorf("could not read the ledger [%s]: %w", ledger.Path, err)
+  }
+  ledger.Entries = entries
+  return nil
+}
+
+// Save the ledger to its file.
+//
+// The ledger is written to a temporary file which is then renamed, so
+// that an interrupted cnSetup never leaves a partial file.
+//
+// NOT THREAD-SAFE (the caller MUST hold the ledger.Mutex lock);
+//
+func (ledger *CertificateLedger) save() error {
+  ledgerBytes := new(bytes.Buffer)
+  for _, anEntry := range ledger.Entries {
+    ledgerBytes.WriteString(anEntry.String()+"\n")
+  }
+  os.MkdirAll(filepath.Dir(ledger.Path), 0755)
+  tmpPath := ledger.Path+".tmp"
+  err := ioutil.WriteFile(tmpPath, ledgerBytes.Bytes(), 0644)
+  if err != nil {
+    return fmt.Errorf("could not write [%s]: %w", tmpPath, err)
+  }
+  err = os.Rename(tmpPath, ledger.Path)
+  if err != nil {
+    return fmt.Errorf("could not rename [%s]: %w", tmpPath, err)
+  }
+  return nil
+}
+
+// Returns the index of the entry with the given serial number (or -1).
+//
+// NOT THREAD-SAFE (the caller MUST hold the ledger.Mutex lock);
+//
+func (ledger *CertificateLedger) indexOf(serial *big.Int) int {
+  for i, anEntry := range ledger.Entries {
+    if anEntry.Serial.Cmp(serial) == 0 { return i }
+  }
+  return -1
+}
+
+// Returns the next (unused) serial number.
+//
+// NOT THREAD-SAFE (the caller MUST hold the ledger.Mutex lock);
+//
+func (ledger *CertificateLedger) nextSerial() *big.Int {
+  serial := big.NewInt(LedgerSerialBase)
+  for _, anEntry := range ledger.Entries {
+    if serial.Cmp(anEntry.Serial) < 0 { serial.Set(anEntry.Serial) }
+  }
+  return serial.Add(serial, big.NewInt(1))
+}
+
+// Issue a certificate: allocate its serial number (unless the template
+// already has one), sign it (using signFunc), and record it in the
+// (saved) ledger.
+//
+// A serial number which has already been issued is refused.
+//
+// THREAD-SAFE;
+//
+func (ledger *CertificateLedger) Issue(
+  template *x509.Certificate,
+  certPath  string,
+  signFunc  func(*x509.Certificate) ([]byte, error),
+) ([]byte, error) {
+  ledger.Mutex.Lock()
+  defer ledger.Mutex.Unlock()
+
+  if template.SerialNumber == nil {
+    template.SerialNumber = ledger.nextSerial()
+  } else if 0 <= ledger.indexOf(template.SerialNumber) {
+    return nil, fmt.Errorf(
+      "the serial number %s has already been issued", template.SerialNumber,
+    )
+  }
+  certBytes, err := signFunc(template)
+  if err != nil { return nil, err }
+
+  // (the ledger, like the certificate, only records whole seconds)
+  //
+  ledger.Entries = append(ledger.Entries, LedgerEntry{
+    Status:    LedgerValid,
+    Not_After: template.NotAfter.UTC().Truncate(time.Second),
+    Serial:    new(big.Int).Set(template.SerialNumber),
+    Cert_Path: certPath,
+    Subject:   ledgerSubject(template.Subject),
+  })
+  err = ledger.save()
+  if err != nil { return nil, err }
+  return certBytes, nil
+}
+
+// Record a certificate issued before the ledger was kept.
+//
+// Returns true if the certificate was added (false if it was already
+// recorded), or an error if a different certificate with the same serial
+// number has already been recorded.
+//
+// THREAD-SAFE;
+//
+func (ledger *CertificateLedger) Import(
+  cert     *x509.Certificate,
+  certPath  string,
+) (bool, error) {
+  ledger.Mutex.Lock()
+  defer ledger.Mutex.Unlock()
+
+  subject := ledgerSubject(cert.Subject)
+  if entryIndex := ledger.indexOf(cert.SerialNumber) ; 0 <= entryIndex {
+    anEntry := ledger.Entries[entryIndex]
+    if anEntry.Subject == subject &&
+      anEntry.Not_After.Unix() == cert.NotAfter.Unix() {
+      return false, nil
+    }
+    return false, fmt.Errorf(
+      "the serial number %s of [%s] has already been issued to [%s]",
+      cert.SerialNumber, certPath, anEntry.Cert_Path,
+    )
+  }
+  ledger.Entries = append(ledger.Entries, LedgerEntry{
+    Status:    LedgerValid,
+    Not_After: cert.NotAfter,
+    Serial:    new(big.Int).Set(cert.SerialNumber),
+    Cert_Path: certPath,
+    Subject:   subject,
+  })
+  return true, ledger.save()
+}
+
+// Import the (existing) certificates of the CA, and of every configured
+// Nursery and User, which are not yet recorded in the ledger.
+//
+// Returns an error for each certificate which could not be recorded
+// (such as a duplicated serial number).
+//
+// READS config;
+// THREAD-SAFE;
+//
+func (ledger *CertificateLedger) ImportConfigured(config *ConfigType) []error {
+  errs := make([]error, 0)
+  for _, aCertPath := range config.CertificatePaths() {
+    certs, err := certificates.LoadCertificatesFromFile(aCertPath)
+    if err != nil { continue } // (not yet) issued
+    imported, err := ledger.Import(certs[0], aCertPath)
+    if err != nil {
+      errs = append(errs, err)
+    } else if imported {
+      fmt.Printf("Recorded the existing certificate [%s] in the ledger\n", aCertPath)
+    }
+  }
+  return errs
+}
+
+// Record the revocation of the certificate with the given serial number.
+//
+// Returns false if the certificate is not in the ledger.
+//
+// THREAD-SAFE;
+//
+func (ledger *CertificateLedger) MarkRevoked(
+  serial    *big.Int,
+  revokedAt  time.Time,
+  reason     string,
+) (bool, error) {
+  ledger.Mutex.Lock()
+  defer ledger.Mutex.Unlock()
+
+  entryIndex := ledger.indexOf(serial)
+  if entryIndex < 0 { return false, nil }
+  ledger.Entries[entryIndex].Status     = LedgerRevoked
+  ledger.Entries[entryIndex].Revoked_At = revokedAt.UTC().Truncate(time.Second)
+  ledger.Entries[entryIndex].Reason     = reason
+  return true, ledger.save()
+}
+
+// Look up the entries whose serial number (in decimal or, with a "0x"
+// prefix, in hex), Common Name, or Cert_Path matches the query.
+//
+// THREAD-SAFE;
+//
+func (ledger *CertificateLedger) Lookup(query string) []LedgerEntry {
+  ledger.Mutex.Lock()
+  defer ledger.Mutex.Unlock()
+
+  serial, isSerial := new(big.Int).SetString(query, 0)
+  found := make([]LedgerEntry, 0)
+  for _, anEntry := range ledger.Entries {
+    if (isSerial && anEntry.Serial.Cmp(serial) == 0) ||
+      anEntry.CommonName() == query ||
+      strings.HasPrefix(anEntry.CommonName(), query+" ") ||
+      anEntry.Cert_Path == query {
+      found = append(found, anEntry)
+    }
+  }
+  return found
+}
+
+// Returns (a copy of) all of the entries in the ledger.
+//
+// THREAD-SAFE;
+//
+func (ledger *CertificateLedger) List() []LedgerEntry {
+  ledger.Mutex.Lock()
+  defer ledger.Mutex.Unlock()
+
+  return append([]LedgerEntry{}, ledger.Entries...)
+}
+
+// Compare the ledger with the certificates currently installed for the
+// CA and every configured Nursery and User.
+//
+// Returns a (human readable) description of each difference: installed
+// certificates which are not recorded, or were revoked, configured
+// certificates which are missing, as well as recorded certificates which
+// are still valid but have been superseded or are no longer configured.
+//
+// READS config;
+// THREAD-SAFE;
+//
+func (ledger *CertificateLedger) Diff(config *ConfigType, now time.Time) []string {
+  ledger.Mutex.Lock()
+  defer ledger.Mutex.Unlock()
+
+  diffs      := make([]string, 0)
+  configured := make(map[string]bool)
+  installed  := make(map[string]*big.Int)
+  for _, aCertPath := range config.CertificatePaths() {
+    configured[aCertPath] = true
+    certs, err := certificates.LoadCertificatesFromFile(aCertPath)
+    if err != nil {
+      diffs = append(diffs, fmt.Sprintf("missing:      [%s]", aCertPath))
+      continue
+    }
+    serial := certs[0].SerialNumber
+    installed[aCertPath] = serial
+    entryIndex := ledger.indexOf(serial)
+    if entryIndex < 0 {
+      diffs = append(diffs, fmt.Sprintf(
+        "unrecorded:   [%s] (serial %s)", aCertPath, serial,
+      ))
+    } else if ledger.Entries[entryIndex].Status == LedgerRevoked {
+      diffs = append(diffs, fmt.Sprintf(
+        "revoked:      [%s] (serial %s) is still installed", aCertPath, serial,
+      ))
+    }
+  }
+  rootPath := ""
+  if config.Certificate_Authority.Intermediate {
+    rootPath = config.Certificate_Authority.Root_Cert_File_Name
+  }
+  for _, anEntry := range ledger.Entries {
+    if anEntry.StatusAt(now) != LedgerValid { continue }
+    if anEntry.Cert_Path == rootPath { continue } // (kept offline)
+    if !configured[anEntry.Cert_Path] {
+      diffs = append(diffs, fmt.Sprintf(
+        "unconfigured: [%s] (serial %s) is still valid", anEntry.Cert_Path, anEntry.Serial,
+      ))
+      continue
+    }
+    serial, isInstalled := installed[anEntry.Cert_Path]
+    if !isInstalled || serial.Cmp(anEntry.Serial) != 0 {
+      diffs = append(diffs, fmt.Sprintf(
+        "superseded:   [%s] (serial %s) is still valid", anEntry.Cert_Path, anEntry.Serial,
+      ))
+    }
+  }
+  return diffs
+}
+
+// Write a (human readable) report of the given ledger entries.
+//
+func WriteLedgerReport(
+  w          io.Writer,
+  entries  []LedgerEntry,
+  now        time.Time,
+) {
+  fmt.Fprintf(w, "%-6s %-14s %-10s %-12s %s\n", "STATUS", "SERIAL", "EXPIRES", "REVOKED", "SUBJECT")
+  for _, anEntry := range entries {
+    revoked := "-"
+    if anEntry.Status == LedgerRevoked {
+      revoked = anEntry.Revoked_At.Format("2006-01-02")
+    }
+    fmt.Fprintf(w, "%-6s %-14s %-10s %-12s %s\n",
+      anEntry.StatusAt(now), anEntry.Serial,
+      anEntry.Not_After.Format("2006-01-02"), revoked, anEntry.CommonName(),
+    )
+    fmt.Fprintf(w, "%-6s %s\n", "", anEntry.Cert_Path)
+  }
+}
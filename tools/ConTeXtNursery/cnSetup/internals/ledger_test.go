@@ -0,0 +1,116 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "bytes"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "github.com/stretchr/testify/assert"
+  "math/big"
+  "os"
+  "strings"
+  "testing"
+  "time"
+)
+
+// Test that the ledger allocates (monotonically increasing) serial
+// numbers, refuses duplicates, and records revocations.
+//
+func TestLedger(t *testing.T) {
+  dir := t.TempDir()
+  config, ca := createTestSetup(t, dir, "plato01", "plato02")
+
+  entries := ca.Ledger.List()
+  assert.Len(t, entries, 3)
+  assert.Equal(t, ca.Cert.SerialNumber, entries[0].Serial)
+  assert.Equal(t, "ConTeXt Nursery ", entries[0].CommonName())
+  for i := 1 ; i < len(entries) ; i++ {
+    assert.Equal(t, 1, entries[i].Serial.Cmp(entries[i-1].Serial))
+  }
+  assert.Equal(t, 1, entries[0].Serial.Cmp(big.NewInt(LedgerSerialBase)))
+
+  // the ledger is persisted (in an openssl index.txt style)
+  reloaded := CreateCertificateLedger(ca.Index_File_Name)
+  assert.NoError(t, reloaded.Load())
+  assert.Equal(t, entries, reloaded.List())
+
+  // a serial number can not be issued twice
+  plato02 := config.Nurseries[1]
+  plato02.Serial_Number = uint(entries[2].Serial.Uint64())
+  err := plato02.RenewNurseryCertificateToFiles(ca, config.Federation_Name, false)
+  assert.Error(t, err)
+  assert.Len(t, ca.Ledger.List(), 3)
+
+  // certificates can be looked up by name, serial or path
+  found := ca.Ledger.Lookup("plato01")
+  assert.Len(t, found, 1)
+  assert.Equal(t, config.Nurseries[0].Cert_Path, found[0].Cert_Path)
+  assert.Len(t, ca.Ledger.Lookup(entries[2].Serial.String()), 1)
+  assert.Len(t, ca.Ledger.Lookup("0x"+entries[2].Serial.Text(16)), 1)
+  assert.Len(t, ca.Ledger.Lookup(plato02.Cert_Path), 1)
+  assert.Empty(t, ca.Ledger.Lookup("socrates"))
+
+  // revocations are recorded
+  revocations := CreateRevocationDB(ca)
+  assert.NoError(t, revocations.RevokeNamed(config, "plato01", "key, compromised"))
+  assert.NoError(t, reloaded.Load())
+  revoked := reloaded.Lookup("plato01")[0]
+  assert.Equal(t, LedgerRevoked, revoked.StatusAt(time.Now()))
+  assert.Equal(t, "key  compromised", revoked.Reason)
+
+  report := new(bytes.Buffer)
+  WriteLedgerReport(report, reloaded.List(), time.Now())
+  assert.Contains(t, report.String(), "plato02")
+  assert.Equal(t, 7, strings.Count(report.String(), "\n"))
+}
+
+// Test importing certificates issued before the ledger was kept, and
+// comparing the ledger with the installed certificates.
+//
+func TestLedgerImportAndDiff(t *testing.T) {
+  dir := t.TempDir()
+  config, ca := createTestSetup(t, dir, "plato01", "plato02")
+  now := time.Now()
+  assert.Empty(t, ca.Ledger.Diff(config, now))
+
+  // forget the ledger, then re-import the installed certificates
+  assert.NoError(t, os.Remove(ca.Index_File_Name))
+  ca.Ledger = CreateCertificateLedger(ca.Index_File_Name)
+  assert.Len(t, ca.Ledger.Diff(config, now), 3)
+  assert.Empty(t, ca.Ledger.ImportConfigured(config))
+  assert.Empty(t, ca.Ledger.ImportConfigured(config))
+  assert.Len(t, ca.Ledger.List(), 3)
+  assert.Empty(t, ca.Ledger.Diff(config, now))
+
+  // a different certificate with an already recorded serial is refused
+  certs, err := certificates.LoadCertificatesFromFile(config.Nurseries[0].Cert_Path)
+  assert.NoError(t, err)
+  duplicate := *certs[0]
+  duplicate.SerialNumber = ca.Ledger.List()[2].Serial
+  _, err = ca.Ledger.Import(&duplicate, "elsewhere")
+  assert.Error(t, err)
+
+  // renewals leave the superseded (but still valid) certificate, while
+  // removing a nursery leaves its certificate unconfigured
+  assert.NoError(t, config.Nurseries[0].RenewNurseryCertificateToFiles(
+    ca, config.Federation_Name, false,
+  ))
+  config.Nurseries = config.Nurseries[:1]
+  config.Users = []UserType{ { Name: "plato@example.com", Cert_Path: dir+"/missing.pem" } }
+  diffs := strings.Join(ca.Ledger.Diff(config, now), "\n")
+  assert.Contains(t, diffs, "superseded:   ["+config.Nurseries[0].Cert_Path+"]")
+  assert.Contains(t, diffs, "unconfigured: ["+dir+"/servers/plato02")
+  assert.Contains(t, diffs, "missing:      ["+dir+"/missing.pem]")
+}
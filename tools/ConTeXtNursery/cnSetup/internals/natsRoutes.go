@@ -0,0 +1,157 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "crypto/rand"
+  "encoding/binary"
+  "fmt"
+  "hash/fnv"
+  "io/ioutil"
+  "net"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// Load the seed used to shuffle the NATS routes of each Nursery and User
+// from the seedPath file.
+//
+// If the file does not (yet) exist, a new (random) seed is created and
+// persisted, so that every later run of cnSetup shuffles the routes in
+// the same way.
+//
+func LoadNatsRoutesSeed(seedPath string) (uint64, error) {
+  seedBytes, err := ioutil.ReadFile(seedPath)
+  if err == nil {
+    seed, err := strconv.ParseUint(strings.TrimSpace(string(seedBytes)), 10, 64)
+    if err != nil {
+      return 0, fmt.Errorf("could not parse the NATS routes seed in [%s]: %w", seedPath, err)
+    }
+    return seed, nil
+  }
+  if !os.IsNotExist(err) {
+    return 0, fmt.Errorf("could not read the NATS routes seed [%s]: %w", seedPath, err)
+  }
+
+  var randomSeed [8]byte
+  _, err = rand.Read(randomSeed[:])
+  if err != nil {
+    return 0, fmt.Errorf("could not read a random seed from the system random stream: %w", err)
+  }
+  seed := binary.LittleEndian.Uint64(randomSeed[:])
+  os.MkdirAll(filepath.Dir(seedPath), 0755)
+  err = ioutil.WriteFile(seedPath, []byte(strconv.FormatUint(seed, 10)+"\n"), 0644)
+  if err != nil {
+    return 0, fmt.Errorf("could not write the NATS routes seed [%s]: %w", seedPath, err)
+  }
+  return seed, nil
+}
+
+// Returns the (seeded) shuffle of the given routes for the named Nursery
+// or User (as the indices of the routes in their shuffled order).
+//
+// Each route is ordered by a hash of the seed, the owner's name and the
+// route itself, so adding (or removing) a route never alters the relative
+// order of the other routes.
+//
+func NatsRouteShuffle(seed uint64, owner string, routes []string) []int {
+  keys    := make([]uint64, len(routes))
+  shuffle := make([]int,    len(routes))
+  for i, aRoute := range routes {
+    hash := fnv.New64a()
+    binary.Write(hash, binary.LittleEndian, seed)
+    hash.Write([]byte(owner+"\x00"+aRoute))
+    keys[i]    = hash.Sum64()
+    shuffle[i] = i
+  }
+  sort.SliceStable(shuffle, func(i, j int) bool {
+    return keys[shuffle[i]] < keys[shuffle[j]]
+  })
+  return shuffle
+}
+
+// Compute the NATS routes of the whole federation, and then (re)set the
+// (seeded) shuffle of these routes for each Nursery and User.
+//
+// ALTERS config;
+// NOT THREAD-SAFE;
+//
+func (config *ConfigType) SetNatsRoutes() {
+  config.NATS_Federation_Routes = make([]string, len(config.Nurseries))
+  config.NATS_Message_Routes    = make([]string, len(config.Nurseries))
+  for i, _ := range config.Nurseries {
+    config.NATS_Federation_Routes[i] = config.Nurseries[i].ComputeFederationNATS()
+    config.NATS_Message_Routes[i]    = config.Nurseries[i].ComputeMessageNATS()
+  }
+
+  for i, aNursery := range config.Nurseries {
+    natsShuffle := NatsRouteShuffle(
+      config.NATS_Routes_Seed, aNursery.Name, config.NATS_Federation_Routes,
+    )
+    config.Nurseries[i].SetNatsRoutes(
+      &config.NATS_Federation_Routes,
+      &config.NATS_Message_Routes,
+      &natsShuffle,
+    )
+  }
+
+  for i, aUser := range config.Users {
+    natsShuffle := NatsRouteShuffle(
+      config.NATS_Routes_Seed, aUser.Name, config.NATS_Message_Routes,
+    )
+    config.Users[i].SetNatsRoutes(
+      &config.NATS_Message_Routes,
+      &natsShuffle,
+    )
+  }
+}
+
+// Compute the identities (mapped, by each Nursery's NATS server, from the 
+// x509 certificates of its TLS clients) used to authorize the Nurseries 
+// and Users. 
+//
+// A Nursery is identified by its first (DNS) host name, while a User is 
+// identified by the (RFC 2253) subject of their certificate (which 
+// contains the user's Common Name). 
+//
+// ALTERS config;
+// NOT THREAD-SAFE;
+//
+func (config *ConfigType) SetNatsUsers() {
+  nurseryUsers := []string{}
+  for _, aNursery := range config.Nurseries {
+    for _, aHost := range aNursery.Hosts {
+      if net.ParseIP(aHost) != nil { continue }
+      nurseryUsers = append(nurseryUsers, aHost)
+      break
+    }
+  }
+
+  userUsers := []string{}
+  for _, aUser := range config.Users {
+    uCert := config.Certificate_Authority.NewBaseCertificate(
+      aUser.CommonName(config.Federation_Name), 0,
+    )
+    userUsers = append(userUsers, uCert.Subject.String())
+  }
+
+  for i, _ := range config.Nurseries {
+    config.Nurseries[i].NATS_Nursery_Users = nurseryUsers
+    config.Nurseries[i].NATS_User_Users    = userUsers
+  }
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "strings"
+  "testing"
+)
+
+// Test that each Nursery's (and User's) NATS routes are a (seeded)
+// shuffle of the federation's routes, and that a Nursery's message routes
+// use the messages (not the cluster) ports.
+//
+func TestNatsRoutes(t *testing.T) {
+  config := CreateConfiguration(logger.CreateLogger("cnSetupTest"))
+  config.Federation_Name  = "test"
+  config.Key_Algorithm    = RsaKey
+  config.NATS_Routes_Seed = 42
+  for i := 1 ; i <= 5 ; i++ {
+    config.Nurseries = append(config.Nurseries, NurseryType{
+      Host: fmt.Sprintf("plato%02d", i),
+    })
+    config.Nurseries[i-1].NormalizeConfig(i-1, &NurseryDefaults, config)
+  }
+  config.Users = []UserType{ { Name: "plato@example.com" } }
+  config.Users[0].NormalizeConfig(0, &UserDefaults, config)
+  config.SetNatsRoutes()
+
+  assert.Len(t, config.NATS_Federation_Routes, 5)
+  assert.Equal(t, "nats://plato01:4221", config.NATS_Federation_Routes[0])
+  assert.Equal(t, "nats://plato01:4222", config.NATS_Message_Routes[0])
+
+  orders := map[string]bool{}
+  for _, aNursery := range config.Nurseries {
+    assert.ElementsMatch(t, config.NATS_Federation_Routes, aNursery.NATS_Federation_Routes)
+    assert.ElementsMatch(t, config.NATS_Message_Routes, aNursery.NATS_Message_Routes)
+    for i, aRoute := range aNursery.NATS_Message_Routes {
+      assert.Equal(t,
+        strings.Replace(aNursery.NATS_Federation_Routes[i], ":4221", ":4222", 1),
+        aRoute,
+      )
+    }
+    orders[strings.Join(aNursery.NATS_Federation_Routes, ",")] = true
+  }
+  assert.Less(t, 1, len(orders))
+  assert.ElementsMatch(t, config.NATS_Message_Routes, config.Users[0].NATS_Message_Routes)
+
+  // the same seed gives the same routes
+  routes := config.Nurseries[2].NATS_Federation_Routes
+  config.SetNatsRoutes()
+  assert.Equal(t, routes, config.Nurseries[2].NATS_Federation_Routes)
+}
+
+// Test the NATS server configuration (and the authorization of Nurseries
+// and Users) when the federation uses nats_tls.
+//
+func TestNatsTLSConfiguration(t *testing.T) {
+  dir := t.TempDir()
+  config, ca := createTestSetup(t, dir, "plato01, 10.0.0.1", "plato02")
+  config.NATS_TLS = true
+  config.Users = []UserType{
+    { Name: "plato@example.com", Cert_Dir: dir+"/users/plato" },
+  }
+  for i, _ := range config.Nurseries {
+    config.Nurseries[i].NormalizeConfig(i, &config.Nursery_Defaults, config)
+  }
+  config.Users[0].NormalizeConfig(0, &UserDefaults, config)
+  plato := &config.Users[0]
+  assert.NoError(t, plato.CreateUserCertificate(0, ca, config.Federation_Name))
+  config.SetNatsRoutes()
+  config.SetNatsUsers()
+
+  plato01 := &config.Nurseries[0]
+  assert.Equal(t, []string{ "plato01", "plato02" }, plato01.NATS_Nursery_Users)
+
+  // the user's identity is the subject of their certificate
+  userCerts, err := certificates.LoadCertificatesFromFile(plato.Cert_Path)
+  assert.NoError(t, err)
+  assert.Equal(t, []string{ userCerts[0].Subject.String() }, plato01.NATS_User_Users)
+  assert.Contains(t, plato01.NATS_User_Users[0], "CN="+plato.CommonName(config.Federation_Name))
+
+  _, err = plato01.WriteNATSConfiguration()
+  assert.NoError(t, err)
+  natsBytes, err := ioutil.ReadFile(plato01.NATS_Path)
+  assert.NoError(t, err)
+  natsConf := string(natsBytes)
+  assert.Contains(t, natsConf, `cert_file: "/cnNursery/conf/plato01-crt.pem"`)
+  assert.Contains(t, natsConf, `ca_file:   "/cnNursery/conf/plato01-ca-crt.pem"`)
+  assert.Contains(t, natsConf, "verify_and_map: true")
+  assert.Contains(t, natsConf, "verify: true")
+  assert.Contains(t, natsConf, `{ user: "plato02" }`)
+  assert.Contains(t, natsConf, fmt.Sprintf("{ user: %q, permissions:", userCerts[0].Subject.String()))
+  assert.Equal(t, 2, strings.Count(natsConf, "tls: {"))
+
+  // the nursery's (and user's) configuration list the messages ports
+  _, err = plato01.WriteConfiguration()
+  assert.NoError(t, err)
+  configBytes, err := ioutil.ReadFile(plato01.Config_Path)
+  assert.NoError(t, err)
+  assert.Contains(t, string(configBytes), "  - nats://plato01:4222\n")
+  assert.NotContains(t, string(configBytes), ":4221\n")
+  _, err = plato.WriteConfiguration()
+  assert.NoError(t, err)
+  userBytes, err := ioutil.ReadFile(plato.Config_Path)
+  assert.NoError(t, err)
+  assert.Contains(t, string(userBytes), "nats_tls:     true")
+
+  // without nats_tls, there is neither TLS nor authorization
+  plato01.NATS_TLS = false
+  _, err = plato01.WriteNATSConfiguration()
+  assert.NoError(t, err)
+  natsBytes, err = ioutil.ReadFile(plato01.NATS_Path)
+  assert.NoError(t, err)
+  assert.NotContains(t, string(natsBytes), "tls")
+  assert.NotContains(t, string(natsBytes), "authorization")
+}
@@ -18,9 +18,11 @@
 package CNSetup
 
 import (
+  "bytes"
   "fmt"
-  "math/rand"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
   "os"
+  "path"
   "strconv"
   "strings"
   "text/template"
@@ -29,7 +31,7 @@ import (
 // The NurseryType contains the information required to:
 //
 //   1. Create x509 Server Certificates as well as associated 
-//      public/private RSA keys.
+//      public/private (RSA, ECDSA or Ed25519) keys.
 //
 //   2. Write out the YAML configuration files used by each cnNursery. 
 //
@@ -43,6 +45,9 @@ type NurseryType struct {
   Host                     string
   Hosts                  []string
   Interface                string
+  Port                     uint
+  Is_Primary               bool
+  Primary_Candidates     []string
   Messages_Port            uint
   Monitor_Port             uint
   Librarian_Port           uint
@@ -51,16 +56,24 @@ type NurseryType struct {
   Ca_Cert_Path             string
   Cert_Path                string
   Key_Path                 string
+  Key_Passphrase           string
+  Crl_Path                 string
+  Base_Url                 string
   Librarian_Url            string
   NATS_Url                 string
   NATS_Federation_Routes []string
   NATS_Message_Routes    []string
+  NATS_TLS                 bool
+  NATS_Conf_Dir            string
+  NATS_Nursery_Users     []string
+  NATS_User_Users        []string
   Config_Path              string
   NATS_Path                string
   ENVS_Path                string
   Work_Dir                 string
   Actions_Dir              string
   Serial_Number            uint
+  Key_Algorithm            string
   Key_Size                 uint
 }
 
@@ -72,6 +85,9 @@ var (
     "",                       // Host
     []string{},               // Hosts
     "0.0.0.0",                // Interface
+    0,                        // Port
+    false,                    // Is_Primary
+    []string{},               // Primary_Candidates
     4222,                     // Messages_Port
     4223,                     // Monitor_Port
     4220,                     // Librarian_Port
@@ -80,20 +96,43 @@ var (
     "",                       // Ca_Cert_Path
     "",                       // Cert_Path
     "",                       // Key_Path
+    "",                       // Key_Passphrase
+    "",                       // Crl_Path
+    "",                       // Base_Url
     "https://localhost:4220", // Librarian_Url
     "nats://localhost:4221",  // NATS_Url
     []string{},               // NATS_Federation_Routes
     []string{},               // NATS_Message_Routes
+    false,                    // NATS_TLS
+    "/cnNursery/conf",        // NATS_Conf_Dir
+    []string{},               // NATS_Nursery_Users
+    []string{},               // NATS_User_Users
     "",                       // Config_Path
     "",                       // NATS_Path
     "",                       // ENVS_Path
     "workDir",                // Word_Dir
     "actionsDir",             // Actions_Dir
     0,                        // Serial_Number
+    "",                       // Key_Algorithm
     0,                        // Key_Size
   }
 )
 
+// Returns the passphrase (read from the nursery's Key_Passphrase source) 
+// used to encrypt the nursery's private key (or nil if the key is not 
+// encrypted). 
+//
+// (The same source is written to the nursery's configuration, so that the 
+// cnNursery can unlock its key at startup.) 
+//
+// READS nursery;
+//
+func (nursery *NurseryType) KeyPassphrase() ([]byte, error) {
+  return KeyPassphrase(
+    nursery.Key_Passphrase, "the ["+nursery.Name+"] Nursery key ["+nursery.Key_Path+"]",
+  )
+}
+
 // Compute the NATS (control) URL associated with a given Nursery.
 //
 // READS nursery;
@@ -110,6 +149,14 @@ func (nursery *NurseryType) ComputeMessageNATS() string {
   return "nats://"+nursery.Hosts[0]+":"+strconv.Itoa(int(nursery.Messages_Port))
 }
 
+// Compute the (webserver's) base URL associated with a given Nursery.
+//
+// READS nursery;
+//
+func (nursery *NurseryType) ComputeBaseUrl() string {
+  return "https://"+nursery.Hosts[0]+":"+strconv.Itoa(int(nursery.Port))
+}
+
 // Compute the Librarian URL associated with a given Nursery.
 //
 // READS nursery;
@@ -135,6 +182,7 @@ func (nursery *NurseryType) NormalizeConfig(
   if nursery.Federation_Name == "" { nursery.Federation_Name = config.Federation_Name }
   if nursery.Federation_Port == 0  { nursery.Federation_Port = defaults.Federation_Port }
   if nursery.Interface       == "" { nursery.Interface       = defaults.Interface }
+  if nursery.Port            == 0  { nursery.Port            = defaults.Port }
   if nursery.Messages_Port   == 0  { nursery.Messages_Port   = defaults.Messages_Port }
   if nursery.Monitor_Port    == 0  { nursery.Monitor_Port    = defaults.Monitor_Port }
   if nursery.Librarian_Port  == 0  { nursery.Librarian_Port  = defaults.Librarian_Port }
@@ -143,8 +191,12 @@ func (nursery *NurseryType) NormalizeConfig(
   if nursery.Ca_Cert_Path    == "" { nursery.Ca_Cert_Path    = defaults.Ca_Cert_Path }
   if nursery.Cert_Path       == "" { nursery.Cert_Path       = defaults.Cert_Path }
   if nursery.Key_Path        == "" { nursery.Key_Path        = defaults.Key_Path }
+  if nursery.Key_Passphrase  == "" { nursery.Key_Passphrase  = defaults.Key_Passphrase }
+  if nursery.Crl_Path        == "" { nursery.Crl_Path        = defaults.Crl_Path }
   if nursery.Work_Dir        == "" { nursery.Work_Dir        = defaults.Work_Dir }
   if nursery.Actions_Dir     == "" { nursery.Actions_Dir     = defaults.Actions_Dir }
+  if nursery.NATS_Conf_Dir   == "" { nursery.NATS_Conf_Dir   = defaults.NATS_Conf_Dir }
+  if nursery.Key_Algorithm   == "" { nursery.Key_Algorithm   = defaults.Key_Algorithm }
   if nursery.Key_Size        == 0  { nursery.Key_Size        = defaults.Key_Size }
   
   if nursery.Host == "" { nursery.Host = defaults.Host }
@@ -161,57 +213,75 @@ func (nursery *NurseryType) NormalizeConfig(
     if nursery.Ca_Cert_Path  == "" { nursery.Ca_Cert_Path  = nPathPrefix+"-ca-crt.pem" }
     if nursery.Cert_Path     == "" { nursery.Cert_Path     = nPathPrefix+"-crt.pem" }
     if nursery.Key_Path      == "" { nursery.Key_Path      = nPathPrefix+"-key.pem" }
+    if nursery.Crl_Path      == "" { nursery.Crl_Path      = nPathPrefix+"-crl.pem" }
     if nursery.Config_Path   == "" { nursery.Config_Path   = nPathPrefix+"-config.yaml" }
     if nursery.NATS_Path     == "" { nursery.NATS_Path     = nursery.Cert_Dir+"/nats-server.conf" }
     if nursery.ENVS_Path     == "" { nursery.ENVS_Path     = nursery.Cert_Dir+"/pod-envs.sh" }
+    if nursery.Base_Url      == "" { nursery.Base_Url      = nursery.ComputeBaseUrl() }
     if nursery.NATS_Url      == "" { nursery.NATS_Url      = nursery.ComputeFederationNATS() }
     if nursery.Librarian_Url == "" { nursery.Librarian_Url = nursery.ComputeLibrarian() }
   }
   
-  // we need to use DIFFERENT serial numbers for each of CA (1<<32),
-  //  C/S  ((1<<5 + nurseryNum)<<33) and
-  //  User ((2<<5 + userNum)<<33)
-  //
-  if nursery.Serial_Number == 0 {
-    nursery.Serial_Number = uint(1<<5 + nurseryNum)
-  }
   if nursery.Key_Size == 0 {
     nursery.Key_Size = config.Key_Size
   }
+  if nursery.Key_Passphrase != "" && !certificates.IsPassphraseSource(nursery.Key_Passphrase) {
+    config.CSLog.Logf(
+      "The key_passphrase for the [%s] nursery MUST be [%s], [%s<NAME>] or [%s<PATH>]",
+      nursery.Name, certificates.PromptPassphrase,
+      certificates.EnvPassphrasePrefix, certificates.FilePassphrasePrefix,
+    )
+    os.Exit(-1)
+  }
+  // (the NATS server can not unlock an encrypted key) 
+  //
+  nursery.NATS_TLS = config.NATS_TLS
+  if nursery.NATS_TLS && nursery.Key_Passphrase != "" {
+    config.CSLog.Logf(
+      "The key for the [%s] nursery can not be encrypted (with a key_passphrase) when nats_tls is used",
+      nursery.Name,
+    )
+    os.Exit(-1)
+  }
+  if nursery.Key_Algorithm == "" { nursery.Key_Algorithm = config.Key_Algorithm }
+  if !IsKeyAlgorithm(nursery.Key_Algorithm) {
+    config.CSLog.Logf(
+      "The key_algorithm for the [%s] nursery MUST be one of [%s], [%s], [%s] or [%s]",
+      nursery.Name, RsaKey, EcdsaP256Key, EcdsaP384Key, Ed25519Key,
+    )
+    os.Exit(-1)
+  }
 }
 
-// Set the Nursery's NATS routes (of the whole federation)
+// Set the Nursery's NATS routes (of the whole federation) in the order 
+// given by the (seeded) natsShuffle. 
 //
 // ALTERS nursery;
 // NOT THREAD-SAFE;
-// CALLED BY: LoadConfiguration ONLY;
+// CALLED BY: ConfigType.SetNatsRoutes ONLY;
 //
 func (nursery *NurseryType) SetNatsRoutes(
   natsFederationRoutes *[]string,
   natsMessageRoutes    *[]string,
   natsShuffle          *[]int,
 ) {
-  rand.Shuffle(len(*natsShuffle), func(i, j int) {
-    (*natsShuffle)[i], (*natsShuffle)[j] =
-      (*natsShuffle)[j], (*natsShuffle)[i]
-  })
   nursery.NATS_Federation_Routes = make([]string, len(*natsShuffle))
   nursery.NATS_Message_Routes    = make([]string, len(*natsShuffle))
   for i, j := range *natsShuffle {
   	nursery.NATS_Federation_Routes[i] = (*natsFederationRoutes)[j]
-  	nursery.NATS_Message_Routes[i]    =
-  	  (*natsFederationRoutes)[(*natsShuffle)[j]]
+  	nursery.NATS_Message_Routes[i]    = (*natsMessageRoutes)[j]
   }
 }
 
 // Write out the YAML configuration file requred to run a given cnNursery 
 // command. 
 //
+// The file is only (re)written (and true returned) if its contents have 
+// changed. 
+//
 // READS nursery;
 //
-func (nursery *NurseryType) WriteConfiguration() error {
-
-  fmt.Printf("\n\nCreating configuration for the [%s] Nursery\n", nursery.Name)
+func (nursery *NurseryType) WriteConfiguration() (bool, error) {
 
   yamlTemplateStr := `
 # This is the configuration for the {{.Name}} Nursery
@@ -223,7 +293,11 @@ func (nursery *NurseryType) WriteConfiguration() error {
 federation_name: "{{.Federation_Name}}"
 name:            "{{.Name}}"
 host:            "{{.Host}}"
-interface:       "{{.Interface}}"
+interface:       "{{.Interface}}"{{ if .Port }}
+port:            "{{.Port}}"{{ end }}
+base_url:        "{{.Base_Url}}"
+primary_candidates:{{ range .Primary_Candidates }}
+  - {{ . }}{{ end }}
 federation_port:  {{.Federation_Port}}
 messages_port:    {{.Messages_Port}}
 monitor_port:     {{.Monitor_Port}}
@@ -231,45 +305,52 @@ librarian_port:   {{.Librarian_Port}}
 html_dir:        "{{.Html_Dir}}"
 ca_cert_path:    "{{.Ca_Cert_Path}}"
 cert_path:       "{{.Cert_Path}}"
-key_path:        "{{.Key_Path}}"
+key_path:        "{{.Key_Path}}"{{ if .Key_Passphrase }}
+key_passphrase:  "{{.Key_Passphrase}}"{{ end }}{{ if .Crl_Path }}
+crl_path:        "{{.Crl_Path}}"{{ end }}
 work_dir:        "{{.Work_Dir}}"
 actions_dir:     "{{.Actions_Dir}}"
-nats_routes:{{ range .NATS_Federation_Routes }}
+nats_routes:{{ range .NATS_Message_Routes }}
   - {{ . }}{{ end }}
 `
 
   yamlTemplate, err := template.New("yamlTemplate").Parse(yamlTemplateStr)
   if err != nil {
-    return fmt.Errorf("Could not parse the yaml template: %w", err)
+    return false, fmt.Errorf("Could not parse the yaml template: %w", err)
   }
 
-  yamlFile, err := os.Create(nursery.Config_Path)
+  var yamlBytes bytes.Buffer
+  err = yamlTemplate.Execute(&yamlBytes, nursery)
   if err != nil {
-    return fmt.Errorf("Could not open the config file for writing: %w", err)
+    return false, fmt.Errorf("Could not run nursery configuration YAML template: %w", err)
   }
 
-  err = yamlTemplate.Execute(yamlFile, nursery)
+  changed, err := writeGeneratedFile(nursery.Config_Path, yamlBytes.Bytes())
   if err != nil {
-    yamlFile.Close()
-    return fmt.Errorf("Could not run nursery configuration YAML template: %w", err)
+    return false, fmt.Errorf("Could not write the nursery config file: %w", err)
   }
-  
-  err = yamlFile.Close()
-  if err != nil {
-    return fmt.Errorf("Could not close the nursery config file: %w", err)
+  if changed {
+    fmt.Printf("\n\nCreating configuration for the [%s] Nursery\n", nursery.Name)
   }
-  
-  return nil
+  return changed, nil
 }
 
 // Write out the YAML configuration file requred to run a given 
 // cnMessages(NATS) microService. 
 //
+// When nats_tls is used, both the (client) messages port and the 
+// (cluster) federation port require TLS (using the Nursery's certificate 
+// and the federation's CA), and each client is authorized by the identity 
+// mapped from its certificate: the Nurseries (by their host names) with 
+// every permission, and the Users (by their certificate's subject) with 
+// permission to use only the "artifact.>" subjects (and their replies). 
+//
+// The file is only (re)written (and true returned) if its contents have 
+// changed. 
+//
 // READS nursery;
 //
-func (nursery *NurseryType) WriteNATSConfiguration() error {
-
-  fmt.Printf("\n\nCreating cnMessages(NATS) configuration for the [%s] Nursery\n", nursery.Name)
+func (nursery *NurseryType) WriteNATSConfiguration() (bool, error) {
 
   yamlTemplateStr := `
 # This is the cnMessages(NATS) configuration for the {{.Name}} Nursery
@@ -280,48 +361,71 @@ func (nursery *NurseryType) WriteNATSConfiguration() error {
 
 server_name: "{{.Name}}"
 port: {{.Messages_Port}}
-http_port: {{.Monitor_Port}}
+http_port: {{.Monitor_Port}}{{ if .NATS_TLS }}
+tls: {
+  cert_file: "{{.NATS_Conf_Dir}}/{{ base .Cert_Path }}"
+  key_file:  "{{.NATS_Conf_Dir}}/{{ base .Key_Path }}"
+  ca_file:   "{{.NATS_Conf_Dir}}/{{ base .Ca_Cert_Path }}"
+  verify_and_map: true
+}
+authorization: {
+  users: [{{ range .NATS_Nursery_Users }}
+    { user: {{ printf "%q" . }} },{{ end }}{{ range .NATS_User_Users }}
+    { user: {{ printf "%q" . }}, permissions: {
+        publish:   [ "artifact.>" ]
+        subscribe: [ "artifact.>", "_INBOX.>" ]
+    } },{{ end }}
+  ]
+}{{ end }}
 cluster: {
   name: "{{.Federation_Name}}"
-  port: {{.Federation_Port}}
+  port: {{.Federation_Port}}{{ if .NATS_TLS }}
+  tls: {
+    cert_file: "{{.NATS_Conf_Dir}}/{{ base .Cert_Path }}"
+    key_file:  "{{.NATS_Conf_Dir}}/{{ base .Key_Path }}"
+    ca_file:   "{{.NATS_Conf_Dir}}/{{ base .Ca_Cert_Path }}"
+    verify: true
+  }{{ end }}
   routes: [{{ range .NATS_Federation_Routes }}
     "{{ . }}",{{ end }}
   ]
 }
 `
 
-  yamlTemplate, err := template.New("yamlTemplate").Parse(yamlTemplateStr)
+  yamlTemplate, err := template.New("yamlTemplate").Funcs(
+    template.FuncMap{ "base": path.Base },
+  ).Parse(yamlTemplateStr)
   if err != nil {
-    return fmt.Errorf("Could not parse the yaml template: %w", err)
+    return false, fmt.Errorf("Could not parse the yaml template: %w", err)
   }
 
-  yamlFile, err := os.Create(nursery.NATS_Path)
+  var yamlBytes bytes.Buffer
+  err = yamlTemplate.Execute(&yamlBytes, nursery)
   if err != nil {
-    return fmt.Errorf("Could not open the config file for writing: %w", err)
+    return false, fmt.Errorf("Could not run nursery configuration YAML template: %w", err)
   }
 
-  err = yamlTemplate.Execute(yamlFile, nursery)
+  changed, err := writeGeneratedFile(nursery.NATS_Path, yamlBytes.Bytes())
   if err != nil {
-    yamlFile.Close()
-    return fmt.Errorf("Could not run nursery configuration YAML template: %w", err)
+    return false, fmt.Errorf("Could not write the nursery NATS config file: %w", err)
   }
-  
-  err = yamlFile.Close()
-  if err != nil {
-    return fmt.Errorf("Could not close the nursery config file: %w", err)
+  if changed {
+    fmt.Printf("\n\nCreating cnMessages(NATS) configuration for the [%s] Nursery\n", nursery.Name)
   }
-  
-  return nil
+  return changed, nil
 }
 
-// Write out the YAML configuration file requred to run a given 
-// cnMessages(NATS) microService. 
+// Write out the pod environment variables file (sourced when a given 
+// Nursery's pod is started) containing the Nursery's name, its 
+// federation's name, and its federation, messages, monitor and librarian 
+// ports. 
+//
+// The file is only (re)written (and true returned) if its contents have 
+// changed. 
 //
 // READS nursery;
 //
-func (nursery *NurseryType) WriteENVSConfiguration() error {
-
-  fmt.Printf("\n\nCreating pod environment variables for the [%s] Nursery\n", nursery.Name)
+func (nursery *NurseryType) WriteENVSConfiguration() (bool, error) {
 
   yamlTemplateStr := `
 # These are the pod environment variables for the {{.Name}} Nursery
@@ -340,24 +444,21 @@ export LIBRARIAN_PORT={{.Librarian_Port}}
 
   yamlTemplate, err := template.New("yamlTemplate").Parse(yamlTemplateStr)
   if err != nil {
-    return fmt.Errorf("Could not parse the yaml template: %w", err)
+    return false, fmt.Errorf("Could not parse the yaml template: %w", err)
   }
 
-  yamlFile, err := os.Create(nursery.ENVS_Path)
+  var yamlBytes bytes.Buffer
+  err = yamlTemplate.Execute(&yamlBytes, nursery)
   if err != nil {
-    return fmt.Errorf("Could not open the pod environment variables file for writing: %w", err)
+    return false, fmt.Errorf("Could not run pod environment variables template: %w", err)
   }
 
-  err = yamlTemplate.Execute(yamlFile, nursery)
+  changed, err := writeGeneratedFile(nursery.ENVS_Path, yamlBytes.Bytes())
   if err != nil {
-    yamlFile.Close()
-    return fmt.Errorf("Could not run pod environment variables template: %w", err)
+    return false, fmt.Errorf("Could not write the pod environment variables file: %w", err)
   }
-  
-  err = yamlFile.Close()
-  if err != nil {
-    return fmt.Errorf("Could not close the pod environment variables file: %w", err)
+  if changed {
+    fmt.Printf("\n\nCreating pod environment variables for the [%s] Nursery\n", nursery.Name)
   }
-  
-  return nil
+  return changed, nil
 }
@@ -0,0 +1,204 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "crypto"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "io"
+  "time"
+)
+
+// The kind of the Certificate Authority's own certificate.
+//
+const CAKind = "ca"
+
+// The status of a single issued certificate.
+//
+// The Serial_Number, Subject and Not_After are only known if the
+// certificate could be loaded (otherwise the Error explains why not).
+//
+type CertificateStatus struct {
+  Kind          string
+  Name          string
+  Cert_Path     string
+  Serial_Number string
+  Subject       string
+  Not_After     time.Time
+  Days_Left     int
+  Revoked       bool
+  Error         string
+}
+
+// Returns true if this certificate SHOULD be renewed, that is it expires 
+// within the given number of days.
+//
+// Revoked certificates (and those which could not be loaded) are never 
+// renewed. 
+//
+func (status CertificateStatus) NeedsRenewal(withinDays uint) bool {
+  if status.Revoked || status.Error != "" { return false }
+  return status.Days_Left <= int(withinDays)
+}
+
+// Load the status of the (first) certificate in the file at certPath.
+//
+// READS db;
+//
+func loadCertificateStatus(
+  kind, name, certPath string,
+  db *RevocationDB,
+  now time.Time,
+) CertificateStatus {
+  status := CertificateStatus{ Kind: kind, Name: name, Cert_Path: certPath }
+  certs, err := certificates.LoadCertificatesFromFile(certPath)
+  if err != nil {
+    status.Error = err.Error()
+    return status
+  }
+  cert := certs[0]
+  status.Serial_Number = cert.SerialNumber.String()
+  status.Subject       = cert.Subject.CommonName
+  status.Not_After     = cert.NotAfter
+  status.Days_Left     = int(cert.NotAfter.Sub(now).Hours() / 24)
+  status.Revoked       = db != nil && db.IsRevoked(cert.SerialNumber)
+  return status
+}
+
+// Collect the status of every certificate issued by the CA, that is the
+// CA's own certificate, as well as the certificate of every configured
+// Nursery and User.
+//
+// READS config;
+// READS db;
+//
+func (config *ConfigType) CertificateStatuses(
+  db  *RevocationDB,
+  now  time.Time,
+) []CertificateStatus {
+  ca       := &config.Certificate_Authority
+  statuses := []CertificateStatus{
+    loadCertificateStatus(CAKind, ca.Common_Name, ca.Cert_File_Name, db, now),
+  }
+  for _, aNursery := range config.Nurseries {
+    statuses = append(statuses, loadCertificateStatus(
+      NurseryKind, aNursery.Name, aNursery.Cert_Path, db, now,
+    ))
+  }
+  for _, aUser := range config.Users {
+    statuses = append(statuses, loadCertificateStatus(
+      UserKind, aUser.Name, aUser.Cert_Path, db, now,
+    ))
+  }
+  return statuses
+}
+
+// Returns the paths of the certificates of the CA, and of every 
+// configured Nursery and User. 
+//
+// READS config;
+//
+func (config *ConfigType) CertificatePaths() []string {
+  certPaths := []string{ config.Certificate_Authority.Cert_File_Name }
+  for _, aNursery := range config.Nurseries {
+    certPaths = append(certPaths, aNursery.Cert_Path)
+  }
+  for _, aUser := range config.Users {
+    certPaths = append(certPaths, aUser.Cert_Path)
+  }
+  return certPaths
+}
+
+// Write a (human readable) report of the status of the certificates,
+// flagging those which expire within the given number of days.
+//
+func WriteStatusReport(
+  w            io.Writer,
+  statuses   []CertificateStatus,
+  withinDays   uint,
+) {
+  fmt.Fprintf(w, "%-8s %-30s %-14s %9s  %s\n", "KIND", "NAME", "SERIAL", "DAYS LEFT", "SUBJECT")
+  for _, aStatus := range statuses {
+    if aStatus.Error != "" {
+      fmt.Fprintf(w, "%-8s %-30s %-14s %9s  (%s)\n",
+        aStatus.Kind, aStatus.Name, "-", "-", aStatus.Error,
+      )
+      continue
+    }
+    note := ""
+    if aStatus.Revoked {
+      note = " [REVOKED]"
+    } else if aStatus.Days_Left < 0 {
+      note = " [EXPIRED]"
+    } else if aStatus.NeedsRenewal(withinDays) {
+      note = " [RENEW]"
+    }
+    fmt.Fprintf(w, "%-8s %-30s %-14s %9d  %s%s\n",
+      aStatus.Kind, aStatus.Name, aStatus.Serial_Number,
+      aStatus.Days_Left, aStatus.Subject, note,
+    )
+  }
+}
+
+// Returns the private key to use for a renewed certificate: either the
+// existing (possibly encrypted) key found at keyPath, or (if rotateKey is
+// true) a new key of the given algorithm (and size).
+//
+// IGNORES ca;
+//
+func (ca *CAType) RenewalKey(
+  keyPath      string,
+  passphrase []byte,
+  keyAlgorithm string,
+  keySize      uint,
+  rotateKey    bool,
+) (crypto.Signer, error) {
+  if rotateKey { return NewPrivateKey(keyAlgorithm, keySize) }
+  return LoadPrivateKey(keyPath, passphrase)
+}
+
+// Select the Nurseries and Users whose certificates are to be renewed.
+//
+// If any names are given, only (and all of) the named Nurseries and Users
+// are selected, otherwise those whose certificates NeedsRenewal within
+// the given number of days are selected. (The CA's own certificate is
+// never selected.)
+//
+// Returns a map of kind (NurseryKind or UserKind) to a set of names.
+//
+func SelectRenewals(
+  statuses   []CertificateStatus,
+  names      []string,
+  withinDays   uint,
+) map[string]map[string]bool {
+  named := make(map[string]bool)
+  for _, aName := range names { named[aName] = true }
+
+  renewals := map[string]map[string]bool{
+    NurseryKind: make(map[string]bool),
+    UserKind:    make(map[string]bool),
+  }
+  for _, aStatus := range statuses {
+    if aStatus.Kind == CAKind { continue }
+    if 0 < len(names) {
+      if !named[aStatus.Name] { continue }
+    } else if !aStatus.NeedsRenewal(withinDays) {
+      continue
+    }
+    renewals[aStatus.Kind][aStatus.Name] = true
+  }
+  return renewals
+}
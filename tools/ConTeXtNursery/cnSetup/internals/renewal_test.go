@@ -0,0 +1,85 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "bytes"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "github.com/stretchr/testify/assert"
+  "testing"
+  "time"
+)
+
+// Test reporting the status of the issued certificates, and renewing them
+// with (and without) rotating their keys.
+//
+func TestRenewal(t *testing.T) {
+  dir := t.TempDir()
+  config, ca := createTestSetup(t, dir, "plato01", "plato02")
+  config.Users = []UserType{ { Name: "plato@example.com" } }
+  config.Users[0].NormalizeConfig(0, &UserDefaults, config)
+  revocations := CreateRevocationDB(ca)
+
+  now      := time.Now()
+  statuses := config.CertificateStatuses(revocations, now)
+  assert.Len(t, statuses, 4)
+  assert.Equal(t, CAKind,      statuses[0].Kind)
+  assert.Equal(t, NurseryKind, statuses[1].Kind)
+  assert.Equal(t, "plato01",   statuses[1].Subject)
+  assert.InDelta(t, 365, statuses[1].Days_Left, 1)
+  // the user's certificate has not (yet) been issued
+  assert.NotEmpty(t, statuses[3].Error)
+
+  report := new(bytes.Buffer)
+  WriteStatusReport(report, statuses, 400)
+  assert.Contains(t, report.String(), statuses[1].Serial_Number)
+  assert.Contains(t, report.String(), "[RENEW]")
+
+  // nothing is renewed outside of the window, unless it is named
+  renewals := SelectRenewals(statuses, nil, 30)
+  assert.Empty(t, renewals[NurseryKind])
+  renewals = SelectRenewals(statuses, nil, 400)
+  assert.Equal(t, map[string]bool{ "plato01": true, "plato02": true }, renewals[NurseryKind])
+  assert.Empty(t, renewals[UserKind])
+  renewals = SelectRenewals(statuses, []string{ "plato02" }, 30)
+  assert.Equal(t, map[string]bool{ "plato02": true }, renewals[NurseryKind])
+
+  // renewing keeps the key (unless it is rotated) but issues a new
+  // certificate
+  oldCerts, err := certificates.LoadCertificatesFromFile(config.Nurseries[0].Cert_Path)
+  assert.NoError(t, err)
+  plato01 := config.Nurseries[0]
+  assert.NoError(t, plato01.RenewNurseryCertificateToFiles(ca, config.Federation_Name, false))
+  newCerts, err := certificates.LoadCertificatesFromFile(plato01.Cert_Path)
+  assert.NoError(t, err)
+  assert.NotEqual(t, oldCerts[0].SerialNumber, newCerts[0].SerialNumber)
+  assert.Equal(t, oldCerts[0].PublicKey, newCerts[0].PublicKey)
+
+  assert.NoError(t, plato01.RenewNurseryCertificateToFiles(ca, config.Federation_Name, true))
+  rotatedCerts, err := certificates.LoadCertificatesFromFile(plato01.Cert_Path)
+  assert.NoError(t, err)
+  assert.NotEqual(t, oldCerts[0].PublicKey, rotatedCerts[0].PublicKey)
+  key, err := LoadPrivateKey(plato01.Key_Path, nil)
+  assert.NoError(t, err)
+  assert.Equal(t, rotatedCerts[0].PublicKey, key.Public())
+
+  // revoked certificates are never renewed
+  revocations.Revoke(NurseryKind, "plato01", rotatedCerts[0], "test")
+  statuses = config.CertificateStatuses(revocations, now)
+  assert.True(t, statuses[1].Revoked)
+  assert.False(t, statuses[1].NeedsRenewal(400))
+  assert.Contains(t, SelectRenewals(statuses, nil, 400)[NurseryKind], "plato02")
+  assert.NotContains(t, SelectRenewals(statuses, nil, 400)[NurseryKind], "plato01")
+}
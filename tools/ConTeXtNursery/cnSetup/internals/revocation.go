@@ -0,0 +1,332 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "bytes"
+  "crypto/rand"
+  "crypto/x509"
+  "encoding/json"
+  "encoding/pem"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "io/ioutil"
+  "math/big"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// The kinds of certificate which can be revoked.
+//
+const (
+  NurseryKind = "nursery"
+  UserKind    = "user"
+)
+
+// The record of a single revoked certificate.
+//
+// The Serial_Number is the (decimal) serial number of the revoked
+// certificate, which was issued to the Nursery or User with the given
+// Kind and Name.
+//
+type RevokedType struct {
+  Serial_Number string
+  Kind          string
+  Name          string
+  Common_Name   string
+  Not_After     time.Time
+  Revoked_At    time.Time
+  Reason        string
+}
+
+// The RevocationDB contains the (persisted) records of all certificates
+// revoked by a Certificate Authority, from which the CA's Certificate
+// Revocation List (CRL) is created.
+//
+// The records are kept (as JSON) in the CA's Revoked_File_Name, next to
+// the CA's certificate and key files.
+//
+// CONSTRAINTS: Once created, the values in this structure SHOULD only be
+// altered by structure methods.
+//
+type RevocationDB struct {
+  Crl_Number   uint64
+  Revoked    []RevokedType
+  CA          *CAType `json:"-"`
+}
+
+// Create an (empty) RevocationDB for the given Certificate Authority.
+//
+// Typically this empty RevocationDB will be used to Load the existing
+// revocations.
+//
+// CREATES db;
+//
+func CreateRevocationDB(ca *CAType) *RevocationDB {
+  return &RevocationDB{
+    Revoked: make([]RevokedType, 0),
+    CA:      ca,
+  }
+}
+
+// Load the revocations from the CA's Revoked_File_Name.
+//
+// A missing file is not an error (nothing has been revoked yet).
+//
+// ALTERS db;
+// NOT THREAD-SAFE;
+//
+func (db *RevocationDB) Load() error {
+  jsonBytes, err := ioutil.ReadFile(db.CA.Revoked_File_Name)
+  if os.IsNotExist(err) { return nil }
+  if err != nil {
+    return fmt.Errorf("could not read [%s]: %w", db.CA.Revoked_File_Name, err)
+  }
+  err = json.Unmarshal(jsonBytes, db)
+  if err != nil {
+    return fmt.Errorf("could not parse [%s]: %w", db.CA.Revoked_File_Name, err)
+  }
+  if db.Revoked == nil { db.Revoked = make([]RevokedType, 0) }
+  return nil
+}
+
+// Save the revocations to the CA's Revoked_File_Name.
+//
+// The revocations are written to a temporary file which is then renamed,
+// so that an interrupted cnSetup never leaves a partial file.
+//
+// READS db;
+//
+func (db *RevocationDB) Save() error {
+  jsonBytes, err := json.MarshalIndent(db, "", "  ")
+  if err != nil {
+    return fmt.Errorf("could not marshal the revocations: %w", err)
+  }
+  os.MkdirAll(filepath.Dir(db.CA.Revoked_File_Name), 0755)
+  tmpPath := db.CA.Revoked_File_Name+".tmp"
+  err = ioutil.WriteFile(tmpPath, jsonBytes, 0644)
+  if err != nil {
+    return fmt.Errorf("could not write [%s]: %w", tmpPath, err)
+  }
+  err = os.Rename(tmpPath, db.CA.Revoked_File_Name)
+  if err != nil {
+    return fmt.Errorf("could not rename [%s]: %w", tmpPath, err)
+  }
+  return nil
+}
+
+// Returns true if the certificate with the given serial number has been
+// revoked.
+//
+// READS db;
+//
+func (db *RevocationDB) IsRevoked(serialNumber *big.Int) bool {
+  for _, aRevoked := range db.Revoked {
+    if aRevoked.Serial_Number == serialNumber.String() { return true }
+  }
+  return false
+}
+
+// Record the revocation of a certificate issued to the Nursery or User
+// with the given kind and name.
+//
+// Returns false if the certificate had already been revoked.
+//
+// ALTERS db;
+// NOT THREAD-SAFE;
+//
+func (db *RevocationDB) Revoke(
+  kind, name  string,
+  cert       *x509.Certificate,
+  reason      string,
+) bool {
+  if db.IsRevoked(cert.SerialNumber) { return false }
+  db.Revoked = append(db.Revoked, RevokedType{
+    Serial_Number: cert.SerialNumber.String(),
+    Kind:          kind,
+    Name:          name,
+    Common_Name:   cert.Subject.CommonName,
+    Not_After:     cert.NotAfter,
+    Revoked_At:    time.Now(),
+    Reason:        reason,
+  })
+  return true
+}
+
+// Revoke the current certificate of the named Nursery or User (as found
+// in the configuration).
+//
+// The revoked certificate, key (and PKCS#12) files are moved aside (to
+// *.revoked files), so that the next run of cnSetup issues a new
+// certificate if the Nursery or User is still configured.
+//
+// ALTERS db;
+// NOT THREAD-SAFE;
+//
+func (db *RevocationDB) RevokeNamed(
+  config *ConfigType,
+  name    string,
+  reason  string,
+) error {
+  kind     := ""
+  certPath := ""
+  paths    := []string{}
+  for _, aNursery := range config.Nurseries {
+    if aNursery.Name != name { continue }
+    kind     = NurseryKind
+    certPath = aNursery.Cert_Path
+    paths    = []string{ aNursery.Cert_Path, aNursery.Key_Path }
+  }
+  for _, aUser := range config.Users {
+    if aUser.Name != name { continue }
+    if kind != "" {
+      return fmt.Errorf("[%s] is both a nursery and a user", name)
+    }
+    kind     = UserKind
+    certPath = aUser.Cert_Path
+    paths    = []string{ aUser.Cert_Path, aUser.Key_Path, aUser.Pkcs12_Path }
+  }
+  if kind == "" {
+    return fmt.Errorf("[%s] is neither a configured nursery nor user", name)
+  }
+
+  certs, err := certificates.LoadCertificatesFromFile(certPath)
+  if err != nil {
+    return fmt.Errorf("could not load the certificate for the %s [%s]: %w", kind, name, err)
+  }
+  // the first certificate is the one issued to the Nursery or User (any
+  // others are the CA's chain)
+  //
+  cert := certs[0]
+  if err = cert.CheckSignatureFrom(db.CA.Cert) ; err != nil {
+    return fmt.Errorf("the certificate for the %s [%s] was not issued by this CA: %w", kind, name, err)
+  }
+  if !db.Revoke(kind, name, cert, reason) {
+    fmt.Printf("The certificate for the %s [%s] has already been revoked\n", kind, name)
+  } else {
+    _, err = db.CA.Ledger.MarkRevoked(cert.SerialNumber, time.Now(), reason)
+    if err != nil {
+      return fmt.Errorf("could not record the revocation in the ledger: %w", err)
+    }
+    fmt.Printf(
+      "Revoked the certificate for the %s [%s] (serial %s)\n",
+      kind, name, cert.SerialNumber,
+    )
+  }
+
+  for _, aPath := range paths {
+    if _, err := os.Stat(aPath) ; err != nil { continue }
+    err = os.Rename(aPath, aPath+".revoked")
+    if err != nil {
+      return fmt.Errorf("could not move aside the revoked [%s]: %w", aPath, err)
+    }
+  }
+  return nil
+}
+
+// Create a new (PEM encoded) Certificate Revocation List, signed by the
+// CA, listing all of the revoked certificates which have not yet expired.
+//
+// Each CRL is given the next Crl_Number, so the RevocationDB SHOULD be
+// saved once the CRL has been written.
+//
+// ALTERS db;
+// NOT THREAD-SAFE;
+//
+func (db *RevocationDB) CreateCRL() ([]byte, error) {
+  if !db.CA.CanSignCRLs() {
+    return nil, fmt.Errorf(
+      "the CA certificate [%s] can not sign CRLs (recreate the CA with the -createCA switch)",
+      db.CA.Cert_File_Name,
+    )
+  }
+
+  now     := time.Now()
+  entries := make([]x509.RevocationListEntry, 0)
+  for _, aRevoked := range db.Revoked {
+    if aRevoked.Not_After.Before(now) { continue }
+    serialNumber, ok := new(big.Int).SetString(aRevoked.Serial_Number, 10)
+    if !ok {
+      return nil, fmt.Errorf("invalid revoked serial number [%s]", aRevoked.Serial_Number)
+    }
+    entries = append(entries, x509.RevocationListEntry{
+      SerialNumber:   serialNumber,
+      RevocationTime: aRevoked.Revoked_At,
+    })
+  }
+
+  db.Crl_Number++
+  crlBytes, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+    Number:                    new(big.Int).SetUint64(db.Crl_Number),
+    ThisUpdate:                now,
+    NextUpdate:                now.AddDate(0, 0, int(db.CA.Crl_Valid_Days)),
+    RevokedCertificateEntries: entries,
+  }, db.CA.Cert, db.CA.PrivateKey)
+  if err != nil {
+    return nil, fmt.Errorf("could not create the CRL: %w", err)
+  }
+
+  crlPEM := new(bytes.Buffer)
+  crlPEM.WriteString("\n")
+  crlPEM.WriteString(
+    "Subject: ConTeXt Nursery " + db.CA.Federation_Name +
+    " Certificate Revocation List\n",
+  )
+  crlPEM.WriteString("Date:    "+now.String()+"\n")
+  pem.Encode(crlPEM, &pem.Block {
+    Type:  "X509 CRL",
+    Bytes: crlBytes,
+  })
+  return crlPEM.Bytes(), nil
+}
+
+// Write a (PEM encoded) Certificate Revocation List to a file.
+//
+// The CRL is written to a temporary file which is then renamed, so that
+// a cnNursery (re)loading the CRL never reads a partial file.
+//
+func WriteCRLFile(crlPath string, crlPEM []byte) error {
+  os.MkdirAll(filepath.Dir(crlPath), 0755)
+  tmpPath := crlPath+".tmp"
+  err := ioutil.WriteFile(tmpPath, crlPEM, 0644)
+  if err != nil {
+    return fmt.Errorf("could not write [%s]: %w", tmpPath, err)
+  }
+  err = os.Rename(tmpPath, crlPath)
+  if err != nil {
+    return fmt.Errorf("could not rename [%s]: %w", tmpPath, err)
+  }
+  return nil
+}
+
+// Create a new Certificate Revocation List, write it to the CA's
+// Crl_File_Name, and save the RevocationDB.
+//
+// Returns the (PEM encoded) CRL, so that it can also be written next to
+// each Nursery's configuration.
+//
+// ALTERS db;
+// NOT THREAD-SAFE;
+//
+func (db *RevocationDB) WriteCRL() ([]byte, error) {
+  crlPEM, err := db.CreateCRL()
+  if err != nil { return nil, err }
+  err = WriteCRLFile(db.CA.Crl_File_Name, crlPEM)
+  if err != nil { return nil, err }
+  err = db.Save()
+  if err != nil { return nil, err }
+  return crlPEM, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "crypto/x509"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "os"
+  "testing"
+)
+
+// Create a configuration (with a new CA and the given nurseries) whose
+// files are all written below dir.
+//
+func createTestSetup(t *testing.T, dir string, hosts ...string) (*ConfigType, *CAType) {
+  return createKeyedTestSetup(t, dir, RsaKey, hosts...)
+}
+
+// Create a configuration (as createTestSetup) whose keys all use the
+// given key algorithm.
+//
+func createKeyedTestSetup(
+  t            *testing.T,
+  dir           string,
+  keyAlgorithm  string,
+  hosts      ...string,
+) (*ConfigType, *CAType) {
+  config := CreateConfiguration(logger.CreateLogger("cnSetupTest"))
+  config.Federation_Name = "test"
+  config.Key_Algorithm   = keyAlgorithm
+  config.Key_Size        = 1024
+  config.Certificate_Authority.Dir = dir+"/ca"
+  config.Certificate_Authority.Valid_For.Years = 1
+  config.Certificate_Authority.NormalizeCA(config)
+  for i, aHost := range hosts {
+    config.Nurseries = append(config.Nurseries, NurseryType{
+      Host:     aHost,
+      Cert_Dir: dir+"/servers/"+aHost,
+    })
+    config.Nurseries[i].NormalizeConfig(i, &NurseryDefaults, config)
+  }
+
+  ca := CreateCA(config)
+  assert.NoError(t, ca.CreateNewCA())
+  assert.NoError(t, ca.WriteCAFiles(config))
+  for i, _ := range config.Nurseries {
+    err := config.Nurseries[i].CreateNurseryCertificateToFiles(i, ca, config.Federation_Name)
+    assert.NoError(t, err)
+  }
+  return config, ca
+}
+
+// Test revoking a nursery's certificate, and that the resulting CRL is
+// accepted (and enforced) by the certificates used by the cnNursery.
+//
+func TestRevocation(t *testing.T) {
+  dir := t.TempDir()
+  config, ca := createTestSetup(t, dir, "plato01", "plato02")
+  assert.True(t, ca.CanSignCRLs())
+
+  revocations := CreateRevocationDB(ca)
+  assert.NoError(t, revocations.Load())
+  assert.Empty(t, revocations.Revoked)
+
+  plato01 := config.Nurseries[0]
+  certs, err := certificates.LoadCertificatesFromFile(plato01.Cert_Path)
+  assert.NoError(t, err)
+  revokedCert := certs[0]
+
+  assert.Error(t, revocations.RevokeNamed(config, "socrates", "unknown"))
+  assert.NoError(t, revocations.RevokeNamed(config, "plato01", "retired"))
+  assert.True(t, revocations.IsRevoked(revokedCert.SerialNumber))
+  assert.False(t, revocations.Revoke(NurseryKind, "plato01", revokedCert, "again"))
+
+  // the revoked files are moved aside
+  _, err = os.Stat(plato01.Cert_Path)
+  assert.True(t, os.IsNotExist(err))
+  _, err = os.Stat(plato01.Cert_Path+".revoked")
+  assert.NoError(t, err)
+
+  crlPEM, err := revocations.WriteCRL()
+  assert.NoError(t, err)
+  assert.NoError(t, WriteCRLFile(config.Nurseries[1].Crl_Path, crlPEM))
+
+  // the revocations are persisted
+  reloaded := CreateRevocationDB(ca)
+  assert.NoError(t, reloaded.Load())
+  assert.Len(t, reloaded.Revoked, 1)
+  assert.Equal(t, "retired", reloaded.Revoked[0].Reason)
+  assert.Equal(t, uint64(1), reloaded.Crl_Number)
+
+  // the CRL is enforced by the remaining nursery
+  plato02 := config.Nurseries[1]
+  nurseryCerts := certificates.CreateCertificates(
+    plato02.Ca_Cert_Path, plato02.Cert_Path, plato02.Key_Path, plato02.Crl_Path,
+    config.CSLog,
+  )
+  assert.Error(t, nurseryCerts.CheckRevoked(revokedCert))
+  assert.NoError(t, nurseryCerts.CheckRevoked(nurseryCerts.CaCerts[0]))
+
+  // the nursery's configuration points at its CRL
+  _, err = plato02.WriteConfiguration()
+  assert.NoError(t, err)
+  configBytes, err := ioutil.ReadFile(plato02.Config_Path)
+  assert.NoError(t, err)
+  assert.Contains(t, string(configBytes), "crl_path:        \""+plato02.Crl_Path+"\"")
+
+  // a CA which can not sign CRLs is refused
+  ca.Cert.KeyUsage = x509.KeyUsageCertSign
+  _, err = revocations.CreateCRL()
+  assert.Error(t, err)
+}
@@ -16,19 +16,41 @@ package CNSetup
 
 import (
   "bytes"
+  "crypto"
+  "crypto/rand"
   "crypto/x509"
   "encoding/pem"
   "fmt"
   "github.com/sethvargo/go-password/password"
   "io/ioutil"
   "os"
-  "os/exec"
+  "software.sslmate.com/src/go-pkcs12"
   "time"
 )
 
 ////////////////////
 // User Certificates
 
+// The encryptions which can be used to protect each user's PKCS#12 file.
+//
+// The "modern" encryption (AES-256-CBC with PBKDF2 and SHA-256) is 
+// understood by all current browsers and operating systems, while the 
+// "legacy" encryption (3DES with SHA-1) is only needed for older ones. 
+//
+const (
+  ModernPkcs12 = "modern"
+  LegacyPkcs12 = "legacy"
+)
+
+// Returns the PKCS#12 encoder for the user's Pkcs12_Encryption.
+//
+// READS user;
+//
+func (user *UserType) Pkcs12Encoder() *pkcs12.Encoder {
+  if user.Pkcs12_Encryption == LegacyPkcs12 { return pkcs12.Legacy }
+  return pkcs12.Modern
+}
+
 // Create a user's X509 certificates and public/private keys.
 //
 // We provide the name of the user (usually one of their email addresses), 
@@ -63,24 +85,71 @@ func (user *UserType) CreateUserCertificate(
   }
 
   fmt.Printf("\n\nCreating certificate files for the user [%s]\n", user.Name)
-  
-  uCert := ca.NewBaseCertificate(
-    user.Name + " ( ConTeXt Nursery " + federationName + " )",
-    user.Serial_Number,
+
+  uPrivateKey, err := NewPrivateKey(user.Key_Algorithm, user.Key_Size)
+  if err != nil {
+    return fmt.Errorf("could not generate %s key for user [%s]: %w", user.Key_Algorithm, user.Name, err)
+  }
+  user.Password = "" // a new PKCS#12 file gets a new password
+  return user.WriteUserCertificateToFiles(ca, federationName, uPrivateKey)
+}
+
+// Renew a user's X509 certificate, either keeping their existing private 
+// key or (if rotateKey is true) rotating it, and regenerate their PKCS#12 
+// file (using their existing password). 
+//
+// READS ca;
+// READS user;
+//
+func (user *UserType) RenewUserCertificate(
+  ca            *CAType,
+  federationName string,
+  rotateKey      bool,
+) error {
+  fmt.Printf("\n\nRenewing certificate files for the user [%s]\n", user.Name)
+
+  uPrivateKey, err := ca.RenewalKey(
+    user.Key_Path, nil, user.Key_Algorithm, user.Key_Size, rotateKey,
   )
-  uCert.ExtKeyUsage  = []x509.ExtKeyUsage{ x509.ExtKeyUsageClientAuth }
-  uCert.SubjectKeyId = []byte{1,2,3,4,6}
-  uCert.KeyUsage     = x509.KeyUsageDigitalSignature |
-      x509.KeyUsageKeyEncipherment |
-      x509.KeyUsageKeyAgreement |
-      x509.KeyUsageDataEncipherment
-  
-  uPrivateKey, err := ca.NewRsaKeys(user.Key_Size)
   if err != nil {
-    return fmt.Errorf("could not generate rsa key for user [%s]: %w", user.Name, err)
+    return fmt.Errorf("could not renew the user [%s]: %w", user.Name, err)
   }
+  return user.WriteUserCertificateToFiles(ca, federationName, uPrivateKey)
+}
 
-  uBytes, err := ca.SignCertificate(uCert, &uPrivateKey.PublicKey)
+// Returns the Common Name of the user's certificate.
+//
+// READS user;
+//
+func (user *UserType) CommonName(federationName string) string {
+  return user.Name + " ( ConTeXt Nursery " + federationName + " )"
+}
+
+// Sign a new user's X509 certificate for the given private key, and write 
+// the CA certificate, the user's certificate and key (in the PEM format), 
+// as well as their (password encrypted) PKCS#12 file, to disk. 
+//
+// The PKCS#12 file is generated in-process (using the user's 
+// Pkcs12_Encryption), so no external openssl command is required. 
+//
+// A new password is generated unless the user already has one.
+//
+// READS ca;
+// ALTERS user (Password);
+//
+func (user *UserType) WriteUserCertificateToFiles(
+  ca            *CAType,
+  federationName string,
+  uPrivateKey    crypto.Signer,
+) error {
+  os.MkdirAll(user.Cert_Dir, 0755)
+
+  uCert := ca.NewBaseCertificate(user.CommonName(federationName), user.Serial_Number)
+  uCert.ExtKeyUsage  = []x509.ExtKeyUsage{ x509.ExtKeyUsageClientAuth }
+  uCert.SubjectKeyId = []byte{1,2,3,4,6}
+  uCert.KeyUsage     = KeyUsageFor(uPrivateKey)
+  
+  uBytes, err := ca.SignCertificate(uCert, uPrivateKey.Public(), user.Cert_Path)
   if err != nil {
     return fmt.Errorf("could not create the certificate for user [%s]: %w", user.Name, err)
   }
@@ -88,14 +157,18 @@ func (user *UserType) CreateUserCertificate(
   uSubject := "Subject: ConTeXt Nursery " + federationName + " User Certificate for user ["+user.Name+"]"
   uDate    := "Date:    "+time.Now().String()+"\n"
 
+  // (the CA's certificates include any root CA's certificate)
+  //
   caPEM := new(bytes.Buffer)
-  caPEM.WriteString("\n")
-  caPEM.WriteString(uSubject + " (CA)\n")
-  caPEM.WriteString(uDate)
-  pem.Encode(caPEM, &pem.Block {
-    Type:  "CERTIFICATE",
-    Bytes: ca.Cert.Raw,
-  })
+  for _, aCaCert := range ca.Certificates() {
+    caPEM.WriteString("\n")
+    caPEM.WriteString(uSubject + " (CA)\n")
+    caPEM.WriteString(uDate)
+    pem.Encode(caPEM, &pem.Block {
+      Type:  "CERTIFICATE",
+      Bytes: aCaCert.Raw,
+    })
+  }
   err = ioutil.WriteFile(user.Ca_Cert_Path, caPEM.Bytes(), 0644)
   if err != nil {
     return fmt.Errorf("could not write the [%s] file: %w",  user.Ca_Cert_Path, err)
@@ -115,62 +188,43 @@ func (user *UserType) CreateUserCertificate(
     return fmt.Errorf("could not write the [%s] file: %w", user.Cert_Path, err)
   }
 
+  uKeyBlock, err := PrivateKeyPEMBlock(uPrivateKey, nil)
+  if err != nil {
+    return fmt.Errorf("could not encode the key for user [%s]: %w", user.Name, err)
+  }
   uPrivateKeyPEM := new(bytes.Buffer)
   uPrivateKeyPEM.WriteString("\n")
   uPrivateKeyPEM.WriteString(uSubject + "\n")
   uPrivateKeyPEM.WriteString(uDate)
-  pem.Encode(uPrivateKeyPEM, &pem.Block {
-    Type: "RSA PRIVATE KEY",
-    Bytes: x509.MarshalPKCS1PrivateKey(uPrivateKey),
-  })
+  pem.Encode(uPrivateKeyPEM, uKeyBlock)
   err = ioutil.WriteFile(user.Key_Path, uPrivateKeyPEM.Bytes(), 0600)
   if err != nil {
     return fmt.Errorf("could not write the [%s] file: %w", user.Key_Path, err)
   }
 
-//  uCert, err := x509.ParseCertificate(uBytes)
-//  if err != nil {
-//    return fmt.Errorf("could not parse x509 certificate: %w", err)
-//  }
-
-//  pfxBytes, err := pkcs12.Encode(rand.Reader, uPrivateKey, uCert, []*x509.Certificate{caCert}, "test")
-//  if err != nil {
-//    return fmt.Errorf("Could not create the pkcs#12 certificate bundle: %w", err)
-//  }
-
-//  err = ioutil.WriteFile(user.Pkcs12_Paht, pfxBytes, 0600)
-//  if err != nil {
-//    return fmt.Errorf("Could not write the pkcs#12 certifcate to a file: %w", err)
-//  }
-
-//  openssl pkcs12 -export
-//    -out stephen\@perceptisys-co-uk.p12
-//    -inkey stephen\@perceptisys-co-uk-key.pem
-//    -in stephen\@perceptisys-co-uk-crt.pem
-//    -certfile stephen\@perceptisys-co-uk-ca-crt.pem
+  if user.Password == "" {
+    thePassword, err := password.Generate(8, 2, 0, false, false)
+    if err != nil {
+      return fmt.Errorf("Could not generate a password: %w", err)
+    }
+    user.Password = thePassword
+  }
 
-  thePassword, err := password.Generate(8, 2, 0, false, false)
+  uCertParsed, err := x509.ParseCertificate(uBytes)
   if err != nil {
-    return fmt.Errorf("Could not generate a password: %w", err)
+    return fmt.Errorf("could not parse the certificate for user [%s]: %w", user.Name, err)
   }
-  user.Password = thePassword
 
-  err = os.Setenv("OPENSSL_PASSWORD", thePassword)
+  pfxBytes, err := user.Pkcs12Encoder().WithRand(rand.Reader).Encode(
+    uPrivateKey, uCertParsed, ca.Certificates(), user.Password,
+  )
   if err != nil {
-    return fmt.Errorf("Could not set the OPENSSL_PASSWORD environment variable: %w", err)
+    return fmt.Errorf("Could not create the pkcs#12 certificate bundle: %w", err)
   }
 
-  cmd := exec.Command("openssl", "pkcs12", "-export",
-    "-out", user.Pkcs12_Path,
-    "-inkey", user.Key_Path,
-    "-in", user.Cert_Path,
-    "-certfile", user.Ca_Cert_Path,
-    "-passout", "env:OPENSSL_PASSWORD",
-  )
-  outErr, err := cmd.CombinedOutput()
+  err = ioutil.WriteFile(user.Pkcs12_Path, pfxBytes, 0600)
   if err != nil {
-    fmt.Printf("ERROR:\n--------------\n%s\n--------------\n", outErr)
-    return fmt.Errorf("Could not create the pkcs#12 file: %w", err)
+    return fmt.Errorf("Could not write the [%s] file: %w", user.Pkcs12_Path, err)
   }
   return nil
 }
@@ -0,0 +1,72 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "software.sslmate.com/src/go-pkcs12"
+  "sync"
+  "testing"
+)
+
+// Test creating (concurrently) users' PKCS#12 files with both the modern
+// and legacy encryptions, and renewing them with the same password.
+//
+func TestUserPkcs12(t *testing.T) {
+  dir := t.TempDir()
+  config, ca := createTestSetup(t, dir)
+  config.Users = []UserType{
+    { Name: "plato@example.com",     Cert_Dir: dir+"/users/plato" },
+    { Name: "aristotle@example.com", Cert_Dir: dir+"/users/aristotle",
+      Pkcs12_Encryption: LegacyPkcs12 },
+  }
+  for i, _ := range config.Users {
+    config.Users[i].NormalizeConfig(i, &UserDefaults, config)
+  }
+  assert.Equal(t, ModernPkcs12, config.Users[0].Pkcs12_Encryption)
+
+  var wg sync.WaitGroup
+  for i, _ := range config.Users {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      err := config.Users[i].CreateUserCertificate(i, ca, config.Federation_Name)
+      assert.NoError(t, err)
+    }(i)
+  }
+  wg.Wait()
+
+  for _, aUser := range config.Users {
+    assert.NotEmpty(t, aUser.Password)
+    pfxBytes, err := ioutil.ReadFile(aUser.Pkcs12_Path)
+    assert.NoError(t, err)
+    _, cert, caCerts, err := pkcs12.DecodeChain(pfxBytes, aUser.Password)
+    assert.NoError(t, err, aUser.Name)
+    assert.Contains(t, cert.Subject.CommonName, aUser.Name)
+    assert.Len(t, caCerts, 1)
+    assert.Equal(t, ca.Cert.Raw, caCerts[0].Raw)
+  }
+
+  // a renewed PKCS#12 file keeps the user's password
+  plato := config.Users[0]
+  password := plato.Password
+  assert.NoError(t, plato.RenewUserCertificate(ca, config.Federation_Name, false))
+  assert.Equal(t, password, plato.Password)
+  pfxBytes, err := ioutil.ReadFile(plato.Pkcs12_Path)
+  assert.NoError(t, err)
+  _, _, _, err = pkcs12.DecodeChain(pfxBytes, password)
+  assert.NoError(t, err)
+}
@@ -18,8 +18,8 @@
 package CNSetup
 
 import (
+  "bytes"
   "fmt"
-  "math/rand"
   "os"
   "path"
   "strings"
@@ -29,7 +29,7 @@ import (
 // The UserType contains the information required to:
 //
 //   1. Create x509 Client Certificates as well as associated
-//      public/private RSA keys.
+//      public/private (RSA or ECDSA) keys.
 //
 //   2. Write out the YAML configuration files used by each cnTypeSetter.
 //
@@ -46,9 +46,12 @@ type UserType struct {
   Key_Path              string
   Key_File              string
   Pkcs12_Path           string
+  Pkcs12_Encryption     string
   NATS_Message_Routes []string
+  NATS_TLS              bool
   Config_Path           string
   Serial_Number         uint
+  Key_Algorithm         string
   Key_Size              uint
   Password              string
 }
@@ -64,9 +67,12 @@ var (
     "",         // Key_Path
     "",         // Key_File
     "",         // Pkcs12_Path
+    "",         // Pkcs12_Encryption
     []string{}, // Primary_Host
+    false,      // NATS_TLS
     "",         // Config_Path
     0,          // Serial_Number
+    "",         // Key_Algorithm
     0,          // Key_Size
     "",         // Password
   }
@@ -95,6 +101,18 @@ func (user *UserType) NormalizeConfig(
   if user.Cert_Path    == "" { user.Cert_Path    = defaults.Cert_Path }
   if user.Key_Path     == "" { user.Key_Path     = defaults.Key_Path }
   if user.Pkcs12_Path  == "" { user.Pkcs12_Path  = defaults.Pkcs12_Path }
+  if user.Pkcs12_Encryption == "" {
+    user.Pkcs12_Encryption = defaults.Pkcs12_Encryption
+  }
+  if user.Pkcs12_Encryption == "" { user.Pkcs12_Encryption = ModernPkcs12 }
+  if user.Pkcs12_Encryption != ModernPkcs12 &&
+     user.Pkcs12_Encryption != LegacyPkcs12 {
+    config.CSLog.Logf(
+      "The pkcs12_encryption for the user [%s] MUST be one of [%s] or [%s]",
+      user.Name, ModernPkcs12, LegacyPkcs12,
+    )
+    os.Exit(-1)
+  }
   
   if -1 < userNum {
     if user.Cert_Dir     == "" { user.Cert_Dir     =  "users/"+user.Name }
@@ -110,30 +128,41 @@ func (user *UserType) NormalizeConfig(
     if user.Config_Path  == "" { user.Config_Path  = user.Cert_Dir+"/cnTypeSetter.yaml" }
   }
 
-  // we need to use DIFFERENT serial numbers for each of CA (1<<32),
-  //  C/S  ((1<<5 + nurseryNum)<<33) and
-  //  User ((2<<5 + userNum)<<33)
-  //
-  if user.Serial_Number == 0 { user.Serial_Number = uint(2<<5 + userNum)  }
-
+  user.NATS_TLS = config.NATS_TLS
   if user.Key_Size == 0 { user.Key_Size = config.Key_Size   }
+
+  // (browsers do not (yet) understand Ed25519 client certificates)
+  //
+  if user.Key_Algorithm == "" { user.Key_Algorithm = defaults.Key_Algorithm }
+  if user.Key_Algorithm == "" { user.Key_Algorithm = config.Key_Algorithm   }
+  if user.Key_Algorithm == Ed25519Key && -1 < userNum {
+    config.CSLog.Logf(
+      "The key_algorithm for the user [%s] can not be [%s] (browsers do not understand it)",
+      user.Name, Ed25519Key,
+    )
+    os.Exit(-1)
+  }
+  if !IsKeyAlgorithm(user.Key_Algorithm) {
+    config.CSLog.Logf(
+      "The key_algorithm for the user [%s] MUST be one of [%s], [%s] or [%s]",
+      user.Name, RsaKey, EcdsaP256Key, EcdsaP384Key,
+    )
+    os.Exit(-1)
+  }
 }
 
 
-// Set the Nursery's NATS routes (of the whole federation)
+// Set the User's NATS routes (of the whole federation) in the order given 
+// by the (seeded) natsShuffle. 
 //
-// ALTERS nursery;
+// ALTERS user;
 // NOT THREAD-SAFE;
-// CALLED BY: LoadConfiguration ONLY;
+// CALLED BY: ConfigType.SetNatsRoutes ONLY;
 //
 func (user *UserType) SetNatsRoutes(
   natsMessageRoutes    *[]string,
   natsShuffle          *[]int,
 ) {
-  rand.Shuffle(len(*natsShuffle), func(i, j int) {
-    (*natsShuffle)[i], (*natsShuffle)[j] =
-      (*natsShuffle)[j], (*natsShuffle)[i]
-  })
   user.NATS_Message_Routes = make([]string, len(*natsShuffle))
   for i, j := range *natsShuffle {
   	user.NATS_Message_Routes[i] = (*natsMessageRoutes)[j]
@@ -148,11 +177,12 @@ func (user *UserType) SetNatsRoutes(
 // We provide the user, the user defaults as well as the primaryUrl of 
 // this federation of Nurseries. 
 //
+// The file is only (re)written (and true returned) if its contents have 
+// changed. 
+//
 // READS user;
 //
-func (user *UserType) WriteConfiguration() error {
-
-  fmt.Printf("\n\nCreating configuration file for the user [%s]\n", user.Name)
+func (user *UserType) WriteConfiguration() (bool, error) {
 
   yamlTemplateStr := `
 # This is the configuration for the {{.Name}} User
@@ -166,28 +196,26 @@ ca_cert_path: "{{.Ca_Cert_File}}"
 cert_path:    "{{.Cert_File}}"
 key_path:     "{{.Key_File}}"
 nats_routes:{{ range .NATS_Message_Routes }}
-  - {{ . }}{{ end }}
+  - {{ . }}{{ end }}{{ if .NATS_TLS }}
+nats_tls:     true{{ end }}
 `
   yamlTemplate, err := template.New("yamlTemplate").Parse(yamlTemplateStr)
   if err != nil {
-    return fmt.Errorf("Could not parse the yaml template: %w", err)
+    return false, fmt.Errorf("Could not parse the yaml template: %w", err)
   }
 
-  yamlFile, err := os.Create(user.Config_Path)
+  var yamlBytes bytes.Buffer
+  err = yamlTemplate.Execute(&yamlBytes, user)
   if err != nil {
-    return fmt.Errorf("Could not open the config file for writing: %w", err)
+    return false, fmt.Errorf("Could not run user configuration YAML template: %w", err)
   }
 
-  err = yamlTemplate.Execute(yamlFile, user)
+  changed, err := writeGeneratedFile(user.Config_Path, yamlBytes.Bytes())
   if err != nil {
-    yamlFile.Close()
-    return fmt.Errorf("Could not run user configuration YAML template: %w", err)
+    return false, fmt.Errorf("Could not write the user config file: %w", err)
   }
-  
-  err = yamlFile.Close()
-  if err != nil {
-    return fmt.Errorf("Could not close the user config file: %w", err)
+  if changed {
+    fmt.Printf("\n\nCreating configuration file for the user [%s]\n", user.Name)
   }
-  
-  return nil
+  return changed, nil
 }
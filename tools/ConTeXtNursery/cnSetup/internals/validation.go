@@ -0,0 +1,275 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "github.com/diSimplex/ConTeXtNursery/configValidation"
+  "gopkg.in/yaml.v3"
+  "reflect"
+  "strconv"
+  "strings"
+)
+
+// The (nursery) ports which MUST all be different.
+//
+var nurseryPortKeys = []string{
+  "port", "federation_port", "messages_port", "monitor_port", "librarian_port",
+}
+
+// Returns the (value) node of the key in the nursery, or (if the nursery
+// does not have the key) in the nursery_defaults (or nil if neither has
+// the key).
+//
+func nurseryValue(aNursery, nurseryDefaults *yaml.Node, key string) *yaml.Node {
+  if value := configValidation.Get(aNursery, key) ; value != nil { return value }
+  return configValidation.Get(nurseryDefaults, key)
+}
+
+// Returns the default value of the given (nursery) port.
+//
+func nurseryPortDefault(key string) uint {
+  switch key {
+    case "federation_port" : return NurseryDefaults.Federation_Port
+    case "messages_port"   : return NurseryDefaults.Messages_Port
+    case "monitor_port"    : return NurseryDefaults.Monitor_Port
+    case "librarian_port"  : return NurseryDefaults.Librarian_Port
+  }
+  return NurseryDefaults.Port
+}
+
+// Record a problem if the key_algorithm value is not known (or, for
+// users, can not be understood by browsers).
+//
+// ALTERS validator;
+//
+func checkKeyAlgorithm(validator *configValidation.Validator, node *yaml.Node, isUser bool) {
+  value := configValidation.Get(node, "key_algorithm")
+  if value == nil || value.Value == "" { return }
+  if !IsKeyAlgorithm(value.Value) {
+    validator.Addf(
+      value, "the key_algorithm [%s] MUST be one of [%s], [%s], [%s] or [%s]",
+      value.Value, RsaKey, EcdsaP256Key, EcdsaP384Key, Ed25519Key,
+    )
+  } else if isUser && value.Value == Ed25519Key {
+    validator.Addf(
+      value, "the key_algorithm of a user can not be [%s] (browsers do not understand it)",
+      Ed25519Key,
+    )
+  }
+}
+
+// Validate the nurseries of the (cnSetup) configuration: each nursery
+// MUST have (unique) host names, a unique name and cert_dir, and
+// (different) ports, while exactly one nursery MUST be the primary.
+//
+// ALTERS validator;
+//
+func validateNurseries(validator *configValidation.Validator) {
+  root            := validator.Root
+  nurseryDefaults := configValidation.Get(root, "nursery_defaults")
+  nurseries       := configValidation.GetItems(root, "nurseries")
+  if len(nurseries) < 1 {
+    node := configValidation.GetKey(root, "nurseries")
+    if node == nil { node = root }
+    validator.Addf(node, "you MUST specify at least ONE nursery")
+    return
+  }
+
+  names     := map[string]int{}
+  hosts     := map[string]int{}
+  certDirs  := map[string]int{}
+  primaries := []*yaml.Node{}
+  for _, aNursery := range nurseries {
+    if aNursery.Kind != yaml.MappingNode { continue }
+
+    // host names (and the name derived from them)
+    //
+    nurseryHosts := []string{}
+    hostNode     := nurseryValue(aNursery, nurseryDefaults, "host")
+    if hostNode != nil {
+      for _, aHost := range strings.Split(hostNode.Value, ",") {
+        aHost = strings.TrimSpace(aHost)
+        if aHost != "" { nurseryHosts = append(nurseryHosts, aHost) }
+      }
+    }
+    if len(nurseryHosts) < 1 {
+      validator.Addf(aNursery, "the nursery MUST have a host")
+      continue
+    }
+    for _, aHost := range nurseryHosts {
+      if line, ok := hosts[aHost] ; ok {
+        validator.Addf(hostNode, "the host [%s] is also used by the nursery at line %d", aHost, line)
+      }
+      hosts[aHost] = aNursery.Line
+    }
+
+    name     := nurseryHosts[0]
+    nameNode := configValidation.Get(aNursery, "name")
+    if nameNode != nil && nameNode.Value != "" {
+      name = nameNode.Value
+    } else {
+      nameNode = hostNode
+    }
+    if line, ok := names[name] ; ok {
+      validator.Addf(nameNode, "the nursery name [%s] is also used at line %d", name, line)
+    }
+    names[name] = aNursery.Line
+
+    certDirNode := nurseryValue(aNursery, nurseryDefaults, "cert_dir")
+    certDir     := "servers/"+name
+    if certDirNode != nil && certDirNode.Value != "" {
+      certDir = certDirNode.Value
+    } else {
+      certDirNode = nameNode
+    }
+    if line, ok := certDirs[certDir] ; ok {
+      validator.Addf(certDirNode, "the cert_dir [%s] is also used by the nursery at line %d", certDir, line)
+    }
+    certDirs[certDir] = aNursery.Line
+
+    // ports
+    //
+    ports := map[uint]string{}
+    for _, aKey := range nurseryPortKeys {
+      port     := nurseryPortDefault(aKey)
+      portNode := nurseryValue(aNursery, nurseryDefaults, aKey)
+      if portNode != nil {
+        aPort, err := strconv.ParseUint(portNode.Value, 10, 16)
+        if err != nil {
+          validator.Addf(portNode, "the %s [%s] is not a valid port", aKey, portNode.Value)
+          continue
+        }
+        port = uint(aPort)
+      } else {
+        portNode = aNursery
+      }
+      if port == 0 && aKey == "port" {
+        validator.Addf(portNode, "the nursery [%s] MUST have a port (it is part of its base_url)", name)
+      }
+      if port == 0 { continue }
+      if otherKey, ok := ports[port] ; ok {
+        validator.Addf(
+          portNode, "the %s [%d] of the nursery [%s] is also its %s",
+          aKey, port, name, otherKey,
+        )
+      }
+      ports[port] = aKey
+    }
+
+    if primaryNode := configValidation.Get(aNursery, "is_primary") ; primaryNode != nil {
+      isPrimary, err := strconv.ParseBool(primaryNode.Value)
+      if err != nil {
+        validator.Addf(primaryNode, "is_primary MUST be either true or false")
+      } else if isPrimary {
+        primaries = append(primaries, primaryNode)
+      }
+    }
+
+    checkKeyAlgorithm(validator, aNursery, false)
+    validator.CheckPassphraseSource(aNursery)
+  }
+
+  if len(primaries) < 1 {
+    validator.Addf(
+      configValidation.GetKey(root, "nurseries"),
+      "EXACTLY one nursery MUST be the primary (is_primary: true), but none are",
+    )
+  }
+  for i := 1 ; i < len(primaries) ; i++ {
+    validator.Addf(
+      primaries[i], "EXACTLY one nursery MUST be the primary, but the nursery at line %d is also the primary",
+      primaries[0].Line,
+    )
+  }
+}
+
+// Validate the users of the (cnSetup) configuration: each user MUST have
+// a unique name, and a pkcs12_encryption (and key_algorithm) which
+// browsers understand.
+//
+// ALTERS validator;
+//
+func validateUsers(validator *configValidation.Validator) {
+  userDefaults := configValidation.Get(validator.Root, "user_defaults")
+  users        := append([]*yaml.Node{ userDefaults }, configValidation.GetItems(validator.Root, "users")...)
+  names        := map[string]int{}
+  for i, aUser := range users {
+    if aUser == nil || aUser.Kind != yaml.MappingNode { continue }
+    if 0 < i {
+      nameNode := configValidation.Get(aUser, "name")
+      if nameNode == nil || nameNode.Value == "" {
+        validator.Addf(aUser, "you MUST supply a name for all users")
+      } else {
+        if line, ok := names[nameNode.Value] ; ok {
+          validator.Addf(nameNode, "the user name [%s] is also used at line %d", nameNode.Value, line)
+        }
+        names[nameNode.Value] = nameNode.Line
+      }
+    }
+    if value := configValidation.Get(aUser, "pkcs12_encryption") ; value != nil &&
+      value.Value != "" && value.Value != ModernPkcs12 && value.Value != LegacyPkcs12 {
+      validator.Addf(
+        value, "the pkcs12_encryption [%s] MUST be one of [%s] or [%s]",
+        value.Value, ModernPkcs12, LegacyPkcs12,
+      )
+    }
+    checkKeyAlgorithm(validator, aUser, true)
+  }
+}
+
+// Validate the (cnSetup) configuration file at configFileName, returning
+// a validator containing EVERY problem found (each at its file:line).
+//
+// Unlike LoadConfiguration, which stops at the first problem, the
+// validation reports unknown keys, duplicate nursery (or user) names,
+// hosts used by more than one nursery, port collisions, a missing (or
+// multiple) primary nursery, bad key algorithms and passphrase sources,
+// as well as (file:) passphrase paths which do not exist.
+//
+// CREATES validator;
+//
+func ValidateConfiguration(configFileName string) *configValidation.Validator {
+  validator := configValidation.LoadValidator(configFileName)
+  if 0 < len(validator.Problems) { return validator }
+  root      := validator.Root
+  validator.CheckKeys(root, reflect.TypeOf(ConfigType{}))
+
+  if value := configValidation.Get(root, "federation_name") ; value != nil && value.Value == "" {
+    validator.Addf(value, "you MUST specify a federation_name")
+  }
+  checkKeyAlgorithm(validator, root, false)
+  ca := configValidation.Get(root, "certificate_authority")
+  checkKeyAlgorithm(validator, ca, false)
+  validator.CheckPassphraseSource(ca)
+  nurseryDefaults := configValidation.Get(root, "nursery_defaults")
+  checkKeyAlgorithm(validator, nurseryDefaults, false)
+  validator.CheckPassphraseSource(nurseryDefaults)
+
+  validateNurseries(validator)
+  validateUsers(validator)
+
+  natsTLS := configValidation.Get(root, "nats_tls")
+  if natsTLS != nil && natsTLS.Value == "true" {
+    for _, aNursery := range append(
+      []*yaml.Node{ nurseryDefaults }, configValidation.GetItems(root, "nurseries")...,
+    ) {
+      if value := configValidation.Get(aNursery, "key_passphrase") ; value != nil && value.Value != "" {
+        validator.Addf(value, "a nursery key can not be encrypted (with a key_passphrase) when nats_tls is used")
+      }
+    }
+  }
+  validator.Sort()
+  return validator
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNSetup
+
+import (
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "testing"
+)
+
+// Test that the example configuration has no problems.
+//
+func TestValidateExample(t *testing.T) {
+  validator := ValidateConfiguration("../nurseries.example.yaml")
+  assert.NoError(t, validator.Err())
+}
+
+// Test that EVERY problem in a configuration is reported (in line order).
+//
+func TestValidateConfiguration(t *testing.T) {
+  configPath := t.TempDir()+"/nurseries.yaml"
+  err := ioutil.WriteFile(configPath, []byte(`federation_name: test
+key_algorithm: dsa
+certificat_authority:
+  common_name: test CA
+nurseries:
+  - host: plato01, 10.0.0.1
+    monitor_port: 4220
+    is_primary: true
+  - host: plato02, plato01
+    key_passphrase: file:/no/such/passphrase
+    is_primary: true
+  - host: plato03
+    name: plato01
+users:
+  - name: plato@example.com
+    pkcs12_encryption: weird
+  - name: plato@example.com
+nursery_defaults:
+  port: 8080
+`), 0644)
+  assert.NoError(t, err)
+
+  validator := ValidateConfiguration(configPath)
+  messages  := map[int]string{}
+  for _, aProblem := range validator.Problems {
+    assert.Equal(t, configPath, aProblem.Path)
+    messages[aProblem.Line] += aProblem.Message+"\n"
+  }
+  assert.Contains(t, messages[2],  "the key_algorithm [dsa]")
+  assert.Contains(t, messages[3],  "unknown key [certificat_authority]")
+  assert.Contains(t, messages[6],  "the librarian_port [4220] of the nursery [plato01] is also its monitor_port")
+  assert.Contains(t, messages[9],  "the host [plato01] is also used by the nursery at line 6")
+  assert.Contains(t, messages[10], "the key_passphrase file [/no/such/passphrase] does not exist")
+  assert.Contains(t, messages[11], "EXACTLY one nursery MUST be the primary")
+  assert.Contains(t, messages[13], "the nursery name [plato01] is also used at line 6")
+  assert.Contains(t, messages[13], "the cert_dir [servers/plato01] is also used")
+  assert.Contains(t, messages[16], "the pkcs12_encryption [weird]")
+  assert.Contains(t, messages[17], "the user name [plato@example.com] is also used at line 15")
+  assert.Len(t, validator.Problems, 10)
+  for i := 1 ; i < len(validator.Problems) ; i++ {
+    assert.LessOrEqual(t, validator.Problems[i-1].Line, validator.Problems[i].Line)
+  }
+}
@@ -19,17 +19,20 @@ package main
 
 import (
   "bufio"
-  crand "crypto/rand"
-  "encoding/binary"
   "flag"
   "fmt"
+  "github.com/diSimplex/ConTeXtNursery/cnNursery/internals"
   "github.com/diSimplex/ConTeXtNursery/cnSetup/internals"
+  "github.com/diSimplex/ConTeXtNursery/cnTypeSetter/internals"
+  "github.com/diSimplex/ConTeXtNursery/configValidation"
   "github.com/diSimplex/ConTeXtNursery/logger"
+  "io/ioutil"
   "os"
-  "math/rand"
+  "path/filepath"
   "runtime"
   "strings"
   "sync"
+  "time"
 )
 
 // A User.Name->User.Password mapping used to write out the 
@@ -42,6 +45,8 @@ var userPasswords = map[string]string{}
 var createCA       bool
 var configFileName string
 var showConfig     bool
+var revokeReason   string
+var rotateKeys     bool
 
 // Flag descriptions and defaults as used by the cnSetup command line 
 // options. 
@@ -51,26 +56,49 @@ const (
   configFileNameUsage   =  "The configuration file to load"
   showConfigDefault     =  false
   showConfigUsage       =  "Show the loaded configuration"
+  revokeReasonDefault   =  ""
+  revokeReasonUsage     =  "The reason recorded for any revocations"
+  rotateKeysDefault     =  false
+  rotateKeysUsage       =  "Should renewed certificates be given new keys?"
 )
 
 func WorkOnNursery(
   i         int,
   aNursery *CNSetup.NurseryType,
   ca       *CNSetup.CAType,
+  crlPEM  []byte,
+  renew     bool,
   config   *CNSetup.ConfigType,
   wg       *sync.WaitGroup,
 ) {
   defer wg.Done()
   
   config.CSLog.DebugLockf("(%d)started on nursery: [%s]\n", i, aNursery.Name)
-  err := aNursery.CreateNurseryCertificateToFiles(i, ca, config.Federation_Name)
+  var err error
+  if renew {
+    err = aNursery.RenewNurseryCertificateToFiles(ca, config.Federation_Name, rotateKeys)
+  } else {
+    err = aNursery.CreateNurseryCertificateToFiles(i, ca, config.Federation_Name)
+  }
   config.CSLog.MayBeErrorf(
     err,
     "Could not create nurseryCertificate for [%s]",
     aNursery.Name,
   )
   if err == nil {
-    err = aNursery.WriteConfiguration()
+    if crlPEM == nil {
+      aNursery.Crl_Path = "" // the nursery can not check revocations
+    } else {
+      err = CNSetup.WriteCRLFile(aNursery.Crl_Path, crlPEM)
+      config.CSLog.MayBeErrorf(
+        err,
+        "Could not write the CRL for the [%s] nursery",
+        aNursery.Name,
+      )
+    }
+  }
+  if err == nil {
+    _, err = aNursery.WriteConfiguration()
     config.CSLog.MayBeErrorf(
       err,
       "Could not write nursery [%s] configuration file", 
@@ -78,7 +106,7 @@ func WorkOnNursery(
     )
   }
   if err == nil {
-    err = aNursery.WriteNATSConfiguration()
+    _, err = aNursery.WriteNATSConfiguration()
     config.CSLog.MayBeErrorf(
       err,
       "Could not write cnMessages(NATS) nursery [%s] configuration file", 
@@ -86,7 +114,7 @@ func WorkOnNursery(
     )
   }
   if err == nil {
-    err = aNursery.WriteENVSConfiguration()
+    _, err = aNursery.WriteENVSConfiguration()
     config.CSLog.MayBeErrorf(
       err,
       "Could not write pod environment variables file for the [%s] nursery", 
@@ -100,21 +128,26 @@ func WorkOnUser(
   i       int,
   aUser  *CNSetup.UserType,
   ca     *CNSetup.CAType,
+  renew   bool,
   config *CNSetup.ConfigType,
   wg     *sync.WaitGroup,
 ) {
   defer wg.Done()
   
   config.CSLog.DebugLockf("(%d)started on user: [%s]\n", i, aUser.Name)
-  aUser.Password = userPasswords[aUser.Name]
-  err := aUser.CreateUserCertificate(i, ca, config.Federation_Name) 
+  var err error
+  if renew {
+    err = aUser.RenewUserCertificate(ca, config.Federation_Name, rotateKeys)
+  } else {
+    err = aUser.CreateUserCertificate(i, ca, config.Federation_Name) 
+  }
   config.CSLog.MayBeErrorf(
     err,
     "Could not create userCertificate for [%s]",
     aUser.Name,
   )
   if err == nil {
-    err = aUser.WriteConfiguration()
+    _, err = aUser.WriteConfiguration()
     config.CSLog.MayBeErrorf(
       err,
       "Could not write user [%s] configuration file",
@@ -124,6 +157,270 @@ func WorkOnUser(
   config.CSLog.DebugLockf("(%d)finished on user: [%s]\n", i, aUser.Name)
 }
 
+// Revoke the certificates of the named Nurseries and Users, and then
+// publish the new Certificate Revocation List (CRL) to the CA's directory
+// as well as to each Nursery's crl_path.
+//
+func RevokeCertificates(
+  names        []string,
+  revocations *CNSetup.RevocationDB,
+  config      *CNSetup.ConfigType,
+) {
+  if len(names) < 1 {
+    config.CSLog.Logf("You MUST specify the names of the users or nurseries to revoke")
+    os.Exit(-1)
+  }
+  for _, aName := range names {
+    err := revocations.RevokeNamed(config, aName, revokeReason)
+    config.CSLog.MayBeFatal("Could not revoke ["+aName+"]", err)
+  }
+
+  crlPEM, err := revocations.WriteCRL()
+  config.CSLog.MayBeFatal("Could not write the CRL", err)
+  for _, aNursery := range config.Nurseries {
+    err = CNSetup.WriteCRLFile(aNursery.Crl_Path, crlPEM)
+    config.CSLog.MayBeErrorf(
+      err,
+      "Could not write the CRL for the [%s] nursery",
+      aNursery.Name,
+    )
+  }
+  fmt.Printf("\nThe new CRL can be found in [%s]\n", config.Certificate_Authority.Crl_File_Name)
+  fmt.Printf("  (and MUST be copied to each nursery's crl_path)\n\n")
+}
+
+// Report the ledger entries of the certificates with the given serial 
+// numbers, (common) names or paths.
+//
+func LookupCertificates(
+  queries  []string,
+  ca      *CNSetup.CAType,
+  config  *CNSetup.ConfigType,
+) {
+  if len(queries) < 1 {
+    config.CSLog.Logf("You MUST specify the serial numbers or names of the certificates to lookup")
+    os.Exit(-1)
+  }
+  for _, aQuery := range queries {
+    found := ca.Ledger.Lookup(aQuery)
+    if len(found) < 1 {
+      fmt.Printf("No certificates found for [%s]\n", aQuery)
+      continue
+    }
+    CNSetup.WriteLedgerReport(os.Stdout, found, time.Now())
+  }
+}
+
+// Load the existing user passwords (from the "users/passwords" file) 
+// into each configured User. 
+//
+func LoadUserPasswords(config *CNSetup.ConfigType) {
+  passwordFile, err := os.Open("users/passwords")
+  if err == nil {
+    scanner := bufio.NewScanner(passwordFile)
+    scanner.Split(bufio.ScanLines)
+    for scanner.Scan() {
+      aLine := scanner.Text()
+      fields    := strings.Split(aLine, "\t")
+      aUser     := fields[0]
+      aPassword := fields[1]
+      userPasswords[aUser] = aPassword
+    }
+    passwordFile.Close()
+  }
+  for i, aUser := range config.Users {
+    config.Users[i].Password = userPasswords[aUser.Name]
+  }
+}
+
+// Write out the (configured) Users' passwords to the "users/passwords" 
+// file. 
+//
+func WriteUserPasswords(config *CNSetup.ConfigType) {
+  passwordFile, err := os.Create("users/passwords")
+  config.CSLog.MayBeFatal("Could not open [users/passwords] file", err)
+  for _, aUser := range config.Users {
+    passwordFile.WriteString(aUser.Name+"\t"+aUser.Password+"\n")
+  }
+  passwordFile.Close()
+  os.Chmod("users/passwords", 0600)
+  fmt.Printf("\nThe automatically generated passwords for each user's PKCS#12 file\n")
+  fmt.Printf("  can be found in the file [users/passwords]\n\n")
+}
+
+// Rewrite the configuration files of every existing Nursery and User 
+// (only those whose contents have changed are written), and report which 
+// of them MUST be pushed to the Nurseries and Users. 
+//
+func ReportPushes(config *CNSetup.ConfigType) {
+  nurseries, errs := config.WriteNurseryConfigurations()
+  users, userErrs := config.WriteUserConfigurations()
+  for _, anErr := range append(errs, userErrs...) {
+    config.CSLog.MayBeError("Could not write a configuration file", anErr)
+  }
+
+  if len(nurseries) < 1 {
+    fmt.Printf("\nNo (existing) nursery configuration needs to be pushed\n")
+  } else {
+    fmt.Printf("\nThe configuration of these nurseries MUST be pushed:\n")
+    for _, aName := range nurseries { fmt.Printf("  %s\n", aName) }
+  }
+  if len(users) < 1 {
+    fmt.Printf("\nNo (existing) user configuration needs to be sent\n\n")
+  } else {
+    fmt.Printf("\nThe configuration of these users MUST be sent:\n")
+    for _, aName := range users { fmt.Printf("  %s\n", aName) }
+    fmt.Printf("\n")
+  }
+}
+
+// Create the certificates (and configuration) of the named (newly 
+// configured) Nurseries or Users, without regenerating the certificates 
+// (or passwords) of any other Nursery or User. 
+//
+// The (seeded) NATS routes of the other Nurseries and Users keep their 
+// order, and only their configuration files which change are rewritten. 
+//
+func AddCertificates(
+  kind         string,
+  names      []string,
+  ca          *CNSetup.CAType,
+  revocations *CNSetup.RevocationDB,
+  config      *CNSetup.ConfigType,
+) {
+  var wg sync.WaitGroup
+
+  if len(names) < 1 {
+    config.CSLog.Logf("You MUST specify the names of the %ss to add", kind)
+    os.Exit(-1)
+  }
+
+  // (the new nurseries get the CA's existing CRL) 
+  //
+  crlPEM, err := ioutil.ReadFile(config.Certificate_Authority.Crl_File_Name)
+  if err != nil {
+    crlPEM, err = revocations.WriteCRL()
+    if err != nil {
+      config.CSLog.MayBeError("Could not write the CRL (no revocations will be checked)", err)
+      crlPEM = nil
+    }
+  }
+  if kind == CNSetup.UserKind { LoadUserPasswords(config) }
+
+  for _, aName := range names {
+    i        := -1
+    certPath := ""
+    if kind == CNSetup.NurseryKind {
+      i = config.NurseryIndex(aName)
+      if -1 < i { certPath = config.Nurseries[i].Cert_Path }
+    } else {
+      i = config.UserIndex(aName)
+      if -1 < i { certPath = config.Users[i].Cert_Path }
+    }
+    if i < 0 {
+      config.CSLog.Logf(
+        "The %s [%s] MUST first be added to [%s]", kind, aName, configFileName,
+      )
+      os.Exit(-1)
+    }
+    if _, err := os.Stat(certPath) ; err == nil {
+      config.CSLog.Logf(
+        "The %s [%s] already has a certificate [%s] (did you mean renew?)",
+        kind, aName, certPath,
+      )
+      os.Exit(-1)
+    }
+
+    fmt.Printf("(%d)working on %s: [%s]\n", i, kind, aName)
+    wg.Add(1)
+    if kind == CNSetup.NurseryKind {
+      _, err = config.Nurseries[i].KeyPassphrase()
+      config.CSLog.MayBeFatal("Could not read the key passphrase for the ["+aName+"] nursery", err)
+      go WorkOnNursery(i, &config.Nurseries[i], ca, crlPEM, false, config, &wg)
+    } else {
+      go WorkOnUser(i, &config.Users[i], ca, false, config, &wg)
+    }
+  }
+  wg.Wait()
+
+  if kind == CNSetup.UserKind { WriteUserPasswords(config) }
+  ReportPushes(config)
+}
+
+// Revoke the certificates of the named Nurseries or Users, remove them 
+// from the (loaded) configuration, and then rewrite (only) the 
+// configuration files of the remaining Nurseries and Users which change. 
+//
+// (The named Nurseries or Users are also removed from the configuration 
+// file, preserving its comments.) 
+//
+func RemoveCertificates(
+  kind         string,
+  names      []string,
+  revocations *CNSetup.RevocationDB,
+  config      *CNSetup.ConfigType,
+) {
+  if len(names) < 1 {
+    config.CSLog.Logf("You MUST specify the names of the %ss to remove", kind)
+    os.Exit(-1)
+  }
+  for _, aName := range names {
+    if (kind == CNSetup.NurseryKind && config.NurseryIndex(aName) < 0) ||
+      (kind == CNSetup.UserKind && config.UserIndex(aName) < 0) {
+      config.CSLog.Logf("[%s] is not a configured %s", aName, kind)
+      os.Exit(-1)
+    }
+  }
+  if kind == CNSetup.UserKind { LoadUserPasswords(config) }
+
+  RevokeCertificates(names, revocations, config)
+  err := config.RemoveNamed(names)
+  config.CSLog.MayBeFatal("Could not remove the "+kind+"s", err)
+  err = CNSetup.RemoveNamedFromFile(configFileName, names)
+  config.CSLog.MayBeFatal("Could not remove the "+kind+"s from ["+configFileName+"]", err)
+
+  if kind == CNSetup.UserKind { WriteUserPasswords(config) }
+  ReportPushes(config)
+  fmt.Printf("%v have been removed from [%s], and\n", names, configFileName)
+  fmt.Printf("  the new CRL MUST be pushed to every nursery\n\n")
+}
+
+// Validate the configuration file, as well as the (cnNursery and 
+// cnTypeSetter) configuration files already written for each Nursery and 
+// User, and report EVERY problem found (each at its file:line). 
+//
+// (The Nursery and User configuration files are only validated once the 
+// configuration file itself has no problems.) 
+//
+func ValidateConfigurations(csLog *logger.LoggerType) {
+  problems := CNSetup.ValidateConfiguration(configFileName).Problems
+  if len(problems) < 1 {
+    config := CNSetup.CreateConfiguration(csLog)
+    config.LoadConfiguration(configFileName, false)
+    validators := []*configValidation.Validator{}
+    for _, aNursery := range config.Nurseries {
+      if _, err := os.Stat(aNursery.Config_Path) ; err != nil { continue }
+      validators = append(validators, CNNurseries.ValidateConfiguration(aNursery.Config_Path))
+    }
+    for _, aUser := range config.Users {
+      if _, err := os.Stat(aUser.Config_Path) ; err != nil { continue }
+      validators = append(validators, CNTypeSetter.ValidateConfiguration(
+        filepath.Dir(aUser.Config_Path), filepath.Base(aUser.Config_Path),
+      ))
+    }
+    for _, aValidator := range validators {
+      problems = append(problems, aValidator.Problems...)
+    }
+  }
+
+  for _, aProblem := range problems { fmt.Println(aProblem.String()) }
+  if 0 < len(problems) {
+    fmt.Printf("\nFound %d problem(s) in the configuration\n", len(problems))
+    os.Exit(-1)
+  }
+  fmt.Printf("No problems found in the configuration [%s]\n", configFileName)
+}
+
 // Orchestrate the (optional) (re)creation of a (self-signed) Certificate 
 // Authority, as well as Certificates and Configuration for each Nursery 
 // and User. 
@@ -132,6 +429,19 @@ func WorkOnUser(
 // sync.WaitGroups to allow the creation of the Certificates (and 
 // configuration) for each Nursery and User to occur in parallel. 
 //
+// The "add-nursery", "add-user", "remove-nursery" and "remove-user" 
+// commands (only) create, or revoke, the certificates of the named 
+// Nurseries or Users (rewriting only the configuration files which 
+// change). The "validate" command only reports every problem in the 
+// configuration (before anything is loaded or created). The "revoke" 
+// command instead revokes the certificates of the named Nurseries and 
+// Users, the "status" command reports on every issued certificate, while 
+// the "renew" command reissues (only) the certificates which are about to 
+// expire (or are named). The "list", "lookup" and "diff" commands report 
+// on the CA's ledger of issued certificates. The "intermediate" command 
+// (re)creates an intermediate CA (signed by the offline root CA) and then 
+// renews every certificate. 
+//
 func main() {
   var (
     wg sync.WaitGroup
@@ -144,21 +454,22 @@ func main() {
   flag.StringVar(&configFileName, "c", configFileNameDefault, configFileNameUsage)
   flag.BoolVar(&showConfig, "show", showConfigDefault, showConfigUsage)
   flag.BoolVar(&showConfig, "s", showConfigDefault, showConfigUsage)
+  flag.StringVar(&revokeReason, "reason", revokeReasonDefault, revokeReasonUsage)
+  flag.BoolVar(&rotateKeys, "rotateKeys", rotateKeysDefault, rotateKeysUsage)
   flag.Parse()
 
   // Setup logging and load the configuration.
   //
   csLog  := logger.CreateLogger("cnSetup")
+  if flag.Arg(0) == "validate" {
+    ValidateConfigurations(csLog)
+    return
+  }
 
-  // seed the math/rand random number generator with a "random" seed
-  // see: https://stackoverflow.com/a/54491783
-  // (random is used when loading the configuration to ensure the NATS 
-  // routes are randomized) 
+  // (the NATS routes are shuffled using a seed persisted in the 
+  // nats_routes_seed_path file, so that they keep the same order on every 
+  // run) 
   //
-  var randomSeed [8]byte
-  _, err := crand.Read(randomSeed[:])
-  csLog.MayBeFatal("Could not read a random seed from the system random stream", err)
-  rand.Seed(int64(binary.LittleEndian.Uint64(randomSeed[:])))
   config := CNSetup.CreateConfiguration(csLog)
   config.LoadConfiguration(configFileName, showConfig)
   
@@ -171,9 +482,20 @@ func main() {
   // Load or (re)Create the CA...
   // (this MUST be done synchronously)
   //
-  ca  := CNSetup.CreateCA(config)
-  err  = ca.LoadCAFromFiles()
-  if err != nil {
+  // (the ledger of the certificates already issued by the CA MUST be 
+  // loaded before any new certificate is issued) 
+  //
+  command := flag.Arg(0)
+  ca      := CNSetup.CreateCA(config)
+  err     := ca.Ledger.Load()
+  csLog.MayBeFatal("Could not load the ledger of issued certificates", err)
+  err      = ca.LoadCAFromFiles()
+  if command == "intermediate" {
+    err = ca.CreateNewIntermediateCA(false)
+    csLog.MayBeFatal("Could not create a new intermediate CA", err)
+    err = ca.WriteCAFiles(config)
+    csLog.MayBeFatal("Could not write CA files", err)
+  } else if err != nil {
     if createCA {
       err = ca.CreateNewCA()
       if err != nil {
@@ -187,6 +509,95 @@ func main() {
     }
   }
 
+  // Record any installed certificates issued before the ledger was kept
+  //
+  for _, anErr := range ca.Ledger.ImportConfigured(config) {
+    csLog.MayBeError("Could not record an existing certificate in the ledger", anErr)
+  }
+
+  // Load the certificates already revoked by the CA...
+  //
+  revocations := CNSetup.CreateRevocationDB(ca)
+  err = revocations.Load()
+  csLog.MayBeFatal("Could not load the revoked certificates", err)
+
+  renewing := command == "renew" || command == "intermediate"
+  switch command {
+    case "", "renew", "intermediate" :
+    case "revoke"                    :
+      RevokeCertificates(flag.Args()[1:], revocations, config)
+      return
+    case "status"                    :
+      CNSetup.WriteStatusReport(
+        os.Stdout,
+        config.CertificateStatuses(revocations, time.Now()),
+        config.Renew_Within_Days,
+      )
+      return
+    case "list"                      :
+      CNSetup.WriteLedgerReport(os.Stdout, ca.Ledger.List(), time.Now())
+      return
+    case "lookup"                    :
+      LookupCertificates(flag.Args()[1:], ca, config)
+      return
+    case "diff"                      :
+      for _, aDiff := range ca.Ledger.Diff(config, time.Now()) {
+        fmt.Println(aDiff)
+      }
+      return
+    case "add-nursery"               :
+      AddCertificates(CNSetup.NurseryKind, flag.Args()[1:], ca, revocations, config)
+      return
+    case "add-user"                  :
+      AddCertificates(CNSetup.UserKind, flag.Args()[1:], ca, revocations, config)
+      return
+    case "remove-nursery"            :
+      RemoveCertificates(CNSetup.NurseryKind, flag.Args()[1:], revocations, config)
+      return
+    case "remove-user"               :
+      RemoveCertificates(CNSetup.UserKind, flag.Args()[1:], revocations, config)
+      return
+    default                          :
+      csLog.Logf("Unknown command [%s]", command)
+      os.Exit(-1)
+  }
+
+  // When renewing, select the (existing) certificates to renew 
+  //
+  // (a new intermediate CA renews every certificate, since those signed 
+  // by the old intermediate CA can no longer be verified) 
+  //
+  renewNames := []string{}
+  if command == "renew" { renewNames = flag.Args()[1:] }
+  if command == "intermediate" {
+    for _, aNursery := range config.Nurseries {
+      renewNames = append(renewNames, aNursery.Name)
+    }
+    for _, aUser := range config.Users {
+      renewNames = append(renewNames, aUser.Name)
+    }
+  }
+  renewals := CNSetup.SelectRenewals(
+    config.CertificateStatuses(revocations, time.Now()),
+    renewNames,
+    config.Renew_Within_Days,
+  )
+  if renewing {
+    fmt.Printf(
+      "Renewing %d nursery and %d user certificates\n",
+      len(renewals[CNSetup.NurseryKind]), len(renewals[CNSetup.UserKind]),
+    )
+  }
+
+  // ... and (re)publish the CRL (unless the CA can not sign one, in which 
+  // case the nurseries will not check for revoked certificates) 
+  //
+  crlPEM, err := revocations.WriteCRL()
+  if err != nil {
+    csLog.MayBeError("Could not write the CRL (no revocations will be checked)", err)
+    crlPEM = nil
+  }
+
   // The creation of the Nursery and User certificates and configuration
   // can take place asynchronously...
   //
@@ -194,35 +605,33 @@ func main() {
   // configuration 
   //
   for i, aNursery := range config.Nurseries {
+    renew := renewals[CNSetup.NurseryKind][aNursery.Name]
+    if renewing && !renew { continue }
+    // (any key passphrase is read (or prompted for) before working on 
+    // the nurseries asynchronously) 
+    //
+    _, err = config.Nurseries[i].KeyPassphrase()
+    csLog.MayBeFatal("Could not read the key passphrase for the ["+aNursery.Name+"] nursery", err)
     fmt.Printf("(%d)working on nursery: [%s]\n", i, aNursery.Name)
     wg.Add(1)
-    go WorkOnNursery(i, &config.Nurseries[i], ca, config, &wg)
+    go WorkOnNursery(i, &config.Nurseries[i], ca, crlPEM, renewing, config, &wg)
   }
 
   // Now deal with the users...
   //
   // ... start by loading in the existing user passwords
   //
-  passwordFile, err := os.Open("users/passwords")
-  if err == nil {
-    scanner := bufio.NewScanner(passwordFile)
-    scanner.Split(bufio.ScanLines)
-    for scanner.Scan() {
-      aLine := scanner.Text()
-      fields    := strings.Split(aLine, "\t")
-      aUser     := fields[0]
-      aPassword := fields[1]
-      userPasswords[aUser] = aPassword
-    }
-    passwordFile.Close()
-  }
+  LoadUserPasswords(config)
 
-  // Now create each User's certificates and cnTypeSetter configuration
+  // Now create (or renew) each User's certificates and cnTypeSetter 
+  // configuration 
   //
   for i, aUser := range config.Users {
+    renew := renewals[CNSetup.UserKind][aUser.Name]
+    if renewing && !renew { continue }
     fmt.Printf("(%d)working on user: [%s]\n", i, aUser.Name)
     wg.Add(1)
-    go WorkOnUser(i, &config.Users[i], ca, config, &wg)
+    go WorkOnUser(i, &config.Users[i], ca, renewing, config, &wg)
   } 
   
   // Wait for all go routines
@@ -230,13 +639,5 @@ func main() {
 
   // Now write out the file of user passwords
   //
-  passwordFile, err = os.Create("users/passwords")
-  csLog.MayBeFatal("Could not open [users/passwords] file", err)
-  for _, aUser := range config.Users {
-    passwordFile.WriteString(aUser.Name+"\t"+aUser.Password+"\n")
-  }
-  passwordFile.Close()
-  os.Chmod("users/passwords", 0600)
-  fmt.Printf("\nThe automatically generated passwords for each user's PKCS#12 file\n")
-  fmt.Printf("  can be found in the file [users/passwords]\n\n")
+  WriteUserPasswords(config)
 }
@@ -17,7 +17,9 @@ package CNTypeSetter
 import (
   "encoding/json"
   "fmt"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
   "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/diSimplex/ConTeXtNursery/webserver"
   "github.com/jinzhu/configor"
   "os"
   "strings"
@@ -26,19 +28,26 @@ import (
 // The TypeSetter configuration
 //
 type ConfigType struct {
-  Name            string
-  Interface       string
-  Port            string
-  Config_Dir      string
-  Browser_App_Dir string
-  Ca_Cert_Path    string
-  Cert_Path       string
-  Key_Path        string
-  Nats_Routes   []string
+  Name                string
+  Interface           string
+  Port                string
+  Config_Dir          string
+  Browser_App_Dir     string
+  Nursery_Url         string
+  Ca_Cert_Path        string
+  Cert_Path           string
+  Key_Path            string
+  Key_Passphrase      string
+  Crl_Path            string
+  Cert_Check_Interval uint
+  Nats_Routes       []string
+  Nats_Tls            bool
+  Limits              webserver.Limits
+  Retry               federationClient.RetryPolicy
 
   // Auxilary fields for logging
   //
-  CNLog                *logger.LoggerType
+  CNLog              *logger.LoggerType
 
 }
 
@@ -89,6 +98,9 @@ func (config *ConfigType) LoadConfiguration(
   if ! strings.HasPrefix(config.Key_Path, "/") {
   	config.Key_Path = configDir + config.Key_Path
   }
+  if config.Crl_Path != "" && ! strings.HasPrefix(config.Crl_Path, "/") {
+  	config.Crl_Path = configDir + config.Crl_Path
+  }
 
   
   if browserAppDir != "" { config.Browser_App_Dir = browserAppDir }
@@ -105,6 +117,12 @@ func (config *ConfigType) LoadConfiguration(
   if config.Interface == "" { config.Interface = "0.0.0.0" }
   if config.Port      == "" { config.Port      = "4224"}
 
+  config.Nursery_Url = strings.TrimSuffix(config.Nursery_Url, "/")
+
+  config.Limits.NormalizeLimits()
+  config.Retry.NormalizeRetry()
+  if config.Cert_Check_Interval == 0 { config.Cert_Check_Interval = 10 }
+
   if showConfig {
     configBytes, _ := json.MarshalIndent(config, "", "  ")
     fmt.Printf("%s\n", string(configBytes))
@@ -0,0 +1,161 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNTypeSetter
+
+import (
+  "encoding/json"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/action"
+  "github.com/diSimplex/ConTeXtNursery/webserver"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+)
+
+// Reply with the error returned by the federation client (using the
+// nursery's own status code, or 502 (Bad Gateway) if the nursery could
+// not be reached).
+//
+func replyFederationError(
+  ws   *webserver.WS,
+  w     http.ResponseWriter,
+  r    *http.Request,
+  err   error,
+) {
+  statusCode := federationClient.StatusCode(err)
+  if statusCode == 0 { statusCode = http.StatusBadGateway }
+  ws.RequestLog(r).MayBeError("The federation request failed", err)
+  ws.ReplyError(w, r, err.Error(), statusCode)
+}
+
+// Add the (read mostly) federation interface used by the browser
+// application, forwarding each request to the nursery at the nurseryUrl
+// using the (typed) federation client.
+//
+// The request id of each browser request is carried (in its context) to
+// the nursery.
+//
+func AddFederationInterface(
+  ws         *webserver.WS,
+  fc         *federationClient.Client,
+  nurseryUrl  string,
+) {
+  ws.DescribeRoute("/heartbeat", "The nurseries in the federation", true)
+  ws.DescribeRoute("/control",   "The control state of the federation", true)
+  ws.DescribeRoute("/action",    "The actions registered with the nursery", true)
+
+  // interface:
+  //   - url: /heartbeat
+  //     method: GET
+  //     response: The currently known NurseryInfo of Nurseries in the Federation
+  //     jsonResp: NurseryInfoMap
+  //
+  err := ws.AddGetHandler(
+    "/heartbeat",
+    func(w http.ResponseWriter, r *http.Request) {
+      niMap, err := fc.ListNurseries(r.Context(), nurseryUrl)
+      if err != nil { replyFederationError(ws, w, r, err) ; return }
+      ws.ReplyInJson(w, r, niMap)
+    },
+  )
+  ws.Log.MayBeError("Could not add GET handler for [/heartbeat]", err)
+
+  // interface:
+  //   - url: /control
+  //     method: GET
+  //     response: The current state of the federation
+  //     jsonResp: FederationStateMap
+  //
+  err = ws.AddGetHandler(
+    "/control",
+    func(w http.ResponseWriter, r *http.Request) {
+      fedMap, err := fc.FederationStatus(r.Context(), nurseryUrl)
+      if err != nil { replyFederationError(ws, w, r, err) ; return }
+      ws.ReplyInJson(w, r, fedMap)
+    },
+  )
+  ws.Log.MayBeError("Could not add GET handler for [/control]", err)
+
+  // interface:
+  //   - url: /action
+  //     method: GET
+  //     response: The list of currently registered actions
+  //     jsonResp: ActionList
+  //
+  //   - url: /action/<anAction>
+  //     method: GET
+  //     response: The available action arguments and environment variables
+  //     jsonResp: ActionDescription
+  //
+  err = ws.AddGetHandler(
+    "/action",
+    func(w http.ResponseWriter, r *http.Request) {
+      pathParts := ws.GetPathParts(r.URL.Path)
+      if len(pathParts) < 2 {
+        actions, err := fc.ListActions(r.Context(), nurseryUrl)
+        if err != nil { replyFederationError(ws, w, r, err) ; return }
+        ws.ReplyInJson(w, r, actions)
+        return
+      }
+      actionDesc, err := fc.DescribeAction(r.Context(), nurseryUrl, pathParts[1])
+      if err != nil { replyFederationError(ws, w, r, err) ; return }
+      ws.ReplyInJson(w, r, actionDesc)
+    },
+  )
+  ws.Log.MayBeError("Could not add GET handler for [/action]", err)
+
+  // interface:
+  //   - url: /action/<anAction>
+  //     method: POST
+  //     jsonPost: ActionConfig
+  //     action: Runs the <anAction> on the nursery
+  //     response: Redirect to <nurseryUrl>/action/output/<anAction>/<aRun>
+  //
+  err = ws.AddPostHandler(
+    "/action",
+    func(w http.ResponseWriter, r *http.Request) {
+      pathParts := ws.GetPathParts(r.URL.Path)
+      if len(pathParts) < 2 {
+        ws.ReplyError(w, r, "No action specified", http.StatusBadRequest)
+        return
+      }
+      theAction := pathParts[1]
+      body, err := ioutil.ReadAll(r.Body)
+      if err != nil {
+        ws.ReplyError(w, r, "Could not read body", http.StatusBadRequest)
+        return
+      }
+      var ac action.ActionConfig
+      err = json.Unmarshal(body, &ac)
+      if err != nil {
+        ws.ReplyError(
+          w, r, "Could not unmarshal action configuration", http.StatusBadRequest,
+        )
+        return
+      }
+      // (the run may outlast the webserver's write timeout)
+      ws.ClearWriteDeadline(w, r)
+      theRunId, err := fc.RunAction(r.Context(), nurseryUrl, theAction, &ac)
+      if err != nil { replyFederationError(ws, w, r, err) ; return }
+
+      http.Redirect(
+        w, r,
+        nurseryUrl+"/action/output/"+url.PathEscape(theAction)+"/"+theRunId,
+        http.StatusSeeOther,
+      )
+    },
+  )
+  ws.Log.MayBeError("Could not add POST handler for [/action]", err)
+}
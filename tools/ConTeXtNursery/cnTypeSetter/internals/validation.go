@@ -0,0 +1,62 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package CNTypeSetter
+
+import (
+  "github.com/diSimplex/ConTeXtNursery/configValidation"
+  "reflect"
+  "strings"
+)
+
+// Validate the (cnTypeSetter) configuration file at configFilePath
+// (which, like its certificate and key paths, is relative to the
+// configDir), returning a validator containing EVERY problem found (each
+// at its file:line).
+//
+// The validation reports unknown keys, bad passphrase sources, a
+// nursery_url which is not an "https://" URL, NATS routes which are not
+// "nats://" URLs, as well as certificate, key (and crl) files which do
+// not exist.
+//
+// CREATES validator;
+//
+func ValidateConfiguration(configDir, configFilePath string) *configValidation.Validator {
+  if ! strings.HasPrefix(configFilePath, "/") &&
+     ! strings.HasPrefix(configFilePath, ".") {
+    configFilePath = strings.TrimSuffix(configDir, "/") + "/" + configFilePath
+  }
+
+  validator := configValidation.LoadValidator(configFilePath)
+  if 0 < len(validator.Problems) { return validator }
+  root      := validator.Root
+  validator.CheckKeys(root, reflect.TypeOf(ConfigType{}))
+
+  validator.Require(root, "ca_cert_path", "cert_path", "key_path")
+  for _, aKey := range []string{ "ca_cert_path", "cert_path", "key_path", "crl_path" } {
+    validator.CheckPathExists(root, aKey, configDir)
+  }
+  validator.CheckPassphraseSource(root)
+  if nurseryUrl := configValidation.Get(root, "nursery_url") ; nurseryUrl != nil &&
+     !strings.HasPrefix(nurseryUrl.Value, "https://") {
+    validator.Addf(nurseryUrl, "the nursery_url [%s] MUST be an https:// URL", nurseryUrl.Value)
+  }
+  for _, aRoute := range configValidation.GetItems(root, "nats_routes") {
+    if !strings.HasPrefix(aRoute.Value, "nats://") {
+      validator.Addf(aRoute, "the NATS route [%s] MUST be a nats:// URL", aRoute.Value)
+    }
+  }
+  validator.Sort()
+  return validator
+}
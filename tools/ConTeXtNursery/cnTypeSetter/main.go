@@ -20,9 +20,13 @@ package main
 
 import (
   crand "crypto/rand"
+  "crypto/tls"
   "encoding/binary"
   "flag"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "github.com/diSimplex/ConTeXtNursery/clientConnection"
   "github.com/diSimplex/ConTeXtNursery/cnTypeSetter/internals"
+  "github.com/diSimplex/ConTeXtNursery/federationClient"
   "github.com/diSimplex/ConTeXtNursery/logger"
   "github.com/diSimplex/ConTeXtNursery/natsServer"
   "github.com/diSimplex/ConTeXtNursery/webserver"
@@ -30,6 +34,7 @@ import (
   "math/rand"
   "os"
   "runtime"
+  "time"
 )
 
 //////////////////////////
@@ -90,7 +95,18 @@ func main() {
   cnLog.Logf("numCPU: %d\n", runtime.NumCPU())
   cnLog.Logf("GOMAXPROCS: %d\n", runtime.GOMAXPROCS(-1))
 
-  _ = natsServer.ConnectServer(config.Nats_Routes, cnLog)
+  certs := certificates.CreateUnlockedCertificates(
+    config.Ca_Cert_Path, config.Cert_Path, config.Key_Path, config.Crl_Path,
+    config.Key_Passphrase, cnLog,
+  )
+  certs.WatchFiles(time.Duration(config.Cert_Check_Interval) * time.Second)
+
+  // (the NATS servers authorize the user by their certificate when the 
+  // federation uses nats_tls)
+  //
+  var natsTLSConfig *tls.Config
+  if config.Nats_Tls { natsTLSConfig = certs.ClientTLSConfig() }
+  _ = natsServer.ConnectServer(config.Nats_Routes, natsTLSConfig, cnLog)
 
   ws := webserver.CreateWebServer(
     config.Interface, config.Port, `
@@ -102,7 +118,8 @@ Each ConTeXt Nursery in the federation is capable of managing the type
 setting of one or more ConTeXt based (sub)documents in parallel.
 
 `,
-    config.Ca_Cert_Path, config.Cert_Path, config.Key_Path,
+    certs,
+    config.Limits,
     cnLog,
   )
 
@@ -114,6 +131,22 @@ setting of one or more ConTeXt based (sub)documents in parallel.
     FSByte,
   )
   cnLog.MayBeError("Could not add static file handlers", err)
-  
-  ws.RunWebServer()
+
+  // (the browser application's federation requests are forwarded to the
+  // nursery at the nursery_url using the typed federation client)
+  //
+  if config.Nursery_Url != "" {
+    cc := clientConnection.CreateClientConnection(certs, cnLog)
+    fc := federationClient.CreateClient(cc, config.Retry)
+    CNTypeSetter.AddFederationInterface(ws, fc, config.Nursery_Url)
+  } else {
+    cnLog.Logf("no nursery_url has been configured (the federation can not be browsed)")
+  }
+
+  // shutdown gracefully when asked to by systemd, podman or the user
+  ws.ShutdownOnSignals()
+
+  err = ws.RunWebServer()
+  cnLog.MayBeFatal("The webserver stopped unexpectedly", err)
+  cnLog.Logf("cnTypeSetter: %s stopped", config.Name)
 }
@@ -0,0 +1,359 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The validation of the (YAML) configuration files used by the cnSetup,
+// cnNursery and cnTypeSetter commands.
+//
+// Every problem found in a configuration file is collected (together with
+// the file and line at which it was found), so that all of them can be
+// reported at once.
+//
+package configValidation
+
+import (
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
+  "gopkg.in/yaml.v3"
+  "io/ioutil"
+  "net/url"
+  "os"
+  "path/filepath"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+//////////////////////////////////////////////////////////////////////
+// Validation types
+//
+
+// A problem found in a configuration file.
+//
+type Problem struct {
+  Path    string
+  Line    int
+  Message string
+}
+
+// Returns the problem as "path:line: message".
+//
+func (problem Problem) String() string {
+  return problem.Path+":"+strconv.Itoa(problem.Line)+": "+problem.Message
+}
+
+// The (parsed) YAML configuration file being validated, together with
+// the problems found in it (so far), and the keys which CheckKeys
+// ignores.
+//
+// NOT THREAD-SAFE;
+//
+type Validator struct {
+  Path       string
+  Root      *yaml.Node
+  Problems []Problem
+  Ignored    map[string]bool
+}
+
+// The (prefix, including the line number, of) yaml (syntax) errors.
+//
+var yamlErrorLine = regexp.MustCompile(`^yaml: (?:line ([0-9]+): )?`)
+
+// Load and parse the YAML configuration file at path.
+//
+// A file which can not be read (or parsed) is recorded as a problem, in
+// which case the Root is an empty mapping (and there is no point in
+// validating it further).
+//
+// CREATES validator;
+//
+func LoadValidator(path string) *Validator {
+  validator := &Validator{
+    Path: path,
+    Root: &yaml.Node{ Kind: yaml.MappingNode, Line: 1 },
+  }
+
+  yamlBytes, err := ioutil.ReadFile(path)
+  if err != nil {
+    validator.Problems = append(validator.Problems, Problem{
+      path, 1, fmt.Sprintf("could not read the configuration: %s", err),
+    })
+    return validator
+  }
+
+  var document yaml.Node
+  err = yaml.Unmarshal(yamlBytes, &document)
+  if err != nil {
+    line := 1
+    if match := yamlErrorLine.FindStringSubmatch(err.Error()) ; match != nil && match[1] != "" {
+      line, _ = strconv.Atoi(match[1])
+    }
+    validator.Problems = append(validator.Problems, Problem{
+      path, line, yamlErrorLine.ReplaceAllString(err.Error(), ""),
+    })
+    return validator
+  }
+  if 0 < len(document.Content) {
+    validator.Root = document.Content[0]
+    if validator.Root.Kind != yaml.MappingNode {
+      validator.Addf(validator.Root, "the configuration MUST be a mapping")
+      validator.Root = &yaml.Node{ Kind: yaml.MappingNode, Line: 1 }
+    }
+  }
+  return validator
+}
+
+// Record a problem found at the given node (which may be nil, in which
+// case the problem is recorded at the start of the file).
+//
+// ALTERS validator;
+//
+func (validator *Validator) Addf(
+  node    *yaml.Node,
+  format   string,
+  args ...interface{},
+) {
+  line := 1
+  if node != nil { line = node.Line }
+  validator.Problems = append(validator.Problems, Problem{
+    validator.Path, line, fmt.Sprintf(format, args...),
+  })
+}
+
+// Returns the value of the key in the given mapping node (or nil if the
+// node is not a mapping or does not contain the key).
+//
+func Get(node *yaml.Node, key string) *yaml.Node {
+  if node == nil || node.Kind != yaml.MappingNode { return nil }
+  for i := 0 ; i+1 < len(node.Content) ; i += 2 {
+    if node.Content[i].Value == key { return node.Content[i+1] }
+  }
+  return nil
+}
+
+// Returns the key node of the key in the given mapping node (or nil if
+// the node is not a mapping or does not contain the key).
+//
+func GetKey(node *yaml.Node, key string) *yaml.Node {
+  if node == nil || node.Kind != yaml.MappingNode { return nil }
+  for i := 0 ; i+1 < len(node.Content) ; i += 2 {
+    if node.Content[i].Value == key { return node.Content[i] }
+  }
+  return nil
+}
+
+// Returns the (scalar) value of the key in the given mapping node (or ""
+// if there is no such key).
+//
+func GetValue(node *yaml.Node, key string) string {
+  value := Get(node, key)
+  if value == nil || value.Kind != yaml.ScalarNode { return "" }
+  return value.Value
+}
+
+// Returns the items of the (sequence) value of the key in the given
+// mapping node.
+//
+func GetItems(node *yaml.Node, key string) []*yaml.Node {
+  value := Get(node, key)
+  if value == nil || value.Kind != yaml.SequenceNode { return nil }
+  return value.Content
+}
+
+// Returns the YAML key used (by the configor package) for a structure's
+// field.
+//
+func fieldKey(field reflect.StructField) string {
+  tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+  if tag != "" { return tag }
+  return strings.ToLower(field.Name)
+}
+
+// Add the (given) keys to those which CheckKeys ignores (wherever they
+// occur), such as keys which are written into a configuration file for
+// the use of another program.
+//
+// ALTERS validator;
+//
+func (validator *Validator) IgnoreKeys(keys ...string) {
+  if validator.Ignored == nil { validator.Ignored = map[string]bool{} }
+  for _, aKey := range keys { validator.Ignored[aKey] = true }
+}
+
+// Record every key (in the node, and recursively in its values) which
+// does not correspond to an (exported) field of the structure (of the
+// given type) into which the configuration is loaded (unless the key is
+// ignored).
+//
+// ALTERS validator;
+//
+func (validator *Validator) CheckKeys(node *yaml.Node, configType reflect.Type) {
+  for configType.Kind() == reflect.Ptr { configType = configType.Elem() }
+  if node == nil { return }
+
+  switch configType.Kind() {
+    case reflect.Struct :
+      if node.Kind != yaml.MappingNode {
+        validator.Addf(node, "expected a mapping (of keys to values)")
+        return
+      }
+      fields := map[string]reflect.StructField{}
+      for i := 0 ; i < configType.NumField() ; i++ {
+        aField := configType.Field(i)
+        if aField.PkgPath != "" { continue } // (unexported)
+        fields[fieldKey(aField)] = aField
+      }
+      for i := 0 ; i+1 < len(node.Content) ; i += 2 {
+        aKey   := node.Content[i]
+        if validator.Ignored[aKey.Value] { continue }
+        aField, ok := fields[aKey.Value]
+        if !ok {
+          validator.Addf(aKey, "unknown key [%s]", aKey.Value)
+          continue
+        }
+        validator.CheckKeys(node.Content[i+1], aField.Type)
+      }
+    case reflect.Slice :
+      if node.Kind != yaml.SequenceNode { return }
+      for _, anItem := range node.Content {
+        validator.CheckKeys(anItem, configType.Elem())
+      }
+  }
+}
+
+// Record a problem for each of the (given) keys which is missing from
+// (or empty in) the node.
+//
+// ALTERS validator;
+//
+func (validator *Validator) Require(node *yaml.Node, keys ...string) {
+  for _, aKey := range keys {
+    if GetValue(node, aKey) == "" {
+      validator.Addf(node, "the %s MUST be specified", aKey)
+    }
+  }
+}
+
+// Record a problem if the (non empty) path in the key's value does not
+// exist. A relative path is relative to the baseDir (if it is not empty).
+//
+// ALTERS validator;
+//
+func (validator *Validator) CheckPathExists(node *yaml.Node, key, baseDir string) {
+  value := Get(node, key)
+  if value == nil || value.Value == "" { return }
+  aPath := value.Value
+  if baseDir != "" && !filepath.IsAbs(aPath) { aPath = filepath.Join(baseDir, aPath) }
+  if _, err := os.Stat(aPath) ; err != nil {
+    validator.Addf(value, "the %s [%s] does not exist", key, aPath)
+  }
+}
+
+// Record a problem if the key_passphrase value (in the given node) is not
+// a passphrase source, or is a "file:" source whose file does not exist.
+//
+// ALTERS validator;
+//
+func (validator *Validator) CheckPassphraseSource(node *yaml.Node) {
+  value := Get(node, "key_passphrase")
+  if value == nil || value.Value == "" { return }
+  if !certificates.IsPassphraseSource(value.Value) {
+    validator.Addf(
+      value, "the key_passphrase MUST be [%s], [%s<NAME>] or [%s<PATH>]",
+      certificates.PromptPassphrase,
+      certificates.EnvPassphrasePrefix, certificates.FilePassphrasePrefix,
+    )
+    return
+  }
+  if strings.HasPrefix(value.Value, certificates.FilePassphrasePrefix) {
+    passphrasePath := strings.TrimPrefix(value.Value, certificates.FilePassphrasePrefix)
+    if _, err := os.Stat(passphrasePath) ; err != nil {
+      validator.Addf(value, "the key_passphrase file [%s] does not exist", passphrasePath)
+    }
+  }
+}
+
+// Record a problem for each of the (given) port keys, in the node, whose
+// value is not a port, or is the same port as that of an earlier key.
+//
+// ALTERS validator;
+//
+func (validator *Validator) CheckPorts(node *yaml.Node, keys ...string) {
+  ports := map[uint64]string{}
+  for _, aKey := range keys {
+    value := Get(node, aKey)
+    if value == nil || value.Value == "" { continue }
+    port, err := strconv.ParseUint(value.Value, 10, 16)
+    if err != nil {
+      validator.Addf(value, "the %s [%s] is not a valid port", aKey, value.Value)
+      continue
+    }
+    if otherKey, ok := ports[port] ; ok {
+      validator.Addf(value, "the %s [%d] is also the %s", aKey, port, otherKey)
+    }
+    ports[port] = aKey
+  }
+}
+
+// Record a problem for each of the (given) keys, in the node, whose
+// (non empty) value, or any of whose (sequence) items, is not an https
+// URL with a host (the cnNurseries only serve https).
+//
+// ALTERS validator;
+//
+func (validator *Validator) CheckUrls(node *yaml.Node, keys ...string) {
+  for _, aKey := range keys {
+    value := Get(node, aKey)
+    if value == nil { continue }
+    items := []*yaml.Node{ value }
+    if value.Kind == yaml.SequenceNode { items = value.Content }
+    for _, anItem := range items {
+      if anItem.Kind != yaml.ScalarNode || anItem.Value == "" { continue }
+      aUrl, err := url.Parse(anItem.Value)
+      if err != nil || aUrl.Scheme != "https" || aUrl.Host == "" {
+        validator.Addf(
+          anItem, "the %s [%s] MUST be an https URL (https://<host>:<port>)",
+          aKey, anItem.Value,
+        )
+      }
+    }
+  }
+}
+
+// Sort the problems found (so far) by their line (keeping the order of
+// the problems found on the same line).
+//
+// ALTERS validator;
+//
+func (validator *Validator) Sort() {
+  sort.SliceStable(validator.Problems, func(i, j int) bool {
+    return validator.Problems[i].Line < validator.Problems[j].Line
+  })
+}
+
+// Returns an error listing every problem found (or nil if there are no
+// problems).
+//
+func (validator *Validator) Err() error {
+  if len(validator.Problems) < 1 { return nil }
+  problems := []string{}
+  for _, aProblem := range validator.Problems {
+    problems = append(problems, aProblem.String())
+  }
+  return fmt.Errorf(
+    "found %d problem(s) in the configuration:\n  %s",
+    len(problems), strings.Join(problems, "\n  "),
+  )
+}
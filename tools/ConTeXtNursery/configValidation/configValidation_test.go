@@ -0,0 +1,125 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configValidation
+
+import (
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "reflect"
+  "testing"
+)
+
+type testItemType struct {
+  Name  string
+  Port  uint
+}
+
+type testConfigType struct {
+  Name     string
+  Renamed  string `yaml:"other_name"`
+  Items  []testItemType
+  Labels   map[string]string
+  hidden   string
+}
+
+// Write the given YAML into a (temporary) configuration file.
+//
+func writeTestConfig(t *testing.T, yamlStr string) string {
+  configPath := t.TempDir()+"/config.yaml"
+  assert.NoError(t, ioutil.WriteFile(configPath, []byte(yamlStr), 0644))
+  return configPath
+}
+
+// Test that unknown keys (at any depth) are reported at their lines.
+//
+func TestCheckKeys(t *testing.T) {
+  configPath := writeTestConfig(t, `name: test
+other_name: again
+hidden: true
+items:
+  - name: one
+    colour: red
+  - port: 42
+labels:
+  anything: goes
+`)
+  validator := LoadValidator(configPath)
+  validator.CheckKeys(validator.Root, reflect.TypeOf(testConfigType{}))
+  assert.Equal(t, []Problem{
+    { configPath, 3, "unknown key [hidden]" },
+    { configPath, 6, "unknown key [colour]" },
+  }, validator.Problems)
+  assert.Contains(t, validator.Err().Error(), configPath+":6: unknown key [colour]")
+
+  // (ignored keys are not reported)
+  //
+  validator = LoadValidator(configPath)
+  validator.IgnoreKeys("hidden", "colour")
+  validator.CheckKeys(validator.Root, reflect.TypeOf(testConfigType{}))
+  assert.Empty(t, validator.Problems)
+}
+
+// Test that read and syntax errors, missing keys, port collisions and
+// missing paths are all reported.
+//
+func TestProblems(t *testing.T) {
+  validator := LoadValidator(t.TempDir()+"/missing.yaml")
+  assert.Len(t, validator.Problems, 1)
+  assert.Equal(t, 1, validator.Problems[0].Line)
+
+  validator = LoadValidator(writeTestConfig(t, "name: test\nitems: [\n"))
+  assert.Len(t, validator.Problems, 1)
+  assert.Equal(t, 2, validator.Problems[0].Line)
+
+  configPath := writeTestConfig(t, `port: 4220
+other_port: 4220
+bad_port: 70000
+key_passphrase: file:/no/such/passphrase
+cert_path: /no/such/cert.pem
+`)
+  validator = LoadValidator(configPath)
+  assert.Empty(t, validator.Problems)
+  validator.Require(validator.Root, "name", "port")
+  validator.CheckPorts(validator.Root, "port", "other_port", "bad_port")
+  validator.CheckPassphraseSource(validator.Root)
+  validator.CheckPathExists(validator.Root, "cert_path", "")
+  validator.Sort()
+
+  lines := []int{}
+  for _, aProblem := range validator.Problems { lines = append(lines, aProblem.Line) }
+  assert.Equal(t, []int{ 1, 2, 3, 4, 5 }, lines)
+  assert.Equal(t, "the name MUST be specified", validator.Problems[0].Message)
+  assert.Equal(t, "the other_port [4220] is also the port", validator.Problems[1].Message)
+  assert.Nil(t, LoadValidator(writeTestConfig(t, "name: test\n")).Err())
+}
+
+// Test that URLs (and sequences of URLs) which are not https URLs with a
+// host are reported at their lines.
+//
+func TestCheckUrls(t *testing.T) {
+  configPath := writeTestConfig(t, `base_url: https://plato01:8080
+other_url: plato01:8080
+urls:
+  - https://plato02:8080
+  - http://plato03:8080
+  - https://
+`)
+  validator := LoadValidator(configPath)
+  validator.CheckUrls(validator.Root, "base_url", "other_url", "urls", "missing_url")
+  lines := []int{}
+  for _, aProblem := range validator.Problems { lines = append(lines, aProblem.Line) }
+  assert.Equal(t, []int{ 2, 5, 6 }, lines)
+  assert.Contains(t, validator.Problems[1].Message, "the urls [http://plato03:8080]")
+}
@@ -0,0 +1,808 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A typed client of the RESTful HTTP interfaces provided by each
+// cnNursery in a federation.
+//
+// Each method corresponds to one interface operation, takes a
+// context.Context, and returns a real error (a
+// *clientConnection.StatusError if the nursery replied with an error
+// status code). Idempotent operations are retried, with exponential
+// backoff, if they fail due to network errors or server side (5xx)
+// errors.
+//
+package federationClient
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/action"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/control"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/election"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/events"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "io/ioutil"
+  "math/rand"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//////////////////////////////////////////////////////////////////////
+// Federation client types
+//
+
+// How (idempotent) requests are retried. All times are in milliseconds.
+//
+// Any zero valued field is replaced by the corresponding field of the
+// RetryDefaults (see NormalizeRetry).
+//
+type RetryPolicy struct {
+  Max_Attempts    uint
+  Initial_Backoff uint
+  Max_Backoff     uint
+  Request_Timeout uint
+}
+
+var (
+  RetryDefaults = RetryPolicy{
+    3,     // Max_Attempts
+    250,   // Initial_Backoff
+    4000,  // Max_Backoff
+    10000, // Request_Timeout
+  }
+)
+
+// A typed client of a federation of cnNurseries.
+//
+type Client struct {
+  Cc    *clientConnection.CC
+  Retry  RetryPolicy
+  Log   *logger.LoggerType
+}
+
+//////////////////////////////////////////////////////////////////////
+// Federation client functions
+//
+
+// Replace any zero valued fields with the corresponding RetryDefaults.
+//
+// ALTERS retry;
+//
+func (retry *RetryPolicy) NormalizeRetry() {
+  if retry.Max_Attempts    == 0 { retry.Max_Attempts    = RetryDefaults.Max_Attempts }
+  if retry.Initial_Backoff == 0 { retry.Initial_Backoff = RetryDefaults.Initial_Backoff }
+  if retry.Max_Backoff     == 0 { retry.Max_Backoff     = RetryDefaults.Max_Backoff }
+  if retry.Request_Timeout == 0 { retry.Request_Timeout = RetryDefaults.Request_Timeout }
+}
+
+// Create a federation client which uses the client connection cc.
+//
+// CREATES client;
+//
+func CreateClient(
+  cc    *clientConnection.CC,
+  retry  RetryPolicy,
+) *Client {
+  retry.NormalizeRetry()
+  return &Client{
+    Cc:    cc,
+    Retry: retry,
+    Log:   cc.Log,
+  }
+}
+
+// Returns the HTTP status code of the error (if any) returned by a
+// nursery, otherwise returns 0.
+//
+func StatusCode(err error) int {
+  var statusErr *clientConnection.StatusError
+  if errors.As(err, &statusErr) { return statusErr.Status_Code }
+  return 0
+}
+
+// Returns true if a failed request is worth retrying.
+//
+func isRetryable(err error) bool {
+  statusCode := StatusCode(err)
+  if statusCode == 0 { return true } // a network (or timeout) error
+  return statusCode == http.StatusTooManyRequests ||
+    http.StatusInternalServerError <= statusCode
+}
+
+// The duration to wait before the given (zero based) attempt.
+//
+// READS client;
+//
+func (client *Client) backoff(attempt uint) time.Duration {
+  backoff := time.Duration(client.Retry.Initial_Backoff) * time.Millisecond
+  maxBackoff := time.Duration(client.Retry.Max_Backoff) * time.Millisecond
+  for i := uint(1); i < attempt && backoff < maxBackoff; i++ {
+    backoff = backoff * 2
+  }
+  if maxBackoff < backoff { backoff = maxBackoff }
+  // add up to 50% of jitter so that nurseries do not retry in lock step
+  return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// Send a single request, with the (optional) JSON encoded reqValue, to
+// the url of the nursery at baseUrl, (optionally) retrying it. Each
+// attempt is limited to the retry policy's Request_Timeout.
+//
+// If respValue is not nil, the reply's body is JSON decoded into it.
+//
+// THREAD-SAFE;
+//
+func (client *Client) call(
+  ctx        context.Context,
+  method     string,
+  baseUrl    string,
+  url        string,
+  reqValue   interface{},
+  respValue  interface{},
+  retryable  bool,
+) (*clientConnection.Reply, error) {
+  return client.callWithTimeout(
+    ctx, method, baseUrl, url, reqValue, respValue, retryable,
+    time.Duration(client.Retry.Request_Timeout) * time.Millisecond,
+  )
+}
+
+// Send a single request (as call), but limit each attempt to the given
+// requestTimeout. A zero requestTimeout leaves the attempts limited only
+// by the ctx (for requests, such as running an action, whose replies
+// take as long as the work they do).
+//
+// If the ctx does not already carry a request id, a new one is created, 
+// so that every attempt is logged (on both ends) under the same id. 
+//
+// THREAD-SAFE;
+//
+func (client *Client) callWithTimeout(
+  ctx            context.Context,
+  method         string,
+  baseUrl        string,
+  url            string,
+  reqValue       interface{},
+  respValue      interface{},
+  retryable      bool,
+  requestTimeout time.Duration,
+) (*clientConnection.Reply, error) {
+  var jsonBytes []byte
+  if reqValue != nil {
+    var err error
+    jsonBytes, err = json.Marshal(reqValue)
+    if err != nil {
+      return nil, fmt.Errorf("could not marshal the %s %s request: %w", method, url, err)
+    }
+  }
+
+  if logger.RequestIdFromContext(ctx) == "" {
+    ctx = logger.ContextWithNewRequestId(ctx)
+  }
+  cnLog := client.Log.ForContext(ctx)
+
+  maxAttempts := client.Retry.Max_Attempts
+  if !retryable { maxAttempts = 1 }
+
+  var reply *clientConnection.Reply
+  var err error
+  for attempt := uint(0); attempt < maxAttempts; attempt++ {
+    if 0 < attempt {
+      select {
+        case <-ctx.Done()                          : return nil, ctx.Err()
+        case <-time.After(client.backoff(attempt)) :
+      }
+      cnLog.Logf(
+        "retrying (%d/%d) %s %s%s", attempt+1, maxAttempts, method, baseUrl, url,
+      )
+    }
+    attemptCtx, cancel := context.WithCancel(ctx)
+    if 0 < requestTimeout {
+      attemptCtx, cancel = context.WithTimeout(ctx, requestTimeout)
+    }
+    reply, err = client.Cc.SendRequest(attemptCtx, method, baseUrl, url, jsonBytes)
+    cancel()
+    if err == nil || !isRetryable(err) || ctx.Err() != nil { break }
+  }
+  if err != nil { return nil, err }
+
+  if respValue != nil && 0 < len(reply.Body) {
+    err = json.Unmarshal(reply.Body, respValue)
+    if err != nil {
+      return nil, fmt.Errorf(
+        "could not unmarshal the reply to %s %s%s: %w", method, baseUrl, url, err,
+      )
+    }
+  }
+  return reply, nil
+}
+
+//////////////////////////////////////////////////////////////////////
+// Health interface
+
+// Check that the nursery at baseUrl is alive.
+//
+//  interface:
+//    - url: /health/live
+//      method: GET
+//      response: The liveness of the nursery
+//
+func (client *Client) Ping(ctx context.Context, baseUrl string) error {
+  _, err := client.call(ctx, http.MethodGet, baseUrl, "/health/live", nil, nil, false)
+  return err
+}
+
+//////////////////////////////////////////////////////////////////////
+// Discovery interface
+
+// Send a heartbeat about this nursery to the (primary) nursery at
+// primaryUrl, asking for the changes to the primary's map since the
+// given version (a since of 0 asks for the whole map).
+//
+//  interface:
+//    - url: /heartbeat?map=<mapId>&since=<version>
+//      method: POST
+//      jsonPost: NurseryInfo
+//      credentials: CommonName of the Client X509 certificate
+//      action: |
+//        Adds or updates the NurseryInfo for the Named Nursery into the
+//        Federation wide NurseryInfo map
+//      response: |
+//        Lists the changes to the NurseryInfo of Nurseries in the Federation
+//        since the <version> of the <mapId> map
+//      jsonResp: NurseryInfoDelta
+//
+func (client *Client) Heartbeat(
+  ctx        context.Context,
+  primaryUrl string,
+  mapId      string,
+  since      uint64,
+  ni         discovery.NurseryInfo,
+) (discovery.NurseryInfoDelta, error) {
+  delta := discovery.NurseryInfoDelta{}
+  query := url.Values{}
+  query.Set("map",   mapId)
+  query.Set("since", strconv.FormatUint(since, 10))
+  _, err := client.call(
+    ctx, http.MethodPost, primaryUrl, "/heartbeat?"+query.Encode(), ni, &delta, true,
+  )
+  return delta, err
+}
+
+// List the nurseries currently known to the nursery at baseUrl.
+//
+//  interface:
+//    - url: /heartbeat
+//      method: GET
+//      response: |
+//        Lists the currently known NurseryInfo of Nurseries in the Federation
+//      jsonResp: NurseryInfoMap
+//
+func (client *Client) ListNurseries(
+  ctx     context.Context,
+  baseUrl string,
+) (discovery.NurseryInfoMap, error) {
+  niMap := discovery.NurseryInfoMap{}
+  _, err := client.call(
+    ctx, http.MethodGet, baseUrl, "/heartbeat", nil, &niMap, true,
+  )
+  return niMap, err
+}
+
+//////////////////////////////////////////////////////////////////////
+// Control interface
+
+// Change the control state of the nursery at baseUrl.
+//
+//  interface:
+//    - url: /control/<state>?reason=<aReason>&actor=<anActor>
+//      method: PUT
+//      credentials: CommonName of the Client X509 certificate
+//      action: brings *this* Nursery to the <state> state
+//      response: |
+//        The current state of the federation (or 409 if the transition to
+//        <state> is illegal)
+//
+func (client *Client) ControlNursery(
+  ctx     context.Context,
+  baseUrl string,
+  change  control.StateChange,
+) (control.FederationStateMap, error) {
+  controlUrl := "/control/"+change.State
+  if query := change.Query().Encode() ; query != "" {
+    controlUrl = controlUrl+"?"+query
+  }
+  fedMap := control.FederationStateMap{}
+  _, err := client.call(
+    ctx, http.MethodPut, baseUrl, controlUrl, nil, &fedMap, true,
+  )
+  return fedMap, err
+}
+
+// Change the control state of the targeted nurseries in the federation 
+// (via the nursery at baseUrl). 
+//
+// Since the nursery at baseUrl fans the change out to every targeted 
+// nursery, a retry could repeat (some of) those changes, so this request 
+// is never retried. 
+//
+//  interface:
+//    - url: /control/all/<state>?nursery=<aNursery>&label=<key>=<value>&dry_run=<bool>&reason=<aReason>
+//      method: PUT
+//      credentials: CommonName of the Client X509 certificate
+//      action: |
+//        Concurrently sends the /control/<state> message to every targeted
+//        nursery, unless this is a dry run
+//      response: The previous state, new state and any error of each nursery
+//      jsonResp: FederationChangeResult
+//
+func (client *Client) ControlFederation(
+  ctx     context.Context,
+  baseUrl string,
+  change  control.StateChange,
+  target  control.ControlTarget,
+) (control.FederationChangeResult, error) {
+  query := target.Query()
+  for aKey, values := range change.Query() { query[aKey] = values }
+  controlUrl := "/control/all/"+change.State
+  if 0 < len(query) { controlUrl = controlUrl+"?"+query.Encode() }
+  result := control.FederationChangeResult{}
+  _, err := client.call(
+    ctx, http.MethodPut, baseUrl, controlUrl, nil, &result, false,
+  )
+  return result, err
+}
+
+// Return the control state of the federation (as known to the nursery at
+// baseUrl).
+//
+//  interface:
+//    - url: /control
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      response: The current state of the federation
+//
+func (client *Client) FederationStatus(
+  ctx     context.Context,
+  baseUrl string,
+) (control.FederationStateMap, error) {
+  fedMap := control.FederationStateMap{}
+  _, err := client.call(
+    ctx, http.MethodGet, baseUrl, "/control", nil, &fedMap, true,
+  )
+  return fedMap, err
+}
+
+// Return the (bounded) history of the control state transitions known to 
+// the nursery at baseUrl. 
+//
+//  interface:
+//    - url: /control/history
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      response: The history of the transitions of each nursery
+//      jsonResp: TransitionHistory
+//
+func (client *Client) ControlHistory(
+  ctx     context.Context,
+  baseUrl string,
+) (control.TransitionHistory, error) {
+  history := control.TransitionHistory{}
+  _, err := client.call(
+    ctx, http.MethodGet, baseUrl, "/control/history", nil, &history, true,
+  )
+  return history, err
+}
+
+// List the scheduled state changes stored by the (primary) nursery at
+// baseUrl.
+//
+//  interface:
+//    - url: /control/schedule
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      response: The scheduled state changes stored by the primary nursery
+//      jsonResp: []Schedule
+//
+func (client *Client) ListSchedules(
+  ctx     context.Context,
+  baseUrl string,
+) ([]control.Schedule, error) {
+  schedules := make([]control.Schedule, 0)
+  _, err := client.call(
+    ctx, http.MethodGet, baseUrl, "/control/schedule", nil, &schedules, true,
+  )
+  return schedules, err
+}
+
+// Add a scheduled state change (via the nursery at baseUrl, which
+// redirects to the primary).
+//
+// NOTE: schedules are NOT retried, since a retried request could add
+// the same schedule twice.
+//
+//  interface:
+//    - url: /control/schedule
+//      method: POST
+//      jsonPost: Schedule
+//      credentials: CommonName of the Client X509 certificate
+//      response: The stored Schedule
+//      jsonResp: Schedule
+//
+func (client *Client) AddSchedule(
+  ctx      context.Context,
+  baseUrl  string,
+  schedule control.Schedule,
+) (control.Schedule, error) {
+  stored := control.Schedule{}
+  reply, err := client.call(
+    ctx, http.MethodPost, baseUrl, "/control/schedule", schedule, &stored, false,
+  )
+  if err != nil { return stored, err }
+
+  // a nursery which is not the primary redirects (once) to the primary
+  if reply.Status_Code == http.StatusTemporaryRedirect {
+    _, err = client.call(
+      ctx, http.MethodPost, "", reply.Location, schedule, &stored, false,
+    )
+  }
+  return stored, err
+}
+
+// Remove a scheduled state change (via the nursery at baseUrl, which
+// redirects to the primary).
+//
+//  interface:
+//    - url: /control/schedule/<aScheduleId>
+//      method: DELETE
+//      credentials: CommonName of the Client X509 certificate
+//      response: The remaining scheduled state changes
+//      jsonResp: []Schedule
+//
+func (client *Client) DeleteSchedule(
+  ctx        context.Context,
+  baseUrl    string,
+  scheduleId string,
+) ([]control.Schedule, error) {
+  schedules   := make([]control.Schedule, 0)
+  scheduleUrl := "/control/schedule/"+url.PathEscape(scheduleId)
+  reply, err := client.call(
+    ctx, http.MethodDelete, baseUrl, scheduleUrl, nil, &schedules, true,
+  )
+  if err != nil { return schedules, err }
+
+  // a nursery which is not the primary redirects (once) to the primary
+  if reply.Status_Code == http.StatusTemporaryRedirect {
+    _, err = client.call(
+      ctx, http.MethodDelete, "", reply.Location, nil, &schedules, true,
+    )
+  }
+  return schedules, err
+}
+
+//////////////////////////////////////////////////////////////////////
+// Election interface
+
+// Ask the (candidate) nursery at baseUrl to grant a lease on the 
+// leadership of the federation. 
+//
+// NOTE: lease requests are NOT retried, since a retried request could 
+// be granted after the lease it requests has (nearly) expired. 
+//
+//  interface:
+//    - url: /election
+//      method: PUT
+//      jsonPost: Lease
+//      credentials: CommonName of the Client X509 certificate
+//      response: Whether or not the lease was granted
+//      jsonResp: LeaseReply
+//
+func (client *Client) RequestLease(
+  ctx     context.Context,
+  baseUrl string,
+  lease   election.Lease,
+) (election.LeaseReply, error) {
+  leaseReply := election.LeaseReply{}
+  _, err := client.call(
+    ctx, http.MethodPut, baseUrl, "/election", lease, &leaseReply, false,
+  )
+  return leaseReply, err
+}
+
+// Return the leader of the federation as known to the nursery at 
+// baseUrl. 
+//
+//  interface:
+//    - url: /election
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      response: The leader of the federation as known to this Nursery
+//      jsonResp: ElectionStatus
+//
+func (client *Client) ElectionStatus(
+  ctx     context.Context,
+  baseUrl string,
+) (election.ElectionStatus, error) {
+  status := election.ElectionStatus{}
+  _, err := client.call(
+    ctx, http.MethodGet, baseUrl, "/election", nil, &status, false,
+  )
+  return status, err
+}
+
+//////////////////////////////////////////////////////////////////////
+// Action interface
+
+// List the actions registered with the nursery at baseUrl.
+//
+//  interface:
+//    - url: /action
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      response: The list of currently registered actions
+//      jsonResp: ActionList
+//
+func (client *Client) ListActions(
+  ctx     context.Context,
+  baseUrl string,
+) (action.ActionList, error) {
+  actions := action.ActionList{}
+  _, err := client.call(
+    ctx, http.MethodGet, baseUrl, "/action", nil, &actions, true,
+  )
+  return actions, err
+}
+
+// Describe the arguments and environment variables of an action
+// registered with the nursery at baseUrl.
+//
+//  interface:
+//    - url: /action/<anAction>
+//      method: GET
+//      response: List the available action arguments and environment variables.
+//      jsonResp: ActionDescription
+//
+func (client *Client) DescribeAction(
+  ctx        context.Context,
+  baseUrl    string,
+  actionName string,
+) (action.ActionDescription, error) {
+  actionDesc := action.ActionDescription{}
+  _, err := client.call(
+    ctx, http.MethodGet, baseUrl, "/action/"+url.PathEscape(actionName),
+    nil, &actionDesc, true,
+  )
+  return actionDesc, err
+}
+
+// Run an action on the nursery at baseUrl.
+//
+// Returns the run id of the new run. Since running an action is NOT
+// idempotent, this request is never retried. The nursery only replies
+// once the run has finished, so the request is NOT limited by the
+// Request_Timeout (only by the ctx).
+//
+//  interface:
+//    - url: /action/<anAction>
+//      method: POST
+//      jsonPost: ActionConfig
+//      credentials: CommonName of the Client X509 certificate
+//      action: Runs the <anAction>
+//      response: Redirect to /action/output/<anAction>/<aRun>
+//
+func (client *Client) RunAction(
+  ctx          context.Context,
+  baseUrl      string,
+  actionName   string,
+  actionConfig *action.ActionConfig,
+) (string, error) {
+  reply, err := client.callWithTimeout(
+    ctx, http.MethodPost, baseUrl, "/action/"+url.PathEscape(actionName),
+    actionConfig, nil, false, 0,
+  )
+  if err != nil { return "", err }
+
+  runPrefix := "/action/output/"+url.PathEscape(actionName)+"/"
+  runIndex  := strings.Index(reply.Location, runPrefix)
+  if runIndex < 0 {
+    return "", fmt.Errorf(
+      "the nursery [%s] did not redirect to the output of the [%s] run",
+      baseUrl, actionName,
+    )
+  }
+  return reply.Location[runIndex+len(runPrefix):], nil
+}
+
+// Run an action on the "best" nursery in the federation, as chosen by the
+// federation's primary nursery (at primaryUrl) using the placement.
+//
+// Returns the (absolute) url of the output of the new run. Since running
+// an action is NOT idempotent, this request is never retried (although a
+// redirect from a nursery which is not the primary is followed). As for
+// RunAction, the request is NOT limited by the Request_Timeout.
+//
+//  interface:
+//    - url: /action/all/<anAction>?policy=<aPolicy>&label=<key>=<value>&nursery=<aNursery>&affinity=<aKey>
+//      method: POST
+//      jsonPost: ActionConfig
+//      credentials: CommonName of the Client X509 certificate
+//      action: Runs the <anAction> on the chosen nursery
+//      response: Redirect to <nurseryUrl>/action/output/<anAction>/<aRun>
+//
+func (client *Client) PlaceAction(
+  ctx          context.Context,
+  primaryUrl   string,
+  actionName   string,
+  placement    action.Placement,
+  actionConfig *action.ActionConfig,
+) (string, error) {
+  actionUrl := "/action/all/"+url.PathEscape(actionName)
+  if query := placement.Query().Encode() ; query != "" {
+    actionUrl = actionUrl+"?"+query
+  }
+  reply, err := client.callWithTimeout(
+    ctx, http.MethodPost, primaryUrl, actionUrl, actionConfig, nil, false, 0,
+  )
+  if err != nil { return "", err }
+
+  // a nursery which is not the primary redirects (once) to the primary
+  if reply.Status_Code == http.StatusTemporaryRedirect {
+    reply, err = client.callWithTimeout(
+      ctx, http.MethodPost, "", reply.Location, actionConfig, nil, false, 0,
+    )
+    if err != nil { return "", err }
+  }
+
+  if !strings.Contains(reply.Location, "/action/output/") {
+    return "", fmt.Errorf(
+      "the primary [%s] did not redirect to the output of the [%s] run",
+      primaryUrl, actionName,
+    )
+  }
+  return reply.Location, nil
+}
+
+// List the runs of an action on the nursery at baseUrl.
+//
+//  interface:
+//    - url: /action/output/<anAction>
+//      method: GET
+//      response: List of available runs associated with this action
+//
+func (client *Client) ListRuns(
+  ctx        context.Context,
+  baseUrl    string,
+  actionName string,
+) (map[string]string, error) {
+  runs := map[string]string{}
+  _, err := client.call(
+    ctx, http.MethodGet, baseUrl, "/action/output/"+url.PathEscape(actionName),
+    nil, &runs, true,
+  )
+  return runs, err
+}
+
+// Follow a run of an action on the nursery at baseUrl by listing its
+// (current) output files.
+//
+//  interface:
+//    - url: /action/output/<anAction>/<aRun>
+//      method: GET
+//      response: |
+//        List the output files associated with <aRun> of the <anAction>.
+//
+func (client *Client) FollowRun(
+  ctx        context.Context,
+  baseUrl    string,
+  actionName string,
+  runId      string,
+) (map[string]string, error) {
+  outputs := map[string]string{}
+  _, err := client.call(
+    ctx, http.MethodGet, baseUrl,
+    "/action/output/"+url.PathEscape(actionName)+"/"+url.PathEscape(runId),
+    nil, &outputs, true,
+  )
+  return outputs, err
+}
+
+//////////////////////////////////////////////////////////////////////
+// Events interface
+
+// Stream the (selected) events emitted, after the event with the lastId, 
+// by the nursery at baseUrl, calling onEvent with each event. 
+//
+// Returns (once the stream ends, or the ctx is done) the Id of the last 
+// event seen, with which the stream should be re-opened. 
+//
+// NOTE: event streams are NOT retried (the caller re-opens them). 
+//
+//  interface:
+//    - url: /events?type=<aType>&nursery=<aNursery>
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      response: A (text/event-stream) stream of events
+//      jsonResp: Event (the data of each event)
+//
+func (client *Client) StreamEvents(
+  ctx     context.Context,
+  baseUrl string,
+  filter  events.EventFilter,
+  lastId  uint64,
+  onEvent func(events.Event),
+) (uint64, error) {
+  eventsUrl := "/events"
+  if query := filter.Query().Encode() ; query != "" {
+    eventsUrl = eventsUrl+"?"+query
+  }
+  req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseUrl+eventsUrl, nil)
+  if err != nil {
+    return lastId, fmt.Errorf("could not create the request: %w", err)
+  }
+  req.Header.Set("Accept", "text/event-stream")
+  if 0 < lastId {
+    req.Header.Set("Last-Event-ID", strconv.FormatUint(lastId, 10))
+  }
+  if requestId := logger.RequestIdFromContext(ctx) ; requestId != "" {
+    req.Header.Set(logger.RequestIdHeader, requestId)
+  }
+
+  resp, err := client.Cc.Client.Do(req)
+  if err != nil {
+    return lastId, fmt.Errorf("could not send the request to [%s]: %w", baseUrl, err)
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    body, _ := ioutil.ReadAll(resp.Body)
+    return lastId, &clientConnection.StatusError{
+      Method:      http.MethodGet,
+      Url:         baseUrl+eventsUrl,
+      Status_Code: resp.StatusCode,
+      Status:      resp.Status,
+      Request_Id:  resp.Header.Get(logger.RequestIdHeader),
+      Body:        string(body),
+    }
+  }
+
+  // each event is a block of "field: value" lines ended by a blank line
+  data    := ""
+  scanner := bufio.NewScanner(resp.Body)
+  for scanner.Scan() {
+    line := scanner.Text()
+    switch {
+      case strings.HasPrefix(line, "data: ") :
+        data = data+strings.TrimPrefix(line, "data: ")
+      case line == "" && data != "" :
+        var anEvent events.Event
+        err := json.Unmarshal([]byte(data), &anEvent)
+        data = ""
+        if err != nil {
+          client.Log.ForContext(ctx).MayBeError("Could not unmarshal an event", err)
+          continue
+        }
+        lastId = anEvent.Id
+        onEvent(anEvent)
+    }
+  }
+  if ctx.Err() != nil { return lastId, nil }
+  return lastId, scanner.Err()
+}
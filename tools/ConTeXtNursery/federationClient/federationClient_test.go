@@ -0,0 +1,163 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package federationClient
+
+import (
+  "context"
+  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/action"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/events"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/stretchr/testify/assert"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// Create a federation client which talks (plain) HTTP to a test server.
+//
+func createTestClient() *Client {
+  cc := &clientConnection.CC{
+    Client: &http.Client{
+      CheckRedirect: func(req *http.Request, via []*http.Request) error {
+        return http.ErrUseLastResponse
+      },
+    },
+    Log: logger.CreateLogger("federationClientTest"),
+  }
+  return CreateClient(cc, RetryPolicy{ Initial_Backoff: 1, Max_Backoff: 2 })
+}
+
+// Test that running an action is not limited by the Request_Timeout
+// (while other requests are).
+//
+func TestLongRunningAction(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(
+    func(w http.ResponseWriter, r *http.Request) {
+      time.Sleep(100 * time.Millisecond)
+      switch r.URL.Path {
+        case "/action/slow" :
+          http.Redirect(w, r, "/action/output/slow/42", http.StatusSeeOther)
+        case "/action/all/slow" :
+          http.Redirect(w, r, "https://a/action/output/slow/42", http.StatusSeeOther)
+        default :
+          w.Write([]byte("[]"))
+      }
+    },
+  ))
+  defer server.Close()
+
+  client := createTestClient()
+  client.Retry.Max_Attempts    = 1
+  client.Retry.Request_Timeout = 20
+
+  _, err := client.ListActions(context.Background(), server.URL)
+  assert.Error(t, err)
+  runId, err := client.RunAction(
+    context.Background(), server.URL, "slow", &action.ActionConfig{},
+  )
+  assert.NoError(t, err)
+  assert.Equal(t, "42", runId)
+  runUrl, err := client.PlaceAction(
+    context.Background(), server.URL, "slow", action.Placement{}, &action.ActionConfig{},
+  )
+  assert.NoError(t, err)
+  assert.Equal(t, "https://a/action/output/slow/42", runUrl)
+}
+
+// Test retrying idempotent requests and reporting status codes.
+//
+func TestRetries(t *testing.T) {
+  numRequests := 0
+  server := httptest.NewServer(http.HandlerFunc(
+    func(w http.ResponseWriter, r *http.Request) {
+      numRequests++
+      switch r.URL.Path {
+        case "/heartbeat" :
+          if numRequests < 3 {
+            http.Error(w, "try again", http.StatusServiceUnavailable)
+            return
+          }
+          assert.Equal(t, "42", r.URL.Query().Get("since"))
+          w.Write([]byte(`{"Map_Id":"aMap","Version":43,"Updated":{"aNursery":{"Name":"aNursery"}}}`))
+        case "/action/test" :
+          http.Redirect(w, r, "/action/output/test/42", http.StatusSeeOther)
+        default :
+          http.Error(w, "not found", http.StatusNotFound)
+      }
+    },
+  ))
+  defer server.Close()
+
+  fc  := createTestClient()
+  ctx := context.Background()
+
+  delta, err := fc.Heartbeat(
+    ctx, server.URL, "aMap", 42, discovery.NurseryInfo{ Name: "aNursery" },
+  )
+  assert.Nil(t, err)
+  assert.Equal(t, 3, numRequests)
+  assert.Equal(t, uint64(43), delta.Version)
+  assert.Equal(t, "aNursery", delta.Updated["aNursery"].Name)
+
+  numRequests = 0
+  _, err = fc.ListActions(ctx, server.URL+"/missing")
+  assert.NotNil(t, err)
+  assert.Equal(t, http.StatusNotFound, StatusCode(err))
+  assert.Equal(t, 1, numRequests) // client errors are not retried
+
+  numRequests = 0
+  runId, err := fc.RunAction(ctx, server.URL, "test", &action.ActionConfig{})
+  assert.Nil(t, err)
+  assert.Equal(t, "42", runId)
+  assert.Equal(t, 1, numRequests)
+
+  server.Close()
+  numRequests = 0
+  err = fc.Ping(ctx, server.URL)
+  assert.NotNil(t, err)
+  assert.Equal(t, 0, StatusCode(err))
+}
+
+// Test streaming events (and resuming from the last event seen).
+//
+func TestStreamEvents(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(
+    func(w http.ResponseWriter, r *http.Request) {
+      assert.Equal(t, "/events", r.URL.Path)
+      assert.Equal(t, "state-changed", r.URL.Query().Get("type"))
+      assert.Equal(t, "7", r.Header.Get("Last-Event-ID"))
+      w.Header().Set("Content-Type", "text/event-stream")
+      w.Write([]byte("retry: 1000\n\n: keep-alive\n\n"))
+      w.Write([]byte("id: 8\nevent: state-changed\ndata: {\"Id\":8,\"Type\":\"state-changed\",\"Nursery\":\"a\",\"State\":\"paused\"}\n\n"))
+      w.Write([]byte("id: 9\nevent: state-changed\ndata: {\"Id\":9,\"Type\":\"state-changed\",\"Nursery\":\"b\",\"State\":\"up\"}\n\n"))
+    },
+  ))
+  defer server.Close()
+
+  seen := make([]string, 0)
+  lastId, err := createTestClient().StreamEvents(
+    context.Background(),
+    server.URL,
+    events.EventFilter{ Types: []string{ events.StateChanged } },
+    7,
+    func(anEvent events.Event) { seen = append(seen, anEvent.Nursery+" "+anEvent.State) },
+  )
+  assert.Nil(t, err)
+  assert.Equal(t, uint64(9), lastId)
+  assert.Equal(t, []string{ "a paused", "b up" }, seen)
+}
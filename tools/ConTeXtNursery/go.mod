@@ -6,11 +6,16 @@ require (
 	github.com/aarzilli/golua v0.0.0-20201110102514-3c8365d671e8
 	github.com/jinzhu/configor v1.1.1
 	github.com/mjibson/esc v0.2.0 // indirect
-	github.com/nats-io/nats.go v1.10.0
+	github.com/nats-io/jwt v0.3.2 // indirect
+	github.com/nats-io/nats.go v1.11.0
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sethvargo/go-password v0.1.3
 	github.com/shirou/gopsutil v2.20.2+incompatible
 	github.com/stretchr/testify v1.5.1
 	github.com/xiexiao/golua v0.0.0-20201125072500-ba522f251a79
-	golang.org/x/tools v0.0.0-20200917161530-60aba8ac75fb // indirect
+	github.com/youmark/pkcs8 v0.0.0-20201027041543-1326539a0a0a
+	golang.org/x/term v0.10.0
+	golang.org/x/tools v0.6.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
@@ -19,8 +19,6 @@ package action
 
 import (
   "encoding/json"
-  "fmt"
-  "github.com/diSimplex/ConTeXtNursery/clientConnection"
   "github.com/diSimplex/ConTeXtNursery/webserver"
   "io"
   "io/ioutil"
@@ -114,42 +112,6 @@ type ActionImpl interface {
 
 
 
-// Send an action request using the client connection
-//
-// interface:
-//   - url: /action/<anAction>
-//     method: POST
-//     jsonPost: ActionConfig
-//     credentials: CommonName of the Client X509 certificate
-//     action: Runs the <anAction>
-//     response: |
-//       Redirect to output file browser which longPolls the log file produced
-//       by this action. (Note we could use mithril.js in an AJAX "pull" model
-//       to ensure the user does not see the whole page refresh).
-//
-func SendActionRequestToNursery(
-  baseUrl      string,
-  action       string,
-  actionConfig *ActionConfig,
-  cc           *clientConnection.CC,
-) {
-  jsonBytes, err := json.Marshal(actionConfig)
-  cc.Log.MayBeError("Could not marshal action configuration", err)
-
-  fmt.Printf("\naction request [%s]\n\n", string(jsonBytes))
-
-  respBody := cc.SendJsonMessage(
-    baseUrl,
-    "/action/"+action,
-    http.MethodPost,
-    jsonBytes,
-  )
-
-  fmt.Printf("\naction response [%s]\n\n", string(respBody))
-
-  // TODO
-}
-
 // Add the Action RESTful HTTP interface to the current webserver.
 //
 // interface:
@@ -280,8 +242,8 @@ func AddActionInterface(
     func(w http.ResponseWriter, r *http.Request) {
       pathParts := ws.GetPathParts(r.URL.Path)
       if len(pathParts) < 2 {
-        ws.Log.MayBeError("No action specified in /action post request", err)
-        http.Error(w, "No action specified", http.StatusBadRequest)
+        ws.RequestLog(r).MayBeError("No action specified in /action post request", err)
+        ws.ReplyError(w, r, "No action specified", http.StatusBadRequest)
         return
       }
       //
@@ -290,22 +252,24 @@ func AddActionInterface(
       body, err := ioutil.ReadAll(r.Body)
       theAction := pathParts[1]
       if err != nil {
-        ws.Log.MayBeError("Could not read body of /action post request", err)
-        http.Error(w, "Could not read body", http.StatusBadRequest)
+        ws.RequestLog(r).MayBeError("Could not read body of /action post request", err)
+        ws.ReplyError(w, r, "Could not read body", http.StatusBadRequest)
         return
       }
-      ws.Log.Logf("[%s] action body: %s", theAction, string(body))
+      ws.RequestLog(r).Logf("[%s] action body: %s", theAction, string(body))
       var ac ActionConfig
       err = json.Unmarshal(body, &ac)
       if err != nil {
-        ws.Log.MayBeError("Could not unmarshal action configuration body", err)
-        http.Error(
-          w,
+        ws.RequestLog(r).MayBeError("Could not unmarshal action configuration body", err)
+        ws.ReplyError(
+          w, r,
           "Could not unmarshal action configuration",
           http.StatusBadRequest,
         )
         return
       }
+      // (the run may outlast the webserver's write timeout)
+      ws.ClearWriteDeadline(w, r)
       theRunId := interfaceImpl.ActionRunAction(theAction, &ac)
 
       http.Redirect(
@@ -383,7 +347,7 @@ func AddActionInterface(
             theRun,
             outputFile,
           )
-        ws.Log.MayBeError("Could not get output file for action", err)
+        ws.RequestLog(r).MayBeError("Could not get output file for action", err)
         ws.ReplyAsRawFile(w, r, ofReader, mimeType)
       }
     },
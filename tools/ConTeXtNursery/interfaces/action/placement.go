@@ -0,0 +1,232 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package action
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
+  "github.com/diSimplex/ConTeXtNursery/webserver"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strings"
+)
+
+//////////////////////////////////////////////////////////////////////
+// Placement interface types
+//
+
+// The names of the standard placement policies.
+//
+const (
+  LeastLoadedPolicy = "least-loaded"
+  CacheAffinePolicy = "cache-affine"
+  PinnedPolicy      = "pinned"
+)
+
+// Describes how the federation's primary Nursery should choose the
+// Nursery which runs an action.
+//
+// Only Nurseries which are up, have registered the action, and have all
+// of the selected Labels are considered. The Policy names the placement
+// policy used to choose among them (an empty Policy uses the primary's
+// default policy). The Nursery names the nursery used by the pinned
+// policy, while the Affinity (which defaults to the action name) is the
+// key used by the cache-affine policy.
+//
+type Placement struct {
+  Policy   string
+  Labels   []discovery.LabelSelector
+  Nursery  string
+  Affinity string
+}
+
+// Parse a Placement from the "policy", "label" (repeatable), "nursery"
+// and "affinity" query parameters.
+//
+func ParsePlacement(query url.Values) (Placement, error) {
+  selectors, err := discovery.ParseLabelSelectors(query["label"])
+  if err != nil { return Placement{}, err }
+  placement := Placement{
+    Policy:   query.Get("policy"),
+    Labels:   selectors,
+    Nursery:  query.Get("nursery"),
+    Affinity: query.Get("affinity"),
+  }
+  if placement.Policy == "" && placement.Nursery != "" {
+    placement.Policy = PinnedPolicy
+  }
+  return placement, nil
+}
+
+// Encode this Placement as the query parameters understood by
+// ParsePlacement.
+//
+func (placement Placement) Query() url.Values {
+  query := url.Values{}
+  if placement.Policy   != "" { query.Set("policy",   placement.Policy) }
+  if placement.Nursery  != "" { query.Set("nursery",  placement.Nursery) }
+  if placement.Affinity != "" { query.Set("affinity", placement.Affinity) }
+  for _, aSelector := range placement.Labels {
+    if aSelector.Any_Value {
+      query.Add("label", aSelector.Key)
+    } else {
+      query.Add("label", aSelector.Key+"="+aSelector.Value)
+    }
+  }
+  return query
+}
+
+// The error returned when an action can not be placed, together with the
+// HTTP status code which should be returned to the client.
+//
+type PlacementError struct {
+  Status_Code int
+  Message     string
+}
+
+func (pe *PlacementError) Error() string {
+  return pe.Message
+}
+
+//////////////////////////////////////////////////////////////////////
+// Placement interface functions
+//
+
+// The Callbacks required to implement the Placement RESTful HTTP
+// interface responsible for running an action on the "best" Nursery in
+// the federation.
+//
+type PlacementImpl interface {
+
+  // Returns the Base_Url of the federation's primary Nursery (or "" if
+  // there is none), and whether or not this Nursery is the primary.
+  //
+  ResponsePrimaryUrl() (string, bool)
+
+  // Choose a Nursery (using the placement) and run the named action on
+  // it. Returns the (absolute) url of the output of the new run.
+  //
+  // Errors which are a *PlacementError carry the HTTP status code to
+  // return.
+  //
+  ActionPlaceAction(
+    ctx context.Context,
+    actionName string,
+    placement Placement,
+    actionConfig *ActionConfig,
+  ) (string, error)
+}
+
+// Add the Placement RESTful HTTP interface to the current webserver.
+//
+// NOTE: this interface MUST be added after the Action interface.
+//
+// interface:
+//   - url: /action/all/<anAction>?policy=<aPolicy>&label=<key>=<value>&nursery=<aNursery>&affinity=<aKey>
+//     method: POST
+//     jsonPost: ActionConfig
+//     credentials: CommonName of the Client X509 certificate
+//     action: |
+//       On the federation's primary Nursery, chooses (using the placement
+//       policy) a Nursery able to run <anAction>, and runs <anAction> on
+//       it. On any other Nursery, redirects (307) to the primary.
+//     response: |
+//       Redirect to the output of the new run on the chosen Nursery
+//
+func AddPlacementInterface(
+  ws *webserver.WS,
+  interfaceImpl PlacementImpl,
+) {
+  ws.DescribeRoute("/action/all", "???action/all description???", true)
+
+  // interface:
+  //   - url: /action/all/<anAction>?policy=<aPolicy>&label=<key>=<value>&nursery=<aNursery>&affinity=<aKey>
+  //     method: POST
+  //     jsonPost: ActionConfig
+  //     credentials: CommonName of the Client X509 certificate
+  //     action: |
+  //       On the federation's primary Nursery, chooses (using the placement
+  //       policy) a Nursery able to run <anAction>, and runs <anAction> on
+  //       it. On any other Nursery, redirects (307) to the primary.
+  //     response: |
+  //       Redirect to the output of the new run on the chosen Nursery
+  //
+  err := ws.AddPostHandler(
+    "/action/all",
+    func(w http.ResponseWriter, r *http.Request) {
+      theAction := strings.TrimPrefix(r.URL.Path, "/action/all/")
+      if theAction == "" || theAction == r.URL.Path {
+        ws.ReplyError(w, r, "No action specified", http.StatusBadRequest)
+        return
+      }
+
+      primaryUrl, isPrimary := interfaceImpl.ResponsePrimaryUrl()
+      if !isPrimary {
+        if primaryUrl == "" {
+          ws.ReplyError(
+            w, r, "The federation has no primary", http.StatusServiceUnavailable,
+          )
+          return
+        }
+        // a 307 redirect ensures the client re-posts the action config
+        http.Redirect(
+          w, r, primaryUrl+r.URL.RequestURI(), http.StatusTemporaryRedirect,
+        )
+        return
+      }
+
+      placement, err := ParsePlacement(r.URL.Query())
+      if err != nil {
+        ws.ReplyError(w, r, err.Error(), http.StatusBadRequest)
+        return
+      }
+      body, err := ioutil.ReadAll(r.Body)
+      if err != nil {
+        ws.RequestLog(r).MayBeError("Could not read body of /action/all post request", err)
+        ws.ReplyError(w, r, "Could not read body", http.StatusBadRequest)
+        return
+      }
+      var ac ActionConfig
+      err = json.Unmarshal(body, &ac)
+      if err != nil {
+        ws.RequestLog(r).MayBeError("Could not unmarshal action configuration body", err)
+        ws.ReplyError(
+          w, r,
+          "Could not unmarshal action configuration",
+          http.StatusBadRequest,
+        )
+        return
+      }
+
+      // (the run may outlast the webserver's write timeout)
+      ws.ClearWriteDeadline(w, r)
+      runUrl, err :=
+        interfaceImpl.ActionPlaceAction(r.Context(), theAction, placement, &ac)
+      if err != nil {
+        statusCode := http.StatusInternalServerError
+        var placementErr *PlacementError
+        if errors.As(err, &placementErr) { statusCode = placementErr.Status_Code }
+        ws.RequestLog(r).MayBeErrorf(err, "Could not place the action [%s]", theAction)
+        ws.ReplyError(w, r, err.Error(), statusCode)
+        return
+      }
+      http.Redirect(w, r, runUrl, http.StatusSeeOther)
+    },
+  )
+  ws.Log.MayBeError("Could not add POST handler for [/action/all]", err)
+}
@@ -26,7 +26,8 @@ var Control = {
     }
     Control.data = result;
   },
-  oninit: function() {
+  events: null,
+  refresh: function() {
     m.request({
       method: "GET",
       url: "/control"
@@ -34,6 +35,26 @@ var Control = {
       Control.storeData(result);
     })
   },
+  oninit: function() {
+    Control.refresh();
+    // refresh whenever the membership or state of the federation changes
+    if ( Control.events == null && typeof(EventSource) !== "undefined" ) {
+      Control.events = new EventSource("/events");
+      [ "nursery-joined", "nursery-reaped", "state-changed" ].forEach(
+        function(aType) {
+          Control.events.addEventListener(aType, function() {
+            Control.refresh()
+          })
+        }
+      )
+    }
+  },
+  onremove: function() {
+    if ( Control.events != null ) {
+      Control.events.close();
+      Control.events = null;
+    }
+  },
   changeState: function(baseUrl, urlModifier, newState) {
     m.request({
       method: "PUT",
@@ -12,18 +12,25 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// A RESTful HTTP interface responsible for managing the up, down, and
-// pause state of either a given Nursery or the whole federation.
+// A RESTful HTTP interface responsible for managing the up, down, pause
+// and draining state of either a given Nursery or the whole federation,
+// as well as the scheduled changes of those states.
 //
 package control
 
 import (
+  "context"
   "encoding/json"
+  "errors"
   "fmt"
-  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "github.com/diSimplex/ConTeXtNursery/interfaces/discovery"
   "github.com/diSimplex/ConTeXtNursery/webserver"
+  "io/ioutil"
   "net/http"
+  "net/url"
+  "strconv"
   "strings"
+  "time"
 )
 
 //////////////////////////////////////////////////////////////////////
@@ -32,11 +39,15 @@ import (
 
 // Records the current control state of a given Nursery.
 //
+// The Desired_State is only recorded for the "Federation" (whose State is 
+// computed from the states of its members). 
+//
 type NurseryState struct {
-  Base_Url     string
-  Url_Modifier string
-  State        string
-  Processes    uint
+  Base_Url      string
+  Url_Modifier  string
+  State         string
+  Desired_State string
+  Processes     uint
 }
 
 // Records the current control state of the federation of ConTeXt
@@ -46,13 +57,307 @@ type NurseryState struct {
 //
 type FederationStateMap map[string]NurseryState
 
+// The control states of a Nursery. A draining Nursery is not given any 
+// new (placed) actions, but lets its running actions finish. 
+//
 const (
-  StateUp     = "up"
-  StatePaused = "paused"
-  StateDown   = "down"
-  StateKill   = "kill"
+  StateUp       = "up"
+  StatePaused   = "paused"
+  StateDraining = "draining"
+  StateDown     = "down"
+  StateKill     = "kill"
 )
 
+// The (computed) states of a federation whose members are not all in the 
+// same state. A federation is degraded if some of its members are down, 
+// killed or not (known to be) alive, and mixed if its members are up, 
+// paused or draining. 
+//
+const (
+  StateDegraded = "degraded"
+  StateMixed    = "mixed"
+)
+
+// The legal transitions between the control states of a Nursery. 
+//
+// A killed Nursery can not be changed (it is shutting down), and a 
+// Nursery which is down must be brought up before it can be paused. 
+// (Re)Requesting the current state is always legal (and changes 
+// nothing). 
+//
+var LegalTransitions = map[string][]string{
+  StateUp:       []string{ StatePaused, StateDraining, StateDown, StateKill },
+  StatePaused:   []string{ StateUp, StateDraining, StateDown, StateKill },
+  StateDraining: []string{ StateUp, StatePaused, StateDown, StateKill },
+  StateDown:     []string{ StateUp, StateKill },
+  StateKill:     []string{},
+}
+
+// Returns true if the state is one of the known control states.
+//
+func IsKnownState(state string) bool {
+  _, known := LegalTransitions[state]
+  return known
+}
+
+// Returns true if a Nursery may move from the fromState to the toState.
+//
+func CanTransition(fromState, toState string) bool {
+  if !IsKnownState(toState) { return false }
+  if fromState == toState   { return true }
+  for _, aState := range LegalTransitions[fromState] {
+    if aState == toState { return true }
+  }
+  return false
+}
+
+// Returns the state of a federation computed from the (non-empty) states 
+// of its members. 
+//
+func ComputeFederationState(memberStates []string) string {
+  if len(memberStates) < 1 { return StateDown }
+  allSame := true
+  for _, aState := range memberStates {
+    if aState != memberStates[0] { allSame = false }
+  }
+  if allSame { return memberStates[0] }
+  for _, aState := range memberStates {
+    switch aState {
+      case StateUp, StatePaused, StateDraining :
+      default :
+        return StateDegraded
+    }
+  }
+  return StateMixed
+}
+
+// A requested change of control state, together with the (free text) 
+// Reason for, and Actor (the requesting user or Nursery) of, the change. 
+//
+type StateChange struct {
+  State  string
+  Reason string
+  Actor  string
+}
+
+// Parse a StateChange (to the given state) from the "reason" and "actor" 
+// query parameters. The actor is the CommonName of the client certificate 
+// (the clientName) which, if an "actor" query parameter is given (by a 
+// Nursery forwarding a federation-wide change), acts on its behalf. 
+//
+func ParseStateChange(
+  state      string,
+  query      url.Values,
+  clientName string,
+) StateChange {
+  actor      := clientName
+  onBehalfOf := query.Get("actor")
+  if onBehalfOf != "" && onBehalfOf != clientName {
+    actor = clientName+" (for "+onBehalfOf+")"
+  }
+  return StateChange{
+    State:  state,
+    Reason: query.Get("reason"),
+    Actor:  actor,
+  }
+}
+
+// Encode the Reason and Actor of this StateChange as the query parameters 
+// understood by ParseStateChange. 
+//
+func (change StateChange) Query() url.Values {
+  query := url.Values{}
+  if change.Reason != "" { query.Set("reason", change.Reason) }
+  if change.Actor  != "" { query.Set("actor",  change.Actor) }
+  return query
+}
+
+// The error returned when a Nursery is asked to make an illegal 
+// transition. 
+//
+type TransitionError struct {
+  From string
+  To   string
+}
+
+func (te *TransitionError) Error() string {
+  return fmt.Sprintf("can not change the state from [%s] to [%s]", te.From, te.To)
+}
+
+// Records one transition between the control states of a Nursery.
+//
+type Transition struct {
+  At         time.Time
+  From       string
+  To         string
+  Reason     string
+  Actor      string
+  Request_Id string
+}
+
+// Records the (bounded, oldest first) history of the transitions of each 
+// Nursery. 
+//
+// The map is indexed by the Nursery Name.
+//
+type TransitionHistory map[string][]Transition
+
+// Selects the Nurseries targeted by a federation-wide state change.
+//
+// An empty target selects the whole federation. Otherwise only the named 
+// Nurseries (if any are named) which have all of the selected Labels are 
+// targeted. If Dry_Run is true, the targeted Nurseries are reported but 
+// their state is not changed. 
+//
+type ControlTarget struct {
+  Nurseries []string
+  Labels    []discovery.LabelSelector
+  Dry_Run   bool
+}
+
+// Parse a ControlTarget from the "nursery" (repeatable), "label" 
+// (repeatable) and "dry_run" query parameters. 
+//
+func ParseControlTarget(query url.Values) (ControlTarget, error) {
+  selectors, err := discovery.ParseLabelSelectors(query["label"])
+  if err != nil { return ControlTarget{}, err }
+  target := ControlTarget{
+    Nurseries: query["nursery"],
+    Labels:    selectors,
+  }
+  if query.Get("dry_run") != "" {
+    target.Dry_Run, err = strconv.ParseBool(query.Get("dry_run"))
+    if err != nil {
+      return target, fmt.Errorf("dry_run must be true or false: %w", err)
+    }
+  }
+  return target, nil
+}
+
+// Encode this ControlTarget as the query parameters understood by 
+// ParseControlTarget. 
+//
+func (target ControlTarget) Query() url.Values {
+  query := url.Values{}
+  for _, aNursery := range target.Nurseries { query.Add("nursery", aNursery) }
+  for _, aSelector := range target.Labels {
+    if aSelector.Any_Value {
+      query.Add("label", aSelector.Key)
+    } else {
+      query.Add("label", aSelector.Key+"="+aSelector.Value)
+    }
+  }
+  if target.Dry_Run { query.Set("dry_run", "true") }
+  return query
+}
+
+// Returns true if this ControlTarget selects the whole federation.
+//
+func (target ControlTarget) IsWholeFederation() bool {
+  return len(target.Nurseries) < 1 && len(target.Labels) < 1
+}
+
+// Returns true if the Nursery (with the given name and information) is 
+// targeted. 
+//
+func (target ControlTarget) Targets(name string, ni discovery.NurseryInfo) bool {
+  if 0 < len(target.Nurseries) {
+    named := false
+    for _, aNursery := range target.Nurseries {
+      if aNursery == name { named = true ; break }
+    }
+    if !named { return false }
+  }
+  return ni.Matches(target.Labels, nil)
+}
+
+// Records the outcome of changing the state of one Nursery: its state 
+// before and after the change, together with any Error (such as an 
+// illegal transition). 
+//
+type NurseryChangeResult struct {
+  Base_Url       string
+  Previous_State string
+  New_State      string
+  Error          string
+}
+
+// Records the outcome of a federation-wide state change.
+//
+// The Nurseries map is indexed by the Nursery Name.
+//
+type FederationChangeResult struct {
+  State_Change string
+  Reason       string
+  Actor        string
+  Dry_Run      bool
+  Nurseries    map[string]NurseryChangeResult
+}
+
+// A scheduled (federation-wide) state change of the targeted Nurseries,
+// stored and applied by the federation's primary Nursery.
+//
+// A Schedule is either one-shot (applied once, At the given time) or
+// cron-like (applied at every time matching its five field Cron
+// specification, in the primary's local time). The Id, Actor, Next_Run,
+// Last_Run and Last_Result are maintained by the primary.
+//
+type Schedule struct {
+  Id          string
+  State       string
+  Target      ControlTarget
+  At          time.Time
+  Cron        string
+  Reason      string
+  Actor       string
+  Next_Run    time.Time
+  Last_Run    time.Time
+  Last_Result *FederationChangeResult `json:",omitempty"`
+}
+
+// Returns an error if this Schedule does not change to a known state, or
+// is not either one-shot or cron-like (with a valid Cron specification).
+//
+func (schedule Schedule) Validate() error {
+  if !IsKnownState(schedule.State) {
+    return fmt.Errorf("unknown state [%s]", schedule.State)
+  }
+  if schedule.At.IsZero() == (schedule.Cron == "") {
+    return fmt.Errorf("a schedule must have exactly one of At or Cron")
+  }
+  if schedule.Cron != "" {
+    _, err := ParseCron(schedule.Cron)
+    if err != nil { return err }
+  }
+  return nil
+}
+
+// Returns the first time, strictly after the given time, at which this
+// (validated) Schedule is due, or the zero time if it is never again due.
+//
+func (schedule Schedule) NextRun(after time.Time) time.Time {
+  if schedule.Cron == "" {
+    if schedule.At.After(after) { return schedule.At }
+    return time.Time{}
+  }
+  cron, err := ParseCron(schedule.Cron)
+  if err != nil { return time.Time{} }
+  return cron.Next(after)
+}
+
+// The error returned when a Schedule is invalid (400), unknown (404), or
+// can not be stored (500), together with the HTTP status code which
+// should be returned to the client.
+//
+type ScheduleError struct {
+  Status_Code int
+  Message     string
+}
+
+func (se *ScheduleError) Error() string {
+  return se.Message
+}
+
 //////////////////////////////////////////////////////////////////////
 // Control interface functions
 //
@@ -65,11 +370,50 @@ type ControlImpl interface {
 
   // Change the control state of this Nursery.
   //
-  ActionChangeNurseryState(string)
+  // The context carries the id of the request which asked for this
+  // change. Returns a *TransitionError if the change is illegal.
+  //
+  ActionChangeNurseryState(context.Context, StateChange) error
+
+  // Change the control state of the targeted Nurseries in the 
+  // federation, returning the outcome for each Nursery.
+  //
+  // The context carries the id of the request which asked for this
+  // change, which is forwarded to every Nursery in the federation.
+  //
+  ActionChangeFederationState(
+    context.Context, StateChange, ControlTarget,
+  ) FederationChangeResult
+
+  // Return the (bounded) history of the transitions of each Nursery known 
+  // to this Nursery. 
+  //
+  ResponseControlHistoryJSON() TransitionHistory
+
+  // Returns the Base_Url of the federation's primary Nursery (or "" if
+  // there is none), and whether or not this Nursery is the primary.
+  //
+  ResponsePrimaryUrl() (string, bool)
+
+  // Return the (Next_Run ordered) scheduled state changes stored by this
+  // (primary) Nursery.
+  //
+  ResponseListSchedulesJSON() []Schedule
+
+  // Validate and store a new scheduled state change, returning it (with
+  // its newly generated Id and its Next_Run).
+  //
+  // Errors which are a *ScheduleError carry the HTTP status code to
+  // return.
+  //
+  ActionAddSchedule(context.Context, Schedule) (Schedule, error)
 
-  // Change the control state of the federation of Nurseries.
+  // Remove the scheduled state change with the given Id.
   //
-  ActionChangeFederationState(string)
+  // Errors which are a *ScheduleError carry the HTTP status code to
+  // return.
+  //
+  ActionDeleteSchedule(context.Context, string) error
 
   // Return the control status information about the federation of ConTeXt
   // Nurseries.
@@ -82,101 +426,138 @@ type ControlImpl interface {
   ResponseListFederationStatusJSON() *FederationStateMap
 }
 
-// Send a control message using the client connection
-//
-// NOTE: We DO NOT implement the federation level (/control/all) version
+// Add the Control RESTful HTTP interface to the current webserver.
 //
 //  interface:
-//    - url: /control/up
-//      method: PUT
+//    - url: /control
+//      method: GET
 //      credentials: CommonName of the Client X509 certificate
-//      action: brings *this* Nursery back to the "up" state
+//      action: None
 //      response: The current state of the federation
 //
-//    - url: /control/pause
+//    - url: /control/up?reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
-//      action: brings *this* Nursery to the "pasued" state
+//      action: brings *this* Nursery back to the "up" state
 //      response: The current state of the federation
 //
-//    - url: /control/kill
+//    - url: /control/paused?reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
-//      action: *this* cnNursery is shutdown and no longer responds
-//      response: None
-//
-func SendNurseryControlMessage(
-  baseUrl, stateChange string,
-  cc *clientConnection.CC,
-) *FederationStateMap {
-  respBody := cc.SendJsonMessage(baseUrl, "/control/"+stateChange, http.MethodPut, []byte{})
-
-  fmt.Printf("\ncontrol response [%s]\n\n", string(respBody))
-
-  var fedMap FederationStateMap
-
-  err := json.Unmarshal(respBody, &fedMap)
-  if err != nil {
-    cc.Log.MayBeError("Could not unmarshal respBody", err)
-    fedMap = FederationStateMap{}
-  }
-  return &fedMap
-}
-
-// Add the Control RESTful HTTP interface to the current webserver.
-//
-//  interface:
-//    - url: /control
-//      method: GET
-//      credentials: CommonName of the Client X509 certificate
-//      action: None
+//      action: brings *this* Nursery to the "paused" state
 //      response: The current state of the federation
 //
-//    - url: /control/up
+//    - url: /control/draining?reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
-//      action: brings *this* Nursery back to the "up" state
+//      action: |
+//        brings *this* Nursery to the "draining" state, in which no new
+//        actions are placed on it but its running actions finish
 //      response: The current state of the federation
 //
-//    - url: /control/pause
+//    - url: /control/down?reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
-//      action: brings *this* Nursery to the "pasued" state
+//      action: brings *this* Nursery to the "down" state
 //      response: The current state of the federation
 //
-//    - url: /control/kill
+//    - url: /control/kill?reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
 //      action: *this* cnNursery is shutdown and no longer responds
 //      response: None
 //
-//    - url: /control/all/up
+//    - url: /control/<state>
+//      method: PUT
+//      response: 409 (Conflict) if the transition to <state> is illegal
+//
+//    - url: /control/all/<state>?nursery=<aNursery>&label=<key>=<value>&dry_run=<bool>&reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
 //      action: |
-//        Walks through the federation and sends the /control/up message
-//      response: The current state of the federation
+//        Concurrently sends the /control/<state> message to every targeted
+//        Nursery (all of them unless some are selected by name or label),
+//        unless this is a dry run
+//      response: The previous state, new state and any error of each Nursery
+//      jsonResp: FederationChangeResult
 //
-//    - url: /control/all/pause
-//      method: PUT
+//    - url: /control/history?nursery=<aNursery>
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      action: None
+//      response: |
+//        The (bounded) history of the transitions of each (or the named)
+//        Nursery
+//      jsonResp: TransitionHistory
+//
+//    - url: /control/schedule
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      action: None
+//      response: The scheduled state changes stored by the primary Nursery
+//      jsonResp: []Schedule
+//
+//    - url: /control/schedule
+//      method: POST
+//      jsonPost: Schedule
 //      credentials: CommonName of the Client X509 certificate
 //      action: |
-//        Walks through the federation and sends the /control/pause message
-//      response: The current state of the federation
+//        On the federation's primary Nursery, stores a (one-shot or
+//        cron-like) scheduled state change of the targeted Nurseries. On
+//        any other Nursery, redirects (307) to the primary. The schedule
+//        is given a new (server generated) Id. NOTE: schedules are only
+//        stored (and persisted) by the primary which accepted them, they
+//        are NOT replicated, so a newly elected primary does not apply
+//        them (until the original primary is the primary again).
+//      response: The stored Schedule (or 400 if it is invalid)
+//      jsonResp: Schedule
 //
-//    - url: /control/all/kill
-//      method: PUT
+//    - url: /control/schedule/<aScheduleId>
+//      method: DELETE
 //      credentials: CommonName of the Client X509 certificate
 //      action: |
-//        Walks through the federation and sends the /control/kill message
-//      response: None
+//        On the federation's primary Nursery, removes the scheduled state
+//        change. On any other Nursery, redirects (307) to the primary.
+//      response: The remaining scheduled state changes (or 404)
+//      jsonResp: []Schedule
 //
 func AddControlInterface(
   ws *webserver.WS,
   interfaceImpl ControlImpl,
 ) {
-  ws.DescribeRoute("/control",     "???control description???", true)
-  ws.DescribeRoute("/control/all", "???control/all description???", true)
+  ws.DescribeRoute("/control",         "???control description???", true)
+  ws.DescribeRoute("/control/all",     "???control/all description???", true)
+  ws.DescribeRoute("/control/history", "???control/history description???", true)
+  ws.DescribeRoute("/control/schedule", "???control/schedule description???", true)
+
+  // Redirect (307) a request to change the schedules to the primary 
+  // Nursery, returning true if this Nursery is not the primary. 
+  //
+  redirectToPrimary := func(w http.ResponseWriter, r *http.Request) bool {
+    primaryUrl, isPrimary := interfaceImpl.ResponsePrimaryUrl()
+    if isPrimary { return false }
+    if primaryUrl == "" {
+      ws.ReplyError(
+        w, r, "The federation has no primary", http.StatusServiceUnavailable,
+      )
+      return true
+    }
+    // a 307 redirect ensures the client re-sends its request
+    http.Redirect(
+      w, r, primaryUrl+r.URL.RequestURI(), http.StatusTemporaryRedirect,
+    )
+    return true
+  }
+
+  // Reply with the status code carried by a *ScheduleError.
+  //
+  replyScheduleError := func(w http.ResponseWriter, r *http.Request, err error) {
+    statusCode := http.StatusInternalServerError
+    var scheduleErr *ScheduleError
+    if errors.As(err, &scheduleErr) { statusCode = scheduleErr.Status_Code }
+    ws.RequestLog(r).MayBeError("Could not change the schedules", err)
+    ws.ReplyError(w, r, err.Error(), statusCode)
+  }
 
 //  interface:
 //    - url: /control
@@ -195,74 +576,223 @@ func AddControlInterface(
   ws.Log.MayBeError("Could not add GET handler for [/control]", err)
 
 //  interface:
-//    - url: /control/up
+//    - url: /control/up?reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
 //      action: brings *this* Nursery back to the "up" state
 //      response: The current state of the federation
 //
-//    - url: /control/pause
+//    - url: /control/paused?reason=<aReason>
+//      method: PUT
+//      credentials: CommonName of the Client X509 certificate
+//      action: brings *this* Nursery to the "paused" state
+//      response: The current state of the federation
+//
+//    - url: /control/draining?reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
-//      action: brings *this* Nursery to the "pasued" state
+//      action: |
+//        brings *this* Nursery to the "draining" state, in which no new
+//        actions are placed on it but its running actions finish
 //      response: The current state of the federation
 //
-//    - url: /control/kill
+//    - url: /control/down?reason=<aReason>
+//      method: PUT
+//      credentials: CommonName of the Client X509 certificate
+//      action: brings *this* Nursery to the "down" state
+//      response: The current state of the federation
+//
+//    - url: /control/kill?reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
 //      action: *this* cnNursery is shutdown and no longer responds
 //      response: None
+//
+//    - url: /control/<state>
+//      method: PUT
+//      response: 409 (Conflict) if the transition to <state> is illegal
 //
   err = ws.AddPutHandler(
     "/control",
     func(w http.ResponseWriter, r *http.Request) {
 
-      stateChange := strings.TrimPrefix(r.URL.Path, "/control/")
-      ws.Log.Logf("control stateChange: [%s]", stateChange)
-      interfaceImpl.ActionChangeNurseryState(stateChange)
+      stateChange := ParseStateChange(
+        strings.TrimPrefix(r.URL.Path, "/control/"),
+        r.URL.Query(),
+        ws.ClientName(r),
+      )
+      ws.RequestLog(r).Logf("control stateChange: [%s]", stateChange.State)
+      if !IsKnownState(stateChange.State) {
+        ws.ReplyError(
+          w, r, "Unknown state ["+stateChange.State+"]", http.StatusBadRequest,
+        )
+        return
+      }
+      err := interfaceImpl.ActionChangeNurseryState(r.Context(), stateChange)
+      if err != nil {
+        ws.ReplyError(w, r, err.Error(), http.StatusConflict)
+        return
+      }
 
       fedMap := interfaceImpl.ResponseListFederationStatusJSON()
-      ws.Log.Json("Control Reply: ", "fedMap", fedMap)
+      ws.RequestLog(r).Json("Control Reply: ", "fedMap", fedMap)
       ws.ReplyInJson(w, r, fedMap)
     },
   )
   ws.Log.MayBeError("Could not add PUT handler for [/control]", err)
 
 //  interface:
-//    - url: /control/all/up
+//    - url: /control/all/<state>?nursery=<aNursery>&label=<key>=<value>&dry_run=<bool>&reason=<aReason>
 //      method: PUT
 //      credentials: CommonName of the Client X509 certificate
 //      action: |
-//        Walks through the federation and sends the /control/up message
-//      response: The current state of the federation
+//        Concurrently sends the /control/<state> message to every targeted
+//        Nursery (all of them unless some are selected by name or label),
+//        unless this is a dry run
+//      response: The previous state, new state and any error of each Nursery
+//      jsonResp: FederationChangeResult
 //
-//    - url: /control/all/pause
-//      method: PUT
+  err = ws.AddPutHandler(
+    "/control/all",
+    func(w http.ResponseWriter, r *http.Request) {
+
+      stateChange := ParseStateChange(
+        strings.TrimPrefix(r.URL.Path, "/control/all/"),
+        r.URL.Query(),
+        ws.ClientName(r),
+      )
+      ws.RequestLog(r).Logf("control/all stateChange: [%s]", stateChange.State)
+      if !IsKnownState(stateChange.State) {
+        ws.ReplyError(
+          w, r, "Unknown state ["+stateChange.State+"]", http.StatusBadRequest,
+        )
+        return
+      }
+      target, err := ParseControlTarget(r.URL.Query())
+      if err != nil {
+        ws.ReplyError(w, r, err.Error(), http.StatusBadRequest)
+        return
+      }
+      result :=
+        interfaceImpl.ActionChangeFederationState(r.Context(), stateChange, target)
+      ws.RequestLog(r).Json("Control Reply: ", "result", result)
+      ws.ReplyInJson(w, r, result)
+    },
+  )
+  ws.Log.MayBeError("Could not add PUT handler for [/control/all]", err)
+
+//  interface:
+//    - url: /control/history?nursery=<aNursery>
+//      method: GET
 //      credentials: CommonName of the Client X509 certificate
-//      action: |
-//        Walks through the federation and sends the /control/pause message
-//      response: The current state of the federation
+//      action: None
+//      response: |
+//        The (bounded) history of the transitions of each (or the named)
+//        Nursery
+//      jsonResp: TransitionHistory
 //
-//    - url: /control/all/kill
-//      method: PUT
+  err = ws.AddGetHandler(
+    "/control/history",
+    func(w http.ResponseWriter, r *http.Request) {
+      history := interfaceImpl.ResponseControlHistoryJSON()
+      if aNursery := r.URL.Query().Get("nursery") ; aNursery != "" {
+        history = TransitionHistory{ aNursery: history[aNursery] }
+      }
+      ws.ReplyInJson(w, r, history)
+    },
+  )
+  ws.Log.MayBeError("Could not add GET handler for [/control/history]", err)
+
+//  interface:
+//    - url: /control/schedule
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      action: None
+//      response: The scheduled state changes stored by the primary Nursery
+//      jsonResp: []Schedule
+//
+  err = ws.AddGetHandler(
+    "/control/schedule",
+    func(w http.ResponseWriter, r *http.Request) {
+      ws.ReplyInJson(w, r, interfaceImpl.ResponseListSchedulesJSON())
+    },
+  )
+  ws.Log.MayBeError("Could not add GET handler for [/control/schedule]", err)
+
+//  interface:
+//    - url: /control/schedule
+//      method: POST
+//      jsonPost: Schedule
 //      credentials: CommonName of the Client X509 certificate
 //      action: |
-//        Walks through the federation and sends the /control/kill message
-//      response: None
+//        On the federation's primary Nursery, stores a (one-shot or
+//        cron-like) scheduled state change of the targeted Nurseries. On
+//        any other Nursery, redirects (307) to the primary. The schedule
+//        is given a new (server generated) Id. NOTE: schedules are only
+//        stored (and persisted) by the primary which accepted them, they
+//        are NOT replicated, so a newly elected primary does not apply
+//        them (until the original primary is the primary again).
+//      response: The stored Schedule (or 400 if it is invalid)
+//      jsonResp: Schedule
 //
-  err = ws.AddPutHandler(
-    "/control/all",
+  err = ws.AddPostHandler(
+    "/control/schedule",
     func(w http.ResponseWriter, r *http.Request) {
+      if redirectToPrimary(w, r) { return }
 
-      stateChange := strings.TrimPrefix(r.URL.Path, "/control/all/")
-      ws.Log.Logf("control/all stateChange: [%s]", stateChange)
-      interfaceImpl.ActionChangeFederationState(stateChange)
+      body, err := ioutil.ReadAll(r.Body)
+      if err != nil {
+        ws.RequestLog(r).MayBeError("Could not read body of /control/schedule post request", err)
+        ws.ReplyError(w, r, "Could not read body", http.StatusBadRequest)
+        return
+      }
+      var schedule Schedule
+      err = json.Unmarshal(body, &schedule)
+      if err != nil {
+        ws.RequestLog(r).MayBeError("Could not unmarshal schedule body", err)
+        ws.ReplyError(w, r, "Could not unmarshal schedule", http.StatusBadRequest)
+        return
+      }
+      schedule.Actor = ws.ClientName(r)
 
-      fedMap := interfaceImpl.ResponseListFederationStatusJSON()
-      ws.Log.Json("Control Reply: ", "fedMap", fedMap)
-      ws.ReplyInJson(w, r, fedMap)
+      schedule, err = interfaceImpl.ActionAddSchedule(r.Context(), schedule)
+      if err != nil {
+        replyScheduleError(w, r, err)
+        return
+      }
+      ws.ReplyInJson(w, r, schedule)
     },
   )
-  ws.Log.MayBeError("Could not add PUT handler for [/control/all]", err)
+  ws.Log.MayBeError("Could not add POST handler for [/control/schedule]", err)
+
+//  interface:
+//    - url: /control/schedule/<aScheduleId>
+//      method: DELETE
+//      credentials: CommonName of the Client X509 certificate
+//      action: |
+//        On the federation's primary Nursery, removes the scheduled state
+//        change. On any other Nursery, redirects (307) to the primary.
+//      response: The remaining scheduled state changes (or 404)
+//      jsonResp: []Schedule
+//
+  err = ws.AddDeleteHandler(
+    "/control/schedule",
+    func(w http.ResponseWriter, r *http.Request) {
+      if redirectToPrimary(w, r) { return }
+
+      scheduleId := strings.TrimPrefix(r.URL.Path, "/control/schedule/")
+      if scheduleId == "" || scheduleId == r.URL.Path {
+        ws.ReplyError(w, r, "No schedule specified", http.StatusBadRequest)
+        return
+      }
+      err := interfaceImpl.ActionDeleteSchedule(r.Context(), scheduleId)
+      if err != nil {
+        replyScheduleError(w, r, err)
+        return
+      }
+      ws.ReplyInJson(w, r, interfaceImpl.ResponseListSchedulesJSON())
+    },
+  )
+  ws.Log.MayBeError("Could not add DELETE handler for [/control/schedule]", err)
 
 }
@@ -0,0 +1,154 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package control
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// A (parsed) cron-like specification of the times at which a Schedule
+// is due.
+//
+// Each field is a bit set of the minutes (0-59), hours (0-23), days of
+// the month (1-31), months (1-12) and days of the week (0-6, Sunday is
+// 0) which match. As in cron, if both the days of the month and the days
+// of the week are restricted, a day matches if either matches.
+//
+type CronSpec struct {
+  Minutes     uint64
+  Hours       uint64
+  Days        uint64
+  Months      uint64
+  Weekdays    uint64
+  Any_Day     bool
+  Any_Weekday bool
+}
+
+// Parse one (comma separated) field of a cron specification, each part
+// of which is one of "*", "<n>", "<n>-<m>", optionally followed by a
+// step "/<s>".
+//
+func parseCronField(field string, min, max int) (uint64, error) {
+  bits := uint64(0)
+  for _, aPart := range strings.Split(field, ",") {
+    rangePart := aPart
+    step      := 1
+    if slash := strings.Index(aPart, "/") ; 0 <= slash {
+      rangePart = aPart[:slash]
+      aStep, err := strconv.Atoi(aPart[slash+1:])
+      if err != nil || aStep < 1 {
+        return 0, fmt.Errorf("invalid step in [%s]", aPart)
+      }
+      step = aStep
+    }
+
+    first, last := min, max
+    if rangePart != "*" {
+      bounds := strings.SplitN(rangePart, "-", 2)
+      var err error
+      first, err = strconv.Atoi(bounds[0])
+      if err != nil { return 0, fmt.Errorf("invalid value in [%s]", aPart) }
+      last = first
+      if 1 < len(bounds) {
+        last, err = strconv.Atoi(bounds[1])
+        if err != nil { return 0, fmt.Errorf("invalid range in [%s]", aPart) }
+      } else if step != 1 {
+        last = max
+      }
+    }
+    if first < min || max < last || last < first {
+      return 0, fmt.Errorf("[%s] is not within %d-%d", aPart, min, max)
+    }
+    for i := first ; i <= last ; i += step { bits |= 1 << uint(i) }
+  }
+  return bits, nil
+}
+
+// Parse a (five field: minute, hour, day of month, month, day of week)
+// cron specification, such as "0 1 * * 1-5" (at 01:00 on weekdays).
+//
+func ParseCron(spec string) (*CronSpec, error) {
+  fields := strings.Fields(spec)
+  if len(fields) != 5 {
+    return nil, fmt.Errorf(
+      "the cron specification [%s] must have 5 fields (minute hour day month weekday)",
+      spec,
+    )
+  }
+  limits := [][2]int{ {0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7} }
+  bits   := make([]uint64, 5)
+  for i, aField := range fields {
+    aBits, err := parseCronField(aField, limits[i][0], limits[i][1])
+    if err != nil {
+      return nil, fmt.Errorf("invalid cron specification [%s]: %w", spec, err)
+    }
+    bits[i] = aBits
+  }
+  // both 0 and 7 are Sunday
+  if bits[4] & (1 << 7) != 0 { bits[4] = (bits[4] | 1) &^ (1 << 7) }
+  return &CronSpec{
+    Minutes:     bits[0],
+    Hours:       bits[1],
+    Days:        bits[2],
+    Months:      bits[3],
+    Weekdays:    bits[4],
+    Any_Day:     fields[2] == "*",
+    Any_Weekday: fields[4] == "*",
+  }, nil
+}
+
+// Returns true if the day (of the given time) matches.
+//
+func (cron *CronSpec) matchesDay(t time.Time) bool {
+  dayOk     := cron.Days     & (1 << uint(t.Day()))     != 0
+  weekdayOk := cron.Weekdays & (1 << uint(t.Weekday())) != 0
+  if !cron.Any_Day && !cron.Any_Weekday { return dayOk || weekdayOk }
+  return dayOk && weekdayOk
+}
+
+// Returns the first (whole minute) time, strictly after the given time,
+// which matches this specification, or the zero time if none does within
+// the next five years (for example "0 0 31 2 *").
+//
+func (cron *CronSpec) Next(after time.Time) time.Time {
+  loc   := after.Location()
+  t     := time.Date(
+    after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, loc,
+  ).Add(time.Minute)
+  limit := t.AddDate(5, 0, 0)
+  for t.Before(limit) {
+    if cron.Months & (1 << uint(t.Month())) == 0 {
+      t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+      continue
+    }
+    if !cron.matchesDay(t) {
+      t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+      continue
+    }
+    if cron.Hours & (1 << uint(t.Hour())) == 0 {
+      t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+      continue
+    }
+    if cron.Minutes & (1 << uint(t.Minute())) == 0 {
+      t = t.Add(time.Minute)
+      continue
+    }
+    return t
+  }
+  return time.Time{}
+}
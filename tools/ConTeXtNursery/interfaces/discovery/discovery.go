@@ -19,10 +19,13 @@ package discovery
 
 import (
   "encoding/json"
-  "github.com/diSimplex/ConTeXtNursery/clientConnection"
+  "fmt"
   "github.com/diSimplex/ConTeXtNursery/webserver"
   "io/ioutil"
   "net/http"
+  "strconv"
+  "strings"
+  "time"
 )
 
 //////////////////////////////////////////////////////////////////////
@@ -39,23 +42,103 @@ type MemoryTU struct {
 
 // Records current information about a given ConTeXt Nursery.
 //
+// The Last_Seen time and Liveness are recorded by the federation's 
+// primary Nursery whenever it receives a heartbeat from this Nursery. 
+//
+// The Labels are defined by the administrator (in the Nursery's 
+// configuration). The Actions map the name of each registered action to 
+// the (sha256) hash of its executable. The Tools map the name of each 
+// detected tool (such as ConTeXt or LuaMetaTeX) to its version. The 
+// Disk_Free is the free space (in bytes) in the Nursery's work 
+// directory, and the Queue_Depth is the number of actions currently 
+// running. 
+//
 type NurseryInfo struct {
-  Name      string
-  Port      string
-  Base_Url  string
-  State     string
-  Processes uint
-  Cores     uint
-  Speed_Mhz float64
-  Memory    MemoryTU
-  Swap      MemoryTU
-  Load      struct {
-    Load1   float64
-    Load5   float64
-    Load15  float64
+  Name        string
+  Port        string
+  Base_Url    string
+  State       string
+  Liveness    string
+  Last_Seen   time.Time
+  Processes   uint
+  Cores       uint
+  Speed_Mhz   float64
+  Memory      MemoryTU
+  Swap        MemoryTU
+  Load        struct {
+    Load1     float64
+    Load5     float64
+    Load15    float64
+  }
+  Labels      map[string]string
+  Actions     map[string]string
+  Tools       map[string]string
+  Fonts_Dir   string
+  Disk_Free   uint64
+  Queue_Depth uint
+}
+
+// A requirement that a Nursery have the label Key with the given Value 
+// (or, if Any_Value is true, with any value). 
+//
+type LabelSelector struct {
+  Key       string
+  Value     string
+  Any_Value bool
+}
+
+// Parse a list of "key=value" (or "key") label selectors.
+//
+func ParseLabelSelectors(selectorStrs []string) ([]LabelSelector, error) {
+  selectors := make([]LabelSelector, 0)
+  for _, aSelectorStr := range selectorStrs {
+    parts := strings.SplitN(aSelectorStr, "=", 2)
+    key   := strings.TrimSpace(parts[0])
+    if key == "" {
+      return nil, fmt.Errorf("the label selector [%s] has no key", aSelectorStr)
+    }
+    if len(parts) < 2 {
+      selectors = append(selectors, LabelSelector{ Key: key, Any_Value: true })
+      continue
+    }
+    selectors = append(selectors, LabelSelector{
+      Key:   key,
+      Value: strings.TrimSpace(parts[1]),
+    })
+  }
+  return selectors, nil
+}
+
+// Returns true if this Nursery has all of the selected labels, and has 
+// registered all of the named actions. 
+//
+func (ni NurseryInfo) Matches(
+  selectors   []LabelSelector,
+  actionNames []string,
+) bool {
+  for _, aSelector := range selectors {
+    value, ok := ni.Labels[aSelector.Key]
+    if !ok { return false }
+    if !aSelector.Any_Value && value != aSelector.Value { return false }
+  }
+  for _, anActionName := range actionNames {
+    if _, ok := ni.Actions[anActionName] ; !ok { return false }
   }
+  return true
 }
 
+// The liveness of a Nursery (as judged by the age of its last heartbeat).
+//
+// A Nursery restored (by a restarted primary) from the persisted map of 
+// the federation is stale until its next heartbeat confirms it. 
+//
+const (
+  LivenessAlive   = "alive"
+  LivenessSuspect = "suspect"
+  LivenessDead    = "dead"
+  LivenessStale   = "stale"
+)
+
 // Records the current information about a federation of ConTeXt
 // Nurseries.
 //
@@ -63,6 +146,38 @@ type NurseryInfo struct {
 //
 type NurseryInfoMap map[string]NurseryInfo
 
+// Returns the Nurseries (in this map) which have all of the selected 
+// labels, and have registered all of the named actions. 
+//
+func (niMap NurseryInfoMap) Select(
+  selectors   []LabelSelector,
+  actionNames []string,
+) NurseryInfoMap {
+  selected := make(NurseryInfoMap)
+  for aName, ni := range niMap {
+    if ni.Matches(selectors, actionNames) { selected[aName] = ni }
+  }
+  return selected
+}
+
+// Records the changes to a (versioned) NurseryInfoMap since a given 
+// version. 
+//
+// The Map_Id identifies the NurseryInfoMap (which changes whenever the 
+// federation's primary Nursery changes). If Full is true, the Updated 
+// map contains the whole NurseryInfoMap (and any previously known 
+// Nurseries which are not listed have been deleted). Otherwise the 
+// Updated map contains the Nurseries which have changed, and Deleted 
+// lists the Nurseries which have been deleted, since the given version. 
+//
+type NurseryInfoDelta struct {
+  Map_Id  string
+  Version uint64
+  Full    bool
+  Updated NurseryInfoMap
+  Deleted []string
+}
+
 //////////////////////////////////////////////////////////////////////
 // Discovery interface functions
 //
@@ -78,48 +193,54 @@ type DiscoveryImpl interface {
   //
   ResponseListNurseryInformationJSON() NurseryInfoMap
 
+  // Return the changes to the heartbeat status information about the
+  // federation of ConTeXt Nurseries since the given version of the given
+  // map.
+  //
+  ResponseNurseryInfoDeltaJSON(mapId string, since uint64) NurseryInfoDelta
+
   // Update the heartbeat status information about the given Nursery in the
   // federation of Nurseries.
   //
   ActionUpdateNurseryInfo(ni NurseryInfo)
 }
 
-// Send a discovery message using the client connection
+// Reply with either the whole NurseryInfoMap, or (if the request has a 
+// "since" query parameter) the NurseryInfoDelta since the version (of 
+// the map) given by the "since" (and "map") query parameters. 
 //
-//  interface:
-//    - url: /heartbeat
-//      method: POST
-//      jsonPost: NurseryInfo
-//      credentials: CommonName of the Client X509 certificate
-//      action: |
-//        Adds or updates the NurseryInfo for the Named Nursery into the
-//        Federation wide NurseryInfo map
-//      response: |
-//        Lists the currently known NurseryInfo of Nurseries in the Federation
-//      jsonResp: NurseryInfoMap
+// The whole NurseryInfoMap can be restricted to those Nurseries which 
+// have all of the labels given by the "label" (key=value or key) query 
+// parameters, and which have registered all of the actions given by the 
+// "action" query parameters. 
 //
-func SendDiscoveryMessage(
-  primaryUrl string,
-  ni NurseryInfo,
-  cc *clientConnection.CC,
-) *NurseryInfoMap {
-  jsonBytes, err := json.Marshal(ni)
-  cc.Log.MayBeError("Could not marshal NurseryInfo", err)
-
-  //fmt.Printf("\nbeat request [%s]\n\n", string(jsonBytes))
-
-  respBody := cc.SendJsonMessage(primaryUrl, "/heartbeat", http.MethodPost, jsonBytes)
-
-  //fmt.Printf("\nbeat response [%s]\n\n", string(respBody))
-
-  var niMap NurseryInfoMap
-
-  err = json.Unmarshal(respBody, &niMap)
+func replyWithNurseryInfo(
+  ws *webserver.WS,
+  w   http.ResponseWriter,
+  r  *http.Request,
+  interfaceImpl DiscoveryImpl,
+) {
+  query := r.URL.Query()
+  if query.Get("since") == "" {
+    selectors, err := ParseLabelSelectors(query["label"])
+    if err != nil {
+      ws.ReplyError(w, r, err.Error(), http.StatusBadRequest)
+      return
+    }
+    niMap := interfaceImpl.ResponseListNurseryInformationJSON()
+    if 0 < len(selectors) || 0 < len(query["action"]) {
+      niMap = niMap.Select(selectors, query["action"])
+    }
+    ws.ReplyInJson(w, r, niMap)
+    return
+  }
+  since, err := strconv.ParseUint(query.Get("since"), 10, 64)
   if err != nil {
-    cc.Log.MayBeError("Could not unmarshal respBody", err)
-    niMap = NurseryInfoMap{}
+    ws.ReplyError(w, r, "The since version must be a number", http.StatusBadRequest)
+    return
   }
-  return &niMap
+  delta := interfaceImpl.ResponseNurseryInfoDeltaJSON(query.Get("map"), since)
+  ws.ReplyInJson(w, r, delta)
 }
 
 // Add the Discovery RESTful HTTP interface to the current webserver.
@@ -133,6 +254,25 @@ func SendDiscoveryMessage(
 //        Lists the currently known NurseryInfo of Nurseries in the Federation
 //      jsonResp: NurseryInfoMap
 //
+//    - url: /heartbeat?label=<key>=<value>&action=<actionName>
+//      method: GET
+//      action: None
+//      credentials: CommonName of the Client X509 certificate
+//      response: |
+//        Lists the currently known NurseryInfo of those Nurseries in the
+//        Federation which have all of the given labels and actions (both
+//        the label and action parameters may be repeated)
+//      jsonResp: NurseryInfoMap
+//
+//    - url: /heartbeat?map=<mapId>&since=<version>
+//      method: GET
+//      action: None
+//      credentials: CommonName of the Client X509 certificate
+//      response: |
+//        Lists the changes to the NurseryInfo of Nurseries in the Federation
+//        since the <version> of the <mapId> map
+//      jsonResp: NurseryInfoDelta
+//
 //    - url: /heartbeat
 //      method: POST
 //      jsonPost: NurseryInfo
@@ -144,6 +284,18 @@ func SendDiscoveryMessage(
 //        Lists the currently known NurseryInfo of Nurseries in the Federation
 //      jsonResp: NurseryInfoMap
 //
+//    - url: /heartbeat?map=<mapId>&since=<version>
+//      method: POST
+//      jsonPost: NurseryInfo
+//      action: |
+//        Adds or updates the NurseryInfo for the Named Nursery into the
+//        Federation wide NurseryInfo map
+//      credentials: CommonName of the Client X509 certificate
+//      response: |
+//        Lists the changes to the NurseryInfo of Nurseries in the Federation
+//        since the <version> of the <mapId> map
+//      jsonResp: NurseryInfoDelta
+//
 func AddDiscoveryInterface(
   ws *webserver.WS,
   interfaceImpl DiscoveryImpl,
@@ -158,12 +310,30 @@ func AddDiscoveryInterface(
 //      response: |
 //        Lists the currently known NurseryInfo of Nurseries in the Federation
 //      jsonResp: NurseryInfoMap
+//
+//    - url: /heartbeat?label=<key>=<value>&action=<actionName>
+//      method: GET
+//      action: None
+//      credentials: CommonName of the Client X509 certificate
+//      response: |
+//        Lists the currently known NurseryInfo of those Nurseries in the
+//        Federation which have all of the given labels and actions (both
+//        the label and action parameters may be repeated)
+//      jsonResp: NurseryInfoMap
+//
+//    - url: /heartbeat?map=<mapId>&since=<version>
+//      method: GET
+//      action: None
+//      credentials: CommonName of the Client X509 certificate
+//      response: |
+//        Lists the changes to the NurseryInfo of Nurseries in the Federation
+//        since the <version> of the <mapId> map
+//      jsonResp: NurseryInfoDelta
 //
   err := ws.AddGetHandler(
     "/heartbeat",
     func(w http.ResponseWriter, r *http.Request) {
-      niMap := interfaceImpl.ResponseListNurseryInformationJSON()
-      ws.ReplyInJson(w, r, niMap)
+      replyWithNurseryInfo(ws, w, r, interfaceImpl)
     },
   )
   ws.Log.MayBeError("Could not add GET handler for [/heartbeat]", err)
@@ -179,27 +349,38 @@ func AddDiscoveryInterface(
 //      response: |
 //        Lists the currently known NurseryInfo of Nurseries in the Federation
 //      jsonResp: NurseryInfoMap
+//
+//    - url: /heartbeat?map=<mapId>&since=<version>
+//      method: POST
+//      jsonPost: NurseryInfo
+//      action: |
+//        Adds or updates the NurseryInfo for the Named Nursery into the
+//        Federation wide NurseryInfo map
+//      credentials: CommonName of the Client X509 certificate
+//      response: |
+//        Lists the changes to the NurseryInfo of Nurseries in the Federation
+//        since the <version> of the <mapId> map
+//      jsonResp: NurseryInfoDelta
 //
   err = ws.AddPostHandler(
     "/heartbeat",
     func(w http.ResponseWriter, r *http.Request) {
       body, err := ioutil.ReadAll(r.Body)
       if err != nil {
-        ws.Log.MayBeError("Could not read body of /heartbeat post request", err)
-        http.Error(w, "can't read body", http.StatusBadRequest)
+        ws.RequestLog(r).MayBeError("Could not read body of /heartbeat post request", err)
+        ws.ReplyError(w, r, "can't read body", http.StatusBadRequest)
         return
       }
 //      ws.Log.Log("heartBeat body: "+string(body))
       var ni NurseryInfo
       err = json.Unmarshal(body, &ni)
       if err != nil {
-        ws.Log.MayBeError("Could not unmarshal heartbeat body", err)
+        ws.RequestLog(r).MayBeError("Could not unmarshal heartbeat body", err)
         ni = NurseryInfo{}
       }
       interfaceImpl.ActionUpdateNurseryInfo(ni)
 
-      niMap := interfaceImpl.ResponseListNurseryInformationJSON()
-      ws.ReplyInJson(w, r, niMap)
+      replyWithNurseryInfo(ws, w, r, interfaceImpl)
     },
   )
   ws.Log.MayBeError("Could not add POST handler for [/heartbeat]", err)
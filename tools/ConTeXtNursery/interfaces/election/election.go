@@ -0,0 +1,193 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A RESTful HTTP interface responsible for the (lease based) election of
+// the federation's primary (leader) Nursery from among the primary
+// candidates.
+//
+package election
+
+import (
+  "crypto/x509"
+  "encoding/json"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/webserver"
+  "io/ioutil"
+  "net/http"
+)
+
+//////////////////////////////////////////////////////////////////////
+// Election interface types
+//
+
+// A request, by the candidate Leader, for a lease on the leadership of
+// the federation for the given Term.
+//
+// The lease lasts for Duration_Ms milliseconds from the time the lease
+// request is granted.
+//
+type Lease struct {
+  Leader      string
+  Term        uint64
+  Duration_Ms uint
+}
+
+// The reply to a Lease request.
+//
+// If the lease was not granted, the Leader and Term are those of the
+// currently leased leader.
+//
+type LeaseReply struct {
+  Granted bool
+  Leader  string
+  Term    uint64
+}
+
+// Records the leader of the federation as currently known to a given
+// Nursery.
+//
+// An empty Leader means that there is no currently leased leader.
+//
+type ElectionStatus struct {
+  Leader             string
+  Term               uint64
+  Lease_Remaining_Ms uint
+  Candidates         []string
+}
+
+// The error returned when a lease is requested for a Leader which is not
+// a primary candidate, or by a Nursery which is not that Leader.
+//
+type LeaseError struct {
+  Leader string
+  Reason string
+}
+
+func (le *LeaseError) Error() string {
+  return fmt.Sprintf("refused the lease for [%s]: %s", le.Leader, le.Reason)
+}
+
+//////////////////////////////////////////////////////////////////////
+// Election interface functions
+//
+
+// The Callbacks required to implement the Election RESTful HTTP interface
+// responsible for the election of the federation's primary Nursery.
+//
+type ElectionImpl interface {
+
+  // Grant (or refuse) a candidate's request for a lease on the
+  // leadership of the federation.
+  //
+  // The clientCert is the (verified) certificate of the requesting
+  // Nursery (or nil if none was presented). Returns a *LeaseError if the
+  // Leader is not a primary candidate or the clientCert is not that of
+  // the Leader.
+  //
+  ActionRequestLease(lease Lease, clientCert *x509.Certificate) (LeaseReply, error)
+
+  // Return the leader of the federation as currently known to this
+  // Nursery.
+  //
+  ResponseElectionStatusJSON() ElectionStatus
+}
+
+// Add the Election RESTful HTTP interface to the current webserver.
+//
+//  interface:
+//    - url: /election
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      action: None
+//      response: The leader of the federation as known to this Nursery
+//      jsonResp: ElectionStatus
+//
+//    - url: /election
+//      method: PUT
+//      jsonPost: Lease
+//      credentials: CommonName of the Client X509 certificate
+//      action: |
+//        Grants (or refuses) the candidate's request for a lease on the
+//        leadership of the federation
+//      response: Whether or not the lease was granted
+//      jsonResp: LeaseReply
+//
+func AddElectionInterface(
+  ws *webserver.WS,
+  interfaceImpl ElectionImpl,
+) {
+  ws.DescribeRoute("/election", "???election description???", true)
+
+//  interface:
+//    - url: /election
+//      method: GET
+//      credentials: CommonName of the Client X509 certificate
+//      action: None
+//      response: The leader of the federation as known to this Nursery
+//      jsonResp: ElectionStatus
+//
+  err := ws.AddGetHandler(
+    "/election",
+    func(w http.ResponseWriter, r *http.Request) {
+      status := interfaceImpl.ResponseElectionStatusJSON()
+      ws.ReplyInJson(w, r, status)
+    },
+  )
+  ws.Log.MayBeError("Could not add GET handler for [/election]", err)
+
+//  interface:
+//    - url: /election
+//      method: PUT
+//      jsonPost: Lease
+//      credentials: CommonName of the Client X509 certificate
+//      action: |
+//        Grants (or refuses) the candidate's request for a lease on the
+//        leadership of the federation
+//      response: |
+//        Whether or not the lease was granted (or 403 if the Leader is not
+//        a primary candidate, or the client is not the Leader)
+//      jsonResp: LeaseReply
+//
+  err = ws.AddPutHandler(
+    "/election",
+    func(w http.ResponseWriter, r *http.Request) {
+      body, err := ioutil.ReadAll(r.Body)
+      if err != nil {
+        ws.RequestLog(r).MayBeError("Could not read body of /election put request", err)
+        ws.ReplyError(w, r, "Could not read body", http.StatusBadRequest)
+        return
+      }
+      var lease Lease
+      err = json.Unmarshal(body, &lease)
+      if err != nil || lease.Leader == "" {
+        ws.RequestLog(r).MayBeError("Could not unmarshal lease body", err)
+        ws.ReplyError(w, r, "Could not unmarshal lease", http.StatusBadRequest)
+        return
+      }
+      var clientCert *x509.Certificate
+      if r.TLS != nil && 0 < len(r.TLS.PeerCertificates) {
+        clientCert = r.TLS.PeerCertificates[0]
+      }
+      leaseReply, err := interfaceImpl.ActionRequestLease(lease, clientCert)
+      if err != nil {
+        ws.RequestLog(r).MayBeError("Refusing the lease request", err)
+        ws.ReplyError(w, r, err.Error(), http.StatusForbidden)
+        return
+      }
+      ws.ReplyInJson(w, r, leaseReply)
+    },
+  )
+  ws.Log.MayBeError("Could not add PUT handler for [/election]", err)
+
+}
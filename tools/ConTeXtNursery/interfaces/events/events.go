@@ -0,0 +1,245 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A RESTful HTTP interface responsible for streaming (as Server-Sent
+// Events) the changes to the membership and state of the federation, and
+// the runs of actions, so that clients need not poll.
+//
+package events
+
+import (
+  "encoding/json"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/webserver"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+)
+
+//////////////////////////////////////////////////////////////////////
+// Events interface types
+//
+
+// The types of event.
+//
+const (
+  NurseryJoined = "nursery-joined"
+  NurseryReaped = "nursery-reaped"
+  StateChanged  = "state-changed"
+  RunStarted    = "run-started"
+  RunFinished   = "run-finished"
+)
+
+// An event in the federation.
+//
+// The Id increases with each event emitted by a given Nursery. The
+// Nursery is the name of the Nursery the event is about. The
+// Previous_State and State are only recorded for state-changed events,
+// while the Action and Run (and any Error) are only recorded for run
+// events.
+//
+type Event struct {
+  Id             uint64
+  Type           string
+  At             time.Time
+  Nursery        string
+  Previous_State string `json:",omitempty"`
+  State          string `json:",omitempty"`
+  Action         string `json:",omitempty"`
+  Run            string `json:",omitempty"`
+  Error          string `json:",omitempty"`
+}
+
+// Selects the events sent to a client.
+//
+// An empty list of Types (or of Nurseries) selects events of every type
+// (or about every Nursery).
+//
+type EventFilter struct {
+  Types     []string
+  Nurseries []string
+}
+
+// Parse an EventFilter from the "type" (repeatable) and "nursery"
+// (repeatable) query parameters.
+//
+func ParseEventFilter(query url.Values) EventFilter {
+  return EventFilter{
+    Types:     query["type"],
+    Nurseries: query["nursery"],
+  }
+}
+
+// Encode this EventFilter as the query parameters understood by
+// ParseEventFilter.
+//
+func (filter EventFilter) Query() url.Values {
+  query := url.Values{}
+  for _, aType    := range filter.Types     { query.Add("type",    aType) }
+  for _, aNursery := range filter.Nurseries { query.Add("nursery", aNursery) }
+  return query
+}
+
+// Returns true if the value is one of the values (or there are no
+// values).
+//
+func selects(values []string, value string) bool {
+  if len(values) < 1 { return true }
+  for _, aValue := range values {
+    if aValue == value { return true }
+  }
+  return false
+}
+
+// Returns true if this EventFilter selects the event.
+//
+func (filter EventFilter) Matches(event Event) bool {
+  return selects(filter.Types, event.Type) &&
+    selects(filter.Nurseries, event.Nursery)
+}
+
+//////////////////////////////////////////////////////////////////////
+// Events interface functions
+//
+
+// The Callbacks required to implement the Events RESTful HTTP interface
+// responsible for streaming the events in the federation.
+//
+type EventsImpl interface {
+
+  // Subscribe to the events emitted after the event with the lastId
+  // (any which are still remembered are sent first).
+  //
+  // Returns the channel on which the events are sent, and the function
+  // which MUST be called to unsubscribe. The channel is closed if the
+  // subscriber can not keep up.
+  //
+  ActionSubscribe(lastId uint64) (<-chan Event, func())
+}
+
+// The interval at which a comment is sent to keep an (otherwise idle)
+// event stream open.
+//
+const KeepAliveInterval = 15 * time.Second
+
+// Add the Events RESTful HTTP interface to the current webserver.
+//
+// interface:
+//   - url: /events?type=<aType>&nursery=<aNursery>
+//     method: GET
+//     credentials: CommonName of the Client X509 certificate
+//     action: |
+//       Streams (as text/event-stream Server-Sent Events) the selected
+//       nursery-joined, nursery-reaped, state-changed, run-started and
+//       run-finished events, starting after the event given by any
+//       Last-Event-ID header. The stream is exempt from the webserver's
+//       write timeout (it is only closed if the connection can not be
+//       reached, and then before the write timeout), but clients should
+//       still reconnect (as browsers' EventSource do) with the
+//       Last-Event-ID of the last event seen.
+//     response: A stream of events
+//     jsonResp: Event (the data of each event)
+//
+func AddEventsInterface(
+  ws *webserver.WS,
+  interfaceImpl EventsImpl,
+) {
+  ws.DescribeRoute("/events", "???events description???", true)
+
+  // interface:
+  //   - url: /events?type=<aType>&nursery=<aNursery>
+  //     method: GET
+  //     credentials: CommonName of the Client X509 certificate
+  //     action: |
+  //       Streams (as text/event-stream Server-Sent Events) the selected
+  //       nursery-joined, nursery-reaped, state-changed, run-started and
+  //       run-finished events, starting after the event given by any
+  //       Last-Event-ID header. The stream is exempt from the webserver's
+  //       write timeout (it is only closed if the connection can not be
+  //       reached, and then before the write timeout), but clients should
+  //       still reconnect (as browsers' EventSource do) with the
+  //       Last-Event-ID of the last event seen.
+  //     response: A stream of events
+  //     jsonResp: Event (the data of each event)
+  //
+  err := ws.AddGetHandler(
+    "/events",
+    func(w http.ResponseWriter, r *http.Request) {
+      flusher, ok := w.(http.Flusher)
+      if !ok {
+        ws.ReplyError(
+          w, r, "Event streams are not supported", http.StatusInternalServerError,
+        )
+        return
+      }
+
+      lastId := uint64(0)
+      if lastEventId := r.Header.Get("Last-Event-ID") ; lastEventId != "" {
+        var err error
+        lastId, err = strconv.ParseUint(lastEventId, 10, 64)
+        if err != nil {
+          ws.ReplyError(w, r, "Invalid Last-Event-ID", http.StatusBadRequest)
+          return
+        }
+      }
+      filter := ParseEventFilter(r.URL.Query())
+
+      eventChan, unsubscribe := interfaceImpl.ActionSubscribe(lastId)
+      defer unsubscribe()
+
+      w.Header().Set("Content-Type",  "text/event-stream")
+      w.Header().Set("Cache-Control", "no-cache")
+      w.WriteHeader(http.StatusOK)
+      fmt.Fprintf(w, "retry: 1000\n\n")
+      flusher.Flush()
+
+      // the stream outlasts the webserver's write timeout (which covers
+      // the whole reply), so clear the write deadline, or, if that is not
+      // possible, close the stream (cleanly) before the write timeout
+      // closes the connection
+      var endOfStream <-chan time.Time
+      err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+      if err != nil {
+        ws.RequestLog(r).MayBeError("Could not clear the write deadline", err)
+        streamFor  := time.Duration(ws.Limits.Write_Timeout) * time.Second * 9 / 10
+        endOfStream = time.After(streamFor)
+      }
+      keepAlive := time.NewTicker(KeepAliveInterval)
+      defer keepAlive.Stop()
+
+      for {
+        select {
+          case <-r.Context().Done() : return
+          case <-ws.Stopping        : return
+          case <-endOfStream        : return
+          case <-keepAlive.C        :
+            fmt.Fprintf(w, ": keep-alive\n\n")
+            flusher.Flush()
+          case event, ok := <-eventChan :
+            if !ok { return }
+            if !filter.Matches(event) { continue }
+            data, err := json.Marshal(event)
+            if err != nil {
+              ws.RequestLog(r).MayBeError("Could not marshal an event", err)
+              continue
+            }
+            fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+            flusher.Flush()
+        }
+      }
+    },
+  )
+  ws.Log.MayBeError("Could not add GET handler for [/events]", err)
+}
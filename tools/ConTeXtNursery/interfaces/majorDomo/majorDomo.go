@@ -19,6 +19,8 @@
 package majorDomo
 
 import (
+  "context"
+  "github.com/diSimplex/ConTeXtNursery/natsServer"
   "github.com/nats-io/nats.go"
 )
 
@@ -43,7 +45,7 @@ type Artifact struct {
 //
 // Populates the dependency graph with all new or updated meta-data. 
 //
-func ArtifactHave(msg *nats.Msg) {
+func ArtifactHave(ctx context.Context, msg *nats.Msg) {
   // do nothing
 }
 
@@ -51,7 +53,7 @@ func ArtifactHave(msg *nats.Msg) {
 //
 // Populates the dependency graph with all new or updated meta-data. 
 //
-func ArtifactWants( msg *nats.Msg) {
+func ArtifactWants(ctx context.Context, msg *nats.Msg) {
   // do nothing
 }
 
@@ -59,21 +61,15 @@ func ArtifactWants( msg *nats.Msg) {
 //
 // Removes the corresponding artifact from the dependency graph.
 //
-func ArtifactDelete(msg *nats.Msg) {
+func ArtifactDelete(ctx context.Context, msg *nats.Msg) {
   // do nothing
 }
 
-func AddMajorDomoInterface(natsConn *nats.Conn) {
-
-  nastConn
-
-  artifactWantsSub, err := natsConn.Subscribe("artifact.wants.>", ArtifactWants)
-  if err != nil {
-  	//??
-  }
-
-  artifactDeleteSub, err := natsConn.Subscribe("artifact.delete.>", ArtifactDelete)
-  if err != nil {
-  	//??
-  }
+// Subscribe to the artifact messages (each handled with the request id
+// of its publisher).
+//
+func AddMajorDomoInterface(ns *natsServer.NATS) {
+  ns.AsyncSubscription("artifact.have.>",   ArtifactHave)
+  ns.AsyncSubscription("artifact.wants.>",  ArtifactWants)
+  ns.AsyncSubscription("artifact.delete.>", ArtifactDelete)
 }
@@ -23,12 +23,12 @@ import (
 // Provide a non-empty method (which should *not* be optimized away)
 //
 func (l *LoggerType) DebugLock(logMesg string) {
-  log.Printf(l.AppName+"(debug): "+logMesg)
+  log.Print(l.prefix("debug")+logMesg)
 }
 
 // Provide a non-empty method (which should *not* be optimized away)
 //
 func (l *LoggerType) DebugLockf(logFormat string, v ...interface{}) {
-  log.Printf(l.AppName+"(debug): "+logFormat, v...)
+  log.Printf(l.prefix("debug")+logFormat, v...)
 }
 
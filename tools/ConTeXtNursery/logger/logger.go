@@ -15,6 +15,9 @@
 package logger
 
 import (
+  "context"
+  "crypto/rand"
+  "encoding/hex"
   "encoding/json"
   "log"
   "runtime/debug"
@@ -27,6 +30,7 @@ import (
 type LoggerType struct {
   AppName    string
   PrintStack bool
+  RequestId  string
 }
 
 func CreateLogger(appName string) *LoggerType {
@@ -37,33 +41,44 @@ func (l *LoggerType) SetPrintStack(printStack bool) {
   l.PrintStack = printStack
 }
 
+// Returns the prefix of each log line for the given log level.
+//
+// If this logger is associated with a request id, the request id is 
+// included in the prefix. 
+//
+func (l *LoggerType) prefix(level string) string {
+  if l.RequestId == "" { return l.AppName + "(" + level + "): " }
+  return l.AppName + "(" + level + ")[" + l.RequestId + "]: "
+}
+
 func (l *LoggerType) MayBeFatal(logMessage string, err error) {
   if err != nil {
     if l.PrintStack { debug.PrintStack() }
-    log.Fatalf("%s(FATAL): %s ERROR: %s", l.AppName, logMessage, err)
+    log.Fatalf("%s%s ERROR: %s", l.prefix("FATAL"), logMessage, err)
   }
 }
 
 func (l *LoggerType) MayBeError(logMessage string, err error) {
   if err != nil {
     if l.PrintStack { debug.PrintStack() }
-    log.Printf("%s(error): %s error: %s", l.AppName, logMessage, err)
+    log.Printf("%s%s error: %s", l.prefix("error"), logMessage, err)
   }
 }
 
 func (l *LoggerType) MayBeErrorf(err error, logFormat string, v ...interface{}) {
   if err != nil {
     if l.PrintStack { debug.PrintStack() }
-    log.Printf(l.AppName+"(error): "+logFormat+" error: %s", v...)
+    v = append(v, err)
+    log.Printf(l.prefix("error")+logFormat+" error: %s", v...)
   }
 }
 
 func (l *LoggerType) Log(logMesg string) {
-  log.Printf("%s(info): %s", l.AppName, logMesg)
+  log.Printf("%s%s", l.prefix("info"), logMesg)
 }
 
 func (l *LoggerType) Logf(logFormat string, v ...interface{}) {
-  log.Printf(l.AppName+"(info): "+logFormat, v...)
+  log.Printf(l.prefix("info")+logFormat, v...)
 }
 
 // Log the logMesg together with the aValue structure as a JSON object.
@@ -77,6 +92,64 @@ func (l *LoggerType) Json(logMesg string, valName string, aValue interface{}) {
     l.MayBeError("Could not marshal "+valName+" into json", err)
     jsonBytes = make([]byte, 0)
   }
-  log.Printf("%s(json): %s %s", l.AppName, logMesg, string(jsonBytes))
+  log.Printf("%s%s %s", l.prefix("json"), logMesg, string(jsonBytes))
+}
+
+/////////////////////////////
+// Request tracing
+//
+
+// The HTTP (and NATS) header used to carry a request id between 
+// nurseries. 
+//
+const RequestIdHeader = "X-Request-Id"
+
+// The (private) type of the key used to store request ids in a 
+// context.Context. 
+//
+type requestIdKey struct{}
+
+// Create a new (random) request id.
+//
+func NewRequestId() string {
+  idBytes := make([]byte, 8)
+  _, err := rand.Read(idBytes)
+  if err != nil { return "unknown" }
+  return hex.EncodeToString(idBytes)
+}
+
+// Returns a copy of the ctx which carries the requestId.
+//
+func ContextWithRequestId(ctx context.Context, requestId string) context.Context {
+  return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// Returns a copy of the ctx which carries a new request id.
+//
+func ContextWithNewRequestId(ctx context.Context) context.Context {
+  return ContextWithRequestId(ctx, NewRequestId())
+}
+
+// Returns the request id carried by the ctx (or "" if there is none).
+//
+func RequestIdFromContext(ctx context.Context) string {
+  requestId, _ := ctx.Value(requestIdKey{}).(string)
+  return requestId
+}
+
+// Returns a copy of this logger which includes the requestId in every 
+// log line. 
+//
+func (l *LoggerType) WithRequestId(requestId string) *LoggerType {
+  newLogger := *l
+  newLogger.RequestId = requestId
+  return &newLogger
+}
+
+// Returns a copy of this logger which includes the request id carried by 
+// the ctx (if any) in every log line. 
+//
+func (l *LoggerType) ForContext(ctx context.Context) *LoggerType {
+  return l.WithRequestId(RequestIdFromContext(ctx))
 }
 
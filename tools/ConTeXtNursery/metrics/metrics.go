@@ -0,0 +1,357 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A (very) small registry of counters, gauges and histograms which can
+// be exported in the Prometheus text exposition format.
+//
+// See: https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+package metrics
+
+import (
+  "fmt"
+  "io"
+  "math"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+//////////////////////////////////////////////////////////////////////
+// Metrics types
+//
+
+const (
+  CounterKind   = "counter"
+  GaugeKind     = "gauge"
+  HistogramKind = "histogram"
+)
+
+// The default histogram buckets (in seconds) used for request latencies.
+//
+var LatencyBuckets = []float64{
+  0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// The default histogram buckets (in seconds) used for (long running)
+// action durations.
+//
+var DurationBuckets = []float64{
+  1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600,
+}
+
+// The labels (name/value pairs) which distinguish the individual series
+// of a metric.
+//
+type Labels map[string]string
+
+// The current value(s) of one labelled series of a metric.
+//
+type Series struct {
+  Labels string   // the rendered labels (without the braces)
+  Value  float64  // counters and gauges
+  Counts []uint64 // histograms (one count per bucket)
+  Sum    float64  // histograms
+  Count  uint64   // histograms
+}
+
+// A named metric together with all of its labelled series.
+//
+type Family struct {
+  Name    string
+  Help    string
+  Kind    string
+  Buckets []float64
+  Series  map[string]*Series
+}
+
+// A registry of metric families.
+//
+// CONSTRAINTS: Once created, the values in this structure SHOULD only be
+// altered by structure methods.
+//
+type Registry struct {
+  Mutex    sync.RWMutex
+  Families map[string]*Family
+}
+
+//////////////////////////////////////////////////////////////////////
+// Metrics functions
+//
+
+// Create an empty metrics registry.
+//
+func CreateRegistry() *Registry {
+  return &Registry{ Families: make(map[string]*Family) }
+}
+
+// Render the labels as a (sorted) Prometheus label list (without the
+// surrounding braces).
+//
+func (labels Labels) String() string {
+  keys := make([]string, 0, len(labels))
+  for aKey := range labels { keys = append(keys, aKey) }
+  sort.Strings(keys)
+
+  pairs := make([]string, 0, len(keys))
+  for _, aKey := range keys {
+    pairs = append(pairs, aKey+"=\""+escapeLabelValue(labels[aKey])+"\"")
+  }
+  return strings.Join(pairs, ",")
+}
+
+// Escape the backslashes, double quotes and newlines in a label value.
+//
+func escapeLabelValue(value string) string {
+  value = strings.ReplaceAll(value, `\`, `\\`)
+  value = strings.ReplaceAll(value, `"`, `\"`)
+  return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+// Format a value as a Prometheus float.
+//
+func formatValue(value float64) string {
+  if math.IsInf(value, +1) { return "+Inf" }
+  if math.IsInf(value, -1) { return "-Inf" }
+  return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Describe (register) a metric family.
+//
+// Describing an already described family only updates its help text.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) describe(
+  name, help, kind string,
+  buckets []float64,
+) *Family {
+  reg.Mutex.Lock()
+  defer reg.Mutex.Unlock()
+
+  return reg.family(name, help, kind, buckets)
+}
+
+// Returns the named family, creating it if it does not yet exist.
+//
+// NOT THREAD-SAFE (the caller MUST hold the reg.Mutex lock);
+//
+func (reg *Registry) family(
+  name, help, kind string,
+  buckets []float64,
+) *Family {
+  aFamily, ok := reg.Families[name]
+  if !ok {
+    aFamily = &Family{
+      Name:    name,
+      Kind:    kind,
+      Buckets: buckets,
+      Series:  make(map[string]*Series),
+    }
+    reg.Families[name] = aFamily
+  }
+  if help != "" { aFamily.Help = help }
+  return aFamily
+}
+
+// Returns the series of the family with the given labels, creating it if
+// it does not yet exist.
+//
+// NOT THREAD-SAFE (the caller MUST hold the reg.Mutex lock);
+//
+func (aFamily *Family) series(labels Labels) *Series {
+  renderedLabels := labels.String()
+  aSeries, ok := aFamily.Series[renderedLabels]
+  if !ok {
+    aSeries = &Series{ Labels: renderedLabels }
+    if aFamily.Kind == HistogramKind {
+      aSeries.Counts = make([]uint64, len(aFamily.Buckets))
+    }
+    aFamily.Series[renderedLabels] = aSeries
+  }
+  return aSeries
+}
+
+// Describe a counter.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) DescribeCounter(name, help string) {
+  reg.describe(name, help, CounterKind, nil)
+}
+
+// Describe a gauge.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) DescribeGauge(name, help string) {
+  reg.describe(name, help, GaugeKind, nil)
+}
+
+// Describe a histogram with the given (increasing) bucket upper bounds.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) DescribeHistogram(name, help string, buckets []float64) {
+  reg.describe(name, help, HistogramKind, buckets)
+}
+
+// Add delta (which SHOULD be positive) to a counter.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) AddToCounter(name string, labels Labels, delta float64) {
+  reg.Mutex.Lock()
+  defer reg.Mutex.Unlock()
+
+  reg.family(name, "", CounterKind, nil).series(labels).Value += delta
+}
+
+// Increment a counter.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) IncCounter(name string, labels Labels) {
+  reg.AddToCounter(name, labels, 1)
+}
+
+// Set a gauge to the value.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) SetGauge(name string, labels Labels, value float64) {
+  reg.Mutex.Lock()
+  defer reg.Mutex.Unlock()
+
+  reg.family(name, "", GaugeKind, nil).series(labels).Value = value
+}
+
+// Add delta (which may be negative) to a gauge.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) AddToGauge(name string, labels Labels, delta float64) {
+  reg.Mutex.Lock()
+  defer reg.Mutex.Unlock()
+
+  reg.family(name, "", GaugeKind, nil).series(labels).Value += delta
+}
+
+// Observe a value in a histogram.
+//
+// A histogram which has not been described uses the LatencyBuckets.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) Observe(name string, labels Labels, value float64) {
+  reg.Mutex.Lock()
+  defer reg.Mutex.Unlock()
+
+  aFamily := reg.family(name, "", HistogramKind, LatencyBuckets)
+  aSeries := aFamily.series(labels)
+  for i, anUpperBound := range aFamily.Buckets {
+    if value <= anUpperBound { aSeries.Counts[i]++ }
+  }
+  aSeries.Sum   += value
+  aSeries.Count++
+}
+
+// Returns the current value of a counter or gauge (or 0 if it does not
+// exist).
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) Value(name string, labels Labels) float64 {
+  reg.Mutex.RLock()
+  defer reg.Mutex.RUnlock()
+
+  aFamily, ok := reg.Families[name]
+  if !ok { return 0 }
+  aSeries, ok := aFamily.Series[labels.String()]
+  if !ok { return 0 }
+  return aSeries.Value
+}
+
+// Join rendered labels with an extra (rendered) label, and add the
+// surrounding braces.
+//
+func withBraces(renderedLabels, extraLabel string) string {
+  if renderedLabels != "" && extraLabel != "" {
+    renderedLabels = renderedLabels + "," + extraLabel
+  } else if extraLabel != "" {
+    renderedLabels = extraLabel
+  }
+  if renderedLabels == "" { return "" }
+  return "{" + renderedLabels + "}"
+}
+
+// Write all metrics in the Prometheus text exposition format.
+//
+// Families and series are written in (name and label) sorted order.
+//
+// THREAD-SAFE;
+//
+func (reg *Registry) WriteText(w io.Writer) error {
+  reg.Mutex.RLock()
+  defer reg.Mutex.RUnlock()
+
+  names := make([]string, 0, len(reg.Families))
+  for aName := range reg.Families { names = append(names, aName) }
+  sort.Strings(names)
+
+  var sb strings.Builder
+  for _, aName := range names {
+    aFamily := reg.Families[aName]
+    if aFamily.Help != "" {
+      help := strings.ReplaceAll(aFamily.Help, `\`, `\\`)
+      help  = strings.ReplaceAll(help, "\n", `\n`)
+      fmt.Fprintf(&sb, "# HELP %s %s\n", aName, help)
+    }
+    fmt.Fprintf(&sb, "# TYPE %s %s\n", aName, aFamily.Kind)
+
+    seriesKeys := make([]string, 0, len(aFamily.Series))
+    for aKey := range aFamily.Series { seriesKeys = append(seriesKeys, aKey) }
+    sort.Strings(seriesKeys)
+
+    for _, aKey := range seriesKeys {
+      aSeries := aFamily.Series[aKey]
+      if aFamily.Kind != HistogramKind {
+        fmt.Fprintf(&sb, "%s%s %s\n",
+          aName, withBraces(aSeries.Labels, ""), formatValue(aSeries.Value),
+        )
+        continue
+      }
+      for i, anUpperBound := range aFamily.Buckets {
+        fmt.Fprintf(&sb, "%s_bucket%s %d\n",
+          aName,
+          withBraces(aSeries.Labels, "le=\""+formatValue(anUpperBound)+"\""),
+          aSeries.Counts[i],
+        )
+      }
+      fmt.Fprintf(&sb, "%s_bucket%s %d\n",
+        aName, withBraces(aSeries.Labels, "le=\"+Inf\""), aSeries.Count,
+      )
+      fmt.Fprintf(&sb, "%s_sum%s %s\n",
+        aName, withBraces(aSeries.Labels, ""), formatValue(aSeries.Sum),
+      )
+      fmt.Fprintf(&sb, "%s_count%s %d\n",
+        aName, withBraces(aSeries.Labels, ""), aSeries.Count,
+      )
+    }
+  }
+
+  _, err := io.WriteString(w, sb.String())
+  return err
+}
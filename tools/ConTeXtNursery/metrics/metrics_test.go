@@ -0,0 +1,58 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+  "github.com/stretchr/testify/assert"
+  "strings"
+  "testing"
+)
+
+func TestWriteText(t *testing.T) {
+  reg := CreateRegistry()
+  reg.DescribeCounter("cn_requests_total", "The number of requests")
+  reg.DescribeHistogram("cn_latency_seconds", "The latency", []float64{ 0.1, 1 })
+
+  reg.IncCounter("cn_requests_total", Labels{ "route": "/a", "method": "GET" })
+  reg.IncCounter("cn_requests_total", Labels{ "method": "GET", "route": "/a" })
+  reg.IncCounter("cn_requests_total", Labels{ "route": "/\"b\"", "method": "PUT" })
+  reg.SetGauge("cn_queue_depth", nil, 3)
+  reg.AddToGauge("cn_queue_depth", nil, -1)
+  reg.Observe("cn_latency_seconds", Labels{ "route": "/a" }, 0.05)
+  reg.Observe("cn_latency_seconds", Labels{ "route": "/a" }, 0.5)
+  reg.Observe("cn_latency_seconds", Labels{ "route": "/a" }, 5)
+
+  assert.Equal(t, 2.0, reg.Value("cn_requests_total", Labels{ "method": "GET", "route": "/a" }))
+  assert.Equal(t, 2.0, reg.Value("cn_queue_depth", nil))
+  assert.Equal(t, 0.0, reg.Value("cn_missing", nil))
+
+  var sb strings.Builder
+  err := reg.WriteText(&sb)
+  assert.Nil(t, err)
+  assert.Equal(t, `# HELP cn_latency_seconds The latency
+# TYPE cn_latency_seconds histogram
+cn_latency_seconds_bucket{route="/a",le="0.1"} 1
+cn_latency_seconds_bucket{route="/a",le="1"} 2
+cn_latency_seconds_bucket{route="/a",le="+Inf"} 3
+cn_latency_seconds_sum{route="/a"} 5.55
+cn_latency_seconds_count{route="/a"} 3
+# TYPE cn_queue_depth gauge
+cn_queue_depth 2
+# HELP cn_requests_total The number of requests
+# TYPE cn_requests_total counter
+cn_requests_total{method="GET",route="/a"} 2
+cn_requests_total{method="PUT",route="/\"b\""} 1
+`, sb.String())
+}
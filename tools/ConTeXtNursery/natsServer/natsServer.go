@@ -17,6 +17,8 @@
 package natsServer
 
 import (
+  "context"
+  "crypto/tls"
   "fmt"
   "strings"
   "sync"
@@ -32,12 +34,47 @@ type NATS struct {
   Log      *logger.LoggerType
 }
 
+// A NATS message handler which is given a context carrying the request 
+// id found in the message's X-Request-Id header (or a new request id if 
+// the message has none). 
+//
+type TracedMsgHandler func(ctx context.Context, msg *nats.Msg)
+
+// Wrap a TracedMsgHandler as a (plain) NATS message handler. 
+//
+func tracedHandler(natsCallback TracedMsgHandler) nats.MsgHandler {
+  return func(msg *nats.Msg) {
+    requestId := ""
+    if msg.Header != nil { requestId = msg.Header.Get(logger.RequestIdHeader) }
+    if requestId == "" { requestId = logger.NewRequestId() }
+    natsCallback(logger.ContextWithRequestId(context.Background(), requestId), msg)
+  }
+}
+
+// Create a message, for the natsSubject, carrying the request id (if any)
+// of the ctx in its X-Request-Id header. 
+//
+func newTracedMsg(
+  ctx         context.Context,
+  natsSubject string,
+  data        []byte,
+) *nats.Msg {
+  msg := nats.NewMsg(natsSubject)
+  msg.Data = data
+  requestId := logger.RequestIdFromContext(ctx)
+  if requestId != "" { msg.Header.Set(logger.RequestIdHeader, requestId) }
+  return msg
+}
+
+// Subscribe to natsSubPath with a TracedMsgHandler (so that the request 
+// id of the publisher is logged by the subscriber). 
+//
 func (ns *NATS) AsyncSubscription(
   natsSubPath  string,
-  natsCallback nats.MsgHandler,
+  natsCallback TracedMsgHandler,
 ) {
   ns.NatsWG.Add(1)
-  theSubscription, err := ns.Conn.Subscribe(natsSubPath, natsCallback)
+  theSubscription, err := ns.Conn.Subscribe(natsSubPath, tracedHandler(natsCallback))
   if err != nil {
     ns.Log.MayBeFatal(
       fmt.Sprintf("Could not register [%s] subscription", natsSubPath),
@@ -48,6 +85,21 @@ func (ns *NATS) AsyncSubscription(
   ns.Subs = append(ns.Subs, theSubscription)
 }
 
+// Publish the data to the natsSubject, carrying the request id (if any) 
+// of the ctx in the message's X-Request-Id header. 
+//
+func (ns *NATS) Publish(
+  ctx         context.Context,
+  natsSubject string,
+  data        []byte,
+) error {
+  err := ns.Conn.PublishMsg(newTracedMsg(ctx, natsSubject, data))
+  if err != nil {
+    ns.Log.ForContext(ctx).MayBeErrorf(err, "Could not publish to [%s]", natsSubject)
+  }
+  return err
+}
+
 func (ns *NATS) CloseDown() {
   for _, aSubscription := range ns.Subs {
     _ = aSubscription.Unsubscribe()
@@ -55,13 +107,21 @@ func (ns *NATS) CloseDown() {
   }
 }
 
+// Connect to (one of) the NATS servers listed in connections.
+//
+// If a tlsConfig is given, the connection uses TLS (presenting the 
+// client's certificate to the NATS server). 
+//
 func ConnectServer(
   connections []string,
+  tlsConfig    *tls.Config,
   cnLog        *logger.LoggerType,
 ) (*NATS){
   ns := NATS{}
   connectionsStr := strings.Join(connections, ",")
-  theConnection, err := nats.Connect(connectionsStr)
+  natsOptions    := []nats.Option{}
+  if tlsConfig != nil { natsOptions = append(natsOptions, nats.Secure(tlsConfig)) }
+  theConnection, err := nats.Connect(connectionsStr, natsOptions...)
   cnLog.MayBeFatal(
     fmt.Sprintf("Could not connect to NATS servers [%s]", connectionsStr),
     err,
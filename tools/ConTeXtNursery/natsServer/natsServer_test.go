@@ -0,0 +1,48 @@
+// Copyright 2020 PerceptiSys Ltd, (Stephen Gaito)
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package natsServer
+
+import (
+  "context"
+  "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/nats-io/nats.go"
+  "github.com/stretchr/testify/assert"
+  "testing"
+)
+
+// Test that the request id of a published message arrives (in the
+// context) on the subscriber side, and that a message without one is
+// given a new request id.
+//
+func TestTracedMessages(t *testing.T) {
+  var gotRequestId string
+  handler := tracedHandler(func(ctx context.Context, msg *nats.Msg) {
+    gotRequestId = logger.RequestIdFromContext(ctx)
+  })
+
+  ctx := logger.ContextWithRequestId(context.Background(), "req-42")
+  msg := newTracedMsg(ctx, "artifact.wants.test", []byte("data"))
+  assert.Equal(t, "artifact.wants.test", msg.Subject)
+  assert.Equal(t, []byte("data"), msg.Data)
+  handler(msg)
+  assert.Equal(t, "req-42", gotRequestId)
+
+  handler(newTracedMsg(context.Background(), "artifact.wants.test", nil))
+  assert.NotEqual(t, "", gotRequestId)
+  assert.NotEqual(t, "req-42", gotRequestId)
+
+  handler(&nats.Msg{ Subject: "artifact.wants.test" })
+  assert.NotEqual(t, "", gotRequestId)
+}
@@ -19,16 +19,21 @@ package webserver
 
 import (
   "bytes"
+  "context"
   "crypto/tls"
-  "crypto/x509"
   "encoding/json"
   "fmt"
+  "github.com/diSimplex/ConTeXtNursery/certificates"
   "github.com/diSimplex/ConTeXtNursery/logger"
+  "github.com/diSimplex/ConTeXtNursery/metrics"
   "io"
-  "io/ioutil"
   "net"
   "net/http"
+  "os"
+  "os/signal"
   "strings"
+  "sync"
+  "syscall"
   "time"
 )
 
@@ -57,68 +62,329 @@ type RouteDesc struct {
   SubRoutes     []*RouteDesc
 }
 
+// The timeouts (in seconds) and sizes (in bytes) used to limit the 
+// resources any one request may consume. 
+//
+// Any zero valued field is replaced by the corresponding field of the 
+// LimitsDefaults (see NormalizeLimits). 
+//
+type Limits struct {
+  Read_Timeout        uint
+  Read_Header_Timeout uint
+  Write_Timeout       uint
+  Idle_Timeout        uint
+  Shutdown_Timeout    uint
+  Max_Header_Bytes    uint
+  Max_Body_Bytes      uint
+}
+
+var (
+  LimitsDefaults = Limits{
+    30,       // Read_Timeout
+    10,       // Read_Header_Timeout
+    300,      // Write_Timeout
+    120,      // Idle_Timeout
+    30,       // Shutdown_Timeout
+    1 << 20,  // Max_Header_Bytes
+    10 << 20, // Max_Body_Bytes
+  }
+)
+
+// A named check which must return nil for the webserver to be considered 
+// ready (see the /health/ready route). 
+//
+type ReadinessCheck struct {
+  Name  string
+  Check func() error
+}
+
 type WS struct {
-  Listener   net.Listener
-  Server    *http.Server
-  HostPort   string
-  BaseRoute *Route
-  InitTime   time.Time
-  Log       *logger.LoggerType
+  Listener         net.Listener
+  Server          *http.Server
+  HostPort         string
+  BaseRoute       *Route
+  InitTime         time.Time
+  Certs           *certificates.Certificates
+  Limits           Limits
+  Mutex            sync.RWMutex
+  Ready            bool
+  ReadinessChecks []ReadinessCheck
+  ShutdownOnce     sync.Once
+  ShutdownDone     chan struct{}
+  StoppingOnce     sync.Once
+  Stopping         chan struct{}
+  Metrics         *metrics.Registry
+  Log             *logger.LoggerType
 }
 
 //////////////////////////////////////////////////////////////////////
 // Webserver functions
 //
 
-// Create a webserver with no routes listening on the given host and
-// port using the given tls.Config.
+// Replace any zero valued fields with the corresponding LimitsDefaults.
+//
+// ALTERS limits;
+//
+func (limits *Limits) NormalizeLimits() {
+  if limits.Read_Timeout        == 0 { limits.Read_Timeout        = LimitsDefaults.Read_Timeout }
+  if limits.Read_Header_Timeout == 0 { limits.Read_Header_Timeout = LimitsDefaults.Read_Header_Timeout }
+  if limits.Write_Timeout       == 0 { limits.Write_Timeout       = LimitsDefaults.Write_Timeout }
+  if limits.Idle_Timeout        == 0 { limits.Idle_Timeout        = LimitsDefaults.Idle_Timeout }
+  if limits.Shutdown_Timeout    == 0 { limits.Shutdown_Timeout    = LimitsDefaults.Shutdown_Timeout }
+  if limits.Max_Header_Bytes    == 0 { limits.Max_Header_Bytes    = LimitsDefaults.Max_Header_Bytes }
+  if limits.Max_Body_Bytes      == 0 { limits.Max_Body_Bytes      = LimitsDefaults.Max_Body_Bytes }
+}
+
+// Convert a number of seconds into a time.Duration.
+//
+func seconds(numSecs uint) time.Duration {
+  return time.Duration(numSecs) * time.Second
+}
+
+// Create a webserver with no routes (other than the /health and /metrics 
+// routes) 
+// listening on the given host and port using the (hot reloadable) 
+// certificates. 
+//
+// The http.Server's timeouts and maximum header size are taken from the 
+// (normalized) limits. 
 //
 func CreateWebServer(
   host, port, description string,
-  caCertPath, certPath, keyPath string,
+  certs     *certificates.Certificates,
+  limits     Limits,
   cnLog     *logger.LoggerType,
 ) *WS {
   var err error
 
-  // Load the Server x509 Certificates and keys for this webServer
-  //
-  serverCert, err := tls.LoadX509KeyPair( certPath, keyPath )
-  cnLog.MayBeFatal("Could not load cert/key pair", err)
-  //
-  caCert, err := ioutil.ReadFile(caCertPath)
-  cnLog.MayBeFatal("Could not load the CA certificate", err)
-  //
-  caCertPool := x509.NewCertPool()
-  caCertPool.AppendCertsFromPEM(caCert)
-  //
   // Setup HTTPS server configuration
   //
-  tlsConfig := &tls.Config{
-    ClientAuth:     tls.RequireAndVerifyClientCert,
-    Certificates: []tls.Certificate{serverCert},
-    RootCAs:        caCertPool,
-    ClientCAs:      caCertPool,
-  }
+  tlsConfig := certs.ServerTLSConfig()
 
   // now create the WebServer structure itself
   //
-  ws          := WS{}
-  ws.InitTime  = time.Now()
-  ws.Log       = cnLog
-  ws.BaseRoute = ws.CreateNewRoute("/", "", description, true)
-  ws.HostPort  = host + ":" + port
+  limits.NormalizeLimits()
+  ws             := WS{}
+  ws.InitTime     = time.Now()
+  ws.Log          = cnLog
+  ws.Certs        = certs
+  ws.Limits       = limits
+  ws.ShutdownDone = make(chan struct{})
+  ws.Stopping     = make(chan struct{})
+  ws.Metrics      = metrics.CreateRegistry()
+  ws.BaseRoute    = ws.CreateNewRoute("/", "", description, true)
+  ws.HostPort     = host + ":" + port
   ws.Log.Logf("listening at [%s]\n", ws.HostPort)
   ws.Listener, err = tls.Listen("tcp",  ws.HostPort, tlsConfig)
   ws.Log.MayBeFatal("Could not create listener", err)
 
   ws.Server = &http.Server{
-    Handler:   &ws,
-    TLSConfig: tlsConfig,
+    Handler:           &ws,
+    TLSConfig:         tlsConfig,
+    ReadTimeout:       seconds(limits.Read_Timeout),
+    ReadHeaderTimeout: seconds(limits.Read_Header_Timeout),
+    WriteTimeout:      seconds(limits.Write_Timeout),
+    IdleTimeout:       seconds(limits.Idle_Timeout),
+    MaxHeaderBytes:    int(limits.Max_Header_Bytes),
   }
 
+  err = ws.AddHealthHandlers()
+  ws.Log.MayBeError("Could not add the health handlers", err)
+
+  err = ws.AddMetricsHandlers()
+  ws.Log.MayBeError("Could not add the metrics handlers", err)
+
   return &ws
 }
 
+// Set whether or not this webserver is ready to accept requests.
+//
+// THREAD-SAFE;
+//
+func (ws *WS) SetReady(ready bool) {
+  ws.Mutex.Lock()
+  defer ws.Mutex.Unlock()
+
+  ws.Ready = ready
+}
+
+// Add a named check which must return nil for this webserver to be 
+// reported as ready. 
+//
+// THREAD-SAFE;
+//
+func (ws *WS) AddReadinessCheck(name string, check func() error) {
+  ws.Mutex.Lock()
+  defer ws.Mutex.Unlock()
+
+  ws.ReadinessChecks = append(ws.ReadinessChecks, ReadinessCheck{
+    Name:  name,
+    Check: check,
+  })
+}
+
+// Returns nil if this webserver is ready, otherwise returns a map of 
+// the failing readiness check names to the reasons they failed. 
+//
+// THREAD-SAFE;
+//
+func (ws *WS) CheckReadiness() map[string]string {
+  ws.Mutex.RLock()
+  defer ws.Mutex.RUnlock()
+
+  failures := make(map[string]string)
+  if !ws.Ready { failures["webserver"] = "not serving" }
+  for _, aCheck := range ws.ReadinessChecks {
+    err := aCheck.Check()
+    if err != nil { failures[aCheck.Name] = err.Error() }
+  }
+  if len(failures) < 1 { return nil }
+  return failures
+}
+
+// The response to the /health/live and /health/ready routes.
+//
+type HealthStatus struct {
+  Status   string
+  Uptime   string
+  Failures map[string]string `json:",omitempty"`
+}
+
+// Add the (hidden) /health, /health/live and /health/ready routes.
+//
+// The /health/live route always responds with http.StatusOK while this 
+// webserver is running. The /health/ready route responds with 
+// http.StatusOK only if all readiness checks pass, otherwise it responds 
+// with http.StatusServiceUnavailable. 
+//
+func (ws *WS) AddHealthHandlers() error {
+  err := ws.DescribeRoute("/health", "Liveness and readiness probes", false)
+  if err != nil { return err }
+  err = ws.DescribeRoute("/health/live", "Liveness probe", false)
+  if err != nil { return err }
+  err = ws.DescribeRoute("/health/ready", "Readiness probe", false)
+  if err != nil { return err }
+
+  err = ws.AddGetHandler(
+    "/health/live",
+    func(w http.ResponseWriter, r *http.Request) {
+      ws.ReplyInJson(w, r, HealthStatus{
+        Status: "alive",
+        Uptime: time.Since(ws.InitTime).String(),
+      })
+    },
+  )
+  if err != nil { return err }
+
+  return ws.AddGetHandler(
+    "/health/ready",
+    func(w http.ResponseWriter, r *http.Request) {
+      health := HealthStatus{
+        Status: "ready",
+        Uptime: time.Since(ws.InitTime).String(),
+      }
+      health.Failures = ws.CheckReadiness()
+      if health.Failures != nil {
+        health.Status = "not ready"
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusServiceUnavailable)
+      }
+      ws.ReplyInJson(w, r, health)
+    },
+  )
+}
+
+// The names of the request metrics recorded by ServeHTTP.
+//
+const (
+  RequestsMetric       = "cn_http_requests_total"
+  RequestLatencyMetric = "cn_http_request_duration_seconds"
+)
+
+// Add the (hidden) /metrics route which exports the webserver's metrics 
+// registry in the Prometheus text exposition format. 
+//
+func (ws *WS) AddMetricsHandlers() error {
+  if ws.Metrics == nil { ws.Metrics = metrics.CreateRegistry() }
+  ws.Metrics.DescribeCounter(
+    RequestsMetric, "The number of HTTP requests by route, method and status code",
+  )
+  ws.Metrics.DescribeHistogram(
+    RequestLatencyMetric, "The HTTP request latencies by route and method",
+    metrics.LatencyBuckets,
+  )
+
+  err := ws.DescribeRoute("/metrics", "Prometheus metrics", false)
+  if err != nil { return err }
+
+  return ws.AddGetHandler(
+    "/metrics",
+    func(w http.ResponseWriter, r *http.Request) {
+      w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+      err := ws.Metrics.WriteText(w)
+      ws.RequestLog(r).MayBeError("Could not write the metrics", err)
+    },
+  )
+}
+
+// A http.ResponseWriter which records the status code of the reply.
+//
+type statusWriter struct {
+  http.ResponseWriter
+  Status int
+}
+
+// Record the status code before writing the header.
+//
+func (sw *statusWriter) WriteHeader(statusCode int) {
+  sw.Status = statusCode
+  sw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Pass any flushes on to the underlying http.ResponseWriter (if it is a
+// http.Flusher).
+//
+func (sw *statusWriter) Flush() {
+  flusher, ok := sw.ResponseWriter.(http.Flusher)
+  if ok { flusher.Flush() }
+}
+
+// Returns the underlying http.ResponseWriter (so that a 
+// http.ResponseController can reach the connection, for example to clear 
+// the write deadline of a long running reply). 
+//
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+  return sw.ResponseWriter
+}
+
+// Record the count and latency of a request.
+//
+// Unknown methods are recorded as "OTHER" so that the number of series 
+// remains bounded. 
+//
+func (ws *WS) recordRequest(
+  routePath  string,
+  method     string,
+  status     int,
+  startTime  time.Time,
+) {
+  if ws.Metrics == nil { return }
+  switch method {
+    case http.MethodGet, http.MethodHead, http.MethodPost,
+      http.MethodPut, http.MethodDelete :
+    default                             : method = "OTHER"
+  }
+  ws.Metrics.IncCounter(RequestsMetric, metrics.Labels{
+    "route":  routePath,
+    "method": method,
+    "code":   fmt.Sprintf("%d", status),
+  })
+  ws.Metrics.Observe(RequestLatencyMetric, metrics.Labels{
+    "route":  routePath,
+    "method": method,
+  }, time.Since(startTime).Seconds())
+}
+
 // Reply in JSON marshaled from the given value.
 //
 func (ws *WS) ReplyInJson(
@@ -134,6 +400,55 @@ func (ws *WS) ReplyInJson(
   w.Write(jsonBytes)
 }
 
+// The (JSON) reply sent whenever a request fails.
+//
+type ErrorReply struct {
+  Error       string
+  Status_Code int
+  Request_Id  string
+}
+
+// Clear the write deadline of a reply which (like the reply to running 
+// an action, which is only sent once the run has finished) may outlast 
+// the webserver's write timeout. 
+//
+func (ws *WS) ClearWriteDeadline(w http.ResponseWriter, r *http.Request) {
+  err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+  ws.RequestLog(r).MayBeError("Could not clear the write deadline", err)
+}
+
+// Reply with a (JSON) ErrorReply which includes the request's id.
+//
+func (ws *WS) ReplyError(
+  w           http.ResponseWriter,
+  r          *http.Request,
+  message     string,
+  statusCode  int,
+) {
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("X-Content-Type-Options", "nosniff")
+  w.WriteHeader(statusCode)
+  ws.ReplyInJson(w, r, ErrorReply{
+    Error:       message,
+    Status_Code: statusCode,
+    Request_Id:  logger.RequestIdFromContext(r.Context()),
+  })
+}
+
+// Returns a logger which includes the request's id in every log line.
+//
+func (ws *WS) RequestLog(r *http.Request) *logger.LoggerType {
+  return ws.Log.ForContext(r.Context())
+}
+
+// Returns the CommonName of the request's (verified) client certificate, 
+// or "anonymous" if the client presented no certificate. 
+//
+func (ws *WS) ClientName(r *http.Request) string {
+  if r.TLS == nil || len(r.TLS.PeerCertificates) < 1 { return "anonymous" }
+  return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
 func (ws *WS) ReplyAsRawFile(
   w http.ResponseWriter,
   r *http.Request,
@@ -463,7 +778,7 @@ func (ws *WS) AddStaticFileHandlers(
   
   err := ws.DescribeRoute("/favicon.ico", "The FavIcon", false)
   if err != nil {
-    fmt.Errorf("Could not describe the route for /favicon.ico %w", err)
+    return fmt.Errorf("Could not describe the route for /favicon.ico %w", err)
   } 
 
   err = ws.AddGetHandler(
@@ -474,7 +789,7 @@ func (ws *WS) AddStaticFileHandlers(
     },
   )
   if err != nil {
-    fmt.Errorf("Could not add getHandler for /favicon.ico %w", err)
+    return fmt.Errorf("Could not add getHandler for /favicon.ico %w", err)
   }
   
   err = ws.DescribeRoute(
@@ -483,7 +798,7 @@ func (ws *WS) AddStaticFileHandlers(
     false,
   )
   if err != nil {
-    fmt.Errorf("Could not describe the route for [%s] %w", staticRoute, err)
+    return fmt.Errorf("Could not describe the route for [%s] %w", staticRoute, err)
   }
   
   err = ws.AddGetHandler(
@@ -496,7 +811,7 @@ func (ws *WS) AddStaticFileHandlers(
     },
   )
   if err != nil {
-    fmt.Errorf("Could not add getHandler for /static %w", err)
+    return fmt.Errorf("Could not add getHandler for /static %w", err)
   }
   return nil
 }
@@ -504,24 +819,114 @@ func (ws *WS) AddStaticFileHandlers(
 // Run the webserver at https://<host>:<port> using the TLS as
 // configured in tlsConfig.
 //
+// Returns nil once the webserver has been (gracefully) shutdown, 
+// otherwise returns the error which stopped the webserver. 
+//
 // NOTE: all routes must have been previously added using the DescribeRoute
 // and AddxxxHandler methods.
 //
-func (ws *WS) RunWebServer() {
-  ws.Server.Serve(ws.Listener)
+func (ws *WS) RunWebServer() error {
+  ws.SetReady(true)
+  err := ws.Server.Serve(ws.Listener)
+  ws.SetReady(false)
+  if err != http.ErrServerClosed { return err }
+
+  // wait for the Shutdown to finish draining any active requests
+  <-ws.ShutdownDone
+  return nil
+}
+
+// Gracefully shutdown the webserver.
+//
+// The webserver is immediately marked as not ready, the Stopping channel 
+// is closed, and then waits (until the ctx is done) for all active 
+// requests to complete. 
+//
+// NOTE: this method MUST NOT be called synchronously from inside a 
+// request handler, since the Shutdown would wait for that handler. 
+//
+// THREAD-SAFE;
+//
+func (ws *WS) Shutdown(ctx context.Context) error {
+  ws.SetReady(false)
+  ws.Log.Log("shutting down the webserver")
+  // long lived (streaming) requests end once the webserver is stopping
+  ws.StoppingOnce.Do(func() { close(ws.Stopping) })
+  err := ws.Server.Shutdown(ctx)
+  ws.ShutdownOnce.Do(func() { close(ws.ShutdownDone) })
+  return err
+}
+
+// Gracefully shutdown the webserver, waiting at most the configured 
+// Shutdown_Timeout for active requests to complete. 
+//
+// THREAD-SAFE;
+//
+func (ws *WS) ShutdownWithTimeout() error {
+  ctx, cancel := context.WithTimeout(
+    context.Background(),
+    seconds(ws.Limits.Shutdown_Timeout),
+  )
+  defer cancel()
+  return ws.Shutdown(ctx)
+}
+
+// Start a go routine which gracefully shuts down the webserver when the 
+// process receives a SIGINT or SIGTERM signal. 
+//
+func (ws *WS) ShutdownOnSignals() {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+  go func() {
+    aSignal := <-signals
+    ws.Log.Logf("received the [%s] signal", aSignal)
+    err := ws.ShutdownWithTimeout()
+    ws.Log.MayBeError("Could not gracefully shutdown the webserver", err)
+  }()
 }
 
 // Find a route for the current URL Path using the FindRoute function, and
 // then use the route's xxxHandler associated with the request method.
 //
 func (ws *WS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-  ws.Log.Logf("url: [%s][%s] method: [%s]", r.URL.Path, r.URL.RawQuery, r.Method)
+
+  // associate a request id with this request (re-using the request id 
+  // of any nursery which forwarded this request to us) 
+  //
+  requestId := r.Header.Get(logger.RequestIdHeader)
+  if requestId == "" { requestId = logger.NewRequestId() }
+  w.Header().Set(logger.RequestIdHeader, requestId)
+  r = r.WithContext(logger.ContextWithRequestId(r.Context(), requestId))
+  reqLog := ws.Log.WithRequestId(requestId)
+
+  reqLog.Logf("url: [%s][%s] method: [%s]", r.URL.Path, r.URL.RawQuery, r.Method)
+
+  // record the count and latency of this request (by route and method)
+  //
+  startTime := time.Now()
+  sw        := &statusWriter{ ResponseWriter: w, Status: http.StatusOK }
+  w          = sw
+  routePath := "none"
+  method    := r.Method
+  defer func() { ws.recordRequest(routePath, method, sw.Status, startTime) }()
+
+  // refuse requests over (kept alive) connections whose client 
+  // certificate has since been revoked 
+  //
+  if ws.Certs != nil && r.TLS != nil && 0 < len(r.TLS.PeerCertificates) {
+    err := ws.Certs.CheckRevoked(r.TLS.PeerCertificates[0])
+    if err != nil {
+      reqLog.MayBeError("Refusing request", err)
+      ws.ReplyError(w, r, "Certificate revoked", http.StatusForbidden)
+      return
+    }
+  }
 
   aRoute, _ := ws.FindRoute(r.URL.Path)
 
   if aRoute == nil {
-    http.Error(
-      w,
+    ws.ReplyError(
+      w, r,
       fmt.Sprintf("No route found for [%s] using [%s]",
         r.URL.Path,
         r.Method,
@@ -530,11 +935,15 @@ func (ws *WS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     )
     return
   }
-  ws.Log.Logf(
+  routePath = aRoute.Path
+  reqLog.Logf(
     "Found route [%s](%s) for path [%s]", aRoute.Path, aRoute.Prefix, r.URL.Path,
   )
+
+  if r.Body != nil && 0 < ws.Limits.Max_Body_Bytes {
+    r.Body = http.MaxBytesReader(w, r.Body, int64(ws.Limits.Max_Body_Bytes))
+  }
   
-  method := r.Method
   query  := r.URL.Query()
   queryMethod := strings.Join(query["method"], "")
   if queryMethod != "" { method = strings.ToUpper(queryMethod) }
@@ -556,21 +965,21 @@ func (ws *WS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
       aRoute.DeleteHandler(w, r) ; return
     }
     default                :
-      ws.Log.Logf("Incorrect RESTful HTTP Method [%s]", method)
-      http.Error(
-        w,
+      reqLog.Logf("Incorrect RESTful HTTP Method [%s]", method)
+      ws.ReplyError(
+        w, r,
         fmt.Sprintf("Incorrect RESTful HTTP Method [%s]", method),
         http.StatusNotFound,
       )
      return
   }
-  ws.Log.Logf(
+  reqLog.Logf(
     "No RESTful HTTP Handler found for [%s] using [%s]",
     r.URL.Path,
     r.Method,
   )
-  http.Error(
-    w,
+  ws.ReplyError(
+    w, r,
     fmt.Sprintf("No RESTful HTTP Handler found for [%s] using [%s]",
       r.URL.Path,
       r.Method,
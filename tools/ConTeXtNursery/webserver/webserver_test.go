@@ -15,8 +15,15 @@
 package webserver
 
 import (
+  "encoding/json"
+  "fmt"
+  "github.com/diSimplex/ConTeXtNursery/logger"
   "github.com/stretchr/testify/assert"
+  "net/http"
+  "io/ioutil"
+  "net/http/httptest"
   "testing"
+  "time"
 )
 
 // Test finding and describing routes in a webserver.
@@ -87,3 +94,108 @@ func TestFindRoute(t *testing.T) {
   assert.Equal(t, err.CurPrefix, "a")
   assert.Contains(t, err.Message, "/this/is/a")
 }
+
+// Test the liveness and readiness probes.
+//
+func TestHealthHandlers(t *testing.T) {
+
+  ws := WS{ Log: logger.CreateLogger("webserverTest") }
+  ws.BaseRoute = ws.CreateNewRoute("/", "", "base route", true)
+  err := ws.AddHealthHandlers()
+  assert.Nil(t, err)
+
+  probe := func(url string) int {
+    w := httptest.NewRecorder()
+    ws.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+    return w.Code
+  }
+
+  assert.Equal(t, http.StatusOK, probe("/health/live"))
+  assert.Equal(t, http.StatusServiceUnavailable, probe("/health/ready"))
+
+  ws.SetReady(true)
+  assert.Equal(t, http.StatusOK, probe("/health/ready"))
+
+  checkErr := fmt.Errorf("not yet")
+  ws.AddReadinessCheck("test", func() error { return checkErr })
+  assert.Equal(t, http.StatusServiceUnavailable, probe("/health/ready"))
+  assert.Contains(t, ws.CheckReadiness()["test"], "not yet")
+
+  checkErr = nil
+  assert.Equal(t, http.StatusOK, probe("/health/ready"))
+  assert.Equal(t, http.StatusOK, probe("/health/live"))
+}
+
+func TestRequestIds(t *testing.T) {
+
+  ws := WS{ Log: logger.CreateLogger("webserverTest") }
+  ws.BaseRoute = ws.CreateNewRoute("/", "", "base route", true)
+
+  // a request id provided by the client is re-used
+  w := httptest.NewRecorder()
+  r := httptest.NewRequest(http.MethodDelete, "/", nil)
+  r.Header.Set(logger.RequestIdHeader, "aRequestId")
+  ws.ServeHTTP(w, r)
+  assert.Equal(t, http.StatusNotFound, w.Code)
+  assert.Equal(t, "aRequestId", w.Header().Get(logger.RequestIdHeader))
+
+  var errReply ErrorReply
+  err := json.Unmarshal(w.Body.Bytes(), &errReply)
+  assert.Nil(t, err)
+  assert.Equal(t, "aRequestId", errReply.Request_Id)
+  assert.Equal(t, http.StatusNotFound, errReply.Status_Code)
+
+  // otherwise a new request id is created
+  w = httptest.NewRecorder()
+  ws.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/", nil))
+  assert.NotEqual(t, "", w.Header().Get(logger.RequestIdHeader))
+}
+
+func TestMetrics(t *testing.T) {
+
+  ws := WS{ Log: logger.CreateLogger("webserverTest") }
+  ws.BaseRoute = ws.CreateNewRoute("/", "", "base route", true)
+  err := ws.AddMetricsHandlers()
+  assert.Nil(t, err)
+
+  ws.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/", nil))
+
+  w := httptest.NewRecorder()
+  ws.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+  assert.Equal(t, http.StatusOK, w.Code)
+  assert.Contains(t, w.Body.String(), `cn_http_requests_total{code="404",method="DELETE",route="/"} 1`)
+  assert.Contains(t, w.Body.String(), `cn_http_request_duration_seconds_count{method="DELETE",route="/"} 1`)
+}
+
+// Test that a handler can (through the statusWriter) clear the write
+// deadline of a reply which outlasts the write timeout.
+//
+func TestClearWriteDeadline(t *testing.T) {
+
+  ws := WS{ Log: logger.CreateLogger("webserverTest") }
+  ws.BaseRoute = ws.CreateNewRoute("/", "", "base route", true)
+  ws.DescribeRoute("/slow", "a slow reply", true)
+  err := ws.AddGetHandler(
+    "/slow",
+    func(w http.ResponseWriter, r *http.Request) {
+      err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+      assert.NoError(t, err)
+      time.Sleep(200 * time.Millisecond)
+      w.Write([]byte("done"))
+    },
+  )
+  assert.Nil(t, err)
+
+  server := httptest.NewUnstartedServer(&ws)
+  server.Config.WriteTimeout = 50 * time.Millisecond
+  server.Start()
+  defer server.Close()
+
+  resp, err := http.Get(server.URL+"/slow")
+  assert.NoError(t, err)
+  if err != nil { return }
+  defer resp.Body.Close()
+  body, err := ioutil.ReadAll(resp.Body)
+  assert.NoError(t, err)
+  assert.Equal(t, "done", string(body))
+}